@@ -7,9 +7,12 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	anthropicSDK "github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
@@ -18,43 +21,46 @@ import (
 	"github.com/mattermost/mattermost-plugin-ai/server/metrics"
 )
 
-const (
-	DefaultMaxTokens       = 8192
-	MaxToolResolutionDepth = 10
-)
+const DefaultMaxTokens = 8192
 
+// messageState is the conversation of a request, kept across the steps of its agent loop
 type messageState struct {
 	messages []anthropicSDK.MessageParam
 	system   string
-	output   chan<- string
-	errChan  chan<- error
-	depth    int
+	events   chan<- llm.StreamEvent
 	config   llm.LanguageModelConfig
 	tools    []llm.Tool
-	resolver func(name string, argsGetter llm.ToolArgumentGetter, context *llm.Context) (string, error)
-	context  *llm.Context
+	// assistantContent replaces the content of the assistant messages, by index, that have thinking blocks the
+	// SDK can't represent
+	assistantContent map[int][]any
 }
 
 type Anthropic struct {
 	client           *anthropicSDK.Client
+	countTokens      llm.TokenCounter
 	defaultModel     string
 	inputTokenLimit  int
 	metricsService   metrics.LLMetrics
 	outputTokenLimit int
+	retryPolicy      llm.RetryPolicy
 }
 
 func New(llmService llm.ServiceConfig, httpClient *http.Client, metricsService metrics.LLMetrics) *Anthropic {
 	client := anthropicSDK.NewClient(
 		option.WithAPIKey(llmService.APIKey),
 		option.WithHTTPClient(httpClient),
+		// Retries are handled by the shared policy so they are limited to before anything has been streamed
+		option.WithMaxRetries(0),
 	)
 
 	return &Anthropic{
 		client:           client,
+		countTokens:      llm.NewTokenCounter(llmService.DefaultModel),
 		defaultModel:     llmService.DefaultModel,
 		inputTokenLimit:  llmService.InputTokenLimit,
 		metricsService:   metricsService,
 		outputTokenLimit: llmService.OutputTokenLimit,
+		retryPolicy:      llm.NewRetryPolicy(llmService),
 	}
 }
 
@@ -144,6 +150,20 @@ func conversationToMessages(posts []llm.Post) (string, []anthropicSDK.MessagePar
 			}
 			currentBlocks = append(currentBlocks, imageBlock)
 		}
+
+		// The results of the calls follow in a user message, the next user post joins it
+		if post.Role == llm.PostRoleBot && len(post.ToolCalls) > 0 {
+			for _, call := range post.ToolCalls {
+				arguments := call.Arguments
+				if arguments == "" {
+					arguments = "{}"
+				}
+				currentBlocks = append(currentBlocks, anthropicSDK.NewToolUseBlockParam(call.ID, call.Name, json.RawMessage(arguments)))
+			}
+			flushCurrentMessage()
+			currentRole = "user"
+			currentBlocks = toolResultBlocks(post.ToolCalls)
+		}
 	}
 
 	flushCurrentMessage()
@@ -170,12 +190,10 @@ func (a *Anthropic) createConfig(opts []llm.LanguageModelOption) llm.LanguageMod
 	return cfg
 }
 
-func (a *Anthropic) streamChatWithTools(state messageState) error {
-	if state.depth >= MaxToolResolutionDepth {
-		return fmt.Errorf("max tool resolution depth (%d) exceeded", MaxToolResolutionDepth)
-	}
-
-	stream := a.client.Messages.NewStreaming(context.Background(), anthropicSDK.MessageNewParams{
+// streamChat streams one response to the conversation, one step of the agent loop. The model's turn is added to
+// the conversation when it calls tools so their results can follow it.
+func (a *Anthropic) streamChat(ctx context.Context, state *messageState) (llm.AgentStepResult, error) {
+	params := anthropicSDK.MessageNewParams{
 		Model:     anthropicSDK.F(state.config.Model),
 		MaxTokens: anthropicSDK.F(int64(state.config.MaxGeneratedTokens)),
 		Messages:  anthropicSDK.F(state.messages),
@@ -184,126 +202,269 @@ func (a *Anthropic) streamChatWithTools(state messageState) error {
 			Text: anthropicSDK.F(state.system),
 		}}),
 		Tools: anthropicSDK.F(convertTools(state.tools)),
-	})
+	}
+
+	// Structured responses are the input of a tool the model is made to call, there is no JSON mode
+	if state.config.JSONSchema != nil {
+		params.Tools = anthropicSDK.F([]anthropicSDK.ToolParam{{
+			Name:        anthropicSDK.F(llm.StructuredResponseName),
+			Description: anthropicSDK.F("Respond with the requested information"),
+			InputSchema: anthropicSDK.F(any(state.config.JSONSchema)),
+		}})
+		params.ToolChoice = anthropicSDK.F[anthropicSDK.ToolChoiceUnionParam](anthropicSDK.ToolChoiceToolParam{
+			Type: anthropicSDK.F(anthropicSDK.ToolChoiceToolTypeTool),
+			Name: anthropicSDK.F(llm.StructuredResponseName),
+		})
+	}
 
-	message := anthropicSDK.Message{}
-	var toolResults []anthropicSDK.ContentBlockParamUnion
+	requestOpts := samplingParameters(&params, state.config)
+	for index, content := range state.assistantContent {
+		requestOpts = append(requestOpts, option.WithJSONSet(fmt.Sprintf("messages.%d.content", index), content))
+	}
 
-	for stream.Next() {
-		event := stream.Current()
-		if err := message.Accumulate(event); err != nil {
-			return fmt.Errorf("error accumulating message: %w", err)
+	// Errors are retried until the first delta has been streamed, including errors like overloaded_error that
+	// arrive as an event after the response has started
+	var message anthropicSDK.Message
+	var thinking thinkingBlocks
+	var usage llm.TokenUsage
+	streamed := false
+	classify := func(err error) (bool, time.Duration) {
+		if streamed {
+			return false, 0
+		}
+		return classifyError(err)
+	}
+	err := a.retryPolicy.Do(ctx, classify, func() error {
+		message, thinking = anthropicSDK.Message{}, thinkingBlocks{}
+		stream := a.client.Messages.NewStreaming(ctx, params, requestOpts...)
+		for stream.Next() {
+			event := stream.Current()
+			if err := message.Accumulate(event); err != nil {
+				return fmt.Errorf("error accumulating message: %w", err)
+			}
+			thinking.accumulate(event)
+
+			// Stream text content immediately
+			switch delta := event.Delta.(type) { // nolint: gocritic
+			case anthropicSDK.ContentBlockDeltaEventDelta:
+				if delta.Text != "" {
+					streamed = true
+					state.events <- llm.StreamEvent{Type: llm.EventTypeText, Text: delta.Text}
+				}
+				if thinking := thinkingDelta(delta); thinking != "" {
+					streamed = true
+					state.events <- llm.StreamEvent{Type: llm.EventTypeReasoning, Text: thinking}
+				}
+				if delta.PartialJSON != "" {
+					streamed = true
+				}
+			}
 		}
 
-		// Stream text content immediately
-		switch delta := event.Delta.(type) { // nolint: gocritic
-		case anthropicSDK.ContentBlockDeltaEventDelta:
-			if delta.Text != "" {
-				state.output <- delta.Text
+		// message_start carries the input tokens and each message_delta the output tokens so far, both
+		// accumulated into the message. Partial usage of a failed attempt is still reported.
+		usage = llm.TokenUsage{}
+		if message.Usage.InputTokens > 0 || message.Usage.OutputTokens > 0 {
+			usage = llm.TokenUsage{
+				Model:        state.config.Model,
+				InputTokens:  message.Usage.InputTokens + message.Usage.CacheCreationInputTokens + message.Usage.CacheReadInputTokens,
+				OutputTokens: message.Usage.OutputTokens,
 			}
+			state.config.ReportUsage(usage)
+			state.events <- llm.StreamEvent{Type: llm.EventTypeUsage, Usage: &usage}
 		}
+
+		return streamError(stream.Err())
+	})
+	if err != nil {
+		return llm.AgentStepResult{}, fmt.Errorf("error from anthropic stream: %w", err)
 	}
 
-	if err := stream.Err(); err != nil {
-		return fmt.Errorf("error from anthropic stream: %w", err)
+	if state.config.JSONSchema != nil {
+		for _, block := range message.Content {
+			if block.Type == anthropicSDK.ContentBlockTypeToolUse && block.Name == llm.StructuredResponseName {
+				state.events <- llm.StreamEvent{Type: llm.EventTypeText, Text: string(block.Input)}
+			}
+		}
+		reason := finishReason(message.StopReason)
+		if message.StopReason == anthropicSDK.MessageStopReasonToolUse {
+			reason = llm.FinishReasonStop
+		}
+		return llm.AgentStepResult{FinishReason: reason, Usage: usage}, nil
 	}
 
-	// Check for tool usage after message is complete
+	result := llm.AgentStepResult{FinishReason: finishReason(message.StopReason), Usage: usage}
 	for _, block := range message.Content {
 		if block.Type == anthropicSDK.ContentBlockTypeToolUse {
-			// Resolve the tool
-			result, err := state.resolver(block.Name, func(args any) error {
-				return json.Unmarshal(block.Input, args)
-			}, state.context)
-
-			if err != nil {
-				return fmt.Errorf("tool resolution error: %w", err)
-			}
-
-			toolResults = append(toolResults, anthropicSDK.NewToolResultBlock(block.ID, result, false))
+			result.Calls = append(result.Calls, llm.ToolCall{ID: block.ID, Name: block.Name, Arguments: string(block.Input)})
 		}
 	}
+	if len(result.Calls) == 0 {
+		return result, nil
+	}
 
-	// If tools were used, continue the conversation with the results
-	if len(toolResults) > 0 {
-		// Add tool results as a new user message
-		state.messages = append(state.messages,
-			message.ToParam(),
-			anthropicSDK.MessageParam{
-				Role:    anthropicSDK.F(anthropicSDK.MessageParamRoleUser),
-				Content: anthropicSDK.F(toolResults),
-			},
-		)
-
-		newState := messageState{
-			messages: state.messages,
-			system:   state.system,
-			output:   state.output,
-			errChan:  state.errChan,
-			depth:    state.depth + 1,
-			config:   state.config,
-			tools:    state.tools,
-			resolver: state.resolver,
-			context:  state.context,
+	assistant := message.ToParam()
+	content, err := thinking.assistantContent(assistant)
+	if err != nil {
+		return llm.AgentStepResult{}, err
+	}
+	if content != nil {
+		if state.assistantContent == nil {
+			state.assistantContent = map[int][]any{}
 		}
+		state.assistantContent[len(state.messages)] = content
+	}
+	state.messages = append(state.messages, assistant)
 
-		// Recursively handle the continued conversation
-		if err := a.streamChatWithTools(newState); err != nil {
-			return err
-		}
+	return result, nil
+}
+
+// addToolResults adds the results of the tools the model called as a new user message
+func (state *messageState) addToolResults(results []llm.ToolCall) {
+	if len(results) == 0 {
+		return
+	}
+	state.messages = append(state.messages, anthropicSDK.MessageParam{
+		Role:    anthropicSDK.F(anthropicSDK.MessageParamRoleUser),
+		Content: anthropicSDK.F(toolResultBlocks(results)),
+	})
+}
+
+func toolResultBlocks(results []llm.ToolCall) []anthropicSDK.ContentBlockParamUnion {
+	blocks := make([]anthropicSDK.ContentBlockParamUnion, 0, len(results))
+	for _, result := range results {
+		blocks = append(blocks, anthropicSDK.NewToolResultBlock(result.ID, result.ModelResult(), result.Err != nil))
 	}
+	return blocks
+}
+
+// finishReason maps Anthropic's stop reasons to the finish reasons of stream events
+func finishReason(stopReason anthropicSDK.MessageStopReason) string {
+	switch stopReason {
+	case anthropicSDK.MessageStopReasonMaxTokens:
+		return llm.FinishReasonLength
+	case anthropicSDK.MessageStopReasonEndTurn, anthropicSDK.MessageStopReasonStopSequence, "":
+		return llm.FinishReasonStop
+	default:
+		return string(stopReason)
+	}
+}
 
-	return nil
+// thinkingDelta returns the reasoning in a thinking_delta, which the SDK doesn't decode
+func thinkingDelta(delta anthropicSDK.ContentBlockDeltaEventDelta) string {
+	if delta.Type != "thinking_delta" {
+		return ""
+	}
+	var thinking struct {
+		Thinking string `json:"thinking"`
+	}
+	if err := json.Unmarshal([]byte(delta.JSON.RawJSON()), &thinking); err != nil {
+		return ""
+	}
+	return thinking.Thinking
 }
 
-func (a *Anthropic) ChatCompletion(request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+// classifyError decides whether a failed request is retried, Anthropic reports overload with status 529
+// streamErrorStatuses are the HTTP statuses of the error events the API sends once a response has started
+var streamErrorStatuses = map[string]int{
+	"overloaded_error": 529,
+	"api_error":        http.StatusInternalServerError,
+	"rate_limit_error": http.StatusTooManyRequests,
+}
+
+// streamError turns an error event of the stream into an APIError, so it is retried like the status it stands for
+func streamError(err error) error {
+	if err == nil {
+		return nil
+	}
+	_, data, found := strings.Cut(err.Error(), "received error while streaming: ")
+	if !found {
+		return err
+	}
+
+	var event struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(data), &event) != nil {
+		return err
+	}
+	status, ok := streamErrorStatuses[event.Error.Type]
+	if !ok {
+		return err
+	}
+	return &llm.APIError{Provider: "anthropic", StatusCode: status, Message: event.Error.Message}
+}
+
+func classifyError(err error) (bool, time.Duration) {
+	var apiErr *anthropicSDK.Error
+	if errors.As(err, &apiErr) {
+		var retryAfter time.Duration
+		if apiErr.Response != nil {
+			retryAfter = llm.ParseRetryAfter(apiErr.Response.Header)
+		}
+		return llm.IsRetryableStatus(apiErr.StatusCode), retryAfter
+	}
+	return llm.ClassifyError(err)
+}
+
+func (a *Anthropic) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
 	a.metricsService.IncrementLLMRequests()
 
-	output := make(chan string)
-	errChan := make(chan error)
+	events := make(chan llm.StreamEvent)
 
 	cfg := a.createConfig(opts)
+	// Thinking blocks have to be sent back with the tool calls that followed them, they aren't kept for
+	// conversations that continue after tool calls like once the user approved them
+	if len(request.Posts) > 0 && len(request.Posts[len(request.Posts)-1].ToolCalls) > 0 {
+		cfg.ThinkingBudget = 0
+		cfg.ReasoningEffort = ""
+	}
 
 	system, messages := conversationToMessages(request.Posts)
 
-	initialState := messageState{
+	state := &messageState{
 		messages: messages,
 		system:   system,
-		output:   output,
-		errChan:  errChan,
-		depth:    0,
+		events:   events,
 		config:   cfg,
-		context:  request.Context,
 	}
 
 	if request.Context.Tools != nil {
-		initialState.tools = request.Context.Tools.GetTools()
-		initialState.resolver = request.Context.Tools.ResolveTool
+		state.tools = request.Context.Tools.GetTools()
 	}
 
 	go func() {
-		defer close(output)
-		defer close(errChan)
-
-		if err := a.streamChatWithTools(initialState); err != nil {
-			errChan <- err
+		defer close(events)
+
+		loop := llm.NewAgentLoop(cfg, request.Context, events)
+		reason, err := loop.Run(ctx, func(ctx context.Context, results []llm.ToolCall) (llm.AgentStepResult, error) {
+			state.addToolResults(results)
+			return a.streamChat(ctx, state)
+		})
+		if err != nil {
+			events <- llm.StreamEvent{Type: llm.EventTypeError, Err: err}
+			return
 		}
+		events <- llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: reason}
 	}()
 
-	return &llm.TextStreamResult{Stream: output, Err: errChan}, nil
+	return &llm.TextStreamResult{Events: events}, nil
 }
 
-func (a *Anthropic) ChatCompletionNoStream(request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+func (a *Anthropic) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
 	// This could perform better if we didn't use the streaming API here, but the complexity is not worth it.
-	result, err := a.ChatCompletion(request, opts...)
+	result, err := a.ChatCompletion(ctx, request, opts...)
 	if err != nil {
 		return "", err
 	}
-	return result.ReadAll(), nil
+	return result.ReadText()
 }
 
 func (a *Anthropic) CountTokens(text string) int {
-	return 0
+	return a.countTokens(text)
 }
 
 // convertTools converts from llm.Tool to anthropicSDK.Tool format
@@ -314,7 +475,7 @@ func convertTools(tools []llm.Tool) []anthropicSDK.ToolParam {
 			AllowAdditionalProperties: false,
 			DoNotReference:            true,
 		}
-		schema := any(reflector.Reflect(tool.Schema))
+		schema := any(llm.ToolSchema(&reflector, tool))
 		converted[i] = anthropicSDK.ToolParam{
 			Name:        anthropicSDK.F(tool.Name),
 			Description: anthropicSDK.F(tool.Description),
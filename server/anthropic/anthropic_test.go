@@ -5,13 +5,31 @@ package anthropic
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
 	"testing"
 
 	anthropicSDK "github.com/anthropics/anthropic-sdk-go"
 	"github.com/mattermost/mattermost-plugin-ai/server/llm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+type noopMetrics struct{}
+
+func (noopMetrics) IncrementLLMRequests()                                   {}
+func (noopMetrics) IncrementLLMFailovers(_, _ string)                       {}
+func (noopMetrics) ObserveLLMTokenUsage(_, _ string, _, _ int64, _ float64) {}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
 func TestConversationToMessages(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -329,6 +347,42 @@ func TestConversationToMessages(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "bot post with tool calls",
+			conversation: []llm.Post{
+				{Role: llm.PostRoleUser, Message: "Create an issue"},
+				{Role: llm.PostRoleBot, Message: "Creating it", ToolCalls: []llm.ToolCall{
+					{ID: "call1", Name: "CreateIssue", Arguments: `{"title":"Bug"}`, Result: "Created MM-1"},
+					{ID: "call2", Name: "Notify", Err: llm.ErrToolCallDenied},
+				}},
+				{Role: llm.PostRoleUser, Message: "Thanks"},
+			},
+			wantSystem: "",
+			wantMessages: []anthropicSDK.MessageParam{
+				{
+					Role: anthropicSDK.F(anthropicSDK.MessageParamRoleUser),
+					Content: anthropicSDK.F([]anthropicSDK.ContentBlockParamUnion{
+						anthropicSDK.NewTextBlock("Create an issue"),
+					}),
+				},
+				{
+					Role: anthropicSDK.F(anthropicSDK.MessageParamRoleAssistant),
+					Content: anthropicSDK.F([]anthropicSDK.ContentBlockParamUnion{
+						anthropicSDK.NewTextBlock("Creating it"),
+						anthropicSDK.NewToolUseBlockParam("call1", "CreateIssue", json.RawMessage(`{"title":"Bug"}`)),
+						anthropicSDK.NewToolUseBlockParam("call2", "Notify", json.RawMessage(`{}`)),
+					}),
+				},
+				{
+					Role: anthropicSDK.F(anthropicSDK.MessageParamRoleUser),
+					Content: anthropicSDK.F([]anthropicSDK.ContentBlockParamUnion{
+						anthropicSDK.NewToolResultBlock("call1", "Created MM-1", false),
+						anthropicSDK.NewToolResultBlock("call2", "Error: the user denied this tool call", true),
+						anthropicSDK.NewTextBlock("Thanks"),
+					}),
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -339,3 +393,278 @@ func TestConversationToMessages(t *testing.T) {
 		})
 	}
 }
+
+func TestChatCompletionReportsUsage(t *testing.T) {
+	events := []string{
+		`event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-5-sonnet-latest","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":25,"cache_read_input_tokens":5,"output_tokens":1}}}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+		`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":15}}`,
+		`event: message_stop
+data: {"type":"message_stop"}`,
+	}
+	httpClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       io.NopCloser(strings.NewReader(strings.Join(events, "\n\n") + "\n\n")),
+			Request:    r,
+		}, nil
+	})}
+	model := New(llm.ServiceConfig{DefaultModel: "claude-3-5-sonnet-latest"}, httpClient, noopMetrics{})
+
+	var usage []llm.TokenUsage
+	text, err := model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+		Context: llm.NewContext(),
+	}, llm.WithUsageCallback(func(u llm.TokenUsage) {
+		usage = append(usage, u)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", text)
+	assert.Equal(t, []llm.TokenUsage{{Model: "claude-3-5-sonnet-latest", InputTokens: 30, OutputTokens: 15}}, usage)
+}
+
+func TestChatCompletionRetriesStreamErrors(t *testing.T) {
+	overloaded := `event: error
+data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`
+	messageStart := `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-5-sonnet-latest","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":1}}}`
+	textBlock := []string{
+		`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+	}
+	finish := []string{
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+		`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":15}}`,
+		`event: message_stop
+data: {"type":"message_stop"}`,
+	}
+
+	newModel := func(responses ...[]string) (*Anthropic, *int) {
+		requests := 0
+		httpClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			events := responses[min(requests, len(responses)-1)]
+			requests++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+				Body:       io.NopCloser(strings.NewReader(strings.Join(events, "\n\n") + "\n\n")),
+				Request:    r,
+			}, nil
+		})}
+		return New(llm.ServiceConfig{DefaultModel: "claude-3-5-sonnet-latest", RetryBackoffMilliseconds: 1}, httpClient, noopMetrics{}), &requests
+	}
+	request := llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+		Context: llm.NewContext(),
+	}
+
+	t.Run("error before the first delta is retried", func(t *testing.T) {
+		success := append(append([]string{messageStart}, textBlock...), finish...)
+		model, requests := newModel([]string{messageStart, overloaded}, success)
+
+		text, err := model.ChatCompletionNoStream(context.Background(), request)
+		require.NoError(t, err)
+		assert.Equal(t, "Hello", text)
+		assert.Equal(t, 2, *requests)
+	})
+
+	t.Run("error after text was streamed is not retried", func(t *testing.T) {
+		model, requests := newModel(append(append([]string{messageStart}, textBlock...), overloaded))
+
+		_, err := model.ChatCompletionNoStream(context.Background(), request)
+		var apiErr *llm.APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, 529, apiErr.StatusCode)
+		assert.Equal(t, 1, *requests)
+	})
+}
+
+func TestChatCompletionJSONSchema(t *testing.T) {
+	events := []string{
+		`event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-5-sonnet-latest","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":25,"output_tokens":1}}}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"response","input":{}}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"emoji\": "}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"\"tada\"}"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+		`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":15}}`,
+		`event: message_stop
+data: {"type":"message_stop"}`,
+	}
+	var received map[string]any
+	httpClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       io.NopCloser(strings.NewReader(strings.Join(events, "\n\n") + "\n\n")),
+			Request:    r,
+		}, nil
+	})}
+	model := New(llm.ServiceConfig{DefaultModel: "claude-3-5-sonnet-latest"}, httpClient, noopMetrics{})
+
+	type emoji struct {
+		Emoji string `json:"emoji"`
+	}
+	result, err := model.ChatCompletion(context.Background(), llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+		Context: llm.NewContext(),
+	}, llm.WithJSONSchema(emoji{}))
+	require.NoError(t, err)
+	var text, reason string
+	for event := range result.Events {
+		require.NoError(t, event.Err)
+		switch event.Type {
+		case llm.EventTypeText:
+			text += event.Text
+		case llm.EventTypeEnd:
+			reason = event.FinishReason
+		}
+	}
+	assert.JSONEq(t, `{"emoji": "tada"}`, text)
+	assert.Equal(t, llm.FinishReasonStop, reason)
+
+	// The response is the input of a tool the model has to call
+	assert.Equal(t, map[string]any{"type": "tool", "name": "response"}, received["tool_choice"])
+	tools := received["tools"].([]any)
+	require.Len(t, tools, 1)
+	assert.Equal(t, "response", tools[0].(map[string]any)["name"])
+	assert.Contains(t, tools[0].(map[string]any)["input_schema"].(map[string]any)["properties"], "emoji")
+}
+
+func TestChatCompletionExtendedThinking(t *testing.T) {
+	responses := [][]string{
+		{
+			`event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-7-sonnet-latest","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":25,"output_tokens":1}}}`,
+			`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+			`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Look up the time"}}`,
+			`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig"}}`,
+			`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+			`event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"time","input":{}}}`,
+			`event: content_block_stop
+data: {"type":"content_block_stop","index":1}`,
+			`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":15}}`,
+			`event: message_stop
+data: {"type":"message_stop"}`,
+		},
+		{
+			`event: message_start
+data: {"type":"message_start","message":{"id":"msg_2","type":"message","role":"assistant","content":[],"model":"claude-3-7-sonnet-latest","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":40,"output_tokens":1}}}`,
+			`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Noon"}}`,
+			`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+			`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":5}}`,
+			`event: message_stop
+data: {"type":"message_stop"}`,
+		},
+	}
+	var received []map[string]any
+	httpClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		events := responses[len(received)]
+		received = append(received, body)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       io.NopCloser(strings.NewReader(strings.Join(events, "\n\n") + "\n\n")),
+			Request:    r,
+		}, nil
+	})}
+	model := New(llm.ServiceConfig{DefaultModel: "claude-3-7-sonnet-latest", OutputTokenLimit: 1000}, httpClient, noopMetrics{})
+
+	tools := llm.NewNoTools()
+	tools.AddTools([]llm.Tool{{
+		Name:   "time",
+		Schema: struct{}{},
+		Resolver: func(_ context.Context, _ *llm.Context, _ llm.ToolArgumentGetter) (string, error) {
+			return "12:00", nil
+		},
+	}})
+	llmContext := llm.NewContext()
+	llmContext.Tools = tools
+
+	result, err := model.ChatCompletion(context.Background(), llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "What time is it?"}},
+		Context: llmContext,
+	}, llm.WithTemperature(0.2), llm.WithStopSequences("END"), llm.WithReasoningEffort(llm.ReasoningEffortLow))
+	require.NoError(t, err)
+	var text, reasoning string
+	for event := range result.Events {
+		require.NoError(t, event.Err)
+		switch event.Type {
+		case llm.EventTypeText:
+			text += event.Text
+		case llm.EventTypeReasoning:
+			reasoning += event.Text
+		}
+	}
+	assert.Equal(t, "Noon", text)
+	assert.Equal(t, "Look up the time", reasoning)
+
+	require.Len(t, received, 2)
+	assert.Equal(t, map[string]any{"type": "enabled", "budget_tokens": float64(1024)}, received[0]["thinking"])
+	assert.Equal(t, float64(2024), received[0]["max_tokens"])
+	assert.Equal(t, []any{"END"}, received[0]["stop_sequences"])
+	// Sampling is fixed while thinking
+	assert.NotContains(t, received[0], "temperature")
+
+	// The thinking is sent back with the tool call
+	messages := received[1]["messages"].([]any)
+	require.Len(t, messages, 3)
+	content := messages[1].(map[string]any)["content"].([]any)
+	require.Len(t, content, 2)
+	assert.Equal(t, map[string]any{"type": "thinking", "thinking": "Look up the time", "signature": "sig"}, content[0])
+	assert.Equal(t, "tool_use", content[1].(map[string]any)["type"])
+}
+
+func TestChatCompletionSamplingParameters(t *testing.T) {
+	var received map[string]any
+	httpClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       io.NopCloser(strings.NewReader("event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")),
+			Request:    r,
+		}, nil
+	})}
+	model := New(llm.ServiceConfig{DefaultModel: "claude-3-5-sonnet-latest"}, httpClient, noopMetrics{})
+
+	_, err := model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+		Context: llm.NewContext(),
+	}, llm.WithTemperature(0), llm.WithTopP(0.5))
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), received["temperature"])
+	assert.Equal(t, 0.5, received["top_p"])
+	assert.NotContains(t, received, "thinking")
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package anthropic
+
+import (
+	"encoding/json"
+	"fmt"
+
+	anthropicSDK "github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+)
+
+// thinkingBudget is the extended thinking budget of the request, 0 when thinking is off. Thinking can't be
+// combined with the forced tool choice of structured responses.
+func thinkingBudget(cfg llm.LanguageModelConfig) int {
+	if cfg.JSONSchema != nil {
+		return 0
+	}
+	budget := cfg.ThinkingBudgetTokens()
+	if budget > 0 && budget < llm.MinAnthropicThinkingBudget {
+		return llm.MinAnthropicThinkingBudget
+	}
+	return budget
+}
+
+// samplingParameters sets the request's parameters and returns the options setting the ones the SDK doesn't
+// support yet
+func samplingParameters(params *anthropicSDK.MessageNewParams, cfg llm.LanguageModelConfig) []option.RequestOption {
+	if len(cfg.StopSequences) > 0 {
+		params.StopSequences = anthropicSDK.F(cfg.StopSequences)
+	}
+
+	budget := thinkingBudget(cfg)
+	if budget == 0 {
+		if cfg.Temperature != nil {
+			params.Temperature = anthropicSDK.F(float64(*cfg.Temperature))
+		}
+		if cfg.TopP != nil {
+			params.TopP = anthropicSDK.F(float64(*cfg.TopP))
+		}
+		return nil
+	}
+
+	// The budget is part of max_tokens, which has to stay above it. Sampling is fixed while thinking.
+	if cfg.MaxGeneratedTokens <= budget {
+		params.MaxTokens = anthropicSDK.F(int64(budget + cfg.MaxGeneratedTokens))
+	}
+	return []option.RequestOption{option.WithJSONSet("thinking", map[string]any{
+		"type":          "enabled",
+		"budget_tokens": budget,
+	})}
+}
+
+// thinkingBlocks accumulates the thinking blocks of a response, which the SDK doesn't decode. They have to be
+// sent back unchanged, signature included, when the response is continued with tool results.
+type thinkingBlocks map[int64]map[string]any
+
+func (b thinkingBlocks) accumulate(event anthropicSDK.MessageStreamEvent) {
+	switch event.Type {
+	case anthropicSDK.MessageStreamEventTypeContentBlockStart:
+		block, ok := event.ContentBlock.(anthropicSDK.ContentBlockStartEventContentBlock)
+		if !ok {
+			return
+		}
+		var raw map[string]any
+		if err := json.Unmarshal([]byte(block.JSON.RawJSON()), &raw); err != nil {
+			return
+		}
+		if raw["type"] == "thinking" || raw["type"] == "redacted_thinking" {
+			b[event.Index] = raw
+		}
+	case anthropicSDK.MessageStreamEventTypeContentBlockDelta:
+		block, ok := b[event.Index]
+		if !ok {
+			return
+		}
+		delta, ok := event.Delta.(anthropicSDK.ContentBlockDeltaEventDelta)
+		if !ok {
+			return
+		}
+		var raw struct {
+			Thinking  string `json:"thinking"`
+			Signature string `json:"signature"`
+		}
+		if err := json.Unmarshal([]byte(delta.JSON.RawJSON()), &raw); err != nil {
+			return
+		}
+		thinking, _ := block["thinking"].(string)
+		signature, _ := block["signature"].(string)
+		block["thinking"] = thinking + raw.Thinking
+		block["signature"] = signature + raw.Signature
+	}
+}
+
+// assistantContent returns the content of the message with its thinking blocks, nil if it has none
+func (b thinkingBlocks) assistantContent(message anthropicSDK.MessageParam) ([]any, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	content := make([]any, 0, len(message.Content.Value))
+	for i, block := range message.Content.Value {
+		if thinking, ok := b[int64(i)]; ok {
+			content = append(content, thinking)
+			continue
+		}
+		data, err := json.Marshal(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal content block: %w", err)
+		}
+		content = append(content, json.RawMessage(data))
+	}
+	return content, nil
+}
@@ -47,16 +47,28 @@ func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Req
 	postRouter.POST("/summarize_transcription", p.handleSummarizeTranscription)
 	postRouter.POST("/stop", p.handleStop)
 	postRouter.POST("/regenerate", p.handleRegenerate)
+	postRouter.POST("/tool_approval", p.handleToolApproval)
 	postRouter.POST("/postback_summary", p.handlePostbackSummary)
+	postRouter.GET("/related", p.handleGetRelatedThreads)
 
 	channelRouter := botRequiredRouter.Group("/channel/:channelid")
 	channelRouter.Use(p.channelAuthorizationRequired)
 	channelRouter.POST("/interval", p.handleInterval)
 
+	searchRouter := botRequiredRouter.Group("/search")
+	searchRouter.POST("/run", p.handleRunSearch)
+	searchRouter.POST("", p.handleSearchQuery)
+
 	adminRouter := router.Group("/admin")
 	adminRouter.Use(p.mattermostAdminAuthorizationRequired)
-
-	// Removed search and reindex routes since we're not supporting those features with MySQL
+	adminRouter.POST("/reindex", p.handleReindexPosts)
+	adminRouter.GET("/reindex/status", p.handleGetJobStatus)
+	adminRouter.POST("/reindex/cancel", p.handleCancelJob)
+	adminRouter.GET("/usage", p.handleGetUsage)
+	adminRouter.POST("/usage/reset", p.handleResetUsage)
+	adminRouter.GET("/usage/report", p.handleGetUsageReport)
+	adminRouter.POST("/ollama/pull", p.handlePullOllamaModel)
+	adminRouter.GET("/ollama/pull/status", p.handleGetOllamaPullStatus)
 
 	router.ServeHTTP(w, r)
 }
@@ -79,6 +91,17 @@ func (p *Plugin) ginlogger(c *gin.Context) {
 	}
 }
 
+// abortWithQuotaError answers requests refused by a quota with 429 and the refusal in the user's language. It returns
+// false, leaving the request to the caller, for other errors.
+func (p *Plugin) abortWithQuotaError(c *gin.Context, err error, locale string) bool {
+	var quotaErr *QuotaExceededError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": quotaErr.Message(i18nLocalizerFunc(p.i18n, locale))})
+	return true
+}
+
 func (p *Plugin) MattermostAuthorizationRequired(c *gin.Context) {
 	userID := c.GetHeader("Mattermost-User-Id")
 	if userID == "" {
@@ -189,8 +212,7 @@ func (p *Plugin) handleGetAIBots(c *gin.Context) {
 		}
 	}
 
-	// Search is always disabled with MySQL version
-	searchEnabled := false
+	searchEnabled := p.getSearch() != nil
 
 	response := AIBotsResponse{
 		Bots:          bots,
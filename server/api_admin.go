@@ -4,7 +4,10 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"errors"
 
@@ -12,27 +15,213 @@ import (
 	"github.com/mattermost/mattermost/server/public/model"
 )
 
-// handleReindexPosts returns an error message for MySQL since vector search is not supported
+// handleReindexPosts starts a background job that rebuilds the search index from all posts
 func (p *Plugin) handleReindexPosts(c *gin.Context) {
-	c.JSON(http.StatusNotImplemented, gin.H{
-		"error": "Reindexing is not available when using MySQL. Vector search requires PostgreSQL with the pgvector extension.",
-	})
+	if p.getSearch() == nil {
+		c.AbortWithError(http.StatusBadRequest, errors.New("search is not configured"))
+		return
+	}
+
+	jobStatus, err := p.startReindexJob()
+	if errors.Is(err, errReindexJobRunning) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "job already running",
+			"status": jobStatus,
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, jobStatus)
 }
 
-// handleGetJobStatus returns an error message for MySQL since vector search is not supported
+// handleGetJobStatus returns the status of the last reindex job
 func (p *Plugin) handleGetJobStatus(c *gin.Context) {
-	c.JSON(http.StatusNotImplemented, gin.H{
-		"error": "Search indexing is not available when using MySQL. Vector search requires PostgreSQL with the pgvector extension.",
-	})
+	status, err := p.getJobStatus()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if status == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "no_job"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
 }
 
-// handleCancelJob returns an error message for MySQL since vector search is not supported
+// handleCancelJob marks the running reindex job as canceled, the job stops at its next status update
 func (p *Plugin) handleCancelJob(c *gin.Context) {
-	c.JSON(http.StatusNotImplemented, gin.H{
-		"error": "Search indexing is not available when using MySQL. Vector search requires PostgreSQL with the pgvector extension.",
+	status, err := p.cancelReindexJob()
+	if errors.Is(err, errNoRunningReindexJob) {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func validUsageScopeType(scopeType string) bool {
+	return scopeType == UsageScopeUser || scopeType == UsageScopeTeam || scopeType == UsageScopeBot
+}
+
+// handleGetUsage returns the usage of one user, team or bot when an id is given, otherwise the usage of
+// every user, team or bot this month
+func (p *Plugin) handleGetUsage(c *gin.Context) {
+	scopeType := c.Query("scope")
+	if !validUsageScopeType(scopeType) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("scope must be one of user, team or bot"))
+		return
+	}
+
+	now := time.Now()
+	scopeID := c.Query("id")
+	if scopeID == "" {
+		usage, err := p.listUsage(scopeType, monthUsagePeriodPrefix(now))
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"scope": scopeType, "month": usage})
+		return
+	}
+
+	scope := UsageScope{Type: scopeType, ID: scopeID}
+	minute, err := p.getUsage(scope, minuteUsagePeriod(now))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	day, err := p.getUsage(scope, dayUsagePeriod(now))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	month, err := p.getUsage(scope, monthUsagePeriodPrefix(now))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"scope":  scope,
+		"minute": minute,
+		"day":    day,
+		"month":  month,
 	})
 }
 
+// handleResetUsage deletes the recorded usage of a user, team or bot, lifting any quota they had reached
+func (p *Plugin) handleResetUsage(c *gin.Context) {
+	var scope UsageScope
+	if err := c.ShouldBindJSON(&scope); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if !validUsageScopeType(scope.Type) || scope.ID == "" {
+		c.AbortWithError(http.StatusBadRequest, errors.New("type must be one of user, team or bot and id is required"))
+		return
+	}
+
+	if err := p.resetUsage(scope); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// handleGetUsageReport sums the tokens and cost of the requests made between since and until, in milliseconds,
+// grouped by bot, user, team, channel, feature or model. It defaults to the current month.
+func (p *Plugin) handleGetUsageReport(c *gin.Context) {
+	groupBy := c.DefaultQuery("group_by", "team")
+	if _, ok := usageReportColumns[groupBy]; !ok {
+		c.AbortWithError(http.StatusBadRequest, errors.New("group_by must be one of bot, user, team, channel, feature or model"))
+		return
+	}
+
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	until := now.UnixMilli() + 1
+	if value := c.Query("since"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid since: %w", err))
+			return
+		}
+		since = parsed
+	}
+	if value := c.Query("until"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid until: %w", err))
+			return
+		}
+		until = parsed
+	}
+
+	rows, err := p.getUsageReport(groupBy, since, until)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"groupBy": groupBy,
+		"since":   since,
+		"until":   until,
+		"rows":    rows,
+	})
+}
+
+// handlePullOllamaModel starts pulling the default model of a bot's Ollama service to the server
+func (p *Plugin) handlePullOllamaModel(c *gin.Context) {
+	var data struct {
+		Bot string `json:"bot"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	status, err := p.startOllamaPull(data.Bot)
+	if errors.Is(err, errNotOllamaBot) {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if errors.Is(err, errOllamaPullRunning) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "pull already running",
+			"status": status,
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// handleGetOllamaPullStatus returns the progress of the last pull of a bot's model
+func (p *Plugin) handleGetOllamaPullStatus(c *gin.Context) {
+	status, ok := p.getOllamaPull(c.Query("bot"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"status": "no_pull"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
 func (p *Plugin) mattermostAdminAuthorizationRequired(c *gin.Context) {
 	userID := c.GetHeader("Mattermost-User-Id")
 
@@ -214,10 +214,14 @@ func (p *Plugin) handleInterval(c *gin.Context) {
 			},
 		},
 		Context: context,
+		Feature: llm.FeatureSummarize,
 	}
 
-	resultStream, err := p.getLLM(bot.cfg).ChatCompletion(completionRequest)
+	// The summary is streamed after the request returns so it can't use the request's context
+	streamContext := p.newStreamingContext()
+	resultStream, err := p.getLLM(bot.cfg).ChatCompletion(streamContext.ctx, completionRequest, llm.WithTemperature(llm.SummaryTemperature))
 	if err != nil {
+		streamContext.cancel()
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
@@ -225,7 +229,7 @@ func (p *Plugin) handleInterval(c *gin.Context) {
 	post := &model.Post{}
 	post.AddProp(NoRegen, "true")
 	// Here we don't have a specific post we're responding to, so pass empty string
-	if err := p.streamResultToNewDM(bot.mmBot.UserId, resultStream, user.Id, post, ""); err != nil {
+	if err := p.streamResultToNewDM(streamContext, bot.mmBot.UserId, resultStream, user.Id, post, ""); err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
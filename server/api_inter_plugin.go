@@ -61,7 +61,7 @@ func (p *Plugin) handleInterPluginSimpleCompletion(c *gin.Context) {
 
 	// Add tools if not disabled
 	if !bot.cfg.DisableTools {
-		context.Tools = p.getDefaultToolsStore(bot, true)
+		context.Tools = p.getDefaultToolsStore(bot, true, nil, user)
 	}
 
 	// Format system prompt using template
@@ -90,10 +90,14 @@ func (p *Plugin) handleInterPluginSimpleCompletion(c *gin.Context) {
 			},
 		},
 		Context: context,
+		Feature: llm.FeatureInterPlugin,
 	}
 
 	// Execute the completion
-	response, err := p.getLLM(bot.cfg).ChatCompletionNoStream(completionRequest)
+	response, err := p.getLLM(bot.cfg).ChatCompletionNoStream(c.Request.Context(), completionRequest)
+	if p.abortWithQuotaError(c, err, user.Locale) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("completion failed: %v", err)})
 		return
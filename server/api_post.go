@@ -4,10 +4,10 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 
 	"errors"
@@ -51,6 +51,22 @@ func (p *Plugin) postAuthorizationRequired(c *gin.Context) {
 	}
 }
 
+// emojiReaction is the response of the emoji selection
+type emojiReaction struct {
+	Emoji string `json:"emoji" jsonschema:"description=The name of the emoji from the list"`
+}
+
+func (r emojiReaction) name() string {
+	return strings.Trim(strings.TrimSpace(r.Emoji), ":")
+}
+
+func (r emojiReaction) Validate() error {
+	if _, found := model.GetSystemEmojiId(r.name()); !found {
+		return fmt.Errorf("%q is not the name of an emoji from the list", r.Emoji)
+	}
+	return nil
+}
+
 func (p *Plugin) handleReact(c *gin.Context) {
 	userID := c.GetHeader("Mattermost-User-Id")
 	post := c.MustGet(ContextPostKey).(*model.Post)
@@ -86,26 +102,27 @@ func (p *Plugin) handleReact(c *gin.Context) {
 			},
 		},
 		Context: context,
+		Feature: llm.FeatureReact,
 	}
-	emojiName, err := p.getLLM(bot.cfg).ChatCompletionNoStream(completionRequest, llm.WithMaxGeneratedTokens(25))
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
-	}
-
-	// Do some emoji post-processing to hopefully make this an actual emoji.
-	emojiName = strings.Trim(strings.TrimSpace(emojiName), ":")
-
-	if _, found := model.GetSystemEmojiId(emojiName); !found {
+	reaction, err := llm.ChatCompletionStructured[emojiReaction](c.Request.Context(), p.getLLM(bot.cfg), completionRequest, llm.WithMaxGeneratedTokens(50))
+	if errors.Is(err, llm.ErrInvalidStructuredResponse) {
 		_ = p.pluginAPI.Post.AddReaction(&model.Reaction{
 			EmojiName: "large_red_square",
 			UserId:    bot.mmBot.UserId,
 			PostId:    post.Id,
 		})
 
-		c.AbortWithError(http.StatusInternalServerError, errors.New("LLM returned somthing other than emoji: "+emojiName))
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("LLM returned somthing other than emoji: %w", err))
+		return
+	}
+	if p.abortWithQuotaError(c, err, user.Locale) {
 		return
 	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	emojiName := reaction.name()
 
 	if err := p.pluginAPI.Post.AddReaction(&model.Reaction{
 		EmojiName: emojiName,
@@ -274,7 +291,7 @@ func (p *Plugin) handleStop(c *gin.Context) {
 		return
 	}
 
-	p.stopPostStreaming(post.Id)
+	p.stopPostStreamingInCluster(post.Id)
 }
 
 func (p *Plugin) handleRegenerate(c *gin.Context) {
@@ -311,11 +328,11 @@ func (p *Plugin) handleRegenerate(c *gin.Context) {
 }
 
 func (p *Plugin) regeneratePost(bot *Bot, post *model.Post, user *model.User, channel *model.Channel) error {
-	ctx, err := p.getPostStreamingContext(context.Background(), post.Id)
+	ctx, err := p.getPostStreamingContext(p.activeContext(), post.Id)
 	if err != nil {
 		return err
 	}
-	defer p.finishPostStreaming(post.Id)
+	defer p.finishPostStreaming(ctx, post.Id)
 
 	threadIDProp := post.GetProp(ThreadIDProp)
 	analysisTypeProp := post.GetProp(AnalysisTypeProp)
@@ -330,7 +347,7 @@ func (p *Plugin) regeneratePost(bot *Bot, post *model.Post, user *model.User, ch
 		post.Message = p.analysisPostMessage(user.Locale, threadID, analysisType, *siteURL)
 
 		var err error
-		result, err = p.analyzeThread(bot, threadID, analysisType, p.BuildLLMContextUserRequest(
+		result, err = p.analyzeThread(ctx, bot, threadID, analysisType, p.BuildLLMContextUserRequest(
 			bot,
 			user,
 			channel,
@@ -373,7 +390,7 @@ func (p *Plugin) regeneratePost(bot *Bot, post *model.Post, user *model.User, ch
 			p.WithLLMContextDefaultTools(bot, originalFileChannel.Type == model.ChannelTypeDirect),
 		)
 		var summaryErr error
-		result, summaryErr = p.summarizeTranscription(bot, transcription, context)
+		result, summaryErr = p.summarizeTranscription(ctx, bot, transcription, context)
 		if summaryErr != nil {
 			return fmt.Errorf("could not summarize transcription on regen: %w", summaryErr)
 		}
@@ -406,7 +423,7 @@ func (p *Plugin) regeneratePost(bot *Bot, post *model.Post, user *model.User, ch
 			p.WithLLMContextDefaultTools(bot, mmapi.IsDMWith(bot.mmBot.UserId, channel)),
 		)
 		var summaryErr error
-		result, summaryErr = p.summarizeTranscription(bot, transcription, context)
+		result, summaryErr = p.summarizeTranscription(ctx, bot, transcription, context)
 		if summaryErr != nil {
 			return fmt.Errorf("unable to summarize transcription: %w", summaryErr)
 		}
@@ -424,21 +441,24 @@ func (p *Plugin) regeneratePost(bot *Bot, post *model.Post, user *model.User, ch
 		}
 
 		var processErr error
-		if result, processErr = p.processUserRequestToBot(bot, user, channel, respondingToPost); processErr != nil {
+		if result, processErr = p.processUserRequestToBot(ctx, bot, user, channel, respondingToPost); processErr != nil {
 			return fmt.Errorf("could not continue conversation on regen: %w", processErr)
 		}
 	}
 
+	p.streamResultToPost(ctx, result, post, p.responseLocale(bot, user, channel))
+
+	return nil
+}
+
+// responseLocale is the locale of the bot's responses in the channel, the user's own in their DM with the bot
+func (p *Plugin) responseLocale(bot *Bot, user *model.User, channel *model.Channel) string {
 	if mmapi.IsDMWith(bot.mmBot.UserId, channel) {
 		if channel.Name == bot.mmBot.UserId+"__"+user.Id || channel.Name == user.Id+"__"+bot.mmBot.UserId {
-			p.streamResultToPost(ctx, result, post, user.Locale)
-			return nil
+			return user.Locale
 		}
 	}
-
-	p.streamResultToPost(ctx, result, post, *p.API.GetConfig().LocalizationSettings.DefaultServerLocale)
-
-	return nil
+	return *p.API.GetConfig().LocalizationSettings.DefaultServerLocale
 }
 
 func (p *Plugin) handlePostbackSummary(c *gin.Context) {
@@ -501,3 +521,36 @@ func (p *Plugin) handlePostbackSummary(c *gin.Context) {
 	}
 	c.Render(http.StatusOK, render.JSON{Data: data})
 }
+
+// handleGetRelatedThreads returns past threads similar to the thread containing the post
+func (p *Plugin) handleGetRelatedThreads(c *gin.Context) {
+	userID := c.GetHeader("Mattermost-User-Id")
+	post := c.MustGet(ContextPostKey).(*model.Post)
+
+	limit := 0
+	if limitParam := c.Query("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			c.AbortWithError(http.StatusBadRequest, errors.New("invalid limit"))
+			return
+		}
+	}
+
+	if p.getSearch() == nil {
+		c.AbortWithError(http.StatusBadRequest, errors.New("search is not configured"))
+		return
+	}
+
+	threads, err := p.findRelatedThreads(c.Request.Context(), userID, post, limit)
+	if err != nil {
+		if errors.Is(err, ErrRelatedNotSupported) {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, threads)
+}
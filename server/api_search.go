@@ -4,21 +4,255 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost/server/public/model"
 )
 
-// Modified handler to return an error message since search is not supported on MySQL
+const (
+	SearchResultsProp = "search_results"
+
+	defaultSearchMaxResults = 5
+)
+
+// SearchRequest is the body of the search endpoints
+type SearchRequest struct {
+	Query      string                `json:"query"`
+	TeamID     string                `json:"teamId"`
+	ChannelID  string                `json:"channelId"`
+	MaxResults int                   `json:"maxResults"`
+	MinScore   float32               `json:"minScore"`
+	Mode       embeddings.SearchMode `json:"mode"`
+}
+
+// RAGResult is a search result enriched with the information needed to display and cite it
+type RAGResult struct {
+	PostID      string  `json:"postId"`
+	ChannelID   string  `json:"channelId"`
+	ChannelName string  `json:"channelName"`
+	UserID      string  `json:"userId"`
+	Username    string  `json:"username"`
+	Content     string  `json:"content"`
+	Score       float32 `json:"score,omitempty"` // Not set for posts that were cited rather than searched for
+	CreateAt    int64   `json:"createAt"`
+	Permalink   string  `json:"permalink"`
+}
+
+// Time returns when the post was created, for prompts
+func (r RAGResult) Time() string {
+	return model.GetTimeForMillis(r.CreateAt).UTC().Format(time.RFC1123)
+}
+
+func (r SearchRequest) validate() error {
+	if r.Query == "" {
+		return errors.New("query is required")
+	}
+
+	switch r.Mode {
+	case "", embeddings.SearchModeVector, embeddings.SearchModeKeyword, embeddings.SearchModeHybrid:
+		return nil
+	}
+
+	return fmt.Errorf("invalid search mode: %s", r.Mode)
+}
+
+// searchPosts runs a search on behalf of a user. The user ID restricts results to channels the user can read.
+func (p *Plugin) searchPosts(ctx context.Context, userID string, req SearchRequest) ([]RAGResult, error) {
+	search := p.getSearch()
+	if search == nil {
+		return nil, errors.New("search is not configured")
+	}
+
+	maxResults := req.MaxResults
+	if maxResults <= 0 {
+		maxResults = defaultSearchMaxResults
+	}
+
+	results, err := search.Search(ctx, req.Query, embeddings.SearchOptions{
+		Limit:     maxResults,
+		MinScore:  req.MinScore,
+		TeamID:    req.TeamID,
+		ChannelID: req.ChannelID,
+		UserID:    userID,
+		Mode:      req.Mode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+
+	return p.convertToRAGResults(results), nil
+}
+
+// convertToRAGResults looks up the channel and user names of search results.
+// Results are already restricted to channels the user can read by the vector store.
+func (p *Plugin) convertToRAGResults(results []embeddings.SearchResult) []RAGResult {
+	ragResults := make([]RAGResult, 0, len(results))
+	for _, result := range results {
+		channelName := result.Document.ChannelID
+		if channel, err := p.pluginAPI.Channel.Get(result.Document.ChannelID); err == nil {
+			channelName = channel.DisplayName
+		}
+
+		ragResults = append(ragResults, p.newRAGResult(result.Document, channelName, result.Score))
+	}
+
+	return ragResults
+}
+
+func (p *Plugin) newRAGResult(doc embeddings.PostDocument, channelName string, score float32) RAGResult {
+	username := doc.UserID
+	if user, err := p.pluginAPI.User.Get(doc.UserID); err == nil {
+		username = user.Username
+	}
+
+	return RAGResult{
+		PostID:      doc.PostID,
+		ChannelID:   doc.ChannelID,
+		ChannelName: channelName,
+		UserID:      doc.UserID,
+		Username:    username,
+		Content:     doc.Content,
+		Score:       score,
+		CreateAt:    doc.CreateAt,
+		Permalink:   p.postPermalink(doc.PostID),
+	}
+}
+
+// postPermalink returns a link to a post that works without knowing its team
+func (p *Plugin) postPermalink(postID string) string {
+	siteURL := ""
+	if url := p.pluginAPI.Configuration.GetConfig().ServiceSettings.SiteURL; url != nil {
+		siteURL = strings.TrimSuffix(*url, "/")
+	}
+
+	return siteURL + "/_redirect/pl/" + postID
+}
+
+// handleRunSearch searches for the query and has the bot answer it in a DM using the results
 func (p *Plugin) handleRunSearch(c *gin.Context) {
-	c.JSON(http.StatusNotImplemented, gin.H{
-		"error": "Search functionality is not available when using MySQL. Vector search requires PostgreSQL with the pgvector extension.",
+	userID := c.GetHeader("Mattermost-User-Id")
+	bot := c.MustGet(ContextBotKey).(*Bot)
+
+	var req SearchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if p.getSearch() == nil {
+		c.AbortWithError(http.StatusBadRequest, errors.New("search is not configured"))
+		return
+	}
+
+	user, err := p.pluginAPI.User.Get(userID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to get user: %w", err))
+		return
+	}
+
+	questionPost := &model.Post{
+		Message: req.Query,
+	}
+	if err := p.botDMNonResponse(bot.mmBot.UserId, userID, questionPost); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to create question post: %w", err))
+		return
+	}
+
+	results, err := p.searchPosts(c.Request.Context(), userID, req)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	streamContext := p.newStreamingContext()
+	stream, err := p.answerFromSearchResults(streamContext.ctx, bot, user, req.Query, results)
+	if err != nil {
+		streamContext.cancel()
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		streamContext.cancel()
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to marshal search results: %w", err))
+		return
+	}
+
+	responsePost := &model.Post{
+		RootId: questionPost.Id,
+	}
+	responsePost.AddProp(SearchResultsProp, string(resultsJSON))
+	if err := p.streamResultToNewDM(streamContext, bot.mmBot.UserId, stream, userID, responsePost, questionPost.Id); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to stream response: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"postId":    responsePost.Id,
+		"channelId": responsePost.ChannelId,
 	})
 }
 
-// Modified handler to return an error message since search is not supported on MySQL
-func (p *Plugin) handleSearchQuery(c *gin.Context) {
-	c.JSON(http.StatusNotImplemented, gin.H{
-		"error": "Search functionality is not available when using MySQL. Vector search requires PostgreSQL with the pgvector extension.",
+// answerFromSearchResults asks the bot to answer the query using only the search results as context
+func (p *Plugin) answerFromSearchResults(ctx context.Context, bot *Bot, user *model.User, query string, results []RAGResult) (*llm.TextStreamResult, error) {
+	llmContext := p.BuildLLMContextUserRequest(bot, user, nil, p.WithLLMContextParameters(map[string]interface{}{
+		"Query":   query,
+		"Results": results,
+	}))
+
+	systemMessage, err := p.prompts.Format(llm.PromptSearchSystem, llmContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to format system message: %w", err)
+	}
+
+	userMessage, err := p.prompts.Format(llm.PromptSearchUser, llmContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to format user message: %w", err)
+	}
+
+	return p.getLLM(bot.cfg).ChatCompletion(ctx, llm.CompletionRequest{
+		Posts: []llm.Post{
+			{Role: llm.PostRoleSystem, Message: systemMessage},
+			{Role: llm.PostRoleUser, Message: userMessage},
+		},
+		Context: llmContext,
+		Feature: llm.FeatureSearch,
 	})
 }
+
+// handleSearchQuery returns the search results without generating an answer
+func (p *Plugin) handleSearchQuery(c *gin.Context) {
+	userID := c.GetHeader("Mattermost-User-Id")
+
+	var req SearchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := p.searchPosts(c.Request.Context(), userID, req)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
@@ -100,7 +100,9 @@ func TestAdminRouter(t *testing.T) {
 	gin.SetMode(gin.ReleaseMode)
 	gin.DefaultWriter = io.Discard
 
-	for urlName, url := range map[string]string{} {
+	for urlName, url := range map[string]string{
+		"reindex status": "/admin/reindex/status",
+	} {
 		for name, test := range map[string]struct {
 			request        *http.Request
 			expectedStatus int
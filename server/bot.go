@@ -133,6 +133,9 @@ func (p *Plugin) EnsureBots() error {
 	for _, bot := range cfgBots {
 		if !bot.IsValid() {
 			p.pluginAPI.Log.Error("Configured bot is not valid", "bot_name", bot.Name, "bot_display_name", bot.DisplayName)
+			if err := bot.ValidateModelParameters(); err != nil {
+				p.pluginAPI.Log.Error("Configured bot has invalid model parameters", "bot_name", bot.Name, "error", err.Error())
+			}
 			continue
 		}
 		if _, ok := aiBotConfigsByUsername[bot.Name]; ok {
@@ -4,12 +4,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +19,7 @@ import (
 
 	"github.com/andygrunwald/go-jira"
 	"github.com/google/go-github/v41/github"
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
 	"github.com/mattermost/mattermost-plugin-ai/server/llm"
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
@@ -26,7 +29,7 @@ type LookupMattermostUserArgs struct {
 	Username string `jsonschema_description:"The username of the user to lookup without a leading '@'. Example: 'firstname.lastname'"`
 }
 
-func (p *Plugin) toolResolveLookupMattermostUser(context *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+func (p *Plugin) toolResolveLookupMattermostUser(_ context.Context, llmContext *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
 	var args LookupMattermostUserArgs
 	err := argsGetter(&args)
 	if err != nil {
@@ -38,7 +41,7 @@ func (p *Plugin) toolResolveLookupMattermostUser(context *llm.Context, argsGette
 	}
 
 	// Fail for guests.
-	if !p.pluginAPI.User.HasPermissionTo(context.RequestingUser.Id, model.PermissionViewMembers) {
+	if !p.pluginAPI.User.HasPermissionTo(llmContext.RequestingUser.Id, model.PermissionViewMembers) {
 		return "user doesn't have permissions", errors.New("user doesn't have permission to lookup users")
 	}
 
@@ -95,7 +98,7 @@ func formatGithubIssue(issue *github.Issue) string {
 
 var validGithubRepoName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
 
-func (p *Plugin) toolGetGithubIssue(context *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+func (p *Plugin) toolGetGithubIssue(ctx context.Context, llmContext *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
 	var args GetGithubIssueArgs
 	err := argsGetter(&args)
 	if err != nil {
@@ -117,7 +120,7 @@ func (p *Plugin) toolGetGithubIssue(context *llm.Context, argsGetter llm.ToolArg
 		return "invalid parameters to function", errors.New("invalid issue number")
 	}
 
-	req, err := http.NewRequest(http.MethodGet,
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
 		fmt.Sprintf("/github/api/v1/issue?owner=%s&repo=%s&number=%d",
 			url.QueryEscape(args.RepoOwner),
 			url.QueryEscape(args.RepoName),
@@ -128,7 +131,7 @@ func (p *Plugin) toolGetGithubIssue(context *llm.Context, argsGetter llm.ToolArg
 	if err != nil {
 		return "internal failure", fmt.Errorf("failed to create request: %w", err)
 	}
-	req.Header.Set("Mattermost-User-ID", context.RequestingUser.Id)
+	req.Header.Set("Mattermost-User-ID", llmContext.RequestingUser.Id)
 
 	resp := p.pluginAPI.Plugin.HTTP(req)
 	if resp == nil {
@@ -274,14 +277,14 @@ var fetchedFields = []string{
 	"comment",
 }
 
-func (p *Plugin) getPublicJiraIssues(instanceURL string, issueKeys []string) ([]jira.Issue, error) {
+func (p *Plugin) getPublicJiraIssues(ctx context.Context, instanceURL string, issueKeys []string) ([]jira.Issue, error) {
 	httpClient := p.createExternalHTTPClient()
 	client, err := jira.NewClient(httpClient, instanceURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Jira client: %w", err)
 	}
 	jql := fmt.Sprintf("key in (%s)", strings.Join(issueKeys, ","))
-	issues, _, err := client.Issue.Search(jql, &jira.SearchOptions{Fields: fetchedFields})
+	issues, _, err := client.Issue.SearchWithContext(ctx, jql, &jira.SearchOptions{Fields: fetchedFields})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get issue: %w", err)
 	}
@@ -292,7 +295,7 @@ func (p *Plugin) getPublicJiraIssues(instanceURL string, issueKeys []string) ([]
 	return issues, nil
 }
 
-func (p *Plugin) toolGetJiraIssue(context *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+func (p *Plugin) toolGetJiraIssue(ctx context.Context, _ *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
 	var args GetJiraIssueArgs
 	err := argsGetter(&args)
 	if err != nil {
@@ -306,7 +309,7 @@ func (p *Plugin) toolGetJiraIssue(context *llm.Context, argsGetter llm.ToolArgum
 		}
 	}
 
-	issues, err := p.getPublicJiraIssues(args.InstanceURL, args.IssueKeys)
+	issues, err := p.getPublicJiraIssues(ctx, args.InstanceURL, args.IssueKeys)
 	if err != nil {
 		return "internal failure", err
 	}
@@ -320,7 +323,111 @@ func (p *Plugin) toolGetJiraIssue(context *llm.Context, argsGetter llm.ToolArgum
 	return result.String(), nil
 }
 
-// Removing the SearchServer tool since search functionality is removed in MySQL version
+type SearchServerArgs struct {
+	Query string `jsonschema_description:"What to search for. Describe the information you are looking for and include any names or exact terms that should appear. Example: 'release date of the mobile app v2'"`
+}
+
+const (
+	searchServerMaxResults = 10
+	searchServerTimeout    = 30 * time.Second
+)
+
+func (p *Plugin) toolSearchServer(ctx context.Context, llmContext *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+	var args SearchServerArgs
+	err := argsGetter(&args)
+	if err != nil {
+		return "invalid parameters to function", fmt.Errorf("failed to get arguments for tool SearchServer: %w", err)
+	}
+
+	if strings.TrimSpace(args.Query) == "" {
+		return "invalid parameters to function", errors.New("empty search query")
+	}
+
+	if llmContext.RequestingUser == nil {
+		return "search is not available", errors.New("no requesting user to search on behalf of")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, searchServerTimeout)
+	defer cancel()
+
+	results, err := p.searchPosts(ctx, llmContext.RequestingUser.Id, SearchRequest{
+		Query:      args.Query,
+		MaxResults: searchServerMaxResults,
+	})
+	if err != nil {
+		return "search failed", err
+	}
+
+	if len(results) == 0 {
+		return "No relevant messages were found.", nil
+	}
+
+	formatted, err := p.prompts.Format(llm.PromptSearchResults, llm.NewContext(p.WithLLMContextParameters(map[string]interface{}{
+		"Results": results,
+	})))
+	if err != nil {
+		return "internal failure", fmt.Errorf("failed to format search results: %w", err)
+	}
+
+	return formatted, nil
+}
+
+type FindRelatedThreadsArgs struct {
+	Post string `jsonschema_description:"The ID of a post or a link to it. Example: 'https://mattermost.example.com/team/pl/4xp9fdt77pncbef59f4k1qe83o'"`
+}
+
+var postIDInLinkPattern = regexp.MustCompile(`/pl/([a-z0-9]{26})`)
+
+func (p *Plugin) toolFindRelatedThreads(ctx context.Context, llmContext *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+	var args FindRelatedThreadsArgs
+	err := argsGetter(&args)
+	if err != nil {
+		return "invalid parameters to function", fmt.Errorf("failed to get arguments for tool FindRelatedThreads: %w", err)
+	}
+
+	postID := strings.TrimSpace(args.Post)
+	if match := postIDInLinkPattern.FindStringSubmatch(postID); match != nil {
+		postID = match[1]
+	}
+	if !model.IsValidId(postID) {
+		return "invalid post ID or link", errors.New("invalid post ID")
+	}
+
+	if llmContext.RequestingUser == nil {
+		return "related threads are not available", errors.New("no requesting user to search on behalf of")
+	}
+
+	post, err := p.pluginAPI.Post.GetPost(postID)
+	if err != nil {
+		return "post not found", fmt.Errorf("failed to get post: %w", err)
+	}
+
+	// The post itself isn't returned but its content is used to search so the user must be able to read it
+	if !p.pluginAPI.User.HasPermissionToChannel(llmContext.RequestingUser.Id, post.ChannelId, model.PermissionReadChannel) {
+		return "post not found", errors.New("user doesn't have permission to read the post")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, searchServerTimeout)
+	defer cancel()
+
+	threads, err := p.findRelatedThreads(ctx, llmContext.RequestingUser.Id, post, defaultRelatedThreads)
+	if err != nil {
+		return "failed to find related threads", err
+	}
+
+	if len(threads) == 0 {
+		return "No related threads were found.", nil
+	}
+
+	formatted, err := p.prompts.Format(llm.PromptSearchResults, llm.NewContext(p.WithLLMContextParameters(map[string]interface{}{
+		"Results": threads,
+	})))
+	if err != nil {
+		return "internal failure", fmt.Errorf("failed to format related threads: %w", err)
+	}
+
+	return formatted, nil
+}
 
 // getBuiltInTools returns the built-in tools that are available to all users.
 // isDM is true if the response will be in a DM with the user. More tools are available in DMs because of security properties.
@@ -328,6 +435,25 @@ func (p *Plugin) getBuiltInTools(isDM bool, bot *Bot) []llm.Tool {
 	builtInTools := []llm.Tool{}
 
 	if isDM {
+		// Search results can come from any channel the user can read so they are only shown in DMs
+		if search := p.getSearch(); search != nil {
+			builtInTools = append(builtInTools, llm.Tool{
+				Name:        "SearchServer",
+				Description: "Search the messages on this Mattermost server that the user has access to. Each result includes its author, channel, time and a link. When you use a result in your answer, cite it with a markdown link to its link, for example [[1]](link).",
+				Schema:      SearchServerArgs{},
+				Resolver:    p.toolSearchServer,
+			})
+
+			if _, ok := search.(embeddings.SimilarSearcher); ok {
+				builtInTools = append(builtInTools, llm.Tool{
+					Name:        "FindRelatedThreads",
+					Description: "Find past threads that discuss the same topic as the thread containing a post, such as earlier answers to a repeated question. Each result is the first post of a thread with its author, channel, time and a link.",
+					Schema:      FindRelatedThreadsArgs{},
+					Resolver:    p.toolFindRelatedThreads,
+				})
+			}
+		}
+
 		builtInTools = append(builtInTools, llm.Tool{
 			Name:        "LookupMattermostUser",
 			Description: "Lookup a Mattermost user by their username. Available information includes: username, full name, email, nickname, position, locale, timezone, last activity, and status.",
@@ -360,11 +486,96 @@ func (p *Plugin) getBuiltInTools(isDM bool, bot *Bot) []llm.Tool {
 	return builtInTools
 }
 
-func (p *Plugin) getDefaultToolsStore(bot *Bot, isDM bool) *llm.ToolStore {
+// getDefaultToolsStore returns the tools the bot can use for the user in the channel, following the bot's tool policy
+func (p *Plugin) getDefaultToolsStore(bot *Bot, isDM bool, channel *model.Channel, user *model.User) *llm.ToolStore {
 	if bot == nil || bot.cfg.DisableTools {
 		return llm.NewNoTools()
 	}
 	store := llm.NewToolStore(&p.pluginAPI.Log, p.getConfiguration().EnableLLMTrace)
-	store.AddTools(p.getBuiltInTools(isDM, bot))
+
+	// The policy only narrows the tools of the channel, tools that are DM only stay out of channels whatever it lists
+	kind := toolChannelKind(isDM, channel)
+	tools := p.getBuiltInTools(isDM, bot)
+	tools = append(tools, p.getMCPTools(bot, kind)...)
+	tools = append(tools, p.getHTTPTools(bot, isDM)...)
+
+	policy := p.toolPolicy(bot.cfg.ToolPolicy, kind)
+	requestContext := &llm.Context{RequestingUser: user}
+	for _, tool := range tools {
+		if policy(tool.Name, requestContext) == nil {
+			store.AddTools([]llm.Tool{tool})
+		}
+	}
+	store.SetPolicy(policy)
+
 	return store
 }
+
+// toolChannelKind is the kind of channel the tool policy applies. DMs between users are treated as group messages
+// since the bot isn't one of the members.
+func toolChannelKind(isDM bool, channel *model.Channel) llm.ToolChannelKind {
+	if isDM || channel == nil {
+		return llm.ToolChannelDirect
+	}
+	switch channel.Type {
+	case model.ChannelTypeOpen:
+		return llm.ToolChannelPublic
+	case model.ChannelTypePrivate:
+		return llm.ToolChannelPrivate
+	default:
+		return llm.ToolChannelGroup
+	}
+}
+
+// toolPolicy checks the calls of a request against the bot's policy for the kind of channel and the requesting user
+func (p *Plugin) toolPolicy(policy llm.ToolPolicy, kind llm.ToolChannelKind) llm.ToolPolicyFunc {
+	return func(name string, llmContext *llm.Context) error {
+		if !policy.AllowsInChannel(kind, name) {
+			return fmt.Errorf("%w: %s can't be used in %s channels", llm.ErrToolNotAllowed, name, kind)
+		}
+
+		userID := ""
+		if llmContext != nil && llmContext.RequestingUser != nil {
+			userID = llmContext.RequestingUser.Id
+		}
+		inTeam := func(teamID string) bool {
+			member, err := p.pluginAPI.Team.GetMember(teamID, userID)
+			return err == nil && member != nil && member.DeleteAt == 0
+		}
+		if !policy.AllowsUser(name, userID, inTeam) {
+			return fmt.Errorf("%w: %s isn't available to the user", llm.ErrToolNotAllowed, name)
+		}
+		return nil
+	}
+}
+
+// toolActivityMessage describes what a tool call is doing, it is shown in the post while the response streams
+func toolActivityMessage(T TranslationFunc, call *llm.ToolCall) string {
+	switch call.Name {
+	case "GetJiraIssue":
+		var args GetJiraIssueArgs
+		if json.Unmarshal([]byte(call.Arguments), &args) == nil && len(args.IssueKeys) > 0 {
+			return T("copilot.tool_activity_jira_issue", "Looking up Jira %s…", strings.Join(args.IssueKeys, ", "))
+		}
+	case "GetGithubIssue":
+		var args GetGithubIssueArgs
+		if json.Unmarshal([]byte(call.Arguments), &args) == nil && args.RepoName != "" {
+			issue := args.RepoOwner + "/" + args.RepoName + "#" + strconv.Itoa(args.Number)
+			return T("copilot.tool_activity_github_issue", "Looking up GitHub issue %s…", issue)
+		}
+	case "LookupMattermostUser":
+		var args LookupMattermostUserArgs
+		if json.Unmarshal([]byte(call.Arguments), &args) == nil && args.Username != "" {
+			return T("copilot.tool_activity_lookup_user", "Looking up @%s…", strings.TrimPrefix(args.Username, "@"))
+		}
+	case "SearchServer":
+		var args SearchServerArgs
+		if json.Unmarshal([]byte(call.Arguments), &args) == nil && args.Query != "" {
+			return T("copilot.tool_activity_search", "Searching for \"%s\"…", args.Query)
+		}
+	case "FindRelatedThreads":
+		return T("copilot.tool_activity_related_threads", "Finding related threads…")
+	}
+
+	return T("copilot.tool_activity_default", "Using %s…", call.Name)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/mcp"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolActivityMessage(t *testing.T) {
+	T := i18nLocalizerFunc(i18nInit(), "en")
+	for _, tc := range []struct {
+		call llm.ToolCall
+		want string
+	}{
+		{llm.ToolCall{Name: "GetJiraIssue", Arguments: `{"InstanceURL":"https://jira.example.com","IssueKeys":["MM-1234"]}`}, "Looking up Jira MM-1234…"},
+		{llm.ToolCall{Name: "GetGithubIssue", Arguments: `{"RepoOwner":"mattermost","RepoName":"mattermost-plugin-ai","Number":42}`}, "Looking up GitHub issue mattermost/mattermost-plugin-ai#42…"},
+		{llm.ToolCall{Name: "LookupMattermostUser", Arguments: `{"Username":"@alice"}`}, "Looking up @alice…"},
+		{llm.ToolCall{Name: "SearchServer", Arguments: `{"Query":"release date"}`}, "Searching for \"release date\"…"},
+		{llm.ToolCall{Name: "FindRelatedThreads", Arguments: `{"Post":"abc"}`}, "Finding related threads…"},
+		{llm.ToolCall{Name: "GetJiraIssue", Arguments: `not json`}, "Using GetJiraIssue…"},
+		{llm.ToolCall{Name: "CustomTool"}, "Using CustomTool…"},
+	} {
+		assert.Equal(t, tc.want, toolActivityMessage(T, &tc.call), tc.call.Name)
+	}
+}
+
+func TestGetDefaultToolsStorePolicy(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	e.mockAPI.On("GetPluginStatus", "github").Return(&model.PluginStatus{State: model.PluginStateNotRunning}, nil)
+	e.mockAPI.On("GetTeamMember", "opsteam", "alice").Return(&model.TeamMember{TeamId: "opsteam", UserId: "alice"}, nil)
+	e.mockAPI.On("GetTeamMember", "opsteam", "bob").Return(nil, &model.AppError{StatusCode: 404})
+
+	e.plugin.setConfiguration(makeConfig(Config{HTTPTools: []HTTPToolConfig{
+		{Name: "tickets", Description: "Tickets", URL: "https://tickets.example.com/api"},
+		{Name: "status", Description: "Status", URL: "https://status.example.com/api", AllowInChannels: true},
+	}}))
+	bot := e.plugin.bots[0]
+	bot.cfg.ToolPolicy = llm.ToolPolicy{
+		PublicChannels: []string{"LookupMattermostUser", "tickets"},
+		GroupMessages:  []string{},
+		Rules:          []llm.ToolRule{{Tool: "GetJiraIssue", TeamIDs: []string{"opsteam"}}},
+	}
+
+	alice := &model.User{Id: "alice"}
+	bob := &model.User{Id: "bob"}
+	toolNames := func(store *llm.ToolStore) []string {
+		var names []string
+		for _, tool := range store.GetTools() {
+			names = append(names, tool.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	dm := &model.Channel{Type: model.ChannelTypeDirect}
+	assert.Equal(t, []string{"GetJiraIssue", "LookupMattermostUser", "status", "tickets"}, toolNames(e.plugin.getDefaultToolsStore(bot, true, dm, alice)))
+	assert.Equal(t, []string{"LookupMattermostUser", "status", "tickets"}, toolNames(e.plugin.getDefaultToolsStore(bot, true, dm, bob)))
+
+	// The policy only narrows the tools of the channel, it doesn't bring DM only tools to public channels
+	public := &model.Channel{Type: model.ChannelTypeOpen}
+	assert.Empty(t, toolNames(e.plugin.getDefaultToolsStore(bot, false, public, alice)))
+	assert.Equal(t, []string{"status"}, toolNames(e.plugin.getDefaultToolsStore(bot, false, &model.Channel{Type: model.ChannelTypePrivate}, alice)))
+	assert.Empty(t, toolNames(e.plugin.getDefaultToolsStore(bot, false, &model.Channel{Type: model.ChannelTypeGroup}, alice)))
+
+	// The policy is checked again when a tool is called
+	store := e.plugin.getDefaultToolsStore(bot, true, dm, alice)
+	_, err := store.ResolveTool(context.Background(), "GetJiraIssue", llm.ToolCall{}.ArgumentGetter(), &llm.Context{RequestingUser: bob})
+	require.ErrorIs(t, err, llm.ErrToolNotAllowed)
+}
+
+type noopSearch struct{}
+
+func (noopSearch) Store(context.Context, []embeddings.PostDocument) error { return nil }
+func (noopSearch) Search(context.Context, string, embeddings.SearchOptions) ([]embeddings.SearchResult, error) {
+	return nil, nil
+}
+func (noopSearch) Delete(context.Context, []string) error { return nil }
+func (noopSearch) Clear(context.Context) error            { return nil }
+
+func TestGetDefaultToolsStoreAllToolsInChannels(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+	defer e.plugin.closeMCPServers()
+
+	e.mockAPI.On("GetPluginStatus", "github").Return(&model.PluginStatus{State: model.PluginStateRunning}, nil)
+	e.plugin.setSearch(noopSearch{})
+	stub := newMCPStub(t, nil)
+	e.plugin.setConfiguration(makeConfig(Config{
+		HTTPTools: []HTTPToolConfig{
+			{Name: "tickets", Description: "Tickets", URL: "https://tickets.example.com/api"},
+			{Name: "status", Description: "Status", URL: "https://status.example.com/api", AllowInChannels: true},
+		},
+		MCPServers: []mcp.ServerConfig{
+			{Name: "dm", Transport: mcp.TransportHTTP, URL: stub.URL},
+			{Name: "channels", Transport: mcp.TransportHTTP, URL: stub.URL, ChannelTypes: []string{"public"}},
+		},
+	}))
+	bot := e.plugin.bots[0]
+	bot.cfg.ToolPolicy = llm.ToolPolicy{PublicChannels: []string{llm.AllTools}}
+
+	toolNames := func(store *llm.ToolStore) []string {
+		var names []string
+		for _, tool := range store.GetTools() {
+			names = append(names, tool.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	user := &model.User{Id: "alice"}
+	dmTools := toolNames(e.plugin.getDefaultToolsStore(bot, true, &model.Channel{Type: model.ChannelTypeDirect}, user))
+	assert.Contains(t, dmTools, "SearchServer")
+	assert.Contains(t, dmTools, "dm_create")
+	assert.Contains(t, dmTools, "tickets")
+
+	// Allowing every tool in public channels still leaves out the tools that are only available in DMs
+	assert.Equal(t, []string{"channels_create", "channels_search_items", "status"},
+		toolNames(e.plugin.getDefaultToolsStore(bot, false, &model.Channel{Type: model.ChannelTypeOpen}, user)))
+}
@@ -6,7 +6,9 @@ package main
 import (
 	"reflect"
 
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
 	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/mcp"
 )
 
 type RollCallConfig struct {
@@ -18,16 +20,20 @@ type RollCallConfig struct {
 }
 
 type Config struct {
-	Services                 []llm.ServiceConfig `json:"services"`
-	Bots                     []llm.BotConfig     `json:"bots"`
-	DefaultBotName           string              `json:"defaultBotName"`
-	TranscriptGenerator      string              `json:"transcriptBackend"`
-	EnableLLMTrace           bool                `json:"enableLLMTrace"`
-	AllowedUpstreamHostnames string              `json:"allowedUpstreamHostnames"`
-	RollCall                 RollCallConfig      `json:"rollCall"`
-	// Note: We still keep the EmbeddingSearchConfig field to avoid breaking existing
-	// configurations, but it won't be used in MySQL version
-	EmbeddingSearchConfig interface{} `json:"embeddingSearchConfig"`
+	Services                 []llm.ServiceConfig              `json:"services"`
+	Bots                     []llm.BotConfig                  `json:"bots"`
+	DefaultBotName           string                           `json:"defaultBotName"`
+	TranscriptGenerator      string                           `json:"transcriptBackend"`
+	EnableLLMTrace           bool                             `json:"enableLLMTrace"`
+	AllowedUpstreamHostnames string                           `json:"allowedUpstreamHostnames"`
+	RollCall                 RollCallConfig                   `json:"rollCall"`
+	EmbeddingSearchConfig    embeddings.EmbeddingSearchConfig `json:"embeddingSearchConfig"`
+	Quotas                   QuotaConfig                      `json:"quotas"`
+	ModelPrices              []ModelPrice                     `json:"modelPrices"`
+	MCPServers               []mcp.ServerConfig               `json:"mcpServers"`
+	HTTPTools                []HTTPToolConfig                 `json:"httpTools"`
+	// ToolSecrets are the secrets the headers of HTTP tools refer to, by name
+	ToolSecrets map[string]string `json:"toolSecrets"`
 }
 
 // configuration captures the plugin's external configuration as exposed in the Mattermost server
@@ -114,5 +120,14 @@ func (p *Plugin) OnConfigurationChange() error {
 		return err
 	}
 
+	if err := p.initSearch(); err != nil {
+		p.pluginAPI.Log.Error("Failed to initialize search, search functionality will be disabled", "error", err)
+	}
+
+	// Servers reconnect with the new configuration when their tools are next needed
+	p.closeMCPServers()
+
+	p.validateHTTPTools()
+
 	return nil
 }
@@ -66,9 +66,11 @@ func (p *Plugin) WithLLMContextRequestingUser(user *model.User) llm.ContextOptio
 	}
 }
 
+// WithLLMContextDefaultTools adds the tools the bot's policy allows in the context's channel for its requesting user,
+// it goes after the options that set them
 func (p *Plugin) WithLLMContextDefaultTools(bot *Bot, isDM bool) llm.ContextOption {
 	return func(c *llm.Context) {
-		c.Tools = p.getDefaultToolsStore(bot, isDM)
+		c.Tools = p.getDefaultToolsStore(bot, isDM, c.Channel, c.RequestingUser)
 	}
 }
 
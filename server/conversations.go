@@ -4,6 +4,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -14,20 +16,50 @@ import (
 
 const RespondingToProp = "responding_to"
 
-func (p *Plugin) processUserRequestToBot(bot *Bot, postingUser *model.User, channel *model.Channel, post *model.Post) (*llm.TextStreamResult, error) {
+func (p *Plugin) processUserRequestToBot(ctx context.Context, bot *Bot, postingUser *model.User, channel *model.Channel, post *model.Post) (*llm.TextStreamResult, error) {
+	completionRequest, err := p.conversationCompletionRequest(bot, postingUser, channel, post)
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.getLLM(bot.cfg).ChatCompletion(ctx, completionRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	// The title is kept even if the response is stopped
+	go func() {
+		request := "Write a short title for the following request. Include only the title and nothing else, no quotations. Request:\n" + post.Message
+		if err := p.generateTitle(bot, request, post.Id, completionRequest.Context, completionRequest.Feature); err != nil {
+			p.API.LogError("Failed to generate title", "error", err.Error())
+			return
+		}
+	}()
+
+	return result, nil
+}
+
+// conversationCompletionRequest is the request for the bot's response to a post of a conversation, with the
+// conversation before the post
+func (p *Plugin) conversationCompletionRequest(bot *Bot, postingUser *model.User, channel *model.Channel, post *model.Post) (llm.CompletionRequest, error) {
+	isDM := mmapi.IsDMWith(bot.mmBot.UserId, channel)
 	context := p.BuildLLMContextUserRequest(
 		bot,
 		postingUser,
 		channel,
-		p.WithLLMContextDefaultTools(bot, mmapi.IsDMWith(bot.mmBot.UserId, channel)),
+		p.WithLLMContextDefaultTools(bot, isDM),
 	)
 
+	feature := llm.FeatureMention
+	if isDM {
+		feature = llm.FeatureDM
+	}
+
 	var posts []llm.Post
 	if post.RootId == "" {
 		// A new conversation
 		prompt, err := p.prompts.Format(llm.PromptDirectMessageQuestionSystem, context)
 		if err != nil {
-			return nil, fmt.Errorf("failed to format prompt: %w", err)
+			return llm.CompletionRequest{}, fmt.Errorf("failed to format prompt: %w", err)
 		}
 		posts = []llm.Post{
 			{
@@ -39,14 +71,14 @@ func (p *Plugin) processUserRequestToBot(bot *Bot, postingUser *model.User, chan
 		// Continuing an existing conversation
 		previousConversation, errThread := p.getThreadAndMeta(post.Id)
 		if errThread != nil {
-			return nil, fmt.Errorf("failed to get previous conversation: %w", errThread)
+			return llm.CompletionRequest{}, fmt.Errorf("failed to get previous conversation: %w", errThread)
 		}
 		previousConversation.cutoffBeforePostID(post.Id)
 
 		var err error
 		posts, err = p.existingConversationToLLMPosts(bot, previousConversation, context)
 		if err != nil {
-			return nil, fmt.Errorf("failed to convert existing conversation to LLM posts: %w", err)
+			return llm.CompletionRequest{}, fmt.Errorf("failed to convert existing conversation to LLM posts: %w", err)
 		}
 	}
 
@@ -55,40 +87,44 @@ func (p *Plugin) processUserRequestToBot(bot *Bot, postingUser *model.User, chan
 		Message: post.Message,
 	})
 
-	completionRequest := llm.CompletionRequest{
-		Posts:   posts,
-		Context: context,
-	}
-	result, err := p.getLLM(bot.cfg).ChatCompletion(completionRequest)
-	if err != nil {
-		return nil, err
+	conversationID := post.RootId
+	if conversationID == "" {
+		conversationID = post.Id
 	}
 
-	go func() {
-		request := "Write a short title for the following request. Include only the title and nothing else, no quotations. Request:\n" + post.Message
-		if err := p.generateTitle(bot, request, post.Id, context); err != nil {
-			p.API.LogError("Failed to generate title", "error", err.Error())
-			return
-		}
-	}()
+	return llm.CompletionRequest{
+		Posts:          posts,
+		Context:        context,
+		Feature:        feature,
+		ConversationID: conversationID,
+	}, nil
+}
 
-	return result, nil
+// conversationTitle is the response of title generation
+type conversationTitle struct {
+	Title string `json:"title" jsonschema:"description=The title, without quotes"`
 }
 
-func (p *Plugin) generateTitle(bot *Bot, request string, postID string, context *llm.Context) error {
+func (t conversationTitle) Validate() error {
+	if strings.TrimSpace(t.Title) == "" {
+		return errors.New("the title is empty")
+	}
+	return nil
+}
+
+func (p *Plugin) generateTitle(bot *Bot, request string, postID string, context *llm.Context, feature string) error {
 	titleRequest := llm.CompletionRequest{
 		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: request}},
 		Context: context,
+		Feature: feature,
 	}
 
-	conversationTitle, err := p.getLLM(bot.cfg).ChatCompletionNoStream(titleRequest, llm.WithMaxGeneratedTokens(25))
+	title, err := llm.ChatCompletionStructured[conversationTitle](p.activeContext(), p.getLLM(bot.cfg), titleRequest, llm.WithMaxGeneratedTokens(50))
 	if err != nil {
 		return fmt.Errorf("failed to get title: %w", err)
 	}
 
-	conversationTitle = strings.Trim(conversationTitle, "\n \"'")
-
-	if err := p.saveTitle(postID, conversationTitle); err != nil {
+	if err := p.saveTitle(postID, strings.Trim(title.Title, "\n \"'")); err != nil {
 		return fmt.Errorf("failed to save title: %w", err)
 	}
 
@@ -0,0 +1,262 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+)
+
+const (
+	// KV store key of the embedding spaces state
+	EmbeddingSpacesKey = "embedding_spaces"
+
+	// embeddingSpacesChangedEvent tells the other nodes of the cluster to rebuild their search
+	embeddingSpacesChangedEvent = "embedding_spaces_changed"
+
+	// staleSpaceDeleteBatch is how many documents of stale spaces are deleted while holding the spaces lock
+	staleSpaceDeleteBatch = 1000
+)
+
+// embeddingCredentialParameters don't change the embeddings a provider creates, so rotating them doesn't need a new space
+var embeddingCredentialParameters = []string{"apiKey", "orgID"}
+
+// EmbeddingSpace is an index version. Embeddings created by different models, dimensions or chunking options
+// can't be compared, so each combination is indexed separately.
+type EmbeddingSpace struct {
+	ID                string                     `json:"id"`
+	EmbeddingProvider embeddings.UpstreamConfig  `json:"embeddingProvider"`
+	Dimensions        int                        `json:"dimensions"`
+	ChunkingOptions   embeddings.ChunkingOptions `json:"chunkingOptions"`
+}
+
+// EmbeddingSpaces tracks the space searches are served from and the space being migrated to, if any.
+// While a space is pending new posts are written to both and the reindex job backfills the pending space.
+type EmbeddingSpaces struct {
+	Active  *EmbeddingSpace `json:"active"`
+	Pending *EmbeddingSpace `json:"pending,omitempty"`
+}
+
+// ids returns the IDs of the spaces in use
+func (s EmbeddingSpaces) ids() []string {
+	var ids []string
+	if s.Active != nil {
+		ids = append(ids, s.Active.ID)
+	}
+	if s.Pending != nil {
+		ids = append(ids, s.Pending.ID)
+	}
+	return ids
+}
+
+// newEmbeddingSpace creates the space for the embedding settings of cfg. The ID is a fingerprint of the settings
+// that affect the embeddings, so it only changes when the index has to be rebuilt.
+func newEmbeddingSpace(cfg embeddings.EmbeddingSearchConfig) (EmbeddingSpace, error) {
+	parameters := map[string]any{}
+	if len(cfg.EmbeddingProvider.Parameters) > 0 {
+		if err := json.Unmarshal(cfg.EmbeddingProvider.Parameters, &parameters); err != nil {
+			return EmbeddingSpace{}, fmt.Errorf("failed to parse embedding provider parameters: %w", err)
+		}
+	}
+	for _, key := range embeddingCredentialParameters {
+		delete(parameters, key)
+	}
+
+	// Map keys are sorted when marshaled so the fingerprint is stable
+	fingerprint, err := json.Marshal(map[string]any{
+		"type":       cfg.EmbeddingProvider.Type,
+		"parameters": parameters,
+		"dimensions": cfg.Dimensions,
+		"chunking":   cfg.ChunkingOptions,
+	})
+	if err != nil {
+		return EmbeddingSpace{}, fmt.Errorf("failed to fingerprint embedding settings: %w", err)
+	}
+	sum := sha256.Sum256(fingerprint)
+
+	return EmbeddingSpace{
+		ID:                hex.EncodeToString(sum[:8]),
+		EmbeddingProvider: cfg.EmbeddingProvider,
+		Dimensions:        cfg.Dimensions,
+		ChunkingOptions:   cfg.ChunkingOptions,
+	}, nil
+}
+
+// nextEmbeddingSpaces returns the spaces after the configuration switched to current and whether they changed.
+// The first space becomes active straight away, later ones are pending until the reindex job has backfilled them.
+// Switching back to the active space abandons the migration.
+func nextEmbeddingSpaces(spaces EmbeddingSpaces, current EmbeddingSpace) (EmbeddingSpaces, bool) {
+	next := EmbeddingSpaces{Active: spaces.Active, Pending: spaces.Pending}
+	switch {
+	case spaces.Active == nil:
+		next.Active = &current
+		next.Pending = nil
+	case spaces.Active.ID == current.ID:
+		// Parameters that aren't part of the ID, like credentials, are still refreshed
+		next.Active = &current
+		next.Pending = nil
+	default:
+		next.Pending = &current
+	}
+
+	changed := !equalEmbeddingSpace(spaces.Active, next.Active) || !equalEmbeddingSpace(spaces.Pending, next.Pending)
+	return next, changed
+}
+
+func equalEmbeddingSpace(a, b *EmbeddingSpace) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return string(aJSON) == string(bJSON)
+}
+
+func (p *Plugin) getEmbeddingSpaces() (EmbeddingSpaces, error) {
+	var spaces EmbeddingSpaces
+	data, appErr := p.API.KVGet(EmbeddingSpacesKey)
+	if appErr != nil {
+		return spaces, fmt.Errorf("failed to get embedding spaces: %w", appErr)
+	}
+	if data == nil {
+		return spaces, nil
+	}
+
+	if err := json.Unmarshal(data, &spaces); err != nil {
+		return spaces, fmt.Errorf("failed to parse embedding spaces: %w", err)
+	}
+
+	return spaces, nil
+}
+
+func (p *Plugin) saveEmbeddingSpaces(spaces EmbeddingSpaces) error {
+	data, err := json.Marshal(spaces)
+	if err != nil {
+		return fmt.Errorf("failed to marshal embedding spaces: %w", err)
+	}
+	if appErr := p.API.KVSet(EmbeddingSpacesKey, data); appErr != nil {
+		return fmt.Errorf("failed to save embedding spaces: %w", appErr)
+	}
+	return nil
+}
+
+// modifyEmbeddingSpaces applies modify to the stored spaces while holding a cluster wide lock
+func (p *Plugin) modifyEmbeddingSpaces(modify func(spaces EmbeddingSpaces) (EmbeddingSpaces, bool, error)) (EmbeddingSpaces, error) {
+	mtx, err := cluster.NewMutex(p.API, "ai_embedding_spaces")
+	if err != nil {
+		return EmbeddingSpaces{}, fmt.Errorf("failed to create mutex: %w", err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	spaces, err := p.getEmbeddingSpaces()
+	if err != nil {
+		return EmbeddingSpaces{}, err
+	}
+
+	next, changed, err := modify(spaces)
+	if err != nil {
+		return EmbeddingSpaces{}, err
+	}
+	if !changed {
+		return spaces, nil
+	}
+
+	if err := p.saveEmbeddingSpaces(next); err != nil {
+		return EmbeddingSpaces{}, err
+	}
+
+	return next, nil
+}
+
+// updateEmbeddingSpaces records the embedding space of the current configuration
+func (p *Plugin) updateEmbeddingSpaces(cfg embeddings.EmbeddingSearchConfig) (EmbeddingSpaces, error) {
+	current, err := newEmbeddingSpace(cfg)
+	if err != nil {
+		return EmbeddingSpaces{}, err
+	}
+
+	return p.modifyEmbeddingSpaces(func(spaces EmbeddingSpaces) (EmbeddingSpaces, bool, error) {
+		next, changed := nextEmbeddingSpaces(spaces, current)
+		if changed && next.Pending != nil && !equalEmbeddingSpace(spaces.Pending, next.Pending) {
+			p.pluginAPI.Log.Info("Embedding settings changed, migrating search index", "from_space", next.Active.ID, "to_space", next.Pending.ID)
+		}
+		return next, changed, nil
+	})
+}
+
+// promoteEmbeddingSpace makes the pending space active once the reindex job has backfilled it. The migration
+// is abandoned if the settings changed again while the job was running.
+func (p *Plugin) promoteEmbeddingSpace(spaceID string) (bool, error) {
+	promoted := false
+	_, err := p.modifyEmbeddingSpaces(func(spaces EmbeddingSpaces) (EmbeddingSpaces, bool, error) {
+		if spaces.Pending == nil || spaces.Pending.ID != spaceID {
+			return spaces, false, nil
+		}
+		promoted = true
+		return EmbeddingSpaces{Active: spaces.Pending}, true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if !promoted {
+		return false, nil
+	}
+
+	// Searches switch to the new space in one step on every node
+	if err := p.initSearch(); err != nil {
+		return true, fmt.Errorf("failed to switch search to the new embedding space: %w", err)
+	}
+	if err := p.API.PublishPluginClusterEvent(
+		model.PluginClusterEvent{Id: embeddingSpacesChangedEvent},
+		model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable},
+	); err != nil {
+		p.pluginAPI.Log.Warn("Failed to notify the cluster of the new embedding space", "error", err)
+	}
+
+	return true, nil
+}
+
+// deleteStaleEmbeddingSpaces removes the documents of spaces that are neither active nor pending in the
+// background, so saving the configuration doesn't wait on it
+func (p *Plugin) deleteStaleEmbeddingSpaces(store embeddings.VectorStore) {
+	collector, ok := store.(embeddings.SpaceGarbageCollector)
+	if !ok {
+		return
+	}
+
+	go func() {
+		for {
+			deleted, err := p.deleteStaleEmbeddingBatch(collector)
+			if err != nil {
+				p.pluginAPI.Log.Warn("Failed to delete stale embedding spaces", "error", err)
+				return
+			}
+			if deleted < staleSpaceDeleteBatch {
+				return
+			}
+		}
+	}()
+}
+
+// deleteStaleEmbeddingBatch deletes a batch of stale documents while holding the spaces lock, so a space
+// can't become pending while its documents are being deleted. The spaces are read again for every batch.
+func (p *Plugin) deleteStaleEmbeddingBatch(collector embeddings.SpaceGarbageCollector) (int64, error) {
+	var deleted int64
+	_, err := p.modifyEmbeddingSpaces(func(spaces EmbeddingSpaces) (EmbeddingSpaces, bool, error) {
+		if spaces.Active == nil {
+			return spaces, false, nil
+		}
+		var err error
+		deleted, err = collector.DeleteSpacesExcept(p.activeContext(), spaces.ids(), staleSpaceDeleteBatch)
+		return spaces, false, err
+	})
+	return deleted, err
+}
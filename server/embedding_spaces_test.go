@@ -0,0 +1,108 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func embeddingConfig(t *testing.T, model, apiKey string) embeddings.EmbeddingSearchConfig {
+	parameters, err := json.Marshal(map[string]string{"embeddingModel": model, "apiKey": apiKey})
+	require.NoError(t, err)
+
+	return embeddings.EmbeddingSearchConfig{
+		Type:              embeddings.SearchTypeComposite,
+		VectorStore:       embeddings.UpstreamConfig{Type: VectorStoreTypeMySQL},
+		EmbeddingProvider: embeddings.UpstreamConfig{Type: EmbeddingProviderTypeOpenAI, Parameters: parameters},
+		Dimensions:        512,
+		ChunkingOptions:   embeddings.DefaultChunkingOptions(),
+	}
+}
+
+func TestNewEmbeddingSpace(t *testing.T) {
+	space, err := newEmbeddingSpace(embeddingConfig(t, "small", "key1"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, space.ID)
+
+	t.Run("credentials don't change the space", func(t *testing.T) {
+		rotated, err := newEmbeddingSpace(embeddingConfig(t, "small", "key2"))
+		require.NoError(t, err)
+		assert.Equal(t, space.ID, rotated.ID)
+	})
+
+	t.Run("model, dimensions and chunking do", func(t *testing.T) {
+		otherModel, err := newEmbeddingSpace(embeddingConfig(t, "large", "key1"))
+		require.NoError(t, err)
+		assert.NotEqual(t, space.ID, otherModel.ID)
+
+		cfg := embeddingConfig(t, "small", "key1")
+		cfg.Dimensions = 1024
+		otherDimensions, err := newEmbeddingSpace(cfg)
+		require.NoError(t, err)
+		assert.NotEqual(t, space.ID, otherDimensions.ID)
+
+		cfg = embeddingConfig(t, "small", "key1")
+		cfg.ChunkingOptions.ChunkSize = 200
+		otherChunking, err := newEmbeddingSpace(cfg)
+		require.NoError(t, err)
+		assert.NotEqual(t, space.ID, otherChunking.ID)
+	})
+}
+
+func TestNextEmbeddingSpaces(t *testing.T) {
+	spaceA, err := newEmbeddingSpace(embeddingConfig(t, "small", "key1"))
+	require.NoError(t, err)
+	spaceARotated, err := newEmbeddingSpace(embeddingConfig(t, "small", "key2"))
+	require.NoError(t, err)
+	spaceB, err := newEmbeddingSpace(embeddingConfig(t, "large", "key1"))
+	require.NoError(t, err)
+	spaceC, err := newEmbeddingSpace(embeddingConfig(t, "huge", "key1"))
+	require.NoError(t, err)
+
+	t.Run("first space is active immediately", func(t *testing.T) {
+		next, changed := nextEmbeddingSpaces(EmbeddingSpaces{}, spaceA)
+		assert.True(t, changed)
+		assert.Equal(t, spaceA.ID, next.Active.ID)
+		assert.Nil(t, next.Pending)
+	})
+
+	t.Run("unchanged settings", func(t *testing.T) {
+		_, changed := nextEmbeddingSpaces(EmbeddingSpaces{Active: &spaceA}, spaceA)
+		assert.False(t, changed)
+	})
+
+	t.Run("rotated credentials refresh the active space", func(t *testing.T) {
+		next, changed := nextEmbeddingSpaces(EmbeddingSpaces{Active: &spaceA}, spaceARotated)
+		assert.True(t, changed)
+		assert.Equal(t, spaceARotated, *next.Active)
+		assert.Nil(t, next.Pending)
+	})
+
+	t.Run("new settings are pending", func(t *testing.T) {
+		next, changed := nextEmbeddingSpaces(EmbeddingSpaces{Active: &spaceA}, spaceB)
+		assert.True(t, changed)
+		assert.Equal(t, spaceA.ID, next.Active.ID)
+		assert.Equal(t, spaceB.ID, next.Pending.ID)
+		assert.ElementsMatch(t, []string{spaceA.ID, spaceB.ID}, next.ids())
+	})
+
+	t.Run("settings changed again during a migration", func(t *testing.T) {
+		next, changed := nextEmbeddingSpaces(EmbeddingSpaces{Active: &spaceA, Pending: &spaceB}, spaceC)
+		assert.True(t, changed)
+		assert.Equal(t, spaceA.ID, next.Active.ID)
+		assert.Equal(t, spaceC.ID, next.Pending.ID)
+	})
+
+	t.Run("switching back abandons the migration", func(t *testing.T) {
+		next, changed := nextEmbeddingSpaces(EmbeddingSpaces{Active: &spaceA, Pending: &spaceB}, spaceA)
+		assert.True(t, changed)
+		assert.Equal(t, spaceA.ID, next.Active.ID)
+		assert.Nil(t, next.Pending)
+	})
+}
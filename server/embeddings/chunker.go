@@ -0,0 +1,191 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ChunkingStrategySentences  = "sentences"
+	ChunkingStrategyParagraphs = "paragraphs"
+	ChunkingStrategyFixed      = "fixed"
+)
+
+// ChunkPostDocument splits a document into chunks according to the chunking options.
+// Documents that fit in a single chunk are returned unchanged.
+// Sizes are measured in characters (runes), so chunks never split a multi-byte character.
+func ChunkPostDocument(doc PostDocument, opts ChunkingOptions) []PostDocument {
+	if opts.ChunkSize <= 0 || utf8.RuneCountInString(doc.Content) <= opts.ChunkSize {
+		return []PostDocument{doc}
+	}
+
+	var contents []string
+	switch opts.ChunkingStrategy {
+	case ChunkingStrategyParagraphs:
+		contents = chunkParagraphs(doc.Content, opts)
+	case ChunkingStrategyFixed:
+		contents = chunkFixed(doc.Content, opts.ChunkSize, opts.ChunkOverlap)
+	default:
+		contents = chunkSentences(doc.Content, opts)
+	}
+
+	chunks := make([]PostDocument, 0, len(contents))
+	for i, content := range contents {
+		chunk := doc
+		chunk.Content = content
+		chunk.IsChunk = true
+		chunk.ChunkIndex = i
+		chunk.TotalChunks = len(contents)
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// chunkFixed splits text into chunks of exactly size characters (except the last) with the given overlap.
+func chunkFixed(text string, size int, overlap int) []string {
+	runes := []rune(text)
+	step := size - overlap
+	if step <= 0 {
+		step = size
+	}
+
+	var chunks []string
+	for start := 0; start < len(runes); start += step {
+		end := min(start+size, len(runes))
+		chunks = append(chunks, string(runes[start:end]))
+		if end == len(runes) {
+			break
+		}
+	}
+
+	return chunks
+}
+
+func chunkSentences(text string, opts ChunkingOptions) []string {
+	return packUnits(splitSentences(text), " ", opts, func(unit string) []string {
+		return chunkFixed(unit, opts.ChunkSize, 0)
+	})
+}
+
+func chunkParagraphs(text string, opts ChunkingOptions) []string {
+	return packUnits(splitParagraphs(text), "\n\n", opts, func(unit string) []string {
+		return chunkSentences(unit, opts)
+	})
+}
+
+// packUnits greedily packs units of text into chunks no longer than the chunk size.
+// Units that are too large on their own are split further with the fallback.
+// If the current chunk is smaller than the minimum chunk size when the next unit doesn't fit,
+// the unit is split on a word boundary to fill the chunk instead of leaving it undersized.
+func packUnits(units []string, separator string, opts ChunkingOptions, fallback func(string) []string) []string {
+	size := opts.ChunkSize
+	minSize := int(float64(size) * opts.MinChunkSize)
+	separatorLen := utf8.RuneCountInString(separator)
+
+	var chunks []string
+	var current strings.Builder
+	currentLen := 0
+
+	flush := func() {
+		if currentLen > 0 {
+			chunks = append(chunks, strings.TrimSpace(current.String()))
+			current.Reset()
+			currentLen = 0
+		}
+	}
+	add := func(unit string, unitLen int) {
+		if currentLen > 0 {
+			current.WriteString(separator)
+			currentLen += separatorLen
+		}
+		current.WriteString(unit)
+		currentLen += unitLen
+	}
+
+	for _, unit := range units {
+		unitLen := utf8.RuneCountInString(unit)
+		if unitLen > size {
+			flush()
+			chunks = append(chunks, fallback(unit)...)
+			continue
+		}
+
+		if currentLen > 0 && currentLen+separatorLen+unitLen > size {
+			if currentLen < minSize {
+				head, tail := splitOnWord(unit, size-currentLen-separatorLen)
+				if head != "" {
+					add(head, utf8.RuneCountInString(head))
+					unit = tail
+					unitLen = utf8.RuneCountInString(tail)
+				}
+			}
+			flush()
+		}
+
+		if unitLen > 0 {
+			add(unit, unitLen)
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// splitOnWord splits text so the head is at most maxLen characters, preferring the last word boundary.
+func splitOnWord(text string, maxLen int) (string, string) {
+	runes := []rune(text)
+	if maxLen <= 0 {
+		return "", text
+	}
+	if len(runes) <= maxLen {
+		return text, ""
+	}
+
+	cut := maxLen
+	for i := maxLen; i > 0; i-- {
+		if unicode.IsSpace(runes[i]) {
+			cut = i
+			break
+		}
+	}
+
+	return strings.TrimSpace(string(runes[:cut])), strings.TrimSpace(string(runes[cut:]))
+}
+
+// splitSentences splits text after '.', '!', '?' or a newline that is followed by whitespace.
+func splitSentences(text string) []string {
+	runes := []rune(text)
+	var sentences []string
+	start := 0
+	for i, r := range runes {
+		isEnd := r == '\n' || ((r == '.' || r == '!' || r == '?') && (i+1 == len(runes) || unicode.IsSpace(runes[i+1])))
+		if !isEnd {
+			continue
+		}
+		if sentence := strings.TrimSpace(string(runes[start : i+1])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = i + 1
+	}
+	if sentence := strings.TrimSpace(string(runes[start:])); sentence != "" {
+		sentences = append(sentences, sentence)
+	}
+
+	return sentences
+}
+
+func splitParagraphs(text string) []string {
+	var paragraphs []string
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			paragraphs = append(paragraphs, paragraph)
+		}
+	}
+
+	return paragraphs
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const SearchTypeComposite = "composite"
+
+// hybridCandidateMultiplier controls how many candidates each source contributes before fusion.
+// Fusion works best when the sources return more than the final limit.
+const hybridCandidateMultiplier = 3
+
+// storeBatchSize bounds the chunks embedded in a single provider request and, unless they are the chunks of a
+// single document, stored at once
+const storeBatchSize = 64
+
+// CompositeSearch implements EmbeddingSearch by combining a vector store, an embedding provider
+// and an optional keyword searcher.
+type CompositeSearch struct {
+	store           VectorStore
+	provider        EmbeddingProvider
+	keyword         KeywordSearcher
+	chunkingOptions ChunkingOptions
+	hybridOptions   HybridSearchOptions
+	reranker        Reranker
+	rerankDepth     int
+}
+
+// CompositeSearchOption configures optional stages of a CompositeSearch
+type CompositeSearchOption func(*CompositeSearch)
+
+// WithReranker reranks the top depth candidates before results are limited
+func WithReranker(reranker Reranker, depth int) CompositeSearchOption {
+	return func(c *CompositeSearch) {
+		if depth <= 0 {
+			depth = DefaultRerankDepth
+		}
+		c.reranker = reranker
+		c.rerankDepth = depth
+	}
+}
+
+// NewCompositeSearch creates a new CompositeSearch. keyword may be nil, in which case only vector search is available.
+func NewCompositeSearch(store VectorStore, provider EmbeddingProvider, keyword KeywordSearcher, chunkingOptions ChunkingOptions, hybridOptions HybridSearchOptions, opts ...CompositeSearchOption) *CompositeSearch {
+	// Configurations saved before hybrid search existed have no weights
+	if hybridOptions.VectorWeight <= 0 && hybridOptions.KeywordWeight <= 0 {
+		defaults := DefaultHybridSearchOptions()
+		hybridOptions.VectorWeight = defaults.VectorWeight
+		hybridOptions.KeywordWeight = defaults.KeywordWeight
+	}
+
+	c := &CompositeSearch{
+		store:           store,
+		provider:        provider,
+		keyword:         keyword,
+		chunkingOptions: chunkingOptions,
+		hybridOptions:   hybridOptions,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Store indexes the documents in batches of at most storeBatchSize chunks, so a long document doesn't exceed
+// the number of inputs or tokens the embedding provider accepts in a request. The chunks of a document are
+// always stored together since storing a post replaces all of its previous chunks.
+func (c *CompositeSearch) Store(ctx context.Context, docs []PostDocument) error {
+	var batch []PostDocument
+	for _, doc := range docs {
+		chunks := ChunkPostDocument(doc, c.chunkingOptions)
+		if len(batch) > 0 && len(batch)+len(chunks) > storeBatchSize {
+			if err := c.storeChunks(ctx, batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+		batch = append(batch, chunks...)
+	}
+
+	return c.storeChunks(ctx, batch)
+}
+
+// storeChunks embeds the chunks, storeBatchSize at a time, and stores them
+func (c *CompositeSearch) storeChunks(ctx context.Context, chunks []PostDocument) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	embeddings := make([][]float32, 0, len(chunks))
+	for start := 0; start < len(chunks); start += storeBatchSize {
+		batch := chunks[start:min(start+storeBatchSize, len(chunks))]
+		texts := make([]string, len(batch))
+		for i, chunk := range batch {
+			texts[i] = chunk.Content
+		}
+
+		batchEmbeddings, err := c.provider.BatchCreateEmbeddings(ctx, texts)
+		if err != nil {
+			return fmt.Errorf("failed to create embeddings: %w", err)
+		}
+		if len(batchEmbeddings) != len(batch) {
+			return fmt.Errorf("embedding provider returned %d embeddings for %d documents", len(batchEmbeddings), len(batch))
+		}
+		embeddings = append(embeddings, batchEmbeddings...)
+	}
+
+	if err := c.store.Store(ctx, chunks, embeddings); err != nil {
+		return fmt.Errorf("failed to store embeddings: %w", err)
+	}
+
+	return nil
+}
+
+func (c *CompositeSearch) Search(ctx context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	if c.reranker == nil {
+		return c.retrieve(ctx, query, opts)
+	}
+
+	candidateOpts := opts
+	candidateOpts.Limit = max(c.rerankDepth, opts.Limit)
+	candidates, err := c.retrieve(ctx, query, candidateOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := c.reranker.Rerank(ctx, query, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rerank results: %w", err)
+	}
+
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+
+	return results, nil
+}
+
+// retrieve gets candidates from the sources selected by the search mode
+func (c *CompositeSearch) retrieve(ctx context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	mode := opts.Mode
+	if mode == "" {
+		mode = c.hybridOptions.DefaultMode
+	}
+
+	switch mode {
+	case "", SearchModeVector:
+		return c.vectorSearch(ctx, query, opts)
+	case SearchModeKeyword:
+		if c.keyword == nil {
+			return nil, errors.New("keyword search is not supported by the configured vector store")
+		}
+		return c.keyword.KeywordSearch(ctx, query, opts)
+	case SearchModeHybrid:
+		if c.keyword == nil {
+			return c.vectorSearch(ctx, query, opts)
+		}
+		return c.hybridSearch(ctx, query, opts)
+	}
+
+	return nil, fmt.Errorf("unknown search mode: %s", mode)
+}
+
+func (c *CompositeSearch) vectorSearch(ctx context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	embedding, err := c.provider.CreateEmbedding(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedding for query: %w", err)
+	}
+
+	return c.store.Search(ctx, embedding, opts)
+}
+
+func (c *CompositeSearch) hybridSearch(ctx context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	candidateOpts := opts
+	if opts.Limit > 0 {
+		candidateOpts.Limit = opts.Limit * hybridCandidateMultiplier
+	}
+
+	vectorResults, err := c.vectorSearch(ctx, query, candidateOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keyword relevance isn't on the same scale as similarity so the minimum score doesn't apply
+	keywordOpts := candidateOpts
+	keywordOpts.MinScore = 0
+	keywordResults, err := c.keyword.KeywordSearch(ctx, query, keywordOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform keyword search: %w", err)
+	}
+
+	results := FuseReciprocalRank([]RankedResults{
+		{Results: vectorResults, Weight: c.hybridOptions.VectorWeight},
+		{Results: keywordResults, Weight: c.hybridOptions.KeywordWeight},
+	}, c.hybridOptions.RankConstant)
+
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+
+	return results, nil
+}
+
+// SearchSimilar searches with the average of the documents' embeddings. Stored embeddings are reused when
+// the store supports it and the remaining documents are embedded on the fly.
+func (c *CompositeSearch) SearchSimilar(ctx context.Context, docs []PostDocument, opts SearchOptions) ([]SearchResult, error) {
+	var vectors [][]float32
+	missing := docs
+	if getter, ok := c.store.(EmbeddingGetter); ok {
+		postIDs := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			postIDs = append(postIDs, doc.PostID)
+		}
+
+		stored, err := getter.GetEmbeddings(ctx, postIDs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get stored embeddings: %w", err)
+		}
+
+		missing = nil
+		for _, doc := range docs {
+			if postVectors, ok := stored[doc.PostID]; ok {
+				vectors = append(vectors, postVectors...)
+			} else {
+				missing = append(missing, doc)
+			}
+		}
+	}
+
+	var texts []string
+	for _, doc := range missing {
+		for _, chunk := range ChunkPostDocument(doc, c.chunkingOptions) {
+			if chunk.Content != "" {
+				texts = append(texts, chunk.Content)
+			}
+		}
+	}
+	if len(texts) > 0 {
+		embedded, err := c.provider.BatchCreateEmbeddings(ctx, texts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create embeddings: %w", err)
+		}
+		vectors = append(vectors, embedded...)
+	}
+
+	centroid := meanVector(vectors)
+	if centroid == nil {
+		return []SearchResult{}, nil
+	}
+
+	return c.store.Search(ctx, centroid, opts)
+}
+
+// meanVector returns the element-wise mean of vectors with the same dimensions as the first, or nil if there are none
+func meanVector(vectors [][]float32) []float32 {
+	if len(vectors) == 0 || len(vectors[0]) == 0 {
+		return nil
+	}
+
+	mean := make([]float32, len(vectors[0]))
+	count := 0
+	for _, vector := range vectors {
+		if len(vector) != len(mean) {
+			continue
+		}
+		for i, value := range vector {
+			mean[i] += value
+		}
+		count++
+	}
+	for i := range mean {
+		mean[i] /= float32(count)
+	}
+
+	return mean
+}
+
+func (c *CompositeSearch) Delete(ctx context.Context, postIDs []string) error {
+	return c.store.Delete(ctx, postIDs)
+}
+
+func (c *CompositeSearch) Clear(ctx context.Context) error {
+	return c.store.Clear(ctx)
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStore struct {
+	results    []SearchResult
+	lastOpts   SearchOptions
+	storedDocs []PostDocument
+}
+
+func (s *fakeStore) Store(_ context.Context, docs []PostDocument, _ [][]float32) error {
+	s.storedDocs = append(s.storedDocs, docs...)
+	return nil
+}
+
+func (s *fakeStore) Search(_ context.Context, _ []float32, opts SearchOptions) ([]SearchResult, error) {
+	s.lastOpts = opts
+	return s.results, nil
+}
+
+func (s *fakeStore) Delete(_ context.Context, _ []string) error { return nil }
+func (s *fakeStore) Clear(_ context.Context) error              { return nil }
+
+type fakeKeyword struct {
+	results  []SearchResult
+	lastOpts SearchOptions
+}
+
+func (k *fakeKeyword) KeywordSearch(_ context.Context, _ string, opts SearchOptions) ([]SearchResult, error) {
+	k.lastOpts = opts
+	return k.results, nil
+}
+
+type fakeProvider struct{}
+
+func (fakeProvider) CreateEmbedding(_ context.Context, _ string) ([]float32, error) {
+	return []float32{1, 0}, nil
+}
+
+func (fakeProvider) BatchCreateEmbeddings(_ context.Context, texts []string) ([][]float32, error) {
+	result := make([][]float32, len(texts))
+	for i := range texts {
+		result[i] = []float32{1, 0}
+	}
+	return result, nil
+}
+
+func (fakeProvider) Dimensions() int { return 2 }
+
+func TestCompositeSearch(t *testing.T) {
+	t.Run("vector mode by default", func(t *testing.T) {
+		store := &fakeStore{results: resultsFor("a")}
+		keyword := &fakeKeyword{results: resultsFor("b")}
+		search := NewCompositeSearch(store, fakeProvider{}, keyword, DefaultChunkingOptions(), HybridSearchOptions{})
+
+		results, err := search.Search(context.Background(), "query", SearchOptions{Limit: 5})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a"}, postIDs(results))
+	})
+
+	t.Run("keyword mode", func(t *testing.T) {
+		store := &fakeStore{results: resultsFor("a")}
+		keyword := &fakeKeyword{results: resultsFor("b")}
+		search := NewCompositeSearch(store, fakeProvider{}, keyword, DefaultChunkingOptions(), HybridSearchOptions{})
+
+		results, err := search.Search(context.Background(), "query", SearchOptions{Limit: 5, Mode: SearchModeKeyword})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b"}, postIDs(results))
+	})
+
+	t.Run("keyword mode without keyword searcher", func(t *testing.T) {
+		search := NewCompositeSearch(&fakeStore{}, fakeProvider{}, nil, DefaultChunkingOptions(), HybridSearchOptions{})
+
+		_, err := search.Search(context.Background(), "query", SearchOptions{Mode: SearchModeKeyword})
+		assert.Error(t, err)
+	})
+
+	t.Run("hybrid mode fuses and limits results", func(t *testing.T) {
+		store := &fakeStore{results: resultsFor("a", "b", "c")}
+		keyword := &fakeKeyword{results: resultsFor("c", "d")}
+		search := NewCompositeSearch(store, fakeProvider{}, keyword, DefaultChunkingOptions(), HybridSearchOptions{})
+
+		results, err := search.Search(context.Background(), "query", SearchOptions{Limit: 2, MinScore: 0.5, Mode: SearchModeHybrid})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"c", "a"}, postIDs(results))
+
+		// Both sources are asked for extra candidates, and the minimum score only applies to similarity
+		assert.Equal(t, 2*hybridCandidateMultiplier, store.lastOpts.Limit)
+		assert.Equal(t, float32(0.5), store.lastOpts.MinScore)
+		assert.Equal(t, 2*hybridCandidateMultiplier, keyword.lastOpts.Limit)
+		assert.Zero(t, keyword.lastOpts.MinScore)
+	})
+
+	t.Run("configured default mode", func(t *testing.T) {
+		store := &fakeStore{results: resultsFor("a")}
+		keyword := &fakeKeyword{results: resultsFor("b")}
+		search := NewCompositeSearch(store, fakeProvider{}, keyword, DefaultChunkingOptions(), HybridSearchOptions{DefaultMode: SearchModeHybrid})
+
+		results, err := search.Search(context.Background(), "query", SearchOptions{Limit: 5})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "b"}, postIDs(results))
+	})
+
+	t.Run("store chunks documents", func(t *testing.T) {
+		store := &fakeStore{}
+		opts := ChunkingOptions{ChunkSize: 10, ChunkingStrategy: ChunkingStrategyFixed}
+		search := NewCompositeSearch(store, fakeProvider{}, nil, opts, HybridSearchOptions{})
+
+		err := search.Store(context.Background(), []PostDocument{{PostID: "a", Content: "0123456789abcdefghij"}})
+		require.NoError(t, err)
+		require.Len(t, store.storedDocs, 2)
+		assert.True(t, store.storedDocs[0].IsChunk)
+	})
+}
+
+type reverseReranker struct {
+	candidates int
+}
+
+func (r *reverseReranker) Rerank(_ context.Context, _ string, results []SearchResult) ([]SearchResult, error) {
+	r.candidates = len(results)
+	reversed := make([]SearchResult, len(results))
+	for i, result := range results {
+		reversed[len(results)-1-i] = result
+	}
+	return reversed, nil
+}
+
+// batchRecorder records the size of each embedding request and the posts of each store call
+type batchRecorder struct {
+	fakeProvider
+	fakeStore
+	requests []int
+	stores   [][]string
+}
+
+func (r *batchRecorder) BatchCreateEmbeddings(ctx context.Context, texts []string) ([][]float32, error) {
+	r.requests = append(r.requests, len(texts))
+	return r.fakeProvider.BatchCreateEmbeddings(ctx, texts)
+}
+
+func (r *batchRecorder) Store(_ context.Context, docs []PostDocument, _ [][]float32) error {
+	var postIDs []string
+	for _, doc := range docs {
+		if len(postIDs) == 0 || postIDs[len(postIDs)-1] != doc.PostID {
+			postIDs = append(postIDs, doc.PostID)
+		}
+	}
+	r.stores = append(r.stores, postIDs)
+	return nil
+}
+
+func TestCompositeSearchStoreBatches(t *testing.T) {
+	recorder := &batchRecorder{}
+	search := NewCompositeSearch(recorder, recorder, nil, ChunkingOptions{ChunkSize: 10, ChunkingStrategy: ChunkingStrategyFixed}, HybridSearchOptions{})
+
+	// A long document with 150 chunks between short ones
+	docs := []PostDocument{{PostID: "first", Content: "short"}, {PostID: "long", Content: strings.Repeat("a", 1500)}}
+	for i := range 70 {
+		docs = append(docs, PostDocument{PostID: fmt.Sprintf("post%d", i), Content: "short"})
+	}
+	require.NoError(t, search.Store(context.Background(), docs))
+
+	for _, size := range recorder.requests {
+		assert.LessOrEqual(t, size, storeBatchSize)
+	}
+	// The long document's chunks are stored together, apart from the other documents
+	require.Len(t, recorder.stores, 4)
+	assert.Equal(t, []string{"first"}, recorder.stores[0])
+	assert.Equal(t, []string{"long"}, recorder.stores[1])
+	assert.Len(t, recorder.stores[2], storeBatchSize)
+	assert.Len(t, recorder.stores[3], 70-storeBatchSize)
+}
+
+func TestCompositeSearchRerank(t *testing.T) {
+	store := &fakeStore{results: resultsFor("a", "b", "c", "d")}
+	reranker := &reverseReranker{}
+	search := NewCompositeSearch(store, fakeProvider{}, nil, DefaultChunkingOptions(), HybridSearchOptions{}, WithReranker(reranker, 20))
+
+	results, err := search.Search(context.Background(), "query", SearchOptions{Limit: 2})
+	require.NoError(t, err)
+
+	// The rerank depth is fetched, reranked, then limited
+	assert.Equal(t, 20, store.lastOpts.Limit)
+	assert.Equal(t, 4, reranker.candidates)
+	assert.Equal(t, []string{"d", "c"}, postIDs(results))
+}
+
+type fakeEmbeddingStore struct {
+	fakeStore
+	stored         map[string][][]float32
+	searchedVector []float32
+}
+
+func (s *fakeEmbeddingStore) GetEmbeddings(_ context.Context, postIDs []string) (map[string][][]float32, error) {
+	result := make(map[string][][]float32)
+	for _, postID := range postIDs {
+		if vectors, ok := s.stored[postID]; ok {
+			result[postID] = vectors
+		}
+	}
+	return result, nil
+}
+
+func (s *fakeEmbeddingStore) Search(ctx context.Context, embedding []float32, opts SearchOptions) ([]SearchResult, error) {
+	s.searchedVector = embedding
+	return s.fakeStore.Search(ctx, embedding, opts)
+}
+
+func TestCompositeSearchSimilar(t *testing.T) {
+	t.Run("averages stored and new embeddings", func(t *testing.T) {
+		store := &fakeEmbeddingStore{
+			fakeStore: fakeStore{results: resultsFor("other")},
+			stored:    map[string][][]float32{"root": {{0, 1}, {0, 3}}},
+		}
+		search := NewCompositeSearch(store, fakeProvider{}, nil, DefaultChunkingOptions(), HybridSearchOptions{})
+
+		results, err := search.SearchSimilar(context.Background(), []PostDocument{
+			{PostID: "root", Content: "stored"},
+			{PostID: "reply", Content: "not stored"},
+		}, SearchOptions{ExcludePostIDs: []string{"root", "reply"}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"other"}, postIDs(results))
+
+		// Two stored chunks and one embedded by the fake provider as [1, 0]
+		assert.InDeltaSlice(t, []float32{1.0 / 3, 4.0 / 3}, store.searchedVector, 0.0001)
+		assert.Equal(t, []string{"root", "reply"}, store.lastOpts.ExcludePostIDs)
+	})
+
+	t.Run("no content", func(t *testing.T) {
+		store := &fakeStore{results: resultsFor("other")}
+		search := NewCompositeSearch(store, fakeProvider{}, nil, DefaultChunkingOptions(), HybridSearchOptions{})
+
+		results, err := search.SearchSimilar(context.Background(), []PostDocument{{PostID: "empty"}}, SearchOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, results)
+	})
+}
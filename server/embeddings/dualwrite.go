@@ -0,0 +1,55 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"context"
+	"errors"
+)
+
+// DualWriteSearch serves searches from the active index while writes go to both the active and the pending index.
+// It is used while history is re-embedded into a new embedding space so that posts created during the
+// migration are not missing once search switches over.
+type DualWriteSearch struct {
+	active  EmbeddingSearch
+	pending EmbeddingSearch
+}
+
+// NewDualWriteSearch creates a new DualWriteSearch
+func NewDualWriteSearch(active, pending EmbeddingSearch) *DualWriteSearch {
+	return &DualWriteSearch{
+		active:  active,
+		pending: pending,
+	}
+}
+
+// Pending returns the index being migrated to
+func (d *DualWriteSearch) Pending() EmbeddingSearch {
+	return d.pending
+}
+
+func (d *DualWriteSearch) Store(ctx context.Context, docs []PostDocument) error {
+	return errors.Join(d.active.Store(ctx, docs), d.pending.Store(ctx, docs))
+}
+
+func (d *DualWriteSearch) Search(ctx context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	return d.active.Search(ctx, query, opts)
+}
+
+func (d *DualWriteSearch) SearchSimilar(ctx context.Context, docs []PostDocument, opts SearchOptions) ([]SearchResult, error) {
+	similar, ok := d.active.(SimilarSearcher)
+	if !ok {
+		return nil, errors.New("similarity search is not supported by the active index")
+	}
+
+	return similar.SearchSimilar(ctx, docs, opts)
+}
+
+func (d *DualWriteSearch) Delete(ctx context.Context, postIDs []string) error {
+	return errors.Join(d.active.Delete(ctx, postIDs), d.pending.Delete(ctx, postIDs))
+}
+
+func (d *DualWriteSearch) Clear(ctx context.Context) error {
+	return errors.Join(d.active.Clear(ctx), d.pending.Clear(ctx))
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSearch struct {
+	results  []SearchResult
+	stored   []PostDocument
+	deleted  []string
+	storeErr error
+	searched bool
+	cleared  bool
+}
+
+func (s *fakeSearch) Store(_ context.Context, docs []PostDocument) error {
+	s.stored = append(s.stored, docs...)
+	return s.storeErr
+}
+
+func (s *fakeSearch) Search(_ context.Context, _ string, _ SearchOptions) ([]SearchResult, error) {
+	s.searched = true
+	return s.results, nil
+}
+
+func (s *fakeSearch) Delete(_ context.Context, postIDs []string) error {
+	s.deleted = append(s.deleted, postIDs...)
+	return nil
+}
+
+func (s *fakeSearch) Clear(_ context.Context) error {
+	s.cleared = true
+	return nil
+}
+
+func TestDualWriteSearch(t *testing.T) {
+	t.Run("writes go to both indexes", func(t *testing.T) {
+		active, pending := &fakeSearch{}, &fakeSearch{}
+		search := NewDualWriteSearch(active, pending)
+
+		docs := []PostDocument{{PostID: "a", Content: "hello"}}
+		require.NoError(t, search.Store(context.Background(), docs))
+		require.NoError(t, search.Delete(context.Background(), []string{"b"}))
+
+		assert.Equal(t, docs, active.stored)
+		assert.Equal(t, docs, pending.stored)
+		assert.Equal(t, []string{"b"}, active.deleted)
+		assert.Equal(t, []string{"b"}, pending.deleted)
+	})
+
+	t.Run("searches only use the active index", func(t *testing.T) {
+		active := &fakeSearch{results: resultsFor("a")}
+		pending := &fakeSearch{results: resultsFor("b")}
+		search := NewDualWriteSearch(active, pending)
+
+		results, err := search.Search(context.Background(), "query", SearchOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a"}, postIDs(results))
+		assert.False(t, pending.searched)
+	})
+
+	t.Run("a failing pending index doesn't stop the active write", func(t *testing.T) {
+		active := &fakeSearch{}
+		pending := &fakeSearch{storeErr: errors.New("unavailable")}
+		search := NewDualWriteSearch(active, pending)
+
+		err := search.Store(context.Background(), []PostDocument{{PostID: "a"}})
+		assert.Error(t, err)
+		assert.Len(t, active.stored, 1)
+	})
+
+	t.Run("similarity search needs an active index that supports it", func(t *testing.T) {
+		search := NewDualWriteSearch(&fakeSearch{}, &fakeSearch{})
+		_, err := search.SearchSimilar(context.Background(), nil, SearchOptions{})
+		assert.Error(t, err)
+
+		store := &fakeStore{results: resultsFor("a")}
+		active := NewCompositeSearch(store, fakeProvider{}, nil, DefaultChunkingOptions(), HybridSearchOptions{})
+		search = NewDualWriteSearch(active, &fakeSearch{})
+		results, err := search.SearchSimilar(context.Background(), []PostDocument{{PostID: "x", Content: "text"}}, SearchOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a"}, postIDs(results))
+	})
+}
@@ -27,15 +27,28 @@ type SearchResult struct {
 	Score    float32
 }
 
+// SearchMode selects which retrieval sources a search uses
+type SearchMode string
+
+const (
+	SearchModeVector  SearchMode = "vector"  // Embedding similarity only
+	SearchModeKeyword SearchMode = "keyword" // Full-text keyword matching only
+	SearchModeHybrid  SearchMode = "hybrid"  // Both, merged with reciprocal rank fusion
+)
+
 // SearchOptions contains parameters for search operations
 type SearchOptions struct {
-	Limit         int
-	MinScore      float32
-	TeamID        string
-	ChannelID     string
-	UserID        string // User ID for permission checks
-	CreatedAfter  int64
-	CreatedBefore int64
+	Limit          int
+	MinScore       float32
+	TeamID         string
+	ChannelID      string
+	UserID         string // Results are limited to channels this user can read
+	CreatedAfter   int64
+	CreatedBefore  int64
+	Mode           SearchMode // Empty uses the configured default mode
+	ExcludePostIDs []string   // Posts to leave out of the results, such as the thread being compared
+
+	ExcludeChannelIDs []string // Channels to leave out of the results
 }
 
 // ChunkingOptions defines options for chunking documents
@@ -86,6 +99,32 @@ type VectorStore interface {
 	Clear(ctx context.Context) error
 }
 
+// KeywordSearcher defines the interface for full-text keyword search over indexed documents
+type KeywordSearcher interface {
+	// KeywordSearch performs a full-text search using the query text.
+	// Scores are only meaningful for ordering within a single result list.
+	KeywordSearch(ctx context.Context, query string, opts SearchOptions) ([]SearchResult, error)
+}
+
+// EmbeddingGetter is implemented by vector stores that can return the embeddings they hold
+type EmbeddingGetter interface {
+	// GetEmbeddings returns the stored embeddings of each post, one per chunk. Posts that aren't stored are left out.
+	GetEmbeddings(ctx context.Context, postIDs []string) (map[string][][]float32, error)
+}
+
+// SimilarSearcher is implemented by searches that can find documents similar to other documents
+type SimilarSearcher interface {
+	// SearchSimilar finds documents similar to the given documents taken together
+	SearchSimilar(ctx context.Context, docs []PostDocument, opts SearchOptions) ([]SearchResult, error)
+}
+
+// SpaceGarbageCollector is implemented by vector stores that keep several embedding spaces side by side
+type SpaceGarbageCollector interface {
+	// DeleteSpacesExcept removes up to limit documents of the embedding spaces not listed in keep and returns
+	// how many it removed
+	DeleteSpacesExcept(ctx context.Context, keep []string, limit int) (int64, error)
+}
+
 // EmbeddingProvider defines the interface for embedding generation
 type EmbeddingProvider interface {
 	// CreateEmbedding generates embedding for the given text
@@ -104,12 +143,32 @@ type UpstreamConfig struct {
 	Parameters json.RawMessage `json:"parameters"`
 }
 
+// HybridSearchOptions defines how keyword and vector results are merged
+type HybridSearchOptions struct {
+	DefaultMode   SearchMode `json:"defaultMode"`   // Mode used when a request doesn't choose one
+	VectorWeight  float32    `json:"vectorWeight"`  // Weight of the vector result ranks
+	KeywordWeight float32    `json:"keywordWeight"` // Weight of the keyword result ranks
+	RankConstant  int        `json:"rankConstant"`  // The k constant of reciprocal rank fusion
+}
+
+// DefaultHybridSearchOptions returns the default hybrid search options
+func DefaultHybridSearchOptions() HybridSearchOptions {
+	return HybridSearchOptions{
+		DefaultMode:   SearchModeVector,
+		VectorWeight:  1.0,
+		KeywordWeight: 1.0,
+		RankConstant:  DefaultRankConstant,
+	}
+}
+
 // ServiceConfig holds configuration for the embedding search service
 type EmbeddingSearchConfig struct {
-	Type              string          `json:"type"`
-	VectorStore       UpstreamConfig  `json:"vectorStore"`
-	EmbeddingProvider UpstreamConfig  `json:"embeddingProvider"`
-	Parameters        json.RawMessage `json:"parameters"`
-	Dimensions        int             `json:"dimensions"`
-	ChunkingOptions   ChunkingOptions `json:"chunkingOptions"`
+	Type              string              `json:"type"`
+	VectorStore       UpstreamConfig      `json:"vectorStore"`
+	EmbeddingProvider UpstreamConfig      `json:"embeddingProvider"`
+	Parameters        json.RawMessage     `json:"parameters"`
+	Dimensions        int                 `json:"dimensions"`
+	ChunkingOptions   ChunkingOptions     `json:"chunkingOptions"`
+	HybridSearch      HybridSearchOptions `json:"hybridSearch"`
+	Rerank            RerankOptions       `json:"rerank"`
 }
@@ -0,0 +1,78 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultRankConstant is the k constant suggested by the original reciprocal rank fusion paper.
+// Larger values flatten the difference between high and low ranks.
+const DefaultRankConstant = 60
+
+// RankedResults is an ordered result list from a single retrieval source
+type RankedResults struct {
+	Results []SearchResult
+	Weight  float32
+}
+
+// FuseReciprocalRank merges ranked result lists using weighted reciprocal rank fusion.
+// Each document scores the sum of weight/(k+rank) over the lists it appears in, where rank starts at 1.
+// Scores are normalized so that a document ranked first by every source scores 1.
+// Only ranks are used, so the sources' own scores don't need to be comparable.
+func FuseReciprocalRank(lists []RankedResults, k int) []SearchResult {
+	if k <= 0 {
+		k = DefaultRankConstant
+	}
+
+	type fusedResult struct {
+		result SearchResult
+		score  float64
+	}
+
+	fusedByKey := make(map[string]*fusedResult)
+	fused := make([]*fusedResult, 0)
+	var maxScore float64
+	for _, list := range lists {
+		if list.Weight <= 0 {
+			continue
+		}
+		maxScore += float64(list.Weight) / float64(k+1)
+
+		for rank, result := range list.Results {
+			key := documentKey(result.Document)
+			entry, ok := fusedByKey[key]
+			if !ok {
+				entry = &fusedResult{result: result}
+				fusedByKey[key] = entry
+				fused = append(fused, entry)
+			}
+			entry.score += float64(list.Weight) / float64(k+rank+1)
+		}
+	}
+
+	if maxScore == 0 {
+		return []SearchResult{}
+	}
+
+	// Stable so ties keep the order of the earlier lists
+	sort.SliceStable(fused, func(i, j int) bool {
+		return fused[i].score > fused[j].score
+	})
+
+	results := make([]SearchResult, 0, len(fused))
+	for _, entry := range fused {
+		result := entry.result
+		result.Score = float32(entry.score / maxScore)
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// documentKey identifies an indexed document, a chunk of a post or a whole post
+func documentKey(doc PostDocument) string {
+	return fmt.Sprintf("%s:%d", doc.PostID, doc.ChunkIndex)
+}
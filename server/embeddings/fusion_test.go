@@ -0,0 +1,84 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func resultsFor(postIDs ...string) []SearchResult {
+	results := make([]SearchResult, 0, len(postIDs))
+	for _, postID := range postIDs {
+		results = append(results, SearchResult{Document: PostDocument{PostID: postID}})
+	}
+	return results
+}
+
+func postIDs(results []SearchResult) []string {
+	ids := make([]string, 0, len(results))
+	for _, result := range results {
+		ids = append(ids, result.Document.PostID)
+	}
+	return ids
+}
+
+func TestFuseReciprocalRank(t *testing.T) {
+	t.Run("no lists", func(t *testing.T) {
+		assert.Empty(t, FuseReciprocalRank(nil, 0))
+	})
+
+	t.Run("documents found by both sources rank first", func(t *testing.T) {
+		fused := FuseReciprocalRank([]RankedResults{
+			{Results: resultsFor("a", "b", "c"), Weight: 1},
+			{Results: resultsFor("d", "c", "e"), Weight: 1},
+		}, DefaultRankConstant)
+
+		require.Len(t, fused, 5)
+		assert.Equal(t, "c", fused[0].Document.PostID)
+		// Ties keep the order of the earlier lists
+		assert.Equal(t, []string{"c", "a", "d", "b", "e"}, postIDs(fused))
+	})
+
+	t.Run("scores are normalized", func(t *testing.T) {
+		fused := FuseReciprocalRank([]RankedResults{
+			{Results: resultsFor("a", "b"), Weight: 1},
+			{Results: resultsFor("a", "b"), Weight: 1},
+		}, DefaultRankConstant)
+
+		require.Len(t, fused, 2)
+		assert.InDelta(t, 1.0, fused[0].Score, 0.0001)
+		assert.Less(t, fused[1].Score, fused[0].Score)
+	})
+
+	t.Run("weights favor a source", func(t *testing.T) {
+		fused := FuseReciprocalRank([]RankedResults{
+			{Results: resultsFor("a", "b"), Weight: 1},
+			{Results: resultsFor("b", "a"), Weight: 3},
+		}, DefaultRankConstant)
+
+		assert.Equal(t, []string{"b", "a"}, postIDs(fused))
+	})
+
+	t.Run("zero weight lists are ignored", func(t *testing.T) {
+		fused := FuseReciprocalRank([]RankedResults{
+			{Results: resultsFor("a"), Weight: 1},
+			{Results: resultsFor("b"), Weight: 0},
+		}, DefaultRankConstant)
+
+		assert.Equal(t, []string{"a"}, postIDs(fused))
+	})
+
+	t.Run("chunks of the same post are separate documents", func(t *testing.T) {
+		chunk0 := SearchResult{Document: PostDocument{PostID: "a", IsChunk: true, ChunkIndex: 0}}
+		chunk1 := SearchResult{Document: PostDocument{PostID: "a", IsChunk: true, ChunkIndex: 1}}
+		fused := FuseReciprocalRank([]RankedResults{
+			{Results: []SearchResult{chunk0, chunk1}, Weight: 1},
+		}, DefaultRankConstant)
+
+		assert.Len(t, fused, 2)
+	})
+}
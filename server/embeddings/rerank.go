@@ -0,0 +1,214 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+)
+
+const (
+	RerankerTypeLexical = "lexical"
+	RerankerTypeLLM     = "llm"
+
+	DefaultRerankDepth        = 30
+	DefaultLLMRerankBatchSize = 10
+
+	// lexicalWeight is how much term overlap counts against the original score in lexical reranking
+	lexicalWeight = 0.5
+
+	// maxLLMRerankScore is the top of the scale the LLM scores passages on
+	maxLLMRerankScore = 10
+)
+
+// Reranker reorders search candidates by relevance to the query. The returned scores replace the original ones.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, results []SearchResult) ([]SearchResult, error)
+}
+
+// RerankOptions configures the optional rerank stage of search
+type RerankOptions struct {
+	Type      string `json:"type"`      // Reranker to use: lexical, llm, or empty to disable reranking
+	Depth     int    `json:"depth"`     // Number of candidates to fetch and rerank
+	Bot       string `json:"bot"`       // Name of the bot whose model scores candidates for the llm reranker
+	BatchSize int    `json:"batchSize"` // Number of candidates scored per prompt by the llm reranker
+}
+
+// sortByScore orders results by descending score. Stable so ties keep their original order.
+func sortByScore(results []SearchResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+}
+
+// LexicalReranker boosts candidates that contain more of the query's terms.
+// It is cheap and helps with names and exact terms that embeddings blur.
+type LexicalReranker struct{}
+
+func NewLexicalReranker() *LexicalReranker {
+	return &LexicalReranker{}
+}
+
+func (r *LexicalReranker) Rerank(_ context.Context, query string, results []SearchResult) ([]SearchResult, error) {
+	queryTerms := uniqueTerms(query)
+	if len(queryTerms) == 0 || len(results) == 0 {
+		return results, nil
+	}
+
+	// Normalize the original scores so they are comparable with the overlap whatever their source
+	var maxScore float32
+	for _, result := range results {
+		maxScore = max(maxScore, result.Score)
+	}
+
+	reranked := make([]SearchResult, len(results))
+	for i, result := range results {
+		docTerms := uniqueTerms(result.Document.Content)
+		matched := 0
+		for term := range queryTerms {
+			if docTerms[term] {
+				matched++
+			}
+		}
+		overlap := float32(matched) / float32(len(queryTerms))
+
+		original := float32(0)
+		if maxScore > 0 {
+			original = result.Score / maxScore
+		}
+
+		reranked[i] = result
+		reranked[i].Score = (1-lexicalWeight)*original + lexicalWeight*overlap
+	}
+	sortByScore(reranked)
+
+	return reranked, nil
+}
+
+// uniqueTerms returns the lowercased words of text, ignoring punctuation
+func uniqueTerms(text string) map[string]bool {
+	terms := make(map[string]bool)
+	for _, term := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		terms[term] = true
+	}
+	return terms
+}
+
+// LLMReranker asks a language model to score how relevant each candidate is to the query.
+// Candidates are scored in batches to keep prompts short.
+type LLMReranker struct {
+	model     llm.LanguageModel
+	prompts   *llm.Prompts
+	batchSize int
+}
+
+func NewLLMReranker(model llm.LanguageModel, prompts *llm.Prompts, batchSize int) *LLMReranker {
+	if batchSize <= 0 {
+		batchSize = DefaultLLMRerankBatchSize
+	}
+
+	return &LLMReranker{
+		model:     model,
+		prompts:   prompts,
+		batchSize: batchSize,
+	}
+}
+
+type rerankPassage struct {
+	Number  int
+	Content string
+}
+
+func (r *LLMReranker) Rerank(ctx context.Context, query string, results []SearchResult) ([]SearchResult, error) {
+	reranked := make([]SearchResult, 0, len(results))
+	for start := 0; start < len(results); start += r.batchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		batch := results[start:min(start+r.batchSize, len(results))]
+		scores, err := r.scoreBatch(ctx, query, batch)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, result := range batch {
+			result.Score = scores[i] / maxLLMRerankScore
+			reranked = append(reranked, result)
+		}
+	}
+	sortByScore(reranked)
+
+	return reranked, nil
+}
+
+func (r *LLMReranker) scoreBatch(ctx context.Context, query string, batch []SearchResult) ([]float32, error) {
+	passages := make([]rerankPassage, len(batch))
+	for i, result := range batch {
+		passages[i] = rerankPassage{Number: i + 1, Content: result.Document.Content}
+	}
+
+	llmContext := llm.NewContext(func(c *llm.Context) {
+		c.Parameters = map[string]interface{}{
+			"Query":    query,
+			"Passages": passages,
+		}
+	})
+
+	systemMessage, err := r.prompts.Format(llm.PromptRerankSystem, llmContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to format rerank system message: %w", err)
+	}
+
+	userMessage, err := r.prompts.Format(llm.PromptRerankUser, llmContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to format rerank user message: %w", err)
+	}
+
+	response, err := r.model.ChatCompletionNoStream(ctx, llm.CompletionRequest{
+		Posts: []llm.Post{
+			{Role: llm.PostRoleSystem, Message: systemMessage},
+			{Role: llm.PostRoleUser, Message: userMessage},
+		},
+		Context: llmContext,
+		Feature: llm.FeatureSearch,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to score candidates: %w", err)
+	}
+
+	return parseRerankScores(response, len(batch))
+}
+
+// parseRerankScores extracts the JSON array of scores from a response, tolerating text around it
+func parseRerankScores(response string, count int) ([]float32, error) {
+	start := strings.Index(response, "[")
+	end := strings.LastIndex(response, "]")
+	if start == -1 || end < start {
+		return nil, errors.New("rerank response does not contain a list of scores")
+	}
+
+	var scores []float32
+	if err := json.Unmarshal([]byte(response[start:end+1]), &scores); err != nil {
+		return nil, fmt.Errorf("failed to parse rerank scores: %w", err)
+	}
+	if len(scores) != count {
+		return nil, fmt.Errorf("rerank response has %d scores for %d candidates", len(scores), count)
+	}
+
+	for i := range scores {
+		scores[i] = min(max(scores[i], 0), maxLLMRerankScore)
+	}
+
+	return scores, nil
+}
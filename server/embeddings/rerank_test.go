@@ -0,0 +1,105 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package embeddings
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func resultsWithContent(contents ...string) []SearchResult {
+	results := make([]SearchResult, 0, len(contents))
+	for i, content := range contents {
+		results = append(results, SearchResult{
+			Document: PostDocument{PostID: content, Content: content},
+			Score:    1 - float32(i)*0.01,
+		})
+	}
+	return results
+}
+
+func TestLexicalReranker(t *testing.T) {
+	reranker := NewLexicalReranker()
+
+	t.Run("exact terms move up", func(t *testing.T) {
+		results := resultsWithContent(
+			"the release is planned for next week",
+			"we had lunch",
+			"error code E1234 happens when the release pipeline fails",
+		)
+
+		reranked, err := reranker.Rerank(context.Background(), "E1234 release", results)
+		require.NoError(t, err)
+		assert.Equal(t, results[2].Document.PostID, reranked[0].Document.PostID)
+		assert.Equal(t, results[1].Document.PostID, reranked[2].Document.PostID)
+	})
+
+	t.Run("empty query keeps order", func(t *testing.T) {
+		results := resultsWithContent("a", "b")
+		reranked, err := reranker.Rerank(context.Background(), "  ", results)
+		require.NoError(t, err)
+		assert.Equal(t, results, reranked)
+	})
+}
+
+type fakeLanguageModel struct {
+	responses []string
+	requests  []llm.CompletionRequest
+}
+
+func (m *fakeLanguageModel) ChatCompletion(_ context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	return nil, nil
+}
+
+func (m *fakeLanguageModel) ChatCompletionNoStream(_ context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	m.requests = append(m.requests, request)
+	response := m.responses[0]
+	m.responses = m.responses[1:]
+	return response, nil
+}
+
+func (m *fakeLanguageModel) CountTokens(text string) int { return len(text) }
+func (m *fakeLanguageModel) InputTokenLimit() int        { return 100000 }
+
+func TestLLMReranker(t *testing.T) {
+	prompts, err := llm.NewPrompts(os.DirFS(".."))
+	require.NoError(t, err)
+
+	model := &fakeLanguageModel{responses: []string{"[2, 9]", "Scores: [5]"}}
+	reranker := NewLLMReranker(model, prompts, 2)
+
+	results := resultsWithContent("first", "second", "third")
+	reranked, err := reranker.Rerank(context.Background(), "which one", results)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"second", "third", "first"}, postIDs(reranked))
+	assert.InDelta(t, 0.9, reranked[0].Score, 0.0001)
+
+	// Candidates are scored in batches
+	require.Len(t, model.requests, 2)
+	assert.Contains(t, model.requests[0].Posts[1].Message, "which one")
+	assert.Contains(t, model.requests[0].Posts[1].Message, "second")
+	assert.NotContains(t, model.requests[0].Posts[1].Message, "third")
+}
+
+func TestParseRerankScores(t *testing.T) {
+	scores, err := parseRerankScores("[1, 10, 20, -3]", 4)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{1, 10, 10, 0}, scores)
+
+	_, err = parseRerankScores("no scores here", 1)
+	assert.Error(t, err)
+
+	_, err = parseRerankScores("[1, 2]", 3)
+	assert.Error(t, err)
+
+	_, err = parseRerankScores("["+strings.Repeat("x", 3)+"]", 1)
+	assert.Error(t, err)
+}
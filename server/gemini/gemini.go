@@ -0,0 +1,607 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package gemini
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/invopop/jsonschema"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/metrics"
+)
+
+const (
+	DefaultAPIURL          = "https://generativelanguage.googleapis.com/v1beta"
+	DefaultInputTokenLimit = 1048576
+
+	// modelInfoTTL controls how long model limits are cached
+	modelInfoTTL = time.Hour
+
+	// modelInfoFailureTTL controls how long a failed lookup is remembered, requests use the default limit meanwhile
+	// rather than each waiting for the API again
+	modelInfoFailureTTL = time.Minute
+
+	// modelInfoTimeout bounds the model limits lookup, the default limit is used if it times out
+	modelInfoTimeout = 10 * time.Second
+)
+
+// unsupportedSchemaKeys are JSON schema keywords the API rejects in function declarations
+var unsupportedSchemaKeys = []string{"$schema", "$id", "$ref", "$defs", "definitions", "additionalProperties"}
+
+type Gemini struct {
+	// ctx bounds the lookups made outside of a request
+	ctx              context.Context
+	httpClient       *http.Client
+	apiURL           string
+	apiKey           string
+	defaultModel     string
+	inputTokenLimit  int
+	outputTokenLimit int
+	retryPolicy      llm.RetryPolicy
+	metricsService   metrics.LLMetrics
+	countTokens      llm.TokenCounter
+}
+
+// New creates a client for the service. ctx ends the model lookups that aren't part of a request, such as the one for
+// InputTokenLimit, it should be cancelled when the plugin stops.
+func New(ctx context.Context, llmService llm.ServiceConfig, httpClient *http.Client, metricsService metrics.LLMetrics) *Gemini {
+	apiURL := strings.TrimSuffix(llmService.APIURL, "/")
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+
+	return &Gemini{
+		ctx:              ctx,
+		httpClient:       httpClient,
+		apiURL:           apiURL,
+		apiKey:           llmService.APIKey,
+		defaultModel:     llmService.DefaultModel,
+		inputTokenLimit:  llmService.InputTokenLimit,
+		outputTokenLimit: llmService.OutputTokenLimit,
+		retryPolicy:      llm.NewRetryPolicy(llmService),
+		metricsService:   metricsService,
+		countTokens:      llm.NewTokenCounter(llmService.DefaultModel),
+	}
+}
+
+type content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []part `json:"parts"`
+}
+
+type part struct {
+	Text             string            `json:"text,omitempty"`
+	InlineData       *inlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *functionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *functionResponse `json:"functionResponse,omitempty"`
+
+	// Thought is set on the parts of thinking models that hold their reasoning rather than the response
+	Thought bool `json:"thought,omitempty"`
+	// Thinking models sign their function calls, the signature has to be sent back with the call
+	ThoughtSignature string `json:"thoughtSignature,omitempty"`
+}
+
+type inlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type functionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type functionResponse struct {
+	ID       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type tool struct {
+	FunctionDeclarations []functionDeclaration `json:"functionDeclarations"`
+}
+
+type functionDeclaration struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+type generationConfig struct {
+	MaxOutputTokens  int             `json:"maxOutputTokens,omitempty"`
+	ResponseMimeType string          `json:"responseMimeType,omitempty"`
+	ResponseSchema   map[string]any  `json:"responseSchema,omitempty"`
+	Temperature      *float32        `json:"temperature,omitempty"`
+	TopP             *float32        `json:"topP,omitempty"`
+	StopSequences    []string        `json:"stopSequences,omitempty"`
+	Seed             *int            `json:"seed,omitempty"`
+	ThinkingConfig   *thinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type thinkingConfig struct {
+	ThinkingBudget  int  `json:"thinkingBudget"`
+	IncludeThoughts bool `json:"includeThoughts"`
+}
+
+type generateRequest struct {
+	Contents          []content         `json:"contents"`
+	SystemInstruction *content          `json:"systemInstruction,omitempty"`
+	Tools             []tool            `json:"tools,omitempty"`
+	GenerationConfig  *generationConfig `json:"generationConfig,omitempty"`
+}
+
+type generateResponse struct {
+	Candidates []struct {
+		Content      content `json:"content"`
+		FinishReason string  `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	// Running totals for the request, the last chunk has the final counts
+	UsageMetadata *struct {
+		PromptTokenCount     int64 `json:"promptTokenCount"`
+		CandidatesTokenCount int64 `json:"candidatesTokenCount"`
+		ThoughtsTokenCount   int64 `json:"thoughtsTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+type apiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+type modelInfo struct {
+	InputTokenLimit  int `json:"inputTokenLimit"`
+	OutputTokenLimit int `json:"outputTokenLimit"`
+}
+
+type cachedModelInfo struct {
+	info    modelInfo
+	err     error
+	expires time.Time
+}
+
+// modelInfoCache is shared because a new client is created for every request
+var (
+	modelInfoCache     = map[string]cachedModelInfo{}
+	modelInfoCacheLock sync.Mutex
+)
+
+// isValidImageType checks if the MIME type is supported by the Gemini API
+func isValidImageType(mimeType string) bool {
+	switch mimeType {
+	case "image/png", "image/jpeg", "image/webp", "image/heic", "image/heif":
+		return true
+	}
+	return false
+}
+
+// conversationToContents creates the system instruction and contents from conversation posts.
+// Consecutive posts from the same role are merged since the API expects the roles to alternate.
+func conversationToContents(posts []llm.Post) (*content, []content) {
+	var system *content
+	contents := make([]content, 0, len(posts))
+
+	for _, post := range posts {
+		var role string
+		switch post.Role {
+		case llm.PostRoleSystem:
+			if system == nil {
+				system = &content{}
+			}
+			system.Parts = append(system.Parts, part{Text: post.Message})
+			continue
+		case llm.PostRoleBot:
+			role = "model"
+		case llm.PostRoleUser:
+			role = "user"
+		default:
+			continue
+		}
+
+		var parts []part
+		if post.Message != "" {
+			parts = append(parts, part{Text: post.Message})
+		}
+		for _, file := range post.Files {
+			if !isValidImageType(file.MimeType) {
+				parts = append(parts, part{Text: fmt.Sprintf("[Unsupported image type: %s]", file.MimeType)})
+				continue
+			}
+			data, err := io.ReadAll(file.Reader)
+			if err != nil {
+				parts = append(parts, part{Text: "[Error reading image data]"})
+				continue
+			}
+			parts = append(parts, part{InlineData: &inlineData{
+				MimeType: file.MimeType,
+				Data:     base64.StdEncoding.EncodeToString(data),
+			}})
+		}
+		if role == "model" {
+			for _, call := range post.ToolCalls {
+				parts = append(parts, part{FunctionCall: &functionCall{ID: call.ID, Name: call.Name, Args: json.RawMessage(call.Arguments)}})
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+
+		if len(contents) > 0 && contents[len(contents)-1].Role == role {
+			contents[len(contents)-1].Parts = append(contents[len(contents)-1].Parts, parts...)
+		} else {
+			contents = append(contents, content{Role: role, Parts: parts})
+		}
+		if role == "model" && len(post.ToolCalls) > 0 {
+			contents = append(contents, functionResponses(post.ToolCalls))
+		}
+	}
+
+	return system, contents
+}
+
+// convertTools converts from llm.Tool to function declarations. The API only accepts a subset of JSON schema.
+func convertTools(tools []llm.Tool) []tool {
+	if len(tools) == 0 {
+		return nil
+	}
+
+	reflector := jsonschema.Reflector{
+		AllowAdditionalProperties: true,
+		DoNotReference:            true,
+	}
+
+	declarations := make([]functionDeclaration, 0, len(tools))
+	for _, t := range tools {
+		declaration := functionDeclaration{
+			Name:        t.Name,
+			Description: t.Description,
+		}
+
+		var schema map[string]any
+		data, err := json.Marshal(llm.ToolSchema(&reflector, t))
+		if err == nil && json.Unmarshal(data, &schema) == nil {
+			cleanSchema(schema)
+			// Tools without arguments have no properties, the API rejects an empty object schema
+			if properties, ok := schema["properties"].(map[string]any); ok && len(properties) > 0 {
+				declaration.Parameters = schema
+			}
+		}
+
+		declarations = append(declarations, declaration)
+	}
+
+	return []tool{{FunctionDeclarations: declarations}}
+}
+
+// cleanSchema removes the keywords the API doesn't support from a schema and its sub-schemas
+func cleanSchema(schema map[string]any) {
+	for _, key := range unsupportedSchemaKeys {
+		delete(schema, key)
+	}
+	for _, value := range schema {
+		switch v := value.(type) {
+		case map[string]any:
+			cleanSchema(v)
+		case []any:
+			for _, item := range v {
+				if sub, ok := item.(map[string]any); ok {
+					cleanSchema(sub)
+				}
+			}
+		}
+	}
+}
+
+func (g *Gemini) post(ctx context.Context, path string, query url.Values, body any) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	return g.do(ctx, http.MethodPost, path, query, bytes.NewReader(data))
+}
+
+func (g *Gemini) do(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	target := g.apiURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", g.apiKey)
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to gemini failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var errResp apiError
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+		return nil, &llm.APIError{
+			Provider:   "gemini",
+			StatusCode: resp.StatusCode,
+			Message:    errResp.Error.Message,
+			RetryAfter: llm.ParseRetryAfter(resp.Header),
+		}
+	}
+
+	return resp, nil
+}
+
+func modelPath(model string) string {
+	return "/models/" + url.PathEscape(strings.TrimPrefix(model, "models/"))
+}
+
+func (g *Gemini) GetDefaultConfig() llm.LanguageModelConfig {
+	return llm.LanguageModelConfig{
+		Model:              g.defaultModel,
+		MaxGeneratedTokens: g.outputTokenLimit,
+	}
+}
+
+func (g *Gemini) createConfig(opts []llm.LanguageModelOption) llm.LanguageModelConfig {
+	cfg := g.GetDefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+func (g *Gemini) generateRequest(cfg llm.LanguageModelConfig, request llm.CompletionRequest) generateRequest {
+	system, contents := conversationToContents(request.Posts)
+	generate := generateRequest{
+		Contents:          contents,
+		SystemInstruction: system,
+	}
+	generation := &generationConfig{
+		MaxOutputTokens: cfg.MaxGeneratedTokens,
+		Temperature:     cfg.Temperature,
+		TopP:            cfg.TopP,
+		StopSequences:   cfg.StopSequences,
+		Seed:            cfg.Seed,
+	}
+	if budget := cfg.ThinkingBudgetTokens(); budget > 0 {
+		generation.ThinkingConfig = &thinkingConfig{ThinkingBudget: budget, IncludeThoughts: true}
+	}
+	if cfg.JSONSchema != nil {
+		var schema map[string]any
+		data, err := json.Marshal(cfg.JSONSchema)
+		if err == nil && json.Unmarshal(data, &schema) == nil {
+			cleanSchema(schema)
+			generation.ResponseMimeType = "application/json"
+			generation.ResponseSchema = schema
+		}
+	}
+	generate.GenerationConfig = generation
+	if request.Context != nil && request.Context.Tools != nil {
+		generate.Tools = convertTools(request.Context.Tools.GetTools())
+	}
+	return generate
+}
+
+// finishReason maps the finish reasons of the API to the ones of llm.StreamEvent
+func finishReason(reason string) string {
+	switch reason {
+	case "", "STOP":
+		return llm.FinishReasonStop
+	case "MAX_TOKENS":
+		return llm.FinishReasonLength
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return llm.FinishReasonContentFilter
+	default:
+		return strings.ToLower(reason)
+	}
+}
+
+// streamGenerate streams one response, one step of the agent loop. The model's turn is added to the request
+// when it calls tools so their results can follow it.
+func (g *Gemini) streamGenerate(ctx context.Context, cfg llm.LanguageModelConfig, request *generateRequest, events chan<- llm.StreamEvent) (llm.AgentStepResult, error) {
+	// Nothing has been streamed for this request yet so failures can be retried
+	var resp *http.Response
+	err := g.retryPolicy.Do(ctx, llm.ClassifyError, func() error {
+		var postErr error
+		resp, postErr = g.post(ctx, modelPath(cfg.Model)+":streamGenerateContent", url.Values{"alt": {"sse"}}, request)
+		return postErr
+	})
+	if err != nil {
+		return llm.AgentStepResult{}, err
+	}
+	defer resp.Body.Close()
+
+	// The parts of the model's turn are kept so tool calls can be sent back as they were received
+	var turn []part
+	var usage llm.TokenUsage
+	var reason string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var chunk generateResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return llm.AgentStepResult{}, fmt.Errorf("failed to decode gemini response: %w", err)
+		}
+		if chunk.UsageMetadata != nil {
+			usage = llm.TokenUsage{
+				Model:        cfg.Model,
+				InputTokens:  chunk.UsageMetadata.PromptTokenCount,
+				OutputTokens: chunk.UsageMetadata.CandidatesTokenCount + chunk.UsageMetadata.ThoughtsTokenCount,
+			}
+		}
+		if chunk.PromptFeedback != nil && chunk.PromptFeedback.BlockReason != "" {
+			return llm.AgentStepResult{}, fmt.Errorf("gemini blocked the prompt: %s", chunk.PromptFeedback.BlockReason)
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+
+		if chunk.Candidates[0].FinishReason != "" {
+			reason = chunk.Candidates[0].FinishReason
+		}
+		for _, p := range chunk.Candidates[0].Content.Parts {
+			switch {
+			case p.Text != "" && p.Thought:
+				events <- llm.StreamEvent{Type: llm.EventTypeReasoning, Text: p.Text}
+			case p.Text != "":
+				events <- llm.StreamEvent{Type: llm.EventTypeText, Text: p.Text}
+			}
+			turn = append(turn, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return llm.AgentStepResult{}, fmt.Errorf("error reading gemini stream: %w", err)
+	}
+	cfg.ReportUsage(usage)
+	events <- llm.StreamEvent{Type: llm.EventTypeUsage, Usage: &usage}
+
+	result := llm.AgentStepResult{FinishReason: finishReason(reason), Usage: usage}
+	for _, p := range turn {
+		if p.FunctionCall != nil {
+			result.Calls = append(result.Calls, llm.ToolCall{ID: p.FunctionCall.ID, Name: p.FunctionCall.Name, Arguments: string(p.FunctionCall.Args)})
+		}
+	}
+	if len(result.Calls) > 0 {
+		request.Contents = append(request.Contents, content{Role: "model", Parts: turn})
+	}
+	return result, nil
+}
+
+// functionResponses are the results of the tools the model called, sent back as a user turn
+func functionResponses(results []llm.ToolCall) content {
+	responses := make([]part, 0, len(results))
+	for _, result := range results {
+		responses = append(responses, part{FunctionResponse: &functionResponse{
+			ID:       result.ID,
+			Name:     result.Name,
+			Response: map[string]any{"result": result.ModelResult()},
+		}})
+	}
+	return content{Role: "user", Parts: responses}
+}
+
+func (g *Gemini) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	g.metricsService.IncrementLLMRequests()
+
+	cfg := g.createConfig(opts)
+	generate := g.generateRequest(cfg, request)
+
+	events := make(chan llm.StreamEvent)
+	go func() {
+		defer close(events)
+
+		loop := llm.NewAgentLoop(cfg, request.Context, events)
+		reason, err := loop.Run(ctx, func(ctx context.Context, results []llm.ToolCall) (llm.AgentStepResult, error) {
+			if len(results) > 0 {
+				generate.Contents = append(generate.Contents, functionResponses(results))
+			}
+			return g.streamGenerate(ctx, cfg, &generate, events)
+		})
+		if err != nil {
+			events <- llm.StreamEvent{Type: llm.EventTypeError, Err: err}
+			return
+		}
+		events <- llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: reason}
+	}()
+
+	return &llm.TextStreamResult{Events: events}, nil
+}
+
+func (g *Gemini) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	result, err := g.ChatCompletion(ctx, request, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	text, err := result.ReadText()
+	if err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// CountTokens counts locally with the ratio learned from the usage the API reports for the model
+func (g *Gemini) CountTokens(text string) int {
+	return g.countTokens(text)
+}
+
+// getModelInfo returns the token limits the API reports for a model
+func (g *Gemini) getModelInfo(ctx context.Context, model string) (modelInfo, error) {
+	key := g.apiURL + "|" + model
+	modelInfoCacheLock.Lock()
+	cached, ok := modelInfoCache[key]
+	modelInfoCacheLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.info, cached.err
+	}
+
+	info, err := g.fetchModelInfo(ctx, model)
+	// Failures are remembered for a shorter time, unless the lookup was only cut short by its caller
+	if err == nil || ctx.Err() == nil {
+		ttl := modelInfoTTL
+		if err != nil {
+			ttl = modelInfoFailureTTL
+		}
+		modelInfoCacheLock.Lock()
+		modelInfoCache[key] = cachedModelInfo{info: info, err: err, expires: time.Now().Add(ttl)}
+		modelInfoCacheLock.Unlock()
+	}
+
+	return info, err
+}
+
+func (g *Gemini) fetchModelInfo(ctx context.Context, model string) (modelInfo, error) {
+	resp, err := g.do(ctx, http.MethodGet, modelPath(model), nil, nil)
+	if err != nil {
+		return modelInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	var info modelInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return modelInfo{}, fmt.Errorf("failed to decode model info: %w", err)
+	}
+	return info, nil
+}
+
+func (g *Gemini) InputTokenLimit() int {
+	if g.inputTokenLimit > 0 {
+		return g.inputTokenLimit
+	}
+
+	// The interface has no context, the lookup is bounded and cached instead
+	ctx, cancel := context.WithTimeout(g.ctx, modelInfoTimeout)
+	defer cancel()
+
+	info, err := g.getModelInfo(ctx, g.defaultModel)
+	if err != nil || info.InputTokenLimit <= 0 {
+		return DefaultInputTokenLimit
+	}
+	return info.InputTokenLimit
+}
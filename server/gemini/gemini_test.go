@@ -0,0 +1,325 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncrementLLMRequests()                                   {}
+func (noopMetrics) IncrementLLMFailovers(_, _ string)                       {}
+func (noopMetrics) ObserveLLMTokenUsage(_, _ string, _, _ int64, _ float64) {}
+
+// fakeGemini answers each streamGenerateContent call with the next scripted list of SSE chunks
+type fakeGemini struct {
+	server   *httptest.Server
+	streams  [][]string
+	requests []generateRequest
+	apiKeys  []string
+}
+
+func newFakeGemini(t *testing.T, streams ...[]string) *fakeGemini {
+	f := &fakeGemini{streams: streams}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.apiKeys = append(f.apiKeys, r.Header.Get("x-goog-api-key"))
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/models/missing"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"model not found","status":"NOT_FOUND"}}`)
+		case strings.HasSuffix(r.URL.Path, ":streamGenerateContent"):
+			assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+			var req generateRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			f.requests = append(f.requests, req)
+			require.NotEmpty(t, f.streams, "unexpected generate request")
+			for _, chunk := range f.streams[0] {
+				fmt.Fprintf(w, "data: %s\r\n\r\n", chunk)
+			}
+			f.streams = f.streams[1:]
+		default:
+			fmt.Fprint(w, `{"name":"models/gemini-test","inputTokenLimit":2097152,"outputTokenLimit":8192}`)
+		}
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeGemini) client(cfg llm.ServiceConfig) *Gemini {
+	cfg.APIURL = f.server.URL
+	cfg.APIKey = "test-key"
+	if cfg.DefaultModel == "" {
+		cfg.DefaultModel = "gemini-test"
+	}
+	return New(context.Background(), cfg, f.server.Client(), noopMetrics{})
+}
+
+func textChunk(text string) string {
+	return fmt.Sprintf(`{"candidates":[{"content":{"role":"model","parts":[{"text":%q}]}}]}`, text)
+}
+
+type searchArgs struct {
+	Query string `json:"query" jsonschema_description:"What to search for"`
+}
+
+func TestConversationToContents(t *testing.T) {
+	system, contents := conversationToContents([]llm.Post{
+		{Role: llm.PostRoleSystem, Message: "You are helpful"},
+		{Role: llm.PostRoleUser, Message: "First"},
+		{Role: llm.PostRoleUser, Message: "Second", Files: []llm.File{
+			{MimeType: "image/png", Reader: bytes.NewReader([]byte("png"))},
+			{MimeType: "image/gif", Reader: bytes.NewReader([]byte("gif"))},
+		}},
+		{Role: llm.PostRoleBot, Message: "Response"},
+	})
+
+	require.NotNil(t, system)
+	assert.Equal(t, []part{{Text: "You are helpful"}}, system.Parts)
+
+	// Consecutive posts from the same role are merged
+	require.Len(t, contents, 2)
+	assert.Equal(t, "user", contents[0].Role)
+	assert.Equal(t, []part{
+		{Text: "First"},
+		{Text: "Second"},
+		{InlineData: &inlineData{MimeType: "image/png", Data: "cG5n"}},
+		{Text: "[Unsupported image type: image/gif]"},
+	}, contents[0].Parts)
+	assert.Equal(t, content{Role: "model", Parts: []part{{Text: "Response"}}}, contents[1])
+}
+
+func TestConversationToContentsToolCalls(t *testing.T) {
+	_, contents := conversationToContents([]llm.Post{
+		{Role: llm.PostRoleUser, Message: "Create an issue"},
+		{Role: llm.PostRoleBot, Message: "Creating it", ToolCalls: []llm.ToolCall{
+			{ID: "call1", Name: "CreateIssue", Arguments: `{"title":"Bug"}`, Err: llm.ErrToolCallDenied},
+		}},
+	})
+
+	// The results of the calls follow the model's turn
+	require.Len(t, contents, 3)
+	assert.Equal(t, content{Role: "model", Parts: []part{
+		{Text: "Creating it"},
+		{FunctionCall: &functionCall{ID: "call1", Name: "CreateIssue", Args: json.RawMessage(`{"title":"Bug"}`)}},
+	}}, contents[1])
+	assert.Equal(t, content{Role: "user", Parts: []part{
+		{FunctionResponse: &functionResponse{ID: "call1", Name: "CreateIssue", Response: map[string]any{"result": "Error: the user denied this tool call"}}},
+	}}, contents[2])
+}
+
+func TestConvertTools(t *testing.T) {
+	tools := convertTools([]llm.Tool{
+		{Name: "search", Description: "Searches", Schema: searchArgs{}},
+		{Name: "now", Description: "Current time", Schema: struct{}{}},
+	})
+	require.Len(t, tools, 1)
+	declarations := tools[0].FunctionDeclarations
+	require.Len(t, declarations, 2)
+
+	schema, err := json.Marshal(declarations[0].Parameters)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "object",
+		"properties": {"query": {"type": "string", "description": "What to search for"}},
+		"required": ["query"]
+	}`, string(schema))
+
+	// Tools without arguments don't declare parameters
+	assert.Nil(t, declarations[1].Parameters)
+}
+
+func TestChatCompletionStreams(t *testing.T) {
+	fake := newFakeGemini(t, []string{textChunk("Hello"), textChunk(" world")})
+	client := fake.client(llm.ServiceConfig{OutputTokenLimit: 1000})
+
+	result, err := client.ChatCompletion(context.Background(), llm.CompletionRequest{
+		Posts: []llm.Post{
+			{Role: llm.PostRoleSystem, Message: "Be brief"},
+			{Role: llm.PostRoleUser, Message: "Hi"},
+		},
+		Context: llm.NewContext(),
+	})
+	require.NoError(t, err)
+
+	var chunks []string
+	var last llm.StreamEvent
+	for event := range result.Events {
+		if event.Type == llm.EventTypeText {
+			chunks = append(chunks, event.Text)
+		}
+		last = event
+	}
+	assert.Equal(t, []string{"Hello", " world"}, chunks)
+	assert.Equal(t, llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: llm.FinishReasonStop}, last)
+
+	require.Len(t, fake.requests, 1)
+	assert.Equal(t, "Be brief", fake.requests[0].SystemInstruction.Parts[0].Text)
+	assert.Equal(t, 1000, fake.requests[0].GenerationConfig.MaxOutputTokens)
+	assert.Equal(t, "test-key", fake.apiKeys[0])
+}
+
+func TestGenerateRequestModelParameters(t *testing.T) {
+	client := New(context.Background(), llm.ServiceConfig{DefaultModel: "gemini-2.5-flash"}, http.DefaultClient, noopMetrics{})
+
+	cfg := client.createConfig([]llm.LanguageModelOption{
+		llm.WithTemperature(0.2),
+		llm.WithTopP(0.9),
+		llm.WithStopSequences("END"),
+		llm.WithSeed(7),
+		llm.WithReasoningEffort(llm.ReasoningEffortMedium),
+	})
+	generation := client.generateRequest(cfg, llm.CompletionRequest{Posts: []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}}}).GenerationConfig
+	require.NotNil(t, generation)
+	assert.Equal(t, float32(0.2), *generation.Temperature)
+	assert.Equal(t, float32(0.9), *generation.TopP)
+	assert.Equal(t, []string{"END"}, generation.StopSequences)
+	assert.Equal(t, 7, *generation.Seed)
+	assert.Equal(t, &thinkingConfig{ThinkingBudget: 8192, IncludeThoughts: true}, generation.ThinkingConfig)
+
+	// An explicit budget wins over the effort
+	cfg = client.createConfig([]llm.LanguageModelOption{llm.WithReasoningEffort(llm.ReasoningEffortHigh), llm.WithThinkingBudget(512)})
+	generation = client.generateRequest(cfg, llm.CompletionRequest{}).GenerationConfig
+	assert.Equal(t, 512, generation.ThinkingConfig.ThinkingBudget)
+	assert.Nil(t, generation.Temperature)
+}
+
+func TestChatCompletionFunctionCalling(t *testing.T) {
+	callChunk := `{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"search","args":{"query":"gemini"}},"thoughtSignature":"sig"}]}}]}`
+	fake := newFakeGemini(t, []string{callChunk}, []string{textChunk("Found it")})
+	client := fake.client(llm.ServiceConfig{})
+
+	var gotQuery string
+	llmContext := llm.NewContext()
+	llmContext.Tools = llm.NewNoTools()
+	llmContext.Tools.AddTools([]llm.Tool{{
+		Name:        "search",
+		Description: "Searches",
+		Schema:      searchArgs{},
+		Resolver: func(_ context.Context, _ *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+			var args searchArgs
+			if err := argsGetter(&args); err != nil {
+				return "", err
+			}
+			gotQuery = args.Query
+			return "search results", nil
+		},
+	}})
+
+	text, err := client.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Look up gemini"}},
+		Context: llmContext,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Found it", text)
+	assert.Equal(t, "gemini", gotQuery)
+
+	require.Len(t, fake.requests, 2)
+	assert.Equal(t, "search", fake.requests[0].Tools[0].FunctionDeclarations[0].Name)
+
+	// The call is sent back with its signature, followed by the result
+	contents := fake.requests[1].Contents
+	require.Len(t, contents, 3)
+	assert.Equal(t, "model", contents[1].Role)
+	assert.Equal(t, "sig", contents[1].Parts[0].ThoughtSignature)
+	assert.Equal(t, "user", contents[2].Role)
+	assert.Equal(t, &functionResponse{Name: "search", Response: map[string]any{"result": "search results"}}, contents[2].Parts[0].FunctionResponse)
+}
+
+func TestChatCompletionStreamsEvents(t *testing.T) {
+	thoughtChunk := `{"candidates":[{"content":{"role":"model","parts":[{"text":"Thinking it over","thought":true}]}}]}`
+	callChunk := `{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"id":"call1","name":"search","args":{"query":"gemini"}}}]}}]}`
+	lengthChunk := `{"candidates":[{"content":{"role":"model","parts":[{"text":"Found"}]},"finishReason":"MAX_TOKENS"}]}`
+	fake := newFakeGemini(t, []string{thoughtChunk, callChunk}, []string{lengthChunk})
+	client := fake.client(llm.ServiceConfig{})
+
+	llmContext := llm.NewContext()
+	llmContext.Tools = llm.NewNoTools()
+	llmContext.Tools.AddTools([]llm.Tool{{
+		Name:        "search",
+		Description: "Searches",
+		Schema:      searchArgs{},
+		Resolver: func(_ context.Context, _ *llm.Context, _ llm.ToolArgumentGetter) (string, error) {
+			return "search results", nil
+		},
+	}})
+
+	result, err := client.ChatCompletion(context.Background(), llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Look up gemini"}},
+		Context: llmContext,
+	})
+	require.NoError(t, err)
+
+	var events []llm.StreamEvent
+	for event := range result.Events {
+		if event.Type != llm.EventTypeUsage {
+			events = append(events, event)
+		}
+	}
+	started := &llm.ToolCall{ID: "call1", Name: "search", Arguments: `{"query":"gemini"}`}
+	finished := &llm.ToolCall{ID: "call1", Name: "search", Arguments: `{"query":"gemini"}`, Result: "search results"}
+	assert.Equal(t, []llm.StreamEvent{
+		{Type: llm.EventTypeReasoning, Text: "Thinking it over"},
+		{Type: llm.EventTypeToolCallStarted, ToolCall: started},
+		{Type: llm.EventTypeToolCallFinished, ToolCall: finished},
+		{Type: llm.EventTypeText, Text: "Found"},
+		{Type: llm.EventTypeEnd, FinishReason: llm.FinishReasonLength},
+	}, events)
+}
+
+func TestChatCompletionErrors(t *testing.T) {
+	fake := newFakeGemini(t)
+	client := fake.client(llm.ServiceConfig{DefaultModel: "missing"})
+
+	_, err := client.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+		Context: llm.NewContext(),
+	})
+	assert.ErrorContains(t, err, "model not found")
+}
+
+func TestCountTokens(t *testing.T) {
+	fake := newFakeGemini(t)
+	// Learned ratios are kept for the process, a new model starts without one
+	model := fmt.Sprintf("gemini-count-%d", time.Now().UnixNano())
+	client := fake.client(llm.ServiceConfig{DefaultModel: model})
+
+	// Counting doesn't call the API, it estimates until usage has been reported for the model
+	assert.Equal(t, llm.EstimateTokens("some text"), client.CountTokens("some text"))
+	assert.Empty(t, fake.apiKeys)
+
+	llm.ObserveTokenUsage(model, strings.Repeat("some text ", 100), 500)
+	assert.Greater(t, client.CountTokens("some text"), llm.EstimateTokens("some text"))
+}
+
+func TestInputTokenLimit(t *testing.T) {
+	fake := newFakeGemini(t)
+	assert.Equal(t, 2097152, fake.client(llm.ServiceConfig{}).InputTokenLimit())
+	assert.Equal(t, 1000, fake.client(llm.ServiceConfig{InputTokenLimit: 1000}).InputTokenLimit())
+	assert.Equal(t, DefaultInputTokenLimit, fake.client(llm.ServiceConfig{DefaultModel: "missing"}).InputTokenLimit())
+
+	// A failed lookup isn't repeated for every request
+	requests := len(fake.apiKeys)
+	assert.Equal(t, DefaultInputTokenLimit, fake.client(llm.ServiceConfig{DefaultModel: "missing"}).InputTokenLimit())
+	assert.Equal(t, requests, len(fake.apiKeys))
+
+	// A lookup cancelled by the caller isn't remembered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client := New(ctx, llm.ServiceConfig{APIURL: fake.server.URL, DefaultModel: "gemini-cancelled"}, fake.server.Client(), noopMetrics{})
+	assert.Equal(t, DefaultInputTokenLimit, client.InputTokenLimit())
+	assert.Equal(t, 2097152, fake.client(llm.ServiceConfig{DefaultModel: "gemini-cancelled"}).InputTokenLimit())
+}
@@ -25,7 +25,7 @@ var (
 )
 
 func (p *Plugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post) {
-	// We're removing all vector search/indexing functionality since we're using MySQL
+	p.indexPostAsync(post)
 
 	// Process the message for AI responses
 	if err := p.handleMessages(post); err != nil {
@@ -96,8 +96,10 @@ func (p *Plugin) handleMentions(bot *Bot, post *model.Post, postingUser *model.U
 		return err
 	}
 
-	stream, err := p.processUserRequestToBot(bot, postingUser, channel, post)
+	streamContext := p.newStreamingContext()
+	stream, err := p.processUserRequestToBot(streamContext.ctx, bot, postingUser, channel, post)
 	if err != nil {
+		streamContext.cancel()
 		return fmt.Errorf("unable to process bot mention: %w", err)
 	}
 
@@ -110,7 +112,7 @@ func (p *Plugin) handleMentions(bot *Bot, post *model.Post, postingUser *model.U
 		ChannelId: channel.Id,
 		RootId:    responseRootID,
 	}
-	if err := p.streamResultToNewPost(bot.mmBot.UserId, postingUser.Id, stream, responsePost, post.Id); err != nil {
+	if err := p.streamResultToNewPost(streamContext, bot.mmBot.UserId, postingUser.Id, stream, responsePost, post.Id); err != nil {
 		return fmt.Errorf("unable to stream response: %w", err)
 	}
 
@@ -122,8 +124,10 @@ func (p *Plugin) handleDMs(bot *Bot, channel *model.Channel, postingUser *model.
 		return err
 	}
 
-	stream, err := p.processUserRequestToBot(bot, postingUser, channel, post)
+	streamContext := p.newStreamingContext()
+	stream, err := p.processUserRequestToBot(streamContext.ctx, bot, postingUser, channel, post)
 	if err != nil {
+		streamContext.cancel()
 		return fmt.Errorf("unable to process bot mention: %w", err)
 	}
 
@@ -136,7 +140,7 @@ func (p *Plugin) handleDMs(bot *Bot, channel *model.Channel, postingUser *model.
 		ChannelId: channel.Id,
 		RootId:    responseRootID,
 	}
-	if err := p.streamResultToNewPost(bot.mmBot.UserId, postingUser.Id, stream, responsePost, post.Id); err != nil {
+	if err := p.streamResultToNewPost(streamContext, bot.mmBot.UserId, postingUser.Id, stream, responsePost, post.Id); err != nil {
 		return fmt.Errorf("unable to stream response: %w", err)
 	}
 
@@ -145,5 +149,12 @@ func (p *Plugin) handleDMs(bot *Bot, channel *model.Channel, postingUser *model.
 
 // MessageHasBeenUpdated is called when a message is updated
 func (p *Plugin) MessageHasBeenUpdated(c *plugin.Context, newPost, oldPost *model.Post) {
-	// No action needed for MySQL as we don't have vector search capabilities
+	p.indexPostAsync(newPost)
+}
+
+// MessageHasBeenDeleted is called when a message is deleted
+func (p *Plugin) MessageHasBeenDeleted(c *plugin.Context, post *model.Post) {
+	if err := p.deletePostFromIndex(post.Id); err != nil {
+		p.pluginAPI.Log.Error("Failed to remove deleted post from index", "post_id", post.Id, "error", err)
+	}
 }
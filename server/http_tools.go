@@ -0,0 +1,432 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/invopop/jsonschema"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+)
+
+const (
+	httpToolTimeout = 30 * time.Second
+	// maxHTTPToolResponseSize is the most that is read of a response, before the result is extracted from it
+	maxHTTPToolResponseSize = 1024 * 1024
+	// defaultHTTPToolResultSize is the longest result sent to the model when the tool doesn't set its own limit
+	defaultHTTPToolResultSize = 10_000
+)
+
+// HTTPToolConfig is a tool that makes an HTTP request, defined by an admin rather than in code.
+//
+// The URL, headers and body are templates where {{name}} is replaced by the argument called name and
+// {{secret.name}} by the tool secret called name. Arguments are escaped for where they are used, as JSON values in
+// the body, and secrets can only be used in headers.
+type HTTPToolConfig struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Schema is the JSON schema of the arguments, an object whose properties are the arguments
+	Schema json.RawMessage `json:"schema"`
+
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+
+	// ResultPath is a JSONPath, like $.items[*].title, selecting the part of a JSON response sent to the model
+	ResultPath string `json:"resultPath"`
+	// MaxResultSize is the most bytes of the result sent to the model, longer results are truncated
+	MaxResultSize int `json:"maxResultSize"`
+
+	// SideEffects asks the requesting user to approve each call, for tools that change things
+	SideEffects bool `json:"sideEffects"`
+	// BotIDs are the bots that can use the tool, all bots can when it is empty
+	BotIDs []string `json:"botIDs"`
+	// AllowInChannels makes the tool available outside of DMs, where everyone in the channel sees the results
+	AllowInChannels bool `json:"allowInChannels"`
+}
+
+var (
+	templatePlaceholder = regexp.MustCompile(`\{\{\s*(secret\.)?([a-zA-Z0-9_]+)\s*\}\}`)
+	validToolName       = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+// Validate checks the tool can be offered to the models and that arguments can't change where the request goes
+func (c *HTTPToolConfig) Validate() error {
+	if !validToolName.MatchString(c.Name) {
+		return fmt.Errorf("invalid tool name %q, use letters, digits, _ and - only", c.Name)
+	}
+	if c.Description == "" {
+		return errors.New("description is required")
+	}
+	if _, err := c.schema(); err != nil {
+		return err
+	}
+
+	switch c.method() {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return fmt.Errorf("unsupported method %s", c.Method)
+	}
+
+	// The scheme and host must come before any placeholder
+	prefix := c.URL
+	if loc := templatePlaceholder.FindStringIndex(c.URL); loc != nil {
+		prefix = c.URL[:loc[0]]
+	}
+	parsed, err := url.Parse(prefix)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("url must be an http or https URL")
+	}
+	if prefix != c.URL && parsed.Path == "" && parsed.RawQuery == "" && !strings.HasSuffix(prefix, "?") {
+		return errors.New("url can't use placeholders in its host")
+	}
+
+	for _, template := range []string{c.URL, c.Body} {
+		for _, match := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+			if match[1] != "" {
+				return fmt.Errorf("secret %s can only be used in headers", match[2])
+			}
+		}
+	}
+
+	if c.ResultPath != "" {
+		if _, err := parseJSONPath(c.ResultPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *HTTPToolConfig) method() string {
+	if c.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(c.Method)
+}
+
+func (c *HTTPToolConfig) schema() (*jsonschema.Schema, error) {
+	if len(c.Schema) == 0 {
+		return &jsonschema.Schema{Type: "object"}, nil
+	}
+	schema := &jsonschema.Schema{}
+	if err := json.Unmarshal(c.Schema, schema); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if schema.Type != "object" {
+		return nil, errors.New("schema must be an object")
+	}
+	return schema, nil
+}
+
+// validateHTTPTools logs the tools that are misconfigured, they are left out of the bots' tools
+func (p *Plugin) validateHTTPTools() {
+	for _, tool := range p.getConfiguration().HTTPTools {
+		if err := tool.Validate(); err != nil {
+			p.pluginAPI.Log.Error("Invalid HTTP tool, it will be unavailable", "tool", tool.Name, "error", err)
+		}
+	}
+}
+
+// getHTTPTools returns the tools defined in the configuration that the bot can use
+func (p *Plugin) getHTTPTools(bot *Bot, isDM bool) []llm.Tool {
+	var tools []llm.Tool
+	for _, cfg := range p.getConfiguration().HTTPTools {
+		if !isDM && !cfg.AllowInChannels {
+			continue
+		}
+		if len(cfg.BotIDs) > 0 && !slices.Contains(cfg.BotIDs, bot.cfg.ID) {
+			continue
+		}
+		if cfg.Validate() != nil {
+			continue
+		}
+
+		schema, _ := cfg.schema()
+		tools = append(tools, llm.Tool{
+			Name:        cfg.Name,
+			Description: cfg.Description,
+			Schema:      schema,
+			Resolver:    p.httpToolResolver(cfg),
+			SideEffects: cfg.SideEffects,
+		})
+	}
+	return tools
+}
+
+func (p *Plugin) httpToolResolver(cfg HTTPToolConfig) func(context.Context, *llm.Context, llm.ToolArgumentGetter) (string, error) {
+	return func(ctx context.Context, _ *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+		var args map[string]any
+		if err := argsGetter(&args); err != nil {
+			return "invalid arguments", fmt.Errorf("failed to get arguments for HTTP tool %s: %w", cfg.Name, err)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, httpToolTimeout)
+		defer cancel()
+
+		req, err := newHTTPToolRequest(ctx, cfg, args, p.getConfiguration().ToolSecrets)
+		if err != nil {
+			return "internal failure", err
+		}
+
+		resp, err := p.createExternalHTTPClient().Do(req)
+		if err != nil {
+			return "request failed", fmt.Errorf("HTTP tool %s request failed: %w", cfg.Name, err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPToolResponseSize))
+		if err != nil {
+			return "request failed", fmt.Errorf("failed to read HTTP tool %s response: %w", cfg.Name, err)
+		}
+
+		// Errors are sent to the model as they are, they often say what was wrong with the request
+		if resp.StatusCode >= 400 {
+			return truncateToolResult(fmt.Sprintf("The request failed with status %d: %s", resp.StatusCode, body), cfg.MaxResultSize),
+				fmt.Errorf("HTTP tool %s returned status %d", cfg.Name, resp.StatusCode)
+		}
+
+		result, err := extractToolResult(body, cfg.ResultPath)
+		if err != nil {
+			return "invalid response", fmt.Errorf("HTTP tool %s: %w", cfg.Name, err)
+		}
+		return truncateToolResult(result, cfg.MaxResultSize), nil
+	}
+}
+
+// newHTTPToolRequest fills the request templates of the tool with the arguments and secrets
+func newHTTPToolRequest(ctx context.Context, cfg HTTPToolConfig, args map[string]any, secrets map[string]string) (*http.Request, error) {
+	var missingSecret error
+	fill := func(template string, escape func(string) string) string {
+		return templatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+			match := templatePlaceholder.FindStringSubmatch(placeholder)
+			if match[1] != "" {
+				secret, ok := secrets[match[2]]
+				if !ok {
+					missingSecret = fmt.Errorf("tool secret %s is not configured", match[2])
+				}
+				return escape(secret)
+			}
+			return escape(argumentString(args[match[2]]))
+		})
+	}
+
+	// Arguments in the query are escaped as query values, the others as parts of the path
+	path, query, hasQuery := strings.Cut(cfg.URL, "?")
+	requestPath := fill(path, url.PathEscape)
+	// Escaping leaves dots alone, an argument of ".." would reach paths outside the tool's
+	for _, segment := range strings.Split(requestPath, "/") {
+		if segment == "." || segment == ".." {
+			return nil, fmt.Errorf("HTTP tool %s arguments can't be %q path segments", cfg.Name, segment)
+		}
+	}
+	requestURL := requestPath
+	if hasQuery {
+		requestURL += "?" + fill(query, url.QueryEscape)
+	}
+
+	var body io.Reader
+	if cfg.Body != "" {
+		body = strings.NewReader(templatePlaceholder.ReplaceAllStringFunc(cfg.Body, func(placeholder string) string {
+			value, err := json.Marshal(args[templatePlaceholder.FindStringSubmatch(placeholder)[2]])
+			if err != nil {
+				return "null"
+			}
+			return string(value)
+		}))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, cfg.method(), requestURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP tool %s request: %w", cfg.Name, err)
+	}
+	if cfg.Body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range cfg.Headers {
+		req.Header.Set(key, fill(value, stripNewlines))
+	}
+	if missingSecret != nil {
+		return nil, missingSecret
+	}
+	return req, nil
+}
+
+func argumentString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+func stripNewlines(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// extractToolResult selects the result from a JSON response, responses are used as they are without a path
+func extractToolResult(body []byte, path string) (string, error) {
+	if path == "" {
+		return string(body), nil
+	}
+
+	var document any
+	if err := json.Unmarshal(body, &document); err != nil {
+		return "", fmt.Errorf("response isn't JSON: %w", err)
+	}
+	value, err := extractJSONPath(document, path)
+	if err != nil {
+		return "", err
+	}
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal result: %w", err)
+	}
+	return string(data), nil
+}
+
+// truncateToolResult cuts results longer than the limit, saying so for the model
+func truncateToolResult(result string, limit int) string {
+	if limit <= 0 {
+		limit = defaultHTTPToolResultSize
+	}
+	if len(result) <= limit {
+		return result
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(result[cut]) {
+		cut--
+	}
+	return result[:cut] + "\n[result truncated]"
+}
+
+// jsonPathStep is a key, an index or a wildcard (both empty and index -1) of a JSONPath
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+// parseJSONPath parses the subset of JSONPath the tools support: $ followed by .key, ['key'], [index], .* and [*]
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("invalid result path %q, it must start with $", path)
+	}
+
+	var steps []jsonPathStep
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			rest = rest[end:]
+			if key == "" {
+				return nil, fmt.Errorf("invalid result path %q", path)
+			}
+			if key == "*" {
+				steps = append(steps, jsonPathStep{index: -1})
+			} else {
+				steps = append(steps, jsonPathStep{key: key})
+			}
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("invalid result path %q", path)
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+			if selector == "*" {
+				steps = append(steps, jsonPathStep{index: -1})
+			} else if key, ok := strings.CutPrefix(selector, "'"); ok && strings.HasSuffix(key, "'") && len(key) > 1 {
+				steps = append(steps, jsonPathStep{key: key[:len(key)-1]})
+			} else if index, err := strconv.Atoi(selector); err == nil && index >= 0 {
+				steps = append(steps, jsonPathStep{index: index})
+			} else {
+				return nil, fmt.Errorf("invalid result path %q", path)
+			}
+		default:
+			return nil, fmt.Errorf("invalid result path %q", path)
+		}
+	}
+	return steps, nil
+}
+
+// extractJSONPath returns the value at the path. Paths with wildcards return the list of the values they match.
+func extractJSONPath(document any, path string) (any, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []any{document}
+	wildcard := false
+	for _, step := range steps {
+		var next []any
+		for _, value := range values {
+			switch {
+			case step.key != "":
+				if object, ok := value.(map[string]any); ok {
+					if child, ok := object[step.key]; ok {
+						next = append(next, child)
+					}
+				}
+			case step.index >= 0:
+				if list, ok := value.([]any); ok && step.index < len(list) {
+					next = append(next, list[step.index])
+				}
+			default:
+				wildcard = true
+				switch v := value.(type) {
+				case []any:
+					next = append(next, v...)
+				case map[string]any:
+					for _, key := range slices.Sorted(maps.Keys(v)) {
+						next = append(next, v[key])
+					}
+				}
+			}
+		}
+		values = next
+	}
+
+	if wildcard {
+		if values == nil {
+			return []any{}, nil
+		}
+		return values, nil
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("result path %s didn't match the response", path)
+	}
+	return values[0], nil
+}
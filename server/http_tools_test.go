@@ -0,0 +1,143 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPToolConfigValidate(t *testing.T) {
+	valid := HTTPToolConfig{
+		Name:        "search_tickets",
+		Description: "Search tickets",
+		Schema:      json.RawMessage(`{"type":"object","properties":{"query":{"type":"string"}}}`),
+		URL:         "https://tickets.example.com/api/search?q={{query}}",
+		Headers:     map[string]string{"Authorization": "Bearer {{secret.tickets}}"},
+		ResultPath:  "$.results[*].title",
+	}
+	require.NoError(t, valid.Validate())
+
+	for name, change := range map[string]func(c *HTTPToolConfig){
+		"invalid name":           func(c *HTTPToolConfig) { c.Name = "search tickets" },
+		"no description":         func(c *HTTPToolConfig) { c.Description = "" },
+		"schema isn't object":    func(c *HTTPToolConfig) { c.Schema = json.RawMessage(`{"type":"string"}`) },
+		"unsupported method":     func(c *HTTPToolConfig) { c.Method = "TRACE" },
+		"not http":               func(c *HTTPToolConfig) { c.URL = "ftp://tickets.example.com/{{query}}" },
+		"placeholder in host":    func(c *HTTPToolConfig) { c.URL = "https://{{query}}.example.com/api" },
+		"placeholder after host": func(c *HTTPToolConfig) { c.URL = "https://tickets.example.com{{query}}" },
+		"secret in url":          func(c *HTTPToolConfig) { c.URL = "https://tickets.example.com/api?key={{secret.tickets}}" },
+		"secret in body":         func(c *HTTPToolConfig) { c.Body = `{"key":{{secret.tickets}}}` },
+		"invalid result path":    func(c *HTTPToolConfig) { c.ResultPath = "results[0]" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			change(&cfg)
+			assert.Error(t, cfg.Validate())
+		})
+	}
+}
+
+func TestNewHTTPToolRequest(t *testing.T) {
+	cfg := HTTPToolConfig{
+		Name:    "create_ticket",
+		Method:  "post",
+		URL:     "https://tickets.example.com/api/{{project}}/tickets?assignee={{assignee}}&notify={{notify}}",
+		Headers: map[string]string{"Authorization": "Bearer {{secret.tickets}}", "X-Title": "{{title}}"},
+		Body:    `{"title": {{title}}, "priority": {{priority}}, "missing": {{missing}}}`,
+	}
+	args := map[string]any{
+		"project":  "web app",
+		"assignee": "a&b=c",
+		"notify":   true,
+		"title":    "Fix \"login\"\r\nnow",
+		"priority": 2.0,
+	}
+
+	req, err := newHTTPToolRequest(context.Background(), cfg, args, map[string]string{"tickets": "token"})
+	require.NoError(t, err)
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "https://tickets.example.com/api/web%20app/tickets?assignee=a%26b%3Dc&notify=true", req.URL.String())
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	assert.Equal(t, `Fix "login"now`, req.Header.Get("X-Title"))
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"title":"Fix \"login\"\r\nnow","priority":2,"missing":null}`, string(body))
+
+	_, err = newHTTPToolRequest(context.Background(), cfg, args, nil)
+	assert.ErrorContains(t, err, "tool secret tickets is not configured")
+
+	// Arguments can't move the request out of the path the tool was given
+	for _, project := range []string{"..", "."} {
+		args["project"] = project
+		_, err = newHTTPToolRequest(context.Background(), cfg, args, map[string]string{"tickets": "token"})
+		assert.Error(t, err, project)
+	}
+	args["project"] = "../admin"
+	req, err = newHTTPToolRequest(context.Background(), cfg, args, map[string]string{"tickets": "token"})
+	require.NoError(t, err)
+	assert.Equal(t, "/api/..%2Fadmin/tickets", req.URL.EscapedPath())
+}
+
+func TestExtractJSONPath(t *testing.T) {
+	var document any
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"total": 2,
+		"results": [
+			{"title": "First", "tags": ["a", "b"], "user.name": "ann"},
+			{"title": "Second", "tags": []}
+		],
+		"meta": {"b": 2, "a": 1}
+	}`), &document))
+
+	for path, expected := range map[string]any{
+		"$":                         document,
+		"$.total":                   2.0,
+		"$.results[1].title":        "Second",
+		"$.results[*].title":        []any{"First", "Second"},
+		"$.results[*].tags[0]":      []any{"a"},
+		"$.results[0]['user.name']": "ann",
+		"$.meta.*":                  []any{1.0, 2.0},
+		"$.results[*].missing":      []any{},
+	} {
+		t.Run(path, func(t *testing.T) {
+			value, err := extractJSONPath(document, path)
+			require.NoError(t, err)
+			assert.Equal(t, expected, value)
+		})
+	}
+
+	_, err := extractJSONPath(document, "$.results[5]")
+	assert.ErrorContains(t, err, "didn't match")
+	_, err = extractJSONPath(document, "$.results[")
+	assert.Error(t, err)
+}
+
+func TestExtractToolResult(t *testing.T) {
+	result, err := extractToolResult([]byte(`{"items":[{"id":1},{"id":2}]}`), "$.items[*].id")
+	require.NoError(t, err)
+	assert.Equal(t, "[1,2]", result)
+
+	result, err = extractToolResult([]byte(`plain text`), "")
+	require.NoError(t, err)
+	assert.Equal(t, "plain text", result)
+
+	_, err = extractToolResult([]byte(`plain text`), "$.items")
+	assert.ErrorContains(t, err, "isn't JSON")
+}
+
+func TestTruncateToolResult(t *testing.T) {
+	assert.Equal(t, "short", truncateToolResult("short", 10))
+	assert.Equal(t, "abcde\n[result truncated]", truncateToolResult("abcdefghij", 5))
+	// Multi-byte characters aren't split
+	assert.Equal(t, "ab\n[result truncated]", truncateToolResult("abéd", 3))
+	assert.Len(t, truncateToolResult(strings.Repeat("a", 20_000), 0), defaultHTTPToolResultSize+len("\n[result truncated]"))
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxToolSteps is how many rounds of tool calls a request can make before it is stopped
+	DefaultMaxToolSteps = 10
+	// DefaultToolTokenBudget is how many tokens a request can use across the steps of its tool calls
+	DefaultToolTokenBudget = 500_000
+	// DefaultToolTimeout is how long a single tool call can take
+	DefaultToolTimeout = time.Minute
+)
+
+var (
+	ErrToolTimeout = errors.New("tool call timed out")
+	// ErrToolCallDenied is the error of calls the requesting user didn't approve
+	ErrToolCallDenied = errors.New("the user denied this tool call")
+)
+
+// AgentStepResult is the response to one step of an agent loop
+type AgentStepResult struct {
+	// Calls are the tools the model called, the response is complete when there are none
+	Calls        []ToolCall
+	FinishReason string
+	Usage        TokenUsage
+}
+
+// AgentStep sends the conversation, with the results of the previous step's tool calls, and streams the response.
+// Services keep the conversation between steps in their own format.
+type AgentStep func(ctx context.Context, results []ToolCall) (AgentStepResult, error)
+
+// AgentLoop runs the steps of a response until the model stops calling tools. The tools called in a step run
+// concurrently and the loop stops once the request runs out of steps or tokens, or when a call needs the user's
+// approval.
+type AgentLoop struct {
+	maxSteps    int
+	tokenBudget int64
+	toolTimeout time.Duration
+	llmContext  *Context
+	events      chan<- StreamEvent
+}
+
+// NewAgentLoop creates the loop of a request, the budgets come from the request's config
+func NewAgentLoop(cfg LanguageModelConfig, llmContext *Context, events chan<- StreamEvent) *AgentLoop {
+	loop := &AgentLoop{
+		maxSteps:    DefaultMaxToolSteps,
+		tokenBudget: DefaultToolTokenBudget,
+		toolTimeout: DefaultToolTimeout,
+		llmContext:  llmContext,
+		events:      events,
+	}
+	if cfg.MaxToolSteps > 0 {
+		loop.maxSteps = cfg.MaxToolSteps
+	}
+	if cfg.ToolTokenBudget > 0 {
+		loop.tokenBudget = cfg.ToolTokenBudget
+	}
+	if cfg.ToolTimeout > 0 {
+		loop.toolTimeout = cfg.ToolTimeout
+	}
+	return loop
+}
+
+// Run runs the steps and returns the finish reason of the response, FinishReasonToolBudget when the budget ran
+// out before the model finished and FinishReasonToolApproval when it waits for the user
+func (l *AgentLoop) Run(ctx context.Context, step AgentStep) (string, error) {
+	var results []ToolCall
+	var usedTokens int64
+	for steps := 0; ; steps++ {
+		response, err := step(ctx, results)
+		if err != nil {
+			return "", err
+		}
+		usedTokens += response.Usage.InputTokens + response.Usage.OutputTokens
+
+		if len(response.Calls) == 0 || l.llmContext == nil || l.llmContext.Tools == nil {
+			return response.FinishReason, nil
+		}
+		if steps+1 >= l.maxSteps || usedTokens >= l.tokenBudget {
+			return FinishReasonToolBudget, nil
+		}
+
+		approval := false
+		for i, call := range response.Calls {
+			if l.llmContext.Tools.HasSideEffects(call.Name) {
+				response.Calls[i].RequiresApproval = true
+				approval = true
+			}
+		}
+
+		results = l.resolve(ctx, response.Calls)
+		if approval {
+			l.events <- StreamEvent{Type: EventTypeToolApproval, ToolCalls: results}
+			return FinishReasonToolApproval, nil
+		}
+	}
+}
+
+// resolve runs the calls concurrently and returns them with their results, in the order they were called. Calls
+// that need approval are left unresolved.
+func (l *AgentLoop) resolve(ctx context.Context, calls []ToolCall) []ToolCall {
+	for _, call := range calls {
+		if call.RequiresApproval {
+			continue
+		}
+		started := call
+		l.events <- StreamEvent{Type: EventTypeToolCallStarted, ToolCall: &started}
+	}
+
+	results := slices.Clone(calls)
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		if call.RequiresApproval {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = l.resolveWithTimeout(ctx, call)
+			finished := results[i]
+			l.events <- StreamEvent{Type: EventTypeToolCallFinished, ToolCall: &finished}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// resolveWithTimeout cancels calls that take longer than the timeout. Resolvers stop once their context is
+// cancelled, one that doesn't is left to finish on its own but its result is no longer used.
+func (l *AgentLoop) resolveWithTimeout(ctx context.Context, call ToolCall) ToolCall {
+	ctx, cancel := context.WithTimeoutCause(ctx, l.toolTimeout, fmt.Errorf("%w after %s", ErrToolTimeout, l.toolTimeout))
+	defer cancel()
+
+	done := make(chan ToolCall, 1)
+	go func(resolved ToolCall) {
+		resolved.Result, resolved.Err = l.llmContext.Tools.ResolveTool(ctx, resolved.Name, resolved.ArgumentGetter(), l.llmContext)
+		done <- resolved
+	}(call)
+
+	select {
+	case resolved := <-done:
+		if errors.Is(context.Cause(ctx), ErrToolTimeout) {
+			resolved.Err = context.Cause(ctx)
+		}
+		return resolved
+	case <-ctx.Done():
+		call.Err = context.Cause(ctx)
+	}
+	return call
+}
+
+// ArgumentGetter unmarshals the call's arguments, calls without arguments have an empty object
+func (c ToolCall) ArgumentGetter() ToolArgumentGetter {
+	arguments := c.Arguments
+	if arguments == "" {
+		arguments = "{}"
+	}
+	return func(args any) error {
+		return json.Unmarshal([]byte(arguments), args)
+	}
+}
+
+// ModelResult is the result sent back to the model. Failed calls are reported to the model so it can recover,
+// with the message the tool returned for it if there is one.
+func (c ToolCall) ModelResult() string {
+	if c.Err == nil || c.Result != "" {
+		return c.Result
+	}
+	return "Error: " + c.Err.Error()
+}
+
+func WithMaxToolSteps(steps int) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.MaxToolSteps = steps
+	}
+}
+
+func WithToolTokenBudget(tokens int64) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.ToolTokenBudget = tokens
+	}
+}
+
+func WithToolTimeout(timeout time.Duration) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.ToolTimeout = timeout
+	}
+}
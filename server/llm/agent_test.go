@@ -0,0 +1,258 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// agentTestLoop returns a loop whose tools echo their name, or wait for release when they are called "wait"
+func agentTestLoop(t *testing.T, cfg LanguageModelConfig, release <-chan struct{}) (*AgentLoop, chan StreamEvent) {
+	t.Helper()
+	tools := NewNoTools()
+	for _, name := range []string{"first", "second", "wait"} {
+		tools.AddTools([]Tool{{
+			Name: name,
+			Resolver: func(ctx context.Context, _ *Context, argsGetter ToolArgumentGetter) (string, error) {
+				var args struct{}
+				if err := argsGetter(&args); err != nil {
+					return "", err
+				}
+				if name == "wait" {
+					select {
+					case <-release:
+					case <-ctx.Done():
+						return "", ctx.Err()
+					}
+				}
+				return name + " result", nil
+			},
+		}})
+	}
+	tools.AddTools([]Tool{{
+		Name: "failing",
+		Resolver: func(_ context.Context, _ *Context, _ ToolArgumentGetter) (string, error) {
+			return "", errors.New("boom")
+		},
+	}, {
+		Name:        "act",
+		SideEffects: true,
+		Resolver: func(_ context.Context, _ *Context, _ ToolArgumentGetter) (string, error) {
+			t.Error("tools with side effects must not run without approval")
+			return "", nil
+		},
+	}})
+	llmContext := NewContext()
+	llmContext.Tools = tools
+
+	events := make(chan StreamEvent, 100)
+	return NewAgentLoop(cfg, llmContext, events), events
+}
+
+func TestAgentLoopResolvesCallsInOrder(t *testing.T) {
+	loop, events := agentTestLoop(t, LanguageModelConfig{}, nil)
+
+	var stepResults [][]ToolCall
+	reason, err := loop.Run(context.Background(), func(_ context.Context, results []ToolCall) (AgentStepResult, error) {
+		stepResults = append(stepResults, results)
+		if len(stepResults) == 1 {
+			return AgentStepResult{Calls: []ToolCall{
+				{ID: "1", Name: "first"},
+				{ID: "2", Name: "failing", Arguments: "{}"},
+				{ID: "3", Name: "second"},
+			}}, nil
+		}
+		return AgentStepResult{FinishReason: FinishReasonStop}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, FinishReasonStop, reason)
+
+	require.Len(t, stepResults, 2)
+	assert.Nil(t, stepResults[0])
+	results := stepResults[1]
+	require.Len(t, results, 3)
+	assert.Equal(t, []string{"1", "2", "3"}, []string{results[0].ID, results[1].ID, results[2].ID})
+	assert.Equal(t, "first result", results[0].ModelResult())
+	assert.EqualError(t, results[1].Err, "boom")
+	assert.Equal(t, "Error: boom", results[1].ModelResult())
+	assert.Equal(t, "second result", results[2].ModelResult())
+
+	close(events)
+	var started, finished int
+	for event := range events {
+		switch event.Type {
+		case EventTypeToolCallStarted:
+			started++
+		case EventTypeToolCallFinished:
+			finished++
+		}
+	}
+	assert.Equal(t, 3, started)
+	assert.Equal(t, 3, finished)
+}
+
+func TestAgentLoopRunsCallsConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	loop, events := agentTestLoop(t, LanguageModelConfig{}, release)
+
+	// The first call only finishes once the second has, which can't happen if they run one at a time
+	var once sync.Once
+	go func() {
+		for event := range events {
+			if event.Type == EventTypeToolCallFinished && event.ToolCall.Name == "second" {
+				once.Do(func() { close(release) })
+			}
+		}
+	}()
+
+	var results []ToolCall
+	_, err := loop.Run(context.Background(), func(_ context.Context, previous []ToolCall) (AgentStepResult, error) {
+		if previous != nil {
+			results = previous
+			return AgentStepResult{FinishReason: FinishReasonStop}, nil
+		}
+		return AgentStepResult{Calls: []ToolCall{{Name: "wait"}, {Name: "second"}}}, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "wait result", results[0].Result)
+	assert.Equal(t, "second result", results[1].Result)
+}
+
+func TestAgentLoopToolTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	loop, _ := agentTestLoop(t, LanguageModelConfig{ToolTimeout: 10 * time.Millisecond}, release)
+	stopped := make(chan error, 1)
+	loop.llmContext.Tools.AddTools([]Tool{{
+		Name: "slow",
+		Resolver: func(ctx context.Context, _ *Context, _ ToolArgumentGetter) (string, error) {
+			<-ctx.Done()
+			stopped <- context.Cause(ctx)
+			return "", ctx.Err()
+		},
+	}})
+
+	var results []ToolCall
+	_, err := loop.Run(context.Background(), func(_ context.Context, previous []ToolCall) (AgentStepResult, error) {
+		if previous != nil {
+			results = previous
+			return AgentStepResult{FinishReason: FinishReasonStop}, nil
+		}
+		return AgentStepResult{Calls: []ToolCall{{Name: "slow"}, {Name: "first"}}}, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.ErrorIs(t, results[0].Err, ErrToolTimeout)
+	assert.Contains(t, results[0].ModelResult(), "tool call timed out")
+	assert.Equal(t, "first result", results[1].Result)
+
+	// The call itself was cancelled, not only abandoned
+	select {
+	case err := <-stopped:
+		assert.ErrorIs(t, err, ErrToolTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("the timed out call wasn't cancelled")
+	}
+}
+
+func TestAgentLoopBudgets(t *testing.T) {
+	alwaysCalls := func(usage TokenUsage, steps *int) AgentStep {
+		return func(_ context.Context, _ []ToolCall) (AgentStepResult, error) {
+			*steps++
+			return AgentStepResult{Calls: []ToolCall{{Name: "first"}}, Usage: usage}, nil
+		}
+	}
+
+	t.Run("steps", func(t *testing.T) {
+		loop, _ := agentTestLoop(t, LanguageModelConfig{MaxToolSteps: 3}, nil)
+		var steps int
+		reason, err := loop.Run(context.Background(), alwaysCalls(TokenUsage{}, &steps))
+		require.NoError(t, err)
+		assert.Equal(t, FinishReasonToolBudget, reason)
+		assert.Equal(t, 3, steps)
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		loop, _ := agentTestLoop(t, LanguageModelConfig{ToolTokenBudget: 250}, nil)
+		var steps int
+		reason, err := loop.Run(context.Background(), alwaysCalls(TokenUsage{InputTokens: 80, OutputTokens: 20}, &steps))
+		require.NoError(t, err)
+		assert.Equal(t, FinishReasonToolBudget, reason)
+		assert.Equal(t, 3, steps)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		loop, _ := agentTestLoop(t, LanguageModelConfig{}, nil)
+		var steps int
+		reason, err := loop.Run(context.Background(), alwaysCalls(TokenUsage{}, &steps))
+		require.NoError(t, err)
+		assert.Equal(t, FinishReasonToolBudget, reason)
+		assert.Equal(t, DefaultMaxToolSteps, steps)
+	})
+}
+
+func TestAgentLoopWithoutTools(t *testing.T) {
+	events := make(chan StreamEvent, 10)
+	loop := NewAgentLoop(LanguageModelConfig{}, NewContext(), events)
+
+	steps := 0
+	reason, err := loop.Run(context.Background(), func(_ context.Context, _ []ToolCall) (AgentStepResult, error) {
+		steps++
+		return AgentStepResult{Calls: []ToolCall{{Name: "first"}}, FinishReason: "tool_calls"}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "tool_calls", reason)
+	assert.Equal(t, 1, steps)
+	assert.Empty(t, events)
+}
+
+func TestAgentLoopToolApproval(t *testing.T) {
+	loop, events := agentTestLoop(t, LanguageModelConfig{}, nil)
+
+	steps := 0
+	reason, err := loop.Run(context.Background(), func(_ context.Context, _ []ToolCall) (AgentStepResult, error) {
+		steps++
+		return AgentStepResult{Calls: []ToolCall{{ID: "1", Name: "first"}, {ID: "2", Name: "act", Arguments: `{"issue":"x"}`}}}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, FinishReasonToolApproval, reason)
+	assert.Equal(t, 1, steps)
+
+	close(events)
+	var approval *StreamEvent
+	var started []string
+	for event := range events {
+		switch event.Type {
+		case EventTypeToolCallStarted:
+			started = append(started, event.ToolCall.Name)
+		case EventTypeToolApproval:
+			approval = &event
+		}
+	}
+	// The calls without side effects run, the others wait with the ones that ran
+	assert.Equal(t, []string{"first"}, started)
+	require.NotNil(t, approval)
+	require.Len(t, approval.ToolCalls, 2)
+	assert.Equal(t, "first result", approval.ToolCalls[0].Result)
+	assert.False(t, approval.ToolCalls[0].RequiresApproval)
+	assert.True(t, approval.ToolCalls[1].RequiresApproval)
+	assert.Empty(t, approval.ToolCalls[1].Result)
+	assert.Equal(t, `{"issue":"x"}`, approval.ToolCalls[1].Arguments)
+}
+
+func TestAgentLoopStepError(t *testing.T) {
+	loop, _ := agentTestLoop(t, LanguageModelConfig{}, nil)
+	_, err := loop.Run(context.Background(), func(_ context.Context, _ []ToolCall) (AgentStepResult, error) {
+		return AgentStepResult{}, errors.New("stream failed")
+	})
+	assert.EqualError(t, err, "stream failed")
+}
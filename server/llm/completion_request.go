@@ -4,9 +4,9 @@
 package llm
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"slices"
 	"strings"
 )
 
@@ -28,37 +28,39 @@ type Post struct {
 	Role    PostRole
 	Message string
 	Files   []File
+	// ToolCalls are the tools a bot post called, with their results, for conversations that continue after
+	// the calls like once the user approved them
+	ToolCalls []ToolCall
 }
 
+// Features name the part of the plugin a request is made for, in usage metrics and reports
+const (
+	FeatureDM          = "dm"
+	FeatureMention     = "mention"
+	FeatureSummarize   = "summarize"
+	FeatureMeeting     = "meeting"
+	FeatureReact       = "react"
+	FeatureInterPlugin = "inter_plugin"
+	FeatureSearch      = "search"
+	FeatureRollCall    = "roll_call"
+	FeatureOther       = "other"
+)
+
 type CompletionRequest struct {
 	Posts   []Post
 	Context *Context
+	// Feature is one of the Feature constants, FeatureOther if empty
+	Feature string
+	// ConversationID identifies the conversation, the root post of its thread, so the summary of its history
+	// can be reused. Empty for requests that aren't part of a conversation.
+	ConversationID string
 }
 
+// Truncate fits the request in maxTokens without summarizing the dropped history, see ContextManager
 func (b *CompletionRequest) Truncate(maxTokens int, countTokens func(string) int) bool {
-	oldPosts := b.Posts
-	b.Posts = make([]Post, 0, len(oldPosts))
-	var totalTokens int
-	for i := len(oldPosts) - 1; i >= 0; i-- {
-		post := oldPosts[i]
-		if totalTokens >= maxTokens {
-			slices.Reverse(b.Posts)
-			return true
-		}
-		postTokens := countTokens(post.Message)
-		if (totalTokens + postTokens) > maxTokens {
-			charactersToCut := (postTokens - (maxTokens - totalTokens)) * 4
-			post.Message = strings.TrimSpace(post.Message[charactersToCut:])
-			b.Posts = append(b.Posts, post)
-			slices.Reverse(b.Posts)
-			return true
-		}
-		totalTokens += postTokens
-		b.Posts = append(b.Posts, post)
-	}
-
-	slices.Reverse(b.Posts)
-	return false
+	manager := ContextManager{CountTokens: countTokens}
+	truncated, _ := manager.Fit(context.Background(), b, maxTokens)
+	return truncated
 }
 
 func (b CompletionRequest) String() string {
@@ -3,6 +3,8 @@
 
 package llm
 
+import "fmt"
+
 type ServiceConfig struct {
 	Name         string `json:"name"`
 	Type         string `json:"type"`
@@ -18,6 +20,14 @@ type ServiceConfig struct {
 
 	// Otherwise known as maxTokens
 	OutputTokenLimit int `json:"outputTokenLimit"`
+
+	// Retries of requests that fail before any output is streamed, 0 uses the default and a negative value disables them
+	MaxRetries int `json:"maxRetries"`
+	// Delay before the first retry, doubled for each following one
+	RetryBackoffMilliseconds int `json:"retryBackoffMilliseconds"`
+
+	// How long Ollama keeps the model loaded after a request, a duration such as 10m or a number of seconds
+	KeepAlive string `json:"keepAlive"`
 }
 
 type ChannelAccessLevel int
@@ -43,6 +53,8 @@ const (
 	ServiceTypeOpenAICompatible = "openaicompatible"
 	ServiceTypeAzure            = "azure"
 	ServiceTypeAnthropic        = "anthropic"
+	ServiceTypeOllama           = "ollama"
+	ServiceTypeGemini           = "gemini"
 )
 
 type BotConfig struct {
@@ -59,6 +71,14 @@ type BotConfig struct {
 	UserIDs            []string           `json:"userIDs"`
 	TeamIDs            []string           `json:"teamIDs"`
 	MaxFileSize        int64              `json:"maxFileSize"`
+	ModelParameters    ModelParameters    `json:"modelParameters"`
+	// ShowReasoning shares the reasoning of thinking models with users, otherwise it is discarded
+	ShowReasoning bool `json:"showReasoning"`
+	// ToolPolicy limits the bot's tools by channel type and by user and team
+	ToolPolicy ToolPolicy `json:"toolPolicy"`
+
+	// Services tried in order when the primary service is unavailable
+	FallbackServices []ServiceConfig `json:"fallbackServices"`
 }
 
 func (c *BotConfig) IsValid() bool {
@@ -75,16 +95,50 @@ func (c *BotConfig) IsValid() bool {
 		return false
 	}
 
-	// Service-specific validation
-	switch c.Service.Type {
+	if !c.Service.IsValid() {
+		return false
+	}
+	for _, fallback := range c.FallbackServices {
+		if !fallback.IsValid() {
+			return false
+		}
+	}
+
+	if c.ToolPolicy.Validate() != nil {
+		return false
+	}
+
+	return c.ValidateModelParameters() == nil
+}
+
+// ValidateModelParameters checks the model parameters against the bot's service and its fallbacks
+func (c *BotConfig) ValidateModelParameters() error {
+	if err := c.ModelParameters.Validate(c.Service.Type); err != nil {
+		return fmt.Errorf("invalid model parameters for %s: %w", c.Service.Type, err)
+	}
+	for _, fallback := range c.FallbackServices {
+		if err := c.ModelParameters.Validate(fallback.Type); err != nil {
+			return fmt.Errorf("invalid model parameters for fallback %s: %w", fallback.Type, err)
+		}
+	}
+	return nil
+}
+
+// IsValid checks the fields required by the service type are set
+func (c *ServiceConfig) IsValid() bool {
+	switch c.Type {
 	case ServiceTypeOpenAI:
-		return c.Service.APIKey != ""
+		return c.APIKey != ""
 	case ServiceTypeOpenAICompatible:
-		return c.Service.APIURL != ""
+		return c.APIURL != ""
 	case ServiceTypeAzure:
-		return c.Service.APIKey != "" && c.Service.APIURL != ""
+		return c.APIKey != "" && c.APIURL != ""
 	case ServiceTypeAnthropic:
-		return c.Service.APIKey != ""
+		return c.APIKey != ""
+	case ServiceTypeOllama:
+		return c.APIURL != ""
+	case ServiceTypeGemini:
+		return c.APIKey != ""
 	default:
 		return false
 	}
@@ -24,6 +24,8 @@ func TestBotConfig_IsValid(t *testing.T) {
 		UserIDs            []string
 		TeamIDs            []string
 		MaxFileSize        int64
+		FallbackServices   []ServiceConfig
+		ModelParameters    ModelParameters
 	}
 	tests := []struct {
 		name   string
@@ -263,6 +265,134 @@ func TestBotConfig_IsValid(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "Ollama service requires API URL to be set",
+			fields: fields{
+				ID:          "xxx",
+				Name:        "xxx",
+				DisplayName: "xxx",
+				Service: ServiceConfig{
+					Name:         "Local",
+					Type:         "ollama",
+					APIURL:       "", // bad
+					DefaultModel: "llama3.2",
+				},
+				ChannelAccessLevel: ChannelAccessLevelAll,
+				UserAccessLevel:    UserAccessLevelAll,
+			},
+			want: false,
+		},
+		{
+			name: "Ollama service does not require an API Key",
+			fields: fields{
+				ID:          "xxx",
+				Name:        "xxx",
+				DisplayName: "xxx",
+				Service: ServiceConfig{
+					Name:         "Local",
+					Type:         "ollama",
+					APIURL:       "http://localhost:11434",
+					DefaultModel: "llama3.2",
+				},
+				ChannelAccessLevel: ChannelAccessLevelAll,
+				UserAccessLevel:    UserAccessLevelAll,
+			},
+			want: true,
+		},
+		{
+			name: "Gemini service requires API Key to be set",
+			fields: fields{
+				ID:          "xxx",
+				Name:        "xxx",
+				DisplayName: "xxx",
+				Service: ServiceConfig{
+					Name:         "Gemini",
+					Type:         "gemini",
+					APIKey:       "", // bad
+					DefaultModel: "gemini-2.0-flash",
+				},
+				ChannelAccessLevel: ChannelAccessLevelAll,
+				UserAccessLevel:    UserAccessLevelAll,
+			},
+			want: false,
+		},
+		{
+			name: "Valid Gemini configuration",
+			fields: fields{
+				ID:          "xxx",
+				Name:        "xxx",
+				DisplayName: "xxx",
+				Service: ServiceConfig{
+					Name:         "Gemini",
+					Type:         "gemini",
+					APIKey:       "key",
+					DefaultModel: "gemini-2.0-flash",
+				},
+				ChannelAccessLevel: ChannelAccessLevelAll,
+				UserAccessLevel:    UserAccessLevelAll,
+			},
+			want: true,
+		},
+		{
+			name: "Fallback services are validated",
+			fields: fields{
+				ID:          "xxx",
+				Name:        "xxx",
+				DisplayName: "xxx",
+				Service: ServiceConfig{
+					Name:   "OpenAI",
+					Type:   "openai",
+					APIKey: "key",
+				},
+				FallbackServices: []ServiceConfig{
+					{Name: "Anthropic", Type: "anthropic", APIKey: "key"},
+					{Name: "Ollama", Type: "ollama", APIURL: ""}, // bad
+				},
+				ChannelAccessLevel: ChannelAccessLevelAll,
+				UserAccessLevel:    UserAccessLevelAll,
+			},
+			want: false,
+		},
+		{
+			name: "Valid configuration with fallback services",
+			fields: fields{
+				ID:          "xxx",
+				Name:        "xxx",
+				DisplayName: "xxx",
+				Service: ServiceConfig{
+					Name:   "OpenAI",
+					Type:   "openai",
+					APIKey: "key",
+				},
+				FallbackServices: []ServiceConfig{
+					{Name: "Anthropic", Type: "anthropic", APIKey: "key"},
+					{Name: "Ollama", Type: "ollama", APIURL: "http://localhost:11434"},
+				},
+				ChannelAccessLevel: ChannelAccessLevelAll,
+				UserAccessLevel:    UserAccessLevelAll,
+			},
+			want: true,
+		},
+		{
+			name: "Model parameters valid for the service but not its fallback",
+			fields: fields{
+				ID:          "xxx",
+				Name:        "xxx",
+				DisplayName: "xxx",
+				Service: ServiceConfig{
+					Type:   ServiceTypeOpenAI,
+					APIKey: "sk-xyz",
+				},
+				FallbackServices: []ServiceConfig{{
+					Type:   ServiceTypeAnthropic,
+					APIKey: "sk-ant",
+				}},
+				ChannelAccessLevel: ChannelAccessLevelAll,
+				UserAccessLevel:    UserAccessLevelAll,
+				ModelParameters:    ModelParameters{Temperature: ptr(float32(1.5))},
+			},
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -280,6 +410,8 @@ func TestBotConfig_IsValid(t *testing.T) {
 				UserIDs:            tt.fields.UserIDs,
 				TeamIDs:            tt.fields.TeamIDs,
 				MaxFileSize:        tt.fields.MaxFileSize,
+				FallbackServices:   tt.fields.FallbackServices,
+				ModelParameters:    tt.fields.ModelParameters,
 			}
 			assert.Equalf(t, tt.want, c.IsValid(), "IsValid() for test case %q", tt.name)
 		})
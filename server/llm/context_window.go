@@ -0,0 +1,306 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SummaryTokenBudget is the room kept for the summary of the dropped history
+const SummaryTokenBudget = 500
+
+// HistorySummarizer extends the summary of a conversation's earlier history, which may be empty, with posts
+type HistorySummarizer func(ctx context.Context, previous string, posts []Post) (string, error)
+
+// HistorySummary is the running summary of the oldest posts of a conversation
+type HistorySummary struct {
+	Summary string
+	// Posts is how many posts of the conversation's history the summary covers
+	Posts int
+	// Hash identifies the covered posts so the summary isn't reused once the history changes
+	Hash string
+}
+
+// HistorySummaryCache keeps the running summaries by conversation
+type HistorySummaryCache interface {
+	GetHistorySummary(conversationID string) (*HistorySummary, error)
+	SaveHistorySummary(conversationID string, summary HistorySummary) error
+}
+
+// ContextManager fits requests into the context window of a model. System posts and the latest user turn are
+// always kept, the history in between is dropped oldest first and replaced by a summary when a Summarizer is set.
+// Posts are only ever cut at sentence or rune boundaries.
+type ContextManager struct {
+	CountTokens func(string) int
+	// Summarizer and Cache are optional, without a Cache the summary is made again for every request
+	Summarizer HistorySummarizer
+	Cache      HistorySummaryCache
+}
+
+// Fit changes the request so it fits in maxTokens and reports whether anything was dropped or cut. The request
+// always fits when Fit returns, an error only means the dropped history couldn't be summarized.
+func (m *ContextManager) Fit(ctx context.Context, request *CompletionRequest, maxTokens int) (bool, error) {
+	tokens := make([]int, len(request.Posts))
+	total := 0
+	for i, post := range request.Posts {
+		tokens[i] = m.CountTokens(post.Message)
+		total += tokens[i]
+	}
+	if total <= maxTokens {
+		return false, nil
+	}
+
+	// The latest user turn starts at the last user post and includes everything after it
+	turnStart := len(request.Posts)
+	for i := len(request.Posts) - 1; i >= 0; i-- {
+		if request.Posts[i].Role == PostRoleUser {
+			turnStart = i
+			break
+		}
+	}
+
+	var pinned, history []int
+	pinnedTokens := 0
+	for i, post := range request.Posts {
+		if post.Role == PostRoleSystem || i >= turnStart {
+			pinned = append(pinned, i)
+			pinnedTokens += tokens[i]
+		} else {
+			history = append(history, i)
+		}
+	}
+
+	if pinnedTokens > maxTokens {
+		pinnedTokens = m.cutPinned(request, pinned, tokens, maxTokens)
+	}
+	available := maxTokens - pinnedTokens
+
+	historyTokens := 0
+	for _, i := range history {
+		historyTokens += tokens[i]
+	}
+	budget := available
+	if historyTokens > available && m.Summarizer != nil {
+		budget = max(available-SummaryTokenBudget, 0)
+	}
+
+	// Keep the newest history that fits
+	firstKept := len(history)
+	keptTokens := 0
+	for firstKept > 0 && keptTokens+tokens[history[firstKept-1]] <= budget {
+		firstKept--
+		keptTokens += tokens[history[firstKept]]
+	}
+	dropped := make([]Post, 0, firstKept)
+	for _, i := range history[:firstKept] {
+		dropped = append(dropped, request.Posts[i])
+	}
+
+	var summary string
+	var summaryErr error
+	if len(dropped) > 0 && m.Summarizer != nil && available > keptTokens {
+		summary, summaryErr = m.summarize(ctx, request.ConversationID, dropped)
+		if summary != "" {
+			summary = cutToTokens("Summary of the earlier conversation:\n"+summary, available-keptTokens, m.CountTokens, false)
+		}
+	}
+
+	droppedIndexes := make(map[int]bool, firstKept)
+	for _, i := range history[:firstKept] {
+		droppedIndexes[i] = true
+	}
+	posts := make([]Post, 0, len(request.Posts)-len(dropped)+1)
+	for i, post := range request.Posts {
+		if droppedIndexes[i] {
+			continue
+		}
+		// The summary takes the place of the history it covers, after the system posts that lead the conversation
+		if summary != "" && post.Role != PostRoleSystem {
+			posts = append(posts, Post{Role: PostRoleSystem, Message: summary})
+			summary = ""
+		}
+		posts = append(posts, post)
+	}
+	if summary != "" {
+		posts = append(posts, Post{Role: PostRoleSystem, Message: summary})
+	}
+	request.Posts = posts
+
+	return true, summaryErr
+}
+
+// cutPinned cuts the largest pinned posts until they fit. System posts keep their beginning, the instructions
+// usually come first, while other posts keep their end where the question usually is.
+func (m *ContextManager) cutPinned(request *CompletionRequest, pinned []int, tokens []int, maxTokens int) int {
+	total := 0
+	for _, i := range pinned {
+		total += tokens[i]
+	}
+	for total > maxTokens {
+		largest := pinned[0]
+		for _, i := range pinned {
+			if tokens[i] > tokens[largest] {
+				largest = i
+			}
+		}
+
+		post := &request.Posts[largest]
+		target := max(tokens[largest]-(total-maxTokens), 0)
+		post.Message = cutToTokens(post.Message, target, m.CountTokens, post.Role != PostRoleSystem)
+		cut := m.CountTokens(post.Message)
+		if cut >= tokens[largest] {
+			// Nothing could be cut, give up rather than loop
+			return total
+		}
+		total -= tokens[largest] - cut
+		tokens[largest] = cut
+	}
+	return total
+}
+
+// summarize returns the summary of the dropped posts, extending the cached summary of the conversation if it
+// covers the oldest of them
+func (m *ContextManager) summarize(ctx context.Context, conversationID string, dropped []Post) (string, error) {
+	var previous *HistorySummary
+	if m.Cache != nil && conversationID != "" {
+		cached, err := m.Cache.GetHistorySummary(conversationID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get history summary: %w", err)
+		}
+		if cached != nil && cached.Posts <= len(dropped) && cached.Hash == hashPosts(dropped[:cached.Posts]) {
+			previous = cached
+		}
+	}
+
+	covered := 0
+	previousSummary := ""
+	if previous != nil {
+		covered, previousSummary = previous.Posts, previous.Summary
+	}
+	if covered == len(dropped) {
+		return previousSummary, nil
+	}
+
+	summary, err := m.Summarizer(ctx, previousSummary, dropped[covered:])
+	if err != nil {
+		return previousSummary, fmt.Errorf("failed to summarize history: %w", err)
+	}
+	summary = strings.TrimSpace(summary)
+
+	if m.Cache != nil && conversationID != "" {
+		if err := m.Cache.SaveHistorySummary(conversationID, HistorySummary{
+			Summary: summary,
+			Posts:   len(dropped),
+			Hash:    hashPosts(dropped),
+		}); err != nil {
+			return summary, fmt.Errorf("failed to save history summary: %w", err)
+		}
+	}
+
+	return summary, nil
+}
+
+func hashPosts(posts []Post) string {
+	hash := sha256.New()
+	for _, post := range posts {
+		fmt.Fprintf(hash, "%d:%d:%s", post.Role, len(post.Message), post.Message)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// cutToTokens shortens text to at most maxTokens, keeping its end if keepEnd is set and its beginning otherwise.
+// Whole sentences are kept when possible, otherwise the text is cut between runes.
+func cutToTokens(text string, maxTokens int, countTokens func(string) int, keepEnd bool) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	if countTokens(text) <= maxTokens {
+		return text
+	}
+
+	fits := func(start, end int) bool {
+		return countTokens(strings.TrimSpace(text[start:end])) <= maxTokens
+	}
+
+	// Offsets between sentences, including both ends of the text
+	boundaries := sentenceBoundaries(text)
+	if keepEnd {
+		// The earliest boundary the rest of the text fits from
+		i := searchFirst(len(boundaries), func(i int) bool { return fits(boundaries[i], len(text)) })
+		if i < len(boundaries)-1 {
+			return strings.TrimSpace(text[boundaries[i]:])
+		}
+		// Not even the last sentence fits
+		last := text[boundaries[len(boundaries)-2]:]
+		runes := runeOffsets(last)
+		j := searchFirst(len(runes), func(j int) bool { return countTokens(strings.TrimSpace(last[runes[j]:])) <= maxTokens })
+		return strings.TrimSpace(last[runes[j]:])
+	}
+
+	// The latest boundary the text fits up to
+	i := searchFirst(len(boundaries), func(i int) bool { return fits(0, boundaries[len(boundaries)-1-i]) })
+	if end := boundaries[len(boundaries)-1-i]; end > 0 {
+		return strings.TrimSpace(text[:end])
+	}
+	// Not even the first sentence fits
+	first := text[:boundaries[1]]
+	runes := runeOffsets(first)
+	j := searchFirst(len(runes), func(j int) bool { return countTokens(strings.TrimSpace(first[:runes[len(runes)-1-j]])) <= maxTokens })
+	return strings.TrimSpace(first[:runes[len(runes)-1-j]])
+}
+
+// searchFirst returns the smallest i in [0, n) for which f is true, assuming f is false and then true, or n-1
+func searchFirst(n int, f func(int) bool) int {
+	low, high := 0, n-1
+	for low < high {
+		mid := (low + high) / 2
+		if f(mid) {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	return low
+}
+
+// sentenceBoundaries returns the offsets where sentences start, preceded by 0 and followed by len(text)
+func sentenceBoundaries(text string) []int {
+	boundaries := []int{0}
+	var previous rune
+	for offset, r := range text {
+		if offset > 0 && !unicode.IsSpace(r) && (previous == '\n' || (unicode.IsSpace(previous) && endsSentence(text[:offset]))) {
+			boundaries = append(boundaries, offset)
+		} else if offset > 0 && isFullWidthStop(previous) && !unicode.IsSpace(r) {
+			boundaries = append(boundaries, offset)
+		}
+		previous = r
+	}
+	return append(boundaries, len(text))
+}
+
+// endsSentence reports whether text, which ends in whitespace, ends a sentence
+func endsSentence(text string) bool {
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	last, _ := utf8.DecodeLastRuneInString(trimmed)
+	return last == '.' || last == '!' || last == '?' || isFullWidthStop(last)
+}
+
+func isFullWidthStop(r rune) bool {
+	return r == '。' || r == '！' || r == '？'
+}
+
+// runeOffsets returns the offsets of the runes in text followed by len(text)
+func runeOffsets(text string) []int {
+	offsets := make([]int, 0, len(text)+1)
+	for offset := range text {
+		offsets = append(offsets, offset)
+	}
+	return append(offsets, len(text))
+}
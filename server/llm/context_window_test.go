@@ -0,0 +1,174 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countRunes counts one token per rune
+func countRunes(text string) int {
+	return utf8.RuneCountInString(text)
+}
+
+type memoryHistorySummaryCache struct {
+	summaries map[string]HistorySummary
+}
+
+func (c *memoryHistorySummaryCache) GetHistorySummary(conversationID string) (*HistorySummary, error) {
+	summary, ok := c.summaries[conversationID]
+	if !ok {
+		return nil, nil
+	}
+	return &summary, nil
+}
+
+func (c *memoryHistorySummaryCache) SaveHistorySummary(conversationID string, summary HistorySummary) error {
+	c.summaries[conversationID] = summary
+	return nil
+}
+
+func conversation(turns int) []Post {
+	posts := []Post{{Role: PostRoleSystem, Message: "Be helpful."}}
+	for i := range turns {
+		posts = append(posts,
+			Post{Role: PostRoleUser, Message: strings.Repeat("q", 20) + string(rune('a'+i))},
+			Post{Role: PostRoleBot, Message: strings.Repeat("a", 20) + string(rune('a'+i))},
+		)
+	}
+	return append(posts, Post{Role: PostRoleUser, Message: "Latest question?"})
+}
+
+func TestContextManagerPinsSystemAndLatestTurn(t *testing.T) {
+	request := CompletionRequest{Posts: conversation(3)}
+	manager := ContextManager{CountTokens: countRunes}
+
+	truncated, err := manager.Fit(context.Background(), &request, 11+16+42)
+	require.NoError(t, err)
+	assert.True(t, truncated)
+
+	// Only the newest exchange of the history fits between the pinned posts
+	require.Len(t, request.Posts, 4)
+	assert.Equal(t, "Be helpful.", request.Posts[0].Message)
+	assert.Equal(t, strings.Repeat("q", 20)+"c", request.Posts[1].Message)
+	assert.Equal(t, strings.Repeat("a", 20)+"c", request.Posts[2].Message)
+	assert.Equal(t, "Latest question?", request.Posts[3].Message)
+}
+
+func TestContextManagerSummarizesDroppedHistory(t *testing.T) {
+	var summarized [][]Post
+	var previousSummaries []string
+	manager := ContextManager{
+		CountTokens: func(text string) int {
+			// The summary is small enough to fit whatever the budget
+			if strings.HasPrefix(text, "Summary of the earlier conversation:") {
+				return 1
+			}
+			return countRunes(text)
+		},
+		Summarizer: func(_ context.Context, previous string, posts []Post) (string, error) {
+			summarized = append(summarized, posts)
+			previousSummaries = append(previousSummaries, previous)
+			return previous + "+" + posts[len(posts)-1].Message[20:], nil
+		},
+		Cache: &memoryHistorySummaryCache{summaries: map[string]HistorySummary{}},
+	}
+
+	request := CompletionRequest{Posts: conversation(2), ConversationID: "thread1"}
+	_, err := manager.Fit(context.Background(), &request, 11+16+10)
+	require.NoError(t, err)
+	require.Len(t, request.Posts, 3)
+	assert.Equal(t, PostRoleSystem, request.Posts[1].Role)
+	assert.Equal(t, "Summary of the earlier conversation:\n+b", request.Posts[1].Message)
+	require.Len(t, summarized, 1)
+	assert.Len(t, summarized[0], 4)
+
+	// The same history is summarized from the cache
+	request = CompletionRequest{Posts: conversation(2), ConversationID: "thread1"}
+	_, err = manager.Fit(context.Background(), &request, 11+16+10)
+	require.NoError(t, err)
+	assert.Equal(t, "Summary of the earlier conversation:\n+b", request.Posts[1].Message)
+	assert.Len(t, summarized, 1)
+
+	// A longer conversation only summarizes the posts the summary doesn't cover yet
+	request = CompletionRequest{Posts: conversation(3), ConversationID: "thread1"}
+	_, err = manager.Fit(context.Background(), &request, 11+16+10)
+	require.NoError(t, err)
+	assert.Equal(t, "Summary of the earlier conversation:\n+b+c", request.Posts[1].Message)
+	require.Len(t, summarized, 2)
+	assert.Len(t, summarized[1], 2)
+	assert.Equal(t, "+b", previousSummaries[1])
+}
+
+func TestContextManagerSummaryFailure(t *testing.T) {
+	manager := ContextManager{
+		CountTokens: countRunes,
+		Summarizer: func(context.Context, string, []Post) (string, error) {
+			return "", errors.New("service unavailable")
+		},
+	}
+
+	request := CompletionRequest{Posts: conversation(2)}
+	truncated, err := manager.Fit(context.Background(), &request, 11+16+5)
+	assert.ErrorContains(t, err, "service unavailable")
+	assert.True(t, truncated)
+
+	// The history is still dropped
+	require.Len(t, request.Posts, 2)
+	assert.Equal(t, "Be helpful.", request.Posts[0].Message)
+	assert.Equal(t, "Latest question?", request.Posts[1].Message)
+}
+
+func TestContextManagerCutsPinnedPosts(t *testing.T) {
+	t.Run("user posts keep their end", func(t *testing.T) {
+		request := CompletionRequest{Posts: []Post{
+			{Role: PostRoleSystem, Message: "Be helpful."},
+			{Role: PostRoleUser, Message: "Here is a long document. It goes on and on. What does it say?"},
+		}}
+		manager := ContextManager{CountTokens: countRunes}
+
+		_, err := manager.Fit(context.Background(), &request, 11+20)
+		require.NoError(t, err)
+		assert.Equal(t, "Be helpful.", request.Posts[0].Message)
+		assert.Equal(t, "What does it say?", request.Posts[1].Message)
+	})
+
+	t.Run("system posts keep their beginning", func(t *testing.T) {
+		request := CompletionRequest{Posts: []Post{
+			{Role: PostRoleSystem, Message: "Answer briefly. Here is a lot of context that follows the instructions."},
+			{Role: PostRoleUser, Message: "Hi"},
+		}}
+		manager := ContextManager{CountTokens: countRunes}
+
+		_, err := manager.Fit(context.Background(), &request, 20)
+		require.NoError(t, err)
+		assert.Equal(t, "Answer briefly.", request.Posts[0].Message)
+		assert.Equal(t, "Hi", request.Posts[1].Message)
+	})
+}
+
+func TestCutToTokensIsRuneSafe(t *testing.T) {
+	vietnamese := "Xin chào các bạn. Hôm nay trời đẹp quá. Chúng ta đi dạo nhé?"
+
+	// One token per byte cuts between multi-byte runes unless the cut is rune aware
+	countBytes := func(text string) int { return len(text) }
+	for maxTokens := 1; maxTokens < len(vietnamese); maxTokens++ {
+		for _, keepEnd := range []bool{true, false} {
+			cut := cutToTokens(vietnamese, maxTokens, countBytes, keepEnd)
+			assert.True(t, utf8.ValidString(cut), "%d %v: %q", maxTokens, keepEnd, cut)
+			assert.LessOrEqual(t, len(cut), maxTokens)
+		}
+	}
+
+	assert.Equal(t, "Chúng ta đi dạo nhé?", cutToTokens(vietnamese, 25, countBytes, true))
+	assert.Equal(t, "Xin chào các bạn.", cutToTokens(vietnamese, 25, countBytes, false))
+	assert.Equal(t, "天气很好。", cutToTokens("你好。天气很好。", 5, countRunes, true))
+}
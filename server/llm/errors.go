@@ -0,0 +1,22 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"fmt"
+	"time"
+)
+
+// APIError is an error response from an upstream LLM API
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the server asked clients to wait before trying again, if it did
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.Provider, e.StatusCode, e.Message)
+}
@@ -3,9 +3,18 @@
 
 package llm
 
+import (
+	"context"
+	"time"
+
+	"github.com/invopop/jsonschema"
+)
+
+// LanguageModel is implemented by the services and the wrappers around them. Cancelling the context aborts
+// the request upstream, including a stream that is still being read.
 type LanguageModel interface {
-	ChatCompletion(conversation CompletionRequest, opts ...LanguageModelOption) (*TextStreamResult, error)
-	ChatCompletionNoStream(conversation CompletionRequest, opts ...LanguageModelOption) (string, error)
+	ChatCompletion(ctx context.Context, conversation CompletionRequest, opts ...LanguageModelOption) (*TextStreamResult, error)
+	ChatCompletionNoStream(ctx context.Context, conversation CompletionRequest, opts ...LanguageModelOption) (string, error)
 
 	CountTokens(text string) int
 	InputTokenLimit() int
@@ -15,6 +24,22 @@ type LanguageModelConfig struct {
 	Model              string
 	MaxGeneratedTokens int
 	EnableVision       bool
+	UsageCallback      func(TokenUsage)
+	// JSONSchema is set with WithJSONSchema, the response must then be a JSON document following it
+	JSONSchema *jsonschema.Schema
+
+	// Sampling and reasoning parameters, see ModelParameters. Services ignore the ones the model doesn't support.
+	Temperature     *float32
+	TopP            *float32
+	StopSequences   []string
+	Seed            *int
+	ReasoningEffort string
+	ThinkingBudget  int
+
+	// Budgets of the agent loop resolving tool calls, the defaults are used when unset
+	MaxToolSteps    int
+	ToolTokenBudget int64
+	ToolTimeout     time.Duration
 }
 
 type LanguageModelOption func(*LanguageModelConfig)
@@ -0,0 +1,162 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	ReasoningEffortLow    = "low"
+	ReasoningEffortMedium = "medium"
+	ReasoningEffortHigh   = "high"
+)
+
+// MinAnthropicThinkingBudget is the smallest budget Anthropic accepts for extended thinking
+const MinAnthropicThinkingBudget = 1024
+
+// SummaryTemperature is pinned by the summarization features, which should stay close to the content
+const SummaryTemperature = 0.2
+
+// reasoningEffortBudgets maps reasoning efforts to thinking budgets for the services that take a budget
+var reasoningEffortBudgets = map[string]int{
+	ReasoningEffortLow:    1024,
+	ReasoningEffortMedium: 8192,
+	ReasoningEffortHigh:   24576,
+}
+
+// ModelParameters are the sampling and reasoning parameters of a bot. Unset parameters are left to the
+// service's defaults.
+type ModelParameters struct {
+	Temperature   *float32 `json:"temperature,omitempty"`
+	TopP          *float32 `json:"topP,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+	Seed          *int     `json:"seed,omitempty"`
+	// ReasoningEffort is one of the ReasoningEffort constants, services that take a thinking budget get the
+	// budget matching it
+	ReasoningEffort string `json:"reasoningEffort,omitempty"`
+	// ThinkingBudget is the tokens Anthropic and Gemini models can use for thinking before they respond
+	ThinkingBudget int `json:"thinkingBudget,omitempty"`
+}
+
+// Options returns the options that apply the parameters to a request
+func (m ModelParameters) Options() []LanguageModelOption {
+	var opts []LanguageModelOption
+	if m.Temperature != nil {
+		opts = append(opts, WithTemperature(*m.Temperature))
+	}
+	if m.TopP != nil {
+		opts = append(opts, WithTopP(*m.TopP))
+	}
+	if len(m.StopSequences) > 0 {
+		opts = append(opts, WithStopSequences(m.StopSequences...))
+	}
+	if m.Seed != nil {
+		opts = append(opts, WithSeed(*m.Seed))
+	}
+	if m.ReasoningEffort != "" {
+		opts = append(opts, WithReasoningEffort(m.ReasoningEffort))
+	}
+	if m.ThinkingBudget != 0 {
+		opts = append(opts, WithThinkingBudget(m.ThinkingBudget))
+	}
+	return opts
+}
+
+// Validate checks the parameters are supported by the service type and within its ranges
+func (m ModelParameters) Validate(serviceType string) error {
+	maxTemperature := float32(2)
+	maxStopSequences := 0
+	supportsSeed, supportsThinkingBudget := true, false
+	switch serviceType {
+	case ServiceTypeOpenAI, ServiceTypeOpenAICompatible, ServiceTypeAzure:
+		maxStopSequences = 4
+	case ServiceTypeAnthropic:
+		maxTemperature = 1
+		supportsSeed, supportsThinkingBudget = false, true
+	case ServiceTypeGemini:
+		maxStopSequences = 5
+		supportsThinkingBudget = true
+	}
+
+	if m.Temperature != nil && (*m.Temperature < 0 || *m.Temperature > maxTemperature) {
+		return fmt.Errorf("temperature must be between 0 and %g", maxTemperature)
+	}
+	if m.TopP != nil && (*m.TopP < 0 || *m.TopP > 1) {
+		return errors.New("top p must be between 0 and 1")
+	}
+	if maxStopSequences > 0 && len(m.StopSequences) > maxStopSequences {
+		return fmt.Errorf("at most %d stop sequences are supported", maxStopSequences)
+	}
+	if m.Seed != nil && !supportsSeed {
+		return errors.New("seed is not supported")
+	}
+	if m.ReasoningEffort != "" && !slices.Contains([]string{ReasoningEffortLow, ReasoningEffortMedium, ReasoningEffortHigh}, m.ReasoningEffort) {
+		return errors.New("reasoning effort must be low, medium or high")
+	}
+	if m.ThinkingBudget != 0 {
+		if !supportsThinkingBudget {
+			return errors.New("thinking budget is not supported, use reasoning effort")
+		}
+		if m.ThinkingBudget < 0 {
+			return errors.New("thinking budget must be positive")
+		}
+	}
+	if serviceType == ServiceTypeAnthropic && (m.ThinkingBudget != 0 || m.ReasoningEffort != "") {
+		if m.ThinkingBudget != 0 && m.ThinkingBudget < MinAnthropicThinkingBudget {
+			return fmt.Errorf("thinking budget must be at least %d", MinAnthropicThinkingBudget)
+		}
+		if m.Temperature != nil || m.TopP != nil {
+			return errors.New("temperature and top p can't be changed with extended thinking")
+		}
+	}
+	return nil
+}
+
+// ThinkingBudgetTokens returns the thinking budget of a request, from its reasoning effort if it has no budget,
+// 0 when the model shouldn't think
+func (c LanguageModelConfig) ThinkingBudgetTokens() int {
+	if c.ThinkingBudget > 0 {
+		return c.ThinkingBudget
+	}
+	return reasoningEffortBudgets[c.ReasoningEffort]
+}
+
+func WithTemperature(temperature float32) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.Temperature = &temperature
+	}
+}
+
+func WithTopP(topP float32) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.TopP = &topP
+	}
+}
+
+func WithStopSequences(stop ...string) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.StopSequences = stop
+	}
+}
+
+func WithSeed(seed int) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.Seed = &seed
+	}
+}
+
+func WithReasoningEffort(effort string) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.ReasoningEffort = effort
+	}
+}
+
+func WithThinkingBudget(tokens int) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.ThinkingBudget = tokens
+	}
+}
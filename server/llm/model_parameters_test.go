@@ -0,0 +1,64 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestModelParametersValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		serviceType string
+		parameters  ModelParameters
+		wantErr     string
+	}{
+		{name: "empty", serviceType: ServiceTypeOpenAI},
+		{
+			name:        "sampling within range",
+			serviceType: ServiceTypeOpenAI,
+			parameters:  ModelParameters{Temperature: ptr(float32(1.5)), TopP: ptr(float32(0.9)), StopSequences: []string{"a", "b"}, Seed: ptr(1)},
+		},
+		{name: "temperature above range", serviceType: ServiceTypeOpenAI, parameters: ModelParameters{Temperature: ptr(float32(2.5))}, wantErr: "temperature must be between 0 and 2"},
+		{name: "anthropic temperature range", serviceType: ServiceTypeAnthropic, parameters: ModelParameters{Temperature: ptr(float32(1.5))}, wantErr: "temperature must be between 0 and 1"},
+		{name: "negative top p", serviceType: ServiceTypeGemini, parameters: ModelParameters{TopP: ptr(float32(-0.1))}, wantErr: "top p must be between 0 and 1"},
+		{name: "too many stop sequences", serviceType: ServiceTypeAzure, parameters: ModelParameters{StopSequences: []string{"a", "b", "c", "d", "e"}}, wantErr: "at most 4 stop sequences"},
+		{name: "ollama takes any stop sequences", serviceType: ServiceTypeOllama, parameters: ModelParameters{StopSequences: []string{"a", "b", "c", "d", "e", "f"}}},
+		{name: "anthropic has no seed", serviceType: ServiceTypeAnthropic, parameters: ModelParameters{Seed: ptr(1)}, wantErr: "seed is not supported"},
+		{name: "unknown effort", serviceType: ServiceTypeOpenAI, parameters: ModelParameters{ReasoningEffort: "max"}, wantErr: "reasoning effort must be low, medium or high"},
+		{name: "openai has no thinking budget", serviceType: ServiceTypeOpenAI, parameters: ModelParameters{ThinkingBudget: 2048}, wantErr: "thinking budget is not supported"},
+		{name: "gemini thinking budget", serviceType: ServiceTypeGemini, parameters: ModelParameters{ThinkingBudget: 512, Temperature: ptr(float32(0.5))}},
+		{name: "anthropic minimum budget", serviceType: ServiceTypeAnthropic, parameters: ModelParameters{ThinkingBudget: 512}, wantErr: "thinking budget must be at least 1024"},
+		{name: "anthropic thinking with temperature", serviceType: ServiceTypeAnthropic, parameters: ModelParameters{ReasoningEffort: ReasoningEffortLow, Temperature: ptr(float32(0.5))}, wantErr: "can't be changed with extended thinking"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.parameters.Validate(tt.serviceType)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestModelParametersOptions(t *testing.T) {
+	assert.Empty(t, ModelParameters{}.Options())
+
+	var cfg LanguageModelConfig
+	for _, opt := range (ModelParameters{Temperature: ptr(float32(0)), StopSequences: []string{"END"}, ReasoningEffort: ReasoningEffortHigh}).Options() {
+		opt(&cfg)
+	}
+	assert.Equal(t, ptr(float32(0)), cfg.Temperature)
+	assert.Nil(t, cfg.TopP)
+	assert.Equal(t, []string{"END"}, cfg.StopSequences)
+	assert.Equal(t, 24576, cfg.ThinkingBudgetTokens())
+}
@@ -15,6 +15,8 @@ const (
 	PromptMeetingSummaryGeneral            = "meeting_summary_general"
 	PromptMeetingSummarySystem             = "meeting_summary_system"
 	PromptMeetingSummaryUser               = "meeting_summary_user"
+	PromptRerankSystem                     = "rerank_system"
+	PromptRerankUser                       = "rerank_user"
 	PromptSearchResults                    = "search_results"
 	PromptSearchSystem                     = "search_system"
 	PromptSearchUser                       = "search_user"
@@ -23,6 +25,8 @@ const (
 	PromptSummarizeChannelRangeSystem      = "summarize_channel_range_system"
 	PromptSummarizeChannelSinceSystem      = "summarize_channel_since_system"
 	PromptSummarizeChunkSystem             = "summarize_chunk_system"
+	PromptSummarizeHistorySystem           = "summarize_history_system"
+	PromptSummarizeHistoryUser             = "summarize_history_user"
 	PromptSummarizeThreadSystem            = "summarize_thread_system"
 	PromptThreadUser                       = "thread_user"
 )
@@ -0,0 +1,212 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxRetries     = 2
+	DefaultInitialBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff     = 30 * time.Second
+)
+
+// RetryPolicy decides how failed requests to an upstream LLM API are retried. Retries are only safe before
+// any output has been streamed to the user, callers are responsible for only retrying in that window.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry, doubled on each following retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. A Retry-After longer than this fails immediately instead.
+	MaxBackoff time.Duration
+}
+
+// RetryClassifier reports whether an error is worth retrying and how long the server asked to wait, if at all
+type RetryClassifier func(err error) (retryable bool, retryAfter time.Duration)
+
+func NewRetryPolicy(cfg ServiceConfig) RetryPolicy {
+	policy := RetryPolicy{
+		MaxRetries:     DefaultMaxRetries,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+	}
+	if cfg.MaxRetries < 0 {
+		policy.MaxRetries = 0
+	} else if cfg.MaxRetries > 0 {
+		policy.MaxRetries = cfg.MaxRetries
+	}
+	if cfg.RetryBackoffMilliseconds > 0 {
+		policy.InitialBackoff = time.Duration(cfg.RetryBackoffMilliseconds) * time.Millisecond
+	}
+	return policy
+}
+
+// Do calls fn until it succeeds, fails with an error the classifier rejects or the retries run out.
+// The last error is returned.
+func (p RetryPolicy) Do(ctx context.Context, classify RetryClassifier, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxRetries {
+			return err
+		}
+
+		retryable, retryAfter := classify(err)
+		if !retryable {
+			return err
+		}
+
+		delay := p.Backoff(attempt)
+		if retryAfter > 0 {
+			if retryAfter > p.MaxBackoff {
+				return err
+			}
+			delay = retryAfter
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Backoff is the jittered delay before the given retry, counting from 0
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 0; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxBackoff)
+	if delay <= 0 {
+		return 0
+	}
+
+	// Equal jitter, at least half the delay so retries don't come back too quickly
+	half := delay / 2
+	return half + rand.N(delay-half+1) //nolint:gosec
+}
+
+// IsRetryableStatus reports whether an HTTP status means the request may succeed if sent again
+func IsRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	// Includes Anthropic's 529 overloaded
+	return statusCode >= http.StatusInternalServerError
+}
+
+// ClassifyError is the RetryClassifier for errors that aren't specific to one provider:
+// APIError, network errors and connections closed early.
+func ClassifyError(err error) (bool, time.Duration) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return IsRetryableStatus(apiErr.StatusCode), apiErr.RetryAfter
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true, 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, 0
+	}
+	return false, 0
+}
+
+// ParseRetryAfter reads how long the server asked to wait from the response headers. Besides the standard
+// Retry-After, in seconds or as a date, the retry-after-ms header sent by OpenAI and Anthropic is supported.
+func ParseRetryAfter(header http.Header) time.Duration {
+	if ms := header.Get("retry-after-ms"); ms != "" {
+		if value, err := strconv.ParseFloat(strings.TrimSpace(ms), 64); err == nil && value > 0 {
+			return time.Duration(value * float64(time.Millisecond))
+		}
+	}
+
+	retryAfter := strings.TrimSpace(header.Get("Retry-After"))
+	if retryAfter == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(retryAfter, 64); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+type retryAfterKey struct{}
+
+// RetryAfterRecorder holds the Retry-After of the last failed response of a request. It is for API clients
+// whose errors don't expose the response headers, see NewRetryAfterRecordingClient.
+type RetryAfterRecorder struct {
+	lock       sync.Mutex
+	retryAfter time.Duration
+}
+
+func (r *RetryAfterRecorder) RetryAfter() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.retryAfter
+}
+
+func (r *RetryAfterRecorder) set(retryAfter time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.retryAfter = retryAfter
+}
+
+// WithRetryAfterRecorder returns a context that collects the Retry-After of responses to requests made with it
+func WithRetryAfterRecorder(ctx context.Context) (context.Context, *RetryAfterRecorder) {
+	recorder := &RetryAfterRecorder{}
+	return context.WithValue(ctx, retryAfterKey{}, recorder), recorder
+}
+
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if recorder, ok := req.Context().Value(retryAfterKey{}).(*RetryAfterRecorder); ok && resp.StatusCode >= http.StatusBadRequest {
+		recorder.set(ParseRetryAfter(resp.Header))
+	}
+	return resp, nil
+}
+
+// NewRetryAfterRecordingClient copies the client, recording Retry-After headers into the request context
+func NewRetryAfterRecordingClient(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	recording := *client
+	recording.Transport = &retryAfterTransport{base: base}
+	return &recording
+}
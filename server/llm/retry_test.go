@@ -0,0 +1,155 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	assert.Equal(t, RetryPolicy{MaxRetries: DefaultMaxRetries, InitialBackoff: DefaultInitialBackoff, MaxBackoff: DefaultMaxBackoff}, NewRetryPolicy(ServiceConfig{}))
+	assert.Equal(t, 0, NewRetryPolicy(ServiceConfig{MaxRetries: -1}).MaxRetries)
+
+	policy := NewRetryPolicy(ServiceConfig{MaxRetries: 5, RetryBackoffMilliseconds: 100})
+	assert.Equal(t, 5, policy.MaxRetries)
+	assert.Equal(t, 100*time.Millisecond, policy.InitialBackoff)
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	unavailable := &APIError{Provider: "test", StatusCode: http.StatusServiceUnavailable}
+
+	t.Run("retries until success", func(t *testing.T) {
+		attempts := 0
+		err := policy.Do(context.Background(), ClassifyError, func() error {
+			attempts++
+			if attempts < 3 {
+				return unavailable
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("gives up after the last retry", func(t *testing.T) {
+		attempts := 0
+		err := policy.Do(context.Background(), ClassifyError, func() error {
+			attempts++
+			return unavailable
+		})
+		assert.ErrorIs(t, err, unavailable)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("doesn't retry request errors", func(t *testing.T) {
+		attempts := 0
+		err := policy.Do(context.Background(), ClassifyError, func() error {
+			attempts++
+			return &APIError{Provider: "test", StatusCode: http.StatusBadRequest}
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("honors Retry-After", func(t *testing.T) {
+		attempts := 0
+		start := time.Now()
+		err := policy.Do(context.Background(), ClassifyError, func() error {
+			attempts++
+			if attempts == 1 {
+				return &APIError{Provider: "test", StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Millisecond}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 5*time.Millisecond)
+	})
+
+	t.Run("fails when Retry-After is too long", func(t *testing.T) {
+		attempts := 0
+		err := policy.Do(context.Background(), ClassifyError, func() error {
+			attempts++
+			return &APIError{Provider: "test", StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		attempts := 0
+		err := RetryPolicy{MaxRetries: 2, InitialBackoff: time.Minute, MaxBackoff: time.Minute}.Do(ctx, ClassifyError, func() error {
+			attempts++
+			return unavailable
+		})
+		assert.ErrorIs(t, err, unavailable)
+		assert.Equal(t, 1, attempts)
+	})
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		backoff := policy.Backoff(attempt)
+		assert.GreaterOrEqual(t, backoff, expected/2, "attempt %d", attempt)
+		assert.LessOrEqual(t, backoff, expected, "attempt %d", attempt)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	retryable, retryAfter := ClassifyError(&APIError{StatusCode: 529, RetryAfter: time.Second})
+	assert.True(t, retryable)
+	assert.Equal(t, time.Second, retryAfter)
+
+	retryable, _ = ClassifyError(&APIError{StatusCode: http.StatusUnauthorized})
+	assert.False(t, retryable)
+
+	retryable, _ = ClassifyError(errors.New("max tool resolution depth exceeded"))
+	assert.False(t, retryable)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	header := http.Header{}
+	assert.Zero(t, ParseRetryAfter(header))
+
+	header.Set("Retry-After", "2")
+	assert.Equal(t, 2*time.Second, ParseRetryAfter(header))
+
+	header.Set("retry-after-ms", "1500")
+	assert.Equal(t, 1500*time.Millisecond, ParseRetryAfter(header))
+
+	header = http.Header{}
+	header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, time.Minute, ParseRetryAfter(header), float64(2*time.Second))
+
+	header.Set("Retry-After", "soon")
+	assert.Zero(t, ParseRetryAfter(header))
+}
+
+func TestRetryAfterRecordingClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, recorder := WithRetryAfterRecorder(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	resp, err := NewRetryAfterRecordingClient(server.Client()).Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 3*time.Second, recorder.RetryAfter())
+}
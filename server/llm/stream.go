@@ -3,32 +3,117 @@
 
 package llm
 
+import (
+	"strings"
+)
+
+type EventType int
+
+const (
+	// EventTypeText carries the next piece of the response in Text
+	EventTypeText EventType = iota
+	// EventTypeReasoning carries the next piece of the model's reasoning in Text, for models that share it
+	EventTypeReasoning
+	// EventTypeToolCallStarted is sent before a tool the model called is resolved, the call is in ToolCall
+	EventTypeToolCallStarted
+	// EventTypeToolCallFinished is sent once the tool is resolved, with its result in ToolCall
+	EventTypeToolCallFinished
+	// EventTypeToolApproval is sent when the model called tools with side effects, with every call of the step in
+	// ToolCalls. The others are resolved, the ones that RequiresApproval wait for the user.
+	EventTypeToolApproval
+	// EventTypeUsage carries the tokens used by one call to the upstream API in Usage
+	EventTypeUsage
+	// EventTypeEnd is the last event of a successful stream, with its FinishReason
+	EventTypeEnd
+	// EventTypeError is the last event of a failed stream, with the error in Err
+	EventTypeError
+)
+
+// Finish reasons of EventTypeEnd. Services may report others.
+const (
+	FinishReasonStop          = "stop"
+	FinishReasonLength        = "length"
+	FinishReasonContentFilter = "content_filter"
+	// FinishReasonToolBudget ends responses the agent loop stopped because their tool calls used up the step or
+	// token budget, what was streamed before is kept
+	FinishReasonToolBudget = "tool_budget"
+	// FinishReasonToolApproval ends responses waiting for the user to approve tool calls with side effects, the
+	// calls are in the EventTypeToolApproval event before it
+	FinishReasonToolApproval = "tool_approval"
+)
+
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+	// Result and Err are set when the call is finished
+	Result string
+	Err    error
+	// RequiresApproval is set on calls to tools with side effects, they aren't resolved until the user decides
+	RequiresApproval bool
+}
+
+type StreamEvent struct {
+	Type         EventType
+	Text         string
+	ToolCall     *ToolCall
+	ToolCalls    []ToolCall
+	Usage        *TokenUsage
+	FinishReason string
+	Err          error
+}
+
+// TextStreamResult is the response of a language model as a stream of events. The stream ends with an
+// EventTypeEnd or EventTypeError event and is then closed.
 type TextStreamResult struct {
-	Stream <-chan string
-	Err    <-chan error
+	Events <-chan StreamEvent
 }
 
 func NewStreamFromString(text string) *TextStreamResult {
-	output := make(chan string)
-	err := make(chan error)
+	events := make(chan StreamEvent)
 
 	go func() {
-		output <- text
-		close(output)
-		close(err)
+		defer close(events)
+		events <- StreamEvent{Type: EventTypeText, Text: text}
+		events <- StreamEvent{Type: EventTypeEnd, FinishReason: FinishReasonStop}
 	}()
 
 	return &TextStreamResult{
-		Stream: output,
-		Err:    err,
+		Events: events,
 	}
 }
 
-func (t *TextStreamResult) ReadAll() string {
-	result := ""
-	for next := range t.Stream {
-		result += next
+func NewStreamFromError(err error) *TextStreamResult {
+	events := make(chan StreamEvent)
+
+	go func() {
+		defer close(events)
+		events <- StreamEvent{Type: EventTypeError, Err: err}
+	}()
+
+	return &TextStreamResult{
+		Events: events,
+	}
+}
+
+// ReadText reads the whole stream, returning the text and the error the stream ended with if any
+func (t *TextStreamResult) ReadText() (string, error) {
+	var result strings.Builder
+	var err error
+	for event := range t.Events {
+		switch event.Type {
+		case EventTypeText:
+			result.WriteString(event.Text)
+		case EventTypeError:
+			err = event.Err
+		}
 	}
 
+	return result.String(), err
+}
+
+// ReadAll reads the whole stream and returns the text, ignoring errors
+func (t *TextStreamResult) ReadAll() string {
+	result, _ := t.ReadText()
 	return result
 }
@@ -0,0 +1,40 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func eventStream(events ...StreamEvent) *TextStreamResult {
+	output := make(chan StreamEvent, len(events))
+	for _, event := range events {
+		output <- event
+	}
+	close(output)
+	return &TextStreamResult{Events: output}
+}
+
+func TestReadText(t *testing.T) {
+	text, err := eventStream(
+		StreamEvent{Type: EventTypeReasoning, Text: "Hmm"},
+		StreamEvent{Type: EventTypeText, Text: "Hello"},
+		StreamEvent{Type: EventTypeToolCallStarted, ToolCall: &ToolCall{Name: "search"}},
+		StreamEvent{Type: EventTypeText, Text: " world"},
+		StreamEvent{Type: EventTypeEnd, FinishReason: FinishReasonStop},
+	).ReadText()
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello world", text)
+
+	streamErr := errors.New("connection reset")
+	text, err = eventStream(
+		StreamEvent{Type: EventTypeText, Text: "Partial"},
+		StreamEvent{Type: EventTypeError, Err: streamErr},
+	).ReadText()
+	assert.ErrorIs(t, err, streamErr)
+	assert.Equal(t, "Partial", text)
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+)
+
+// StructuredResponseName names the schema of structured responses where the services need a name for it
+const StructuredResponseName = "response"
+
+// ErrInvalidStructuredResponse is returned when the response doesn't follow the schema, even after the model
+// was asked to repair it
+var ErrInvalidStructuredResponse = errors.New("invalid structured response")
+
+// StructuredValidator is implemented by structured responses that need more checks than their schema
+type StructuredValidator interface {
+	Validate() error
+}
+
+// WithJSONSchema asks for a response that is a JSON document following the schema. The schema is either a
+// *jsonschema.Schema or a value whose type the schema is reflected from, like the schemas of tools.
+func WithJSONSchema(schema any) LanguageModelOption {
+	reflected, ok := schema.(*jsonschema.Schema)
+	if !ok {
+		reflected = ReflectJSONSchema(schema)
+	}
+	return func(cfg *LanguageModelConfig) {
+		cfg.JSONSchema = reflected
+	}
+}
+
+// ReflectJSONSchema returns the schema of the type of value, without references so every service accepts it
+func ReflectJSONSchema(value any) *jsonschema.Schema {
+	reflector := jsonschema.Reflector{
+		Anonymous:      true,
+		ExpandedStruct: true,
+		DoNotReference: true,
+	}
+	return reflector.Reflect(value)
+}
+
+// ChatCompletionStructured requests a response following the schema of T and unmarshals it. A response that
+// doesn't follow the schema, or fails the validation of T, is sent back to the model once to be repaired.
+func ChatCompletionStructured[T any](ctx context.Context, model LanguageModel, request CompletionRequest, opts ...LanguageModelOption) (T, error) {
+	var result T
+	schema := ReflectJSONSchema(&result)
+	opts = append(slices.Clone(opts), WithJSONSchema(schema))
+
+	response, err := model.ChatCompletionNoStream(ctx, request, opts...)
+	if err != nil {
+		return result, err
+	}
+
+	parseErr := parseStructured(response, schema, &result)
+	if parseErr == nil {
+		return result, nil
+	}
+
+	repair := request
+	repair.Posts = append(slices.Clone(request.Posts),
+		Post{Role: PostRoleBot, Message: response},
+		Post{Role: PostRoleUser, Message: fmt.Sprintf("That response is not valid: %s. Respond again with only the corrected JSON.", parseErr)},
+	)
+	response, err = model.ChatCompletionNoStream(ctx, repair, opts...)
+	if err != nil {
+		return result, err
+	}
+
+	result = *new(T)
+	if err := parseStructured(response, schema, &result); err != nil {
+		return result, fmt.Errorf("%w: %w", ErrInvalidStructuredResponse, err)
+	}
+	return result, nil
+}
+
+// parseStructured validates the response against the schema and unmarshals it into result
+func parseStructured(response string, schema *jsonschema.Schema, result any) error {
+	document := extractJSON(response)
+
+	var value any
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		return fmt.Errorf("response is not JSON: %w", err)
+	}
+	if err := validateJSON(value, schema, "response"); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(document), result); err != nil {
+		return fmt.Errorf("response doesn't match the schema: %w", err)
+	}
+
+	if validator, ok := result.(StructuredValidator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+// extractJSON returns the JSON document in a response, services without a JSON mode tend to wrap it in text
+// or a code block
+func extractJSON(response string) string {
+	response = strings.TrimSpace(response)
+	start := strings.IndexAny(response, "{[")
+	if start == -1 {
+		return response
+	}
+	closing := "}"
+	if response[start] == '[' {
+		closing = "]"
+	}
+	end := strings.LastIndex(response, closing)
+	if end < start {
+		return response
+	}
+	return response[start : end+1]
+}
+
+// validateJSON checks the parts of the schema reflected from Go types: types, required and unknown properties,
+// items and enums
+func validateJSON(value any, schema *jsonschema.Schema, path string) error {
+	if schema == nil {
+		return nil
+	}
+
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(allowed any) bool {
+		return fmt.Sprint(allowed) == fmt.Sprint(value)
+	}) {
+		return fmt.Errorf("%s must be one of %v", path, schema.Enum)
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		for name, property := range object {
+			var propertySchema *jsonschema.Schema
+			if schema.Properties != nil {
+				propertySchema, _ = schema.Properties.Get(name)
+			}
+			if propertySchema == nil {
+				if schema.AdditionalProperties == jsonschema.FalseSchema {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := validateJSON(property, propertySchema, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		for i, item := range array {
+			if err := validateJSON(item, schema.Items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+	}
+	return nil
+}
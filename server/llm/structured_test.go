@@ -0,0 +1,147 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// responsesModel answers each request with the next response
+type responsesModel struct {
+	responses []string
+	requests  []CompletionRequest
+	configs   []LanguageModelConfig
+}
+
+func (m *responsesModel) ChatCompletion(ctx context.Context, request CompletionRequest, opts ...LanguageModelOption) (*TextStreamResult, error) {
+	text, err := m.ChatCompletionNoStream(ctx, request, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamFromString(text), nil
+}
+
+func (m *responsesModel) ChatCompletionNoStream(_ context.Context, request CompletionRequest, opts ...LanguageModelOption) (string, error) {
+	var cfg LanguageModelConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	m.requests = append(m.requests, request)
+	m.configs = append(m.configs, cfg)
+	if len(m.responses) == 0 {
+		return "", errors.New("no more responses")
+	}
+	response := m.responses[0]
+	m.responses = m.responses[1:]
+	return response, nil
+}
+
+func (m *responsesModel) CountTokens(text string) int { return len(text) }
+func (m *responsesModel) InputTokenLimit() int        { return 1000 }
+
+type testTitle struct {
+	Title string   `json:"title"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+func (t testTitle) Validate() error {
+	if t.Title == "" {
+		return errors.New("title is empty")
+	}
+	return nil
+}
+
+func TestChatCompletionStructured(t *testing.T) {
+	request := CompletionRequest{Posts: []Post{{Role: PostRoleUser, Message: "Name this"}}}
+
+	t.Run("valid response", func(t *testing.T) {
+		model := &responsesModel{responses: []string{`{"title": "Release plan", "tags": ["planning"]}`}}
+		title, err := ChatCompletionStructured[testTitle](context.Background(), model, request)
+		require.NoError(t, err)
+		assert.Equal(t, testTitle{Title: "Release plan", Tags: []string{"planning"}}, title)
+
+		require.Len(t, model.configs, 1)
+		require.NotNil(t, model.configs[0].JSONSchema)
+		assert.Equal(t, []string{"title"}, model.configs[0].JSONSchema.Required)
+	})
+
+	t.Run("wrapped in text", func(t *testing.T) {
+		model := &responsesModel{responses: []string{"Sure!\n```json\n{\"title\": \"Release plan\"}\n```"}}
+		title, err := ChatCompletionStructured[testTitle](context.Background(), model, request)
+		require.NoError(t, err)
+		assert.Equal(t, "Release plan", title.Title)
+	})
+
+	t.Run("repaired", func(t *testing.T) {
+		model := &responsesModel{responses: []string{`{"name": "Release plan"}`, `{"title": "Release plan"}`}}
+		title, err := ChatCompletionStructured[testTitle](context.Background(), model, request)
+		require.NoError(t, err)
+		assert.Equal(t, "Release plan", title.Title)
+
+		// The invalid response is sent back with what is wrong with it
+		require.Len(t, model.requests, 2)
+		repair := model.requests[1].Posts
+		require.Len(t, repair, 3)
+		assert.Equal(t, Post{Role: PostRoleBot, Message: `{"name": "Release plan"}`}, repair[1])
+		assert.Contains(t, repair[2].Message, "response.title is required")
+		assert.Len(t, request.Posts, 1)
+	})
+
+	t.Run("failed validation is repaired", func(t *testing.T) {
+		model := &responsesModel{responses: []string{`{"title": ""}`, `{"title": "Release plan"}`}}
+		title, err := ChatCompletionStructured[testTitle](context.Background(), model, request)
+		require.NoError(t, err)
+		assert.Equal(t, "Release plan", title.Title)
+		assert.Contains(t, model.requests[1].Posts[2].Message, "title is empty")
+	})
+
+	t.Run("invalid after repair", func(t *testing.T) {
+		model := &responsesModel{responses: []string{`not json`, `{"title": 42}`}}
+		_, err := ChatCompletionStructured[testTitle](context.Background(), model, request)
+		assert.ErrorIs(t, err, ErrInvalidStructuredResponse)
+		assert.ErrorContains(t, err, "response.title must be a string")
+	})
+
+	t.Run("service error", func(t *testing.T) {
+		model := &responsesModel{}
+		_, err := ChatCompletionStructured[testTitle](context.Background(), model, request)
+		assert.ErrorContains(t, err, "no more responses")
+		assert.NotErrorIs(t, err, ErrInvalidStructuredResponse)
+	})
+}
+
+func TestValidateJSON(t *testing.T) {
+	type item struct {
+		Count int  `json:"count"`
+		Done  bool `json:"done,omitempty"`
+	}
+	type list struct {
+		Items []item `json:"items"`
+		Kind  string `json:"kind" jsonschema:"enum=todo,enum=done"`
+	}
+	schema := ReflectJSONSchema(&list{})
+
+	for document, expected := range map[string]string{
+		`{"items": [{"count": 1}], "kind": "todo"}`:                "",
+		`{"items": [{"count": 1.5}], "kind": "todo"}`:              "response.items[0].count must be an integer",
+		`{"items": [{"count": 1, "extra": true}], "kind": "todo"}`: "response.items[0].extra is not allowed",
+		`{"items": {"count": 1}, "kind": "todo"}`:                  "response.items must be an array",
+		`{"items": [], "kind": "later"}`:                           "response.kind must be one of [todo done]",
+		`{"items": [{"count": 1, "done": "yes"}], "kind": "done"}`: "response.items[0].done must be a boolean",
+		`[]`: "response must be an object",
+	} {
+		var result list
+		err := parseStructured(document, schema, &result)
+		if expected == "" {
+			assert.NoError(t, err, document)
+		} else {
+			assert.EqualError(t, err, expected, document)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+type thinkState int
+
+const (
+	thinkStateStart thinkState = iota
+	thinkStateThinking
+	thinkStateAnswering
+)
+
+// ThinkTagParser separates the reasoning that models served through generic APIs, like DeepSeek R1 or QwQ, put
+// between think tags at the start of their response. Tags may be split across chunks so text that could be part
+// of one is held back until the next chunk.
+type ThinkTagParser struct {
+	state   thinkState
+	pending string
+	// trimLeading drops the whitespace models put between the reasoning and the answer
+	trimLeading bool
+}
+
+// Parse returns the text and reasoning events for the next chunk of the response
+func (p *ThinkTagParser) Parse(text string) []StreamEvent {
+	switch p.state {
+	case thinkStateStart:
+		p.pending += text
+		trimmed := strings.TrimLeftFunc(p.pending, unicode.IsSpace)
+		if strings.HasPrefix(thinkOpenTag, trimmed) {
+			// Either only whitespace so far or the start of the tag
+			return nil
+		}
+		if !strings.HasPrefix(trimmed, thinkOpenTag) {
+			p.state = thinkStateAnswering
+			pending := p.pending
+			p.pending = ""
+			return []StreamEvent{{Type: EventTypeText, Text: pending}}
+		}
+		p.state = thinkStateThinking
+		p.pending = ""
+		return p.Parse(strings.TrimPrefix(trimmed, thinkOpenTag))
+	case thinkStateThinking:
+		p.pending += text
+		if index := strings.Index(p.pending, thinkCloseTag); index >= 0 {
+			reasoning, rest := p.pending[:index], p.pending[index+len(thinkCloseTag):]
+			p.state = thinkStateAnswering
+			p.pending = ""
+			p.trimLeading = true
+			events := reasoningEvents(reasoning)
+			return append(events, p.Parse(rest)...)
+		}
+		// Hold back what could be the start of the closing tag
+		keep := 0
+		for i := len(thinkCloseTag) - 1; i > 0; i-- {
+			if strings.HasSuffix(p.pending, thinkCloseTag[:i]) {
+				keep = i
+				break
+			}
+		}
+		reasoning := p.pending[:len(p.pending)-keep]
+		p.pending = p.pending[len(p.pending)-keep:]
+		return reasoningEvents(reasoning)
+	default:
+		if p.trimLeading {
+			text = strings.TrimLeftFunc(text, unicode.IsSpace)
+			if text == "" {
+				return nil
+			}
+			p.trimLeading = false
+		}
+		if text == "" {
+			return nil
+		}
+		return []StreamEvent{{Type: EventTypeText, Text: text}}
+	}
+}
+
+// Flush returns what was held back once the response is complete
+func (p *ThinkTagParser) Flush() []StreamEvent {
+	pending := p.pending
+	p.pending = ""
+	switch {
+	case pending == "":
+		return nil
+	case p.state == thinkStateThinking:
+		return reasoningEvents(pending)
+	default:
+		return []StreamEvent{{Type: EventTypeText, Text: pending}}
+	}
+}
+
+func reasoningEvents(reasoning string) []StreamEvent {
+	if reasoning == "" {
+		return nil
+	}
+	return []StreamEvent{{Type: EventTypeReasoning, Text: reasoning}}
+}
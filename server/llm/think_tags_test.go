@@ -0,0 +1,53 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseChunks(chunks ...string) (string, string) {
+	var parser ThinkTagParser
+	var text, reasoning string
+	collect := func(events []StreamEvent) {
+		for _, event := range events {
+			switch event.Type {
+			case EventTypeText:
+				text += event.Text
+			case EventTypeReasoning:
+				reasoning += event.Text
+			}
+		}
+	}
+	for _, chunk := range chunks {
+		collect(parser.Parse(chunk))
+	}
+	collect(parser.Flush())
+	return text, reasoning
+}
+
+func TestThinkTagParser(t *testing.T) {
+	tests := []struct {
+		name          string
+		chunks        []string
+		wantText      string
+		wantReasoning string
+	}{
+		{name: "no tags", chunks: []string{"Hello", " world"}, wantText: "Hello world"},
+		{name: "reasoning then answer", chunks: []string{"<think>Let me see</think>\n\nHello"}, wantText: "Hello", wantReasoning: "Let me see"},
+		{name: "tags split across chunks", chunks: []string{"\n<th", "ink>Let me", " see</thi", "nk>", "\n", "Hello"}, wantText: "Hello", wantReasoning: "Let me see"},
+		{name: "tags later in the answer are kept", chunks: []string{"Use <think>", " tags</think>"}, wantText: "Use <think> tags</think>"},
+		{name: "unfinished reasoning", chunks: []string{"<think>Still thinking</"}, wantReasoning: "Still thinking</"},
+		{name: "almost a tag", chunks: []string{"<thin", "g>"}, wantText: "<thing>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, reasoning := parseChunks(tt.chunks...)
+			assert.Equal(t, tt.wantText, text)
+			assert.Equal(t, tt.wantReasoning, reasoning)
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	EncodingCL100K = "cl100k_base"
+	EncodingO200K  = "o200k_base"
+)
+
+// ClaudeTokensPerCL100KToken calibrates cl100k counts to Claude's tokenizer, which isn't public. Claude uses
+// somewhat more tokens for the same text so the count errs on the side of truncating more.
+const ClaudeTokensPerCL100KToken = 1.15
+
+// openAIEncodingPrefixes maps OpenAI models to their vocabulary, the more specific prefixes first
+var openAIEncodingPrefixes = []struct {
+	prefix   string
+	encoding string
+}{
+	{"gpt-4o", EncodingO200K},
+	{"chatgpt-4o", EncodingO200K},
+	{"gpt-4.1", EncodingO200K},
+	{"gpt-4.5", EncodingO200K},
+	{"gpt-5", EncodingO200K},
+	{"o1", EncodingO200K},
+	{"o3", EncodingO200K},
+	{"o4", EncodingO200K},
+	{"gpt-4", EncodingCL100K},
+	{"gpt-3.5", EncodingCL100K},
+	{"text-embedding-3", EncodingCL100K},
+	{"text-embedding-ada-002", EncodingCL100K},
+}
+
+func init() {
+	// The vocabularies are embedded rather than downloaded when first used
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// TokenCounter counts the tokens of text the way a model does
+type TokenCounter func(text string) int
+
+// NewTokenCounter returns the most accurate counter available for a model: the BPE vocabulary of OpenAI models,
+// a calibrated BPE count for Claude models and otherwise the chars per token ratio learned from the usage
+// services report, see ObserveTokenUsage
+func NewTokenCounter(model string) TokenCounter {
+	name := strings.ToLower(model)
+	encoding, scale := OpenAIEncodingForModel(name), 1.0
+	if encoding == "" && strings.HasPrefix(name, "claude") {
+		encoding, scale = EncodingCL100K, ClaudeTokensPerCL100KToken
+	}
+
+	// The vocabulary is only loaded once something is counted
+	return func(text string) int {
+		if encoding != "" {
+			if counter := bpeCounter(encoding); counter != nil {
+				return int(math.Ceil(float64(counter(text)) * scale))
+			}
+		}
+		return learnedRatios.countTokens(model, text)
+	}
+}
+
+// OpenAIEncodingForModel returns the vocabulary of an OpenAI model, empty if the model isn't known
+func OpenAIEncodingForModel(model string) string {
+	for _, entry := range openAIEncodingPrefixes {
+		if strings.HasPrefix(model, entry.prefix) {
+			return entry.encoding
+		}
+	}
+	return ""
+}
+
+type bpeEncoding struct {
+	once     sync.Once
+	tiktoken *tiktoken.Tiktoken
+}
+
+// bpeEncodings are loaded once when first used, each takes tens of megabytes
+var bpeEncodings = map[string]*bpeEncoding{
+	EncodingCL100K: {},
+	EncodingO200K:  {},
+}
+
+// bpeCounter returns a counter for the vocabulary, nil if it can't be loaded
+func bpeCounter(encoding string) TokenCounter {
+	entry, ok := bpeEncodings[encoding]
+	if !ok {
+		return nil
+	}
+	entry.once.Do(func() {
+		// A failure leaves the encoding nil and the caller falls back to estimates
+		entry.tiktoken, _ = tiktoken.GetEncoding(encoding)
+	})
+	if entry.tiktoken == nil {
+		return nil
+	}
+	return func(text string) int {
+		return len(entry.tiktoken.EncodeOrdinary(text))
+	}
+}
+
+// ObserveTokenUsage learns the chars per token ratio of a model from the input tokens a service reported for text
+func ObserveTokenUsage(model string, text string, inputTokens int64) {
+	learnedRatios.observe(model, text, inputTokens)
+}
+
+// learnedRatios are kept for the life of the plugin, services are created for every request
+var learnedRatios = newTokenRatios()
+
+// ratioDecay is how much weight earlier observations keep when a new one comes in
+const ratioDecay = 0.9
+
+type tokenRatio struct {
+	chars  float64
+	tokens float64
+}
+
+type tokenRatios struct {
+	mu     sync.Mutex
+	models map[string]*tokenRatio
+}
+
+func newTokenRatios() *tokenRatios {
+	return &tokenRatios{models: map[string]*tokenRatio{}}
+}
+
+func (r *tokenRatios) observe(model string, text string, inputTokens int64) {
+	chars := utf8.RuneCountInString(text)
+	if chars == 0 || inputTokens <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ratio, ok := r.models[model]
+	if !ok {
+		ratio = &tokenRatio{}
+		r.models[model] = ratio
+	}
+	ratio.chars = ratio.chars*ratioDecay + float64(chars)
+	ratio.tokens = ratio.tokens*ratioDecay + float64(inputTokens)
+}
+
+// countTokens uses the learned ratio of the model, or a heuristic until there is one
+func (r *tokenRatios) countTokens(model string, text string) int {
+	r.mu.Lock()
+	ratio, ok := r.models[model]
+	var tokensPerChar float64
+	if ok {
+		tokensPerChar = ratio.tokens / ratio.chars
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return EstimateTokens(text)
+	}
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) * tokensPerChar))
+}
+
+// EstimateTokens approximates the tokens of text, averaging the estimates by characters and by words
+func EstimateTokens(text string) int {
+	charCount := float64(len(text)) / 4.0
+	wordCount := float64(len(strings.Fields(text))) / 0.75
+	return int((charCount + wordCount) / 2.0)
+}
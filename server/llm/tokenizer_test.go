@@ -0,0 +1,92 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAIEncodingForModel(t *testing.T) {
+	for model, expected := range map[string]string{
+		"gpt-4o":                 EncodingO200K,
+		"gpt-4o-mini":            EncodingO200K,
+		"gpt-4.1-nano":           EncodingO200K,
+		"o3-mini":                EncodingO200K,
+		"gpt-4-turbo":            EncodingCL100K,
+		"gpt-3.5-turbo":          EncodingCL100K,
+		"text-embedding-3-large": EncodingCL100K,
+		"llama3":                 "",
+		"claude-3-5-sonnet":      "",
+	} {
+		assert.Equal(t, expected, OpenAIEncodingForModel(model), model)
+	}
+}
+
+func TestNewTokenCounter(t *testing.T) {
+	assert.Equal(t, 6, NewTokenCounter("gpt-4")("tiktoken is great!"))
+	assert.Equal(t, 2, NewTokenCounter("gpt-4o")("hello world"))
+	assert.Equal(t, 0, NewTokenCounter("gpt-4o")(""))
+
+	// Claude counts are scaled up from cl100k
+	assert.Equal(t, 7, NewTokenCounter("claude-3-5-sonnet-latest")("tiktoken is great!"))
+}
+
+func TestTokenRatios(t *testing.T) {
+	ratios := newTokenRatios()
+	text := strings.Repeat("a", 400)
+
+	// The heuristic is used until something is observed
+	assert.Equal(t, EstimateTokens(text), ratios.countTokens("llama3", text))
+
+	ratios.observe("llama3", strings.Repeat("a", 1000), 500)
+	assert.Equal(t, 200, ratios.countTokens("llama3", text))
+	assert.Equal(t, EstimateTokens(text), ratios.countTokens("mistral", text))
+
+	// Newer observations weigh more than older ones
+	ratios.observe("llama3", strings.Repeat("a", 1000), 250)
+	assert.Equal(t, 148, ratios.countTokens("llama3", text))
+
+	// Nothing is learned from empty requests or missing usage
+	ratios.observe("llama3", "", 100)
+	ratios.observe("llama3", text, 0)
+	assert.Equal(t, 148, ratios.countTokens("llama3", text))
+
+	// Characters are runes so multi-byte text isn't overcounted
+	ratios.observe("qwen", strings.Repeat("ă", 100), 100)
+	assert.Equal(t, 10, ratios.countTokens("qwen", strings.Repeat("ê", 10)))
+}
+
+var benchmarkTexts = map[string]string{
+	"english":    strings.Repeat("The quick brown fox jumps over the lazy dog while the team reviews the release notes. ", 100),
+	"vietnamese": strings.Repeat("Xin chào các bạn, hôm nay chúng ta sẽ xem lại ghi chú phát hành của nhóm. ", 100),
+	"code":       strings.Repeat("func (p *Plugin) handle(w http.ResponseWriter, r *http.Request) { p.serve(w, r) }\n", 100),
+}
+
+func BenchmarkCountTokens(b *testing.B) {
+	ratios := newTokenRatios()
+	ratios.observe("llama3", benchmarkTexts["english"], 2000)
+
+	counters := map[string]TokenCounter{
+		"o200k":     NewTokenCounter("gpt-4o"),
+		"cl100k":    NewTokenCounter("gpt-4"),
+		"claude":    NewTokenCounter("claude-3-5-sonnet-latest"),
+		"learned":   func(text string) int { return ratios.countTokens("llama3", text) },
+		"estimated": EstimateTokens,
+	}
+	for counterName, counter := range counters {
+		// Load the vocabulary outside of the measurement
+		counter("warm up")
+		for textName, text := range benchmarkTexts {
+			b.Run(counterName+"/"+textName, func(b *testing.B) {
+				b.SetBytes(int64(len(text)))
+				for i := 0; i < b.N; i++ {
+					counter(text)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"errors"
+	"slices"
+)
+
+// ToolChannelKind is the kind of channel a response is in, for the tool policy
+type ToolChannelKind string
+
+const (
+	ToolChannelDirect  ToolChannelKind = "direct"  // DMs with the bot
+	ToolChannelPublic  ToolChannelKind = "public"  // Public channels
+	ToolChannelPrivate ToolChannelKind = "private" // Private channels
+	ToolChannelGroup   ToolChannelKind = "group"   // Group messages, and DMs between users the bot responds in
+)
+
+// AllTools allows every tool in a list of the tool policy
+const AllTools = "*"
+
+// ToolPolicy limits which tools a bot can use. A list that isn't set keeps the default tools of its kind of channel,
+// every tool in DMs and only the tools allowed outside of DMs elsewhere. A list that is set allows the tools it names
+// from those defaults, so an empty list allows none and no list adds tools that are only available in DMs.
+type ToolPolicy struct {
+	DirectMessages  []string `json:"directMessages"`
+	PublicChannels  []string `json:"publicChannels"`
+	PrivateChannels []string `json:"privateChannels"`
+	GroupMessages   []string `json:"groupMessages"`
+
+	// Rules limit tools to some users and teams wherever they are allowed
+	Rules []ToolRule `json:"rules"`
+}
+
+// ToolRule limits a tool to the listed users and the members of the listed teams
+type ToolRule struct {
+	Tool    string   `json:"tool"`
+	UserIDs []string `json:"userIDs"`
+	TeamIDs []string `json:"teamIDs"`
+}
+
+// ErrToolNotAllowed is returned for calls to tools the bot's policy doesn't allow in the request
+var ErrToolNotAllowed = errors.New("tool is not allowed here")
+
+// ToolPolicyFunc returns an error when the policy doesn't allow the tool in the context of the request
+type ToolPolicyFunc func(name string, context *Context) error
+
+// ChannelTools returns the tools allowed in the kind of channel, and whether the policy sets them
+func (p ToolPolicy) ChannelTools(kind ToolChannelKind) ([]string, bool) {
+	var tools []string
+	switch kind {
+	case ToolChannelDirect:
+		tools = p.DirectMessages
+	case ToolChannelPublic:
+		tools = p.PublicChannels
+	case ToolChannelPrivate:
+		tools = p.PrivateChannels
+	case ToolChannelGroup:
+		tools = p.GroupMessages
+	}
+	return tools, tools != nil
+}
+
+// AllowsInChannel reports whether the tool can be used in the kind of channel, tools are allowed where the policy
+// doesn't set the channel's tools
+func (p ToolPolicy) AllowsInChannel(kind ToolChannelKind, name string) bool {
+	tools, set := p.ChannelTools(kind)
+	return !set || slices.Contains(tools, AllTools) || slices.Contains(tools, name)
+}
+
+// AllowsUser reports whether the user can use the tool, inTeam tells whether the user is a member of a team
+func (p ToolPolicy) AllowsUser(name, userID string, inTeam func(teamID string) bool) bool {
+	for _, rule := range p.Rules {
+		if rule.Tool != name {
+			continue
+		}
+		if userID == "" {
+			return false
+		}
+		if slices.Contains(rule.UserIDs, userID) {
+			continue
+		}
+		if !slices.ContainsFunc(rule.TeamIDs, inTeam) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that every rule names its tool
+func (p ToolPolicy) Validate() error {
+	for _, rule := range p.Rules {
+		if rule.Tool == "" {
+			return errors.New("tool rules must name a tool")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolPolicyAllowsInChannel(t *testing.T) {
+	policy := ToolPolicy{
+		PublicChannels: []string{"search"},
+		GroupMessages:  []string{},
+		DirectMessages: []string{AllTools},
+	}
+
+	assert.True(t, policy.AllowsInChannel(ToolChannelPublic, "search"))
+	assert.False(t, policy.AllowsInChannel(ToolChannelPublic, "create"))
+	assert.False(t, policy.AllowsInChannel(ToolChannelGroup, "search"), "an empty list allows no tools")
+	assert.True(t, policy.AllowsInChannel(ToolChannelPrivate, "create"), "a list that isn't set keeps the defaults")
+	assert.True(t, policy.AllowsInChannel(ToolChannelDirect, "create"))
+}
+
+func TestToolPolicyAllowsUser(t *testing.T) {
+	policy := ToolPolicy{Rules: []ToolRule{
+		{Tool: "deploy", UserIDs: []string{"alice"}, TeamIDs: []string{"ops"}},
+	}}
+	inTeam := func(userTeams ...string) func(string) bool {
+		return func(teamID string) bool {
+			return slices.Contains(userTeams, teamID)
+		}
+	}
+
+	assert.True(t, policy.AllowsUser("deploy", "alice", inTeam()))
+	assert.True(t, policy.AllowsUser("deploy", "bob", inTeam("ops")))
+	assert.False(t, policy.AllowsUser("deploy", "bob", inTeam("dev")))
+	assert.False(t, policy.AllowsUser("deploy", "", inTeam("ops")))
+	assert.True(t, policy.AllowsUser("search", "bob", inTeam()), "tools without rules are available to everyone")
+}
+
+func TestToolStorePolicy(t *testing.T) {
+	store := NewNoTools()
+	store.AddTools([]Tool{{
+		Name: "deploy",
+		Resolver: func(_ context.Context, _ *Context, _ ToolArgumentGetter) (string, error) {
+			return "deployed", nil
+		},
+	}})
+	store.SetPolicy(func(_ string, llmContext *Context) error {
+		if llmContext.RequestingUser.Id != "alice" {
+			return ErrToolNotAllowed
+		}
+		return nil
+	})
+
+	args := ToolCall{}.ArgumentGetter()
+	result, err := store.ResolveTool(context.Background(), "deploy", args, &Context{RequestingUser: &model.User{Id: "alice"}})
+	require.NoError(t, err)
+	assert.Equal(t, "deployed", result)
+
+	// The policy is checked when the tool is called, not only when the tools are listed
+	_, err = store.ResolveTool(context.Background(), "deploy", args, &Context{RequestingUser: &model.User{Id: "bob"}})
+	assert.ErrorIs(t, err, ErrToolNotAllowed)
+}
+
+func TestToolPolicyValidate(t *testing.T) {
+	assert.NoError(t, ToolPolicy{Rules: []ToolRule{{Tool: "deploy", UserIDs: []string{"alice"}}}}.Validate())
+	assert.Error(t, ToolPolicy{Rules: []ToolRule{{UserIDs: []string{"alice"}}}}.Validate())
+}
@@ -4,9 +4,12 @@
 package llm
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+
+	"github.com/invopop/jsonschema"
 )
 
 // Tool represents a function that can be called by the language model during a conversation.
@@ -14,20 +17,33 @@ import (
 // Each tool has a name, description, and schema that defines its parameters. These are passed to the LLM for it to understand what capabilities it has.
 // It is the Resolver function that implements the actual functionality.
 //
-// The Schema field should contain a struct that defines the expected JSON structure of the tool's arguments. The Resolver function receives the conversation context and a way to access the parsed arguments, and returns either a result that will be passed to the LLM or an error.
+// The Schema field should contain a struct that defines the expected JSON structure of the tool's arguments, or a *jsonschema.Schema for tools that come with their own schema. The Resolver function receives a context that is cancelled when the call times out or the request stops, the conversation context and a way to access the parsed arguments, and returns either a result that will be passed to the LLM or an error.
 type Tool struct {
 	Name        string
 	Description string
 	Schema      any
-	Resolver    func(context *Context, argsGetter ToolArgumentGetter) (string, error)
+	Resolver    func(ctx context.Context, llmContext *Context, argsGetter ToolArgumentGetter) (string, error)
+	// SideEffects marks tools that act rather than read, like creating issues or posting messages. The response
+	// stops when the model calls one and only continues once the requesting user approves or denies the call.
+	SideEffects bool
 }
 
 type ToolArgumentGetter func(args any) error
 
+// ToolSchema returns the schema of the tool's arguments, reflected from the type of its Schema unless it already
+// is one
+func ToolSchema(reflector *jsonschema.Reflector, tool Tool) *jsonschema.Schema {
+	if schema, ok := tool.Schema.(*jsonschema.Schema); ok {
+		return schema
+	}
+	return reflector.Reflect(tool.Schema)
+}
+
 type ToolStore struct {
 	tools   map[string]Tool
 	log     TraceLog
 	doTrace bool
+	policy  ToolPolicyFunc
 }
 
 type TraceLog interface {
@@ -56,17 +72,33 @@ func (s *ToolStore) AddTools(tools []Tool) {
 	}
 }
 
-func (s *ToolStore) ResolveTool(name string, argsGetter ToolArgumentGetter, context *Context) (string, error) {
+// SetPolicy checks every call against the policy, so tools left out of the model's list can't be called anyway
+func (s *ToolStore) SetPolicy(policy ToolPolicyFunc) {
+	s.policy = policy
+}
+
+func (s *ToolStore) ResolveTool(ctx context.Context, name string, argsGetter ToolArgumentGetter, llmContext *Context) (string, error) {
 	tool, ok := s.tools[name]
 	if !ok {
 		s.TraceUnknown(name, argsGetter)
 		return "", errors.New("unknown tool " + name)
 	}
-	results, err := tool.Resolver(context, argsGetter)
+	if s.policy != nil {
+		if err := s.policy(name, llmContext); err != nil {
+			return "", err
+		}
+	}
+	results, err := tool.Resolver(ctx, llmContext, argsGetter)
 	s.TraceResolved(name, argsGetter, results)
 	return results, err
 }
 
+// HasSideEffects reports whether calls to the tool need the requesting user's approval
+func (s *ToolStore) HasSideEffects(name string) bool {
+	tool, ok := s.tools[name]
+	return ok && tool.SideEffects
+}
+
 func (s *ToolStore) GetTools() []Tool {
 	result := make([]Tool, 0, len(s.tools))
 	for _, tool := range s.tools {
@@ -0,0 +1,38 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package llm
+
+import "cmp"
+
+// TokenUsage is the number of tokens a call to the upstream API consumed, as reported by the service
+type TokenUsage struct {
+	// Model is the model the request was sent to
+	Model        string
+	InputTokens  int64
+	OutputTokens int64
+}
+
+// Add sums the tokens of both, the model of other is kept when set
+func (u TokenUsage) Add(other TokenUsage) TokenUsage {
+	return TokenUsage{
+		Model:        cmp.Or(other.Model, u.Model),
+		InputTokens:  u.InputTokens + other.InputTokens,
+		OutputTokens: u.OutputTokens + other.OutputTokens,
+	}
+}
+
+// WithUsageCallback asks the service to report the usage of every upstream API call made for the request,
+// requests resolving tools make more than one call. Services that don't know their usage never call it.
+func WithUsageCallback(callback func(TokenUsage)) LanguageModelOption {
+	return func(cfg *LanguageModelConfig) {
+		cfg.UsageCallback = callback
+	}
+}
+
+// ReportUsage passes usage to the callback set with WithUsageCallback, if any
+func (c LanguageModelConfig) ReportUsage(usage TokenUsage) {
+	if c.UsageCallback != nil {
+		c.UsageCallback(usage)
+	}
+}
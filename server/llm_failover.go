@@ -0,0 +1,325 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	anthropicSDK "github.com/anthropics/anthropic-sdk-go"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/openai"
+	openaiClient "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// Consecutive failures before a service is skipped
+	CircuitBreakerThreshold = 3
+	// How long a service is skipped before it is tried again
+	CircuitBreakerCooldown = 30 * time.Second
+)
+
+type FailoverService struct {
+	// Name is used in logs and metrics
+	Name string
+	// BreakerKey identifies the circuit breaker tracking this service
+	BreakerKey string
+	Model      llm.LanguageModel
+}
+
+// FailoverLanguageModel sends requests to the first available service and moves on to the next one
+// when a service fails before producing any output.
+type FailoverLanguageModel struct {
+	services   []FailoverService
+	breakers   *circuitBreakers
+	onFailover func(from, to string, err error)
+}
+
+func NewFailoverLanguageModel(services []FailoverService, breakers *circuitBreakers, onFailover func(from, to string, err error)) *FailoverLanguageModel {
+	return &FailoverLanguageModel{
+		services:   services,
+		breakers:   breakers,
+		onFailover: onFailover,
+	}
+}
+
+// available returns the services whose circuit breaker is closed. If every breaker is open all services are
+// returned, failing outright would be no better than trying.
+func (f *FailoverLanguageModel) available() []FailoverService {
+	available := make([]FailoverService, 0, len(f.services))
+	for _, service := range f.services {
+		if f.breakers.allow(service.BreakerKey) {
+			available = append(available, service)
+		}
+	}
+	if len(available) == 0 {
+		return f.services
+	}
+	return available
+}
+
+func (f *FailoverLanguageModel) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	nextRequest, err := replayableRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	services := f.available()
+	var lastErr error
+	var lastErrStreamed bool
+	for i, service := range services {
+		result, err := service.Model.ChatCompletion(ctx, nextRequest(), opts...)
+		streamed := false
+		if err == nil {
+			var buffered []llm.StreamEvent
+			buffered, err = waitForOutput(result)
+			if err == nil {
+				f.breakers.recordSuccess(service.BreakerKey)
+				return forwardStream(buffered, result), nil
+			}
+			streamed = true
+		}
+
+		// Once the caller gave up there is no point trying another service
+		if !shouldFailover(err) || ctx.Err() != nil {
+			return failedResult(err, streamed)
+		}
+
+		f.breakers.recordFailure(service.BreakerKey)
+		lastErr, lastErrStreamed = err, streamed
+		if i+1 < len(services) {
+			f.onFailover(service.Name, services[i+1].Name, err)
+		}
+	}
+
+	return failedResult(lastErr, lastErrStreamed)
+}
+
+func (f *FailoverLanguageModel) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	nextRequest, err := replayableRequest(request)
+	if err != nil {
+		return "", err
+	}
+
+	services := f.available()
+	var lastErr error
+	for i, service := range services {
+		result, err := service.Model.ChatCompletionNoStream(ctx, nextRequest(), opts...)
+		if err == nil {
+			f.breakers.recordSuccess(service.BreakerKey)
+			return result, nil
+		}
+		if !shouldFailover(err) || ctx.Err() != nil {
+			return "", err
+		}
+
+		f.breakers.recordFailure(service.BreakerKey)
+		lastErr = err
+		if i+1 < len(services) {
+			f.onFailover(service.Name, services[i+1].Name, err)
+		}
+	}
+
+	return "", lastErr
+}
+
+func (f *FailoverLanguageModel) CountTokens(text string) int {
+	return f.services[0].Model.CountTokens(text)
+}
+
+func (f *FailoverLanguageModel) InputTokenLimit() int {
+	return f.services[0].Model.InputTokenLimit()
+}
+
+// failedResult reports an error the same way the service did, errors from the stream stay on the stream.
+func failedResult(err error, streamed bool) (*llm.TextStreamResult, error) {
+	if !streamed {
+		return nil, err
+	}
+	return llm.NewStreamFromError(err), nil
+}
+
+// waitForOutput blocks until the stream produces output, fails or finishes. Events that come before the output,
+// like usage, are returned with the first output so they can be passed on. Empty text is dropped.
+func waitForOutput(result *llm.TextStreamResult) ([]llm.StreamEvent, error) {
+	var buffered []llm.StreamEvent
+	for event := range result.Events {
+		switch event.Type {
+		case llm.EventTypeError:
+			return nil, event.Err
+		case llm.EventTypeText:
+			if event.Text == "" {
+				continue
+			}
+			return append(buffered, event), nil
+		case llm.EventTypeUsage:
+			buffered = append(buffered, event)
+		default:
+			return append(buffered, event), nil
+		}
+	}
+	return buffered, nil
+}
+
+// forwardStream passes on the events read while waiting for output, then the rest of the stream
+func forwardStream(buffered []llm.StreamEvent, result *llm.TextStreamResult) *llm.TextStreamResult {
+	events := make(chan llm.StreamEvent)
+	go func() {
+		defer close(events)
+
+		for _, event := range buffered {
+			events <- event
+		}
+		for event := range result.Events {
+			events <- event
+		}
+	}()
+	return &llm.TextStreamResult{Events: events}
+}
+
+// replayableRequest reads attached files into memory so the request can be sent more than once.
+// The returned function gives a copy of the request with fresh file readers.
+func replayableRequest(request llm.CompletionRequest) (func() llm.CompletionRequest, error) {
+	type fileIndex struct{ post, file int }
+	contents := make(map[fileIndex][]byte)
+	for i, post := range request.Posts {
+		for j, file := range post.Files {
+			if file.Reader == nil {
+				continue
+			}
+			data, err := io.ReadAll(file.Reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file: %w", err)
+			}
+			contents[fileIndex{i, j}] = data
+		}
+	}
+
+	return func() llm.CompletionRequest {
+		if len(contents) == 0 {
+			return request
+		}
+
+		posts := make([]llm.Post, len(request.Posts))
+		for i, post := range request.Posts {
+			posts[i] = post
+			if len(post.Files) == 0 {
+				continue
+			}
+			posts[i].Files = make([]llm.File, len(post.Files))
+			for j, file := range post.Files {
+				if data, ok := contents[fileIndex{i, j}]; ok {
+					file.Reader = bytes.NewReader(data)
+				}
+				posts[i].Files[j] = file
+			}
+		}
+
+		replay := request
+		replay.Posts = posts
+		return replay
+	}, nil
+}
+
+// shouldFailover reports whether an error means the service is unavailable rather than the request being bad
+func shouldFailover(err error) bool {
+	if errors.Is(err, openai.ErrStreamingTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	statusCode := errorStatusCode(err)
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// errorStatusCode extracts the HTTP status code from the error types returned by the services, 0 if there is none
+func errorStatusCode(err error) int {
+	var openaiAPIErr *openaiClient.APIError
+	if errors.As(err, &openaiAPIErr) {
+		return openaiAPIErr.HTTPStatusCode
+	}
+	var openaiRequestErr *openaiClient.RequestError
+	if errors.As(err, &openaiRequestErr) {
+		return openaiRequestErr.HTTPStatusCode
+	}
+	var anthropicErr *anthropicSDK.Error
+	if errors.As(err, &anthropicErr) {
+		return anthropicErr.StatusCode
+	}
+	var apiErr *llm.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// circuitBreakers tracks consecutive failures per service. Once a service reaches the threshold it is skipped
+// until the cooldown passes, after which a single failure opens it again.
+type circuitBreakers struct {
+	lock     sync.Mutex
+	breakers map[string]*circuitBreaker
+	now      func() time.Time
+}
+
+func (c *circuitBreakers) currentTime() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *circuitBreakers) allow(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	breaker, ok := c.breakers[key]
+	if !ok {
+		return true
+	}
+	return !c.currentTime().Before(breaker.openUntil)
+}
+
+func (c *circuitBreakers) recordFailure(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.breakers == nil {
+		c.breakers = make(map[string]*circuitBreaker)
+	}
+	breaker, ok := c.breakers[key]
+	if !ok {
+		breaker = &circuitBreaker{}
+		c.breakers[key] = breaker
+	}
+
+	breaker.failures++
+	if breaker.failures >= CircuitBreakerThreshold {
+		breaker.openUntil = c.currentTime().Add(CircuitBreakerCooldown)
+	}
+}
+
+func (c *circuitBreakers) recordSuccess(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.breakers, key)
+}
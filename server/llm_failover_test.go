@@ -0,0 +1,230 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/openai"
+	openaiClient "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedModel streams the given chunks and then fails with err, or fails the call itself with callErr.
+// A non zero usage is reported, and sent as an event, once the chunks are streamed.
+type scriptedModel struct {
+	chunks  []string
+	err     error
+	callErr error
+	usage   llm.TokenUsage
+
+	calls int
+	files [][]byte
+}
+
+func (m *scriptedModel) ChatCompletion(_ context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	m.calls++
+	var cfg llm.LanguageModelConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	for _, post := range request.Posts {
+		for _, file := range post.Files {
+			data, _ := io.ReadAll(file.Reader)
+			m.files = append(m.files, data)
+		}
+	}
+	if m.callErr != nil {
+		return nil, m.callErr
+	}
+
+	events := make(chan llm.StreamEvent)
+	go func() {
+		defer close(events)
+		for _, chunk := range m.chunks {
+			events <- llm.StreamEvent{Type: llm.EventTypeText, Text: chunk}
+		}
+		if m.usage != (llm.TokenUsage{}) {
+			cfg.ReportUsage(m.usage)
+			usage := m.usage
+			events <- llm.StreamEvent{Type: llm.EventTypeUsage, Usage: &usage}
+		}
+		if m.err != nil {
+			events <- llm.StreamEvent{Type: llm.EventTypeError, Err: m.err}
+			return
+		}
+		events <- llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: llm.FinishReasonStop}
+	}()
+	return &llm.TextStreamResult{Events: events}, nil
+}
+
+func (m *scriptedModel) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	result, err := m.ChatCompletion(ctx, request, opts...)
+	if err != nil {
+		return "", err
+	}
+	return result.ReadText()
+}
+
+func (m *scriptedModel) CountTokens(text string) int { return len(text) }
+func (m *scriptedModel) InputTokenLimit() int        { return 1000 }
+
+type failoverRecord struct{ from, to string }
+
+func newTestFailoverModel(breakers *circuitBreakers, models ...*scriptedModel) (*FailoverLanguageModel, *[]failoverRecord) {
+	var failovers []failoverRecord
+	services := make([]FailoverService, 0, len(models))
+	for i, model := range models {
+		name := fmt.Sprintf("service%d", i)
+		services = append(services, FailoverService{Name: name, BreakerKey: "bot/" + name, Model: model})
+	}
+	return NewFailoverLanguageModel(services, breakers, func(from, to string, _ error) {
+		failovers = append(failovers, failoverRecord{from, to})
+	}), &failovers
+}
+
+func TestFailoverBeforeFirstToken(t *testing.T) {
+	primary := &scriptedModel{chunks: []string{""}, err: openai.ErrStreamingTimeout}
+	fallback := &scriptedModel{chunks: []string{"Hello", " world"}}
+	model, failovers := newTestFailoverModel(&circuitBreakers{}, primary, fallback)
+
+	result, err := model.ChatCompletion(context.Background(), llm.CompletionRequest{
+		Posts: []llm.Post{{Message: "Hi", Files: []llm.File{{MimeType: "image/png", Reader: bytes.NewReader([]byte("png"))}}}},
+	})
+	require.NoError(t, err)
+	text, err := result.ReadText()
+	require.NoError(t, err)
+	assert.Equal(t, "Hello world", text)
+
+	assert.Equal(t, []failoverRecord{{"service0", "service1"}}, *failovers)
+
+	// Both services received the attached file
+	assert.Equal(t, [][]byte{[]byte("png")}, primary.files)
+	assert.Equal(t, [][]byte{[]byte("png")}, fallback.files)
+}
+
+func TestFailoverNotAfterFirstToken(t *testing.T) {
+	primary := &scriptedModel{chunks: []string{"Hello"}, err: openai.ErrStreamingTimeout}
+	fallback := &scriptedModel{chunks: []string{"Other"}}
+	model, failovers := newTestFailoverModel(&circuitBreakers{}, primary, fallback)
+
+	result, err := model.ChatCompletion(context.Background(), llm.CompletionRequest{})
+	require.NoError(t, err)
+	text, err := result.ReadText()
+	assert.ErrorIs(t, err, openai.ErrStreamingTimeout)
+	assert.Equal(t, "Hello", text)
+
+	assert.Empty(t, *failovers)
+	assert.Zero(t, fallback.calls)
+}
+
+func TestFailoverPassesOnEventsBeforeOutput(t *testing.T) {
+	usage := llm.TokenUsage{Model: "gpt-4o", InputTokens: 10}
+	model, _ := newTestFailoverModel(&circuitBreakers{}, &scriptedModel{usage: usage})
+
+	result, err := model.ChatCompletion(context.Background(), llm.CompletionRequest{})
+	require.NoError(t, err)
+
+	var events []llm.StreamEvent
+	for event := range result.Events {
+		events = append(events, event)
+	}
+	assert.Equal(t, []llm.StreamEvent{
+		{Type: llm.EventTypeUsage, Usage: &usage},
+		{Type: llm.EventTypeEnd, FinishReason: llm.FinishReasonStop},
+	}, events)
+}
+
+func TestFailoverIgnoresRequestErrors(t *testing.T) {
+	badRequest := &openaiClient.APIError{HTTPStatusCode: http.StatusBadRequest, Message: "invalid request"}
+	primary := &scriptedModel{callErr: badRequest}
+	fallback := &scriptedModel{chunks: []string{"Other"}}
+	model, failovers := newTestFailoverModel(&circuitBreakers{}, primary, fallback)
+
+	_, err := model.ChatCompletion(context.Background(), llm.CompletionRequest{})
+	assert.ErrorIs(t, err, badRequest)
+	assert.Empty(t, *failovers)
+	assert.Zero(t, fallback.calls)
+}
+
+func TestFailoverStopsWhenCancelled(t *testing.T) {
+	primary := &scriptedModel{callErr: context.DeadlineExceeded}
+	fallback := &scriptedModel{chunks: []string{"Other"}}
+	model, failovers := newTestFailoverModel(&circuitBreakers{}, primary, fallback)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := model.ChatCompletionNoStream(ctx, llm.CompletionRequest{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, *failovers)
+	assert.Zero(t, fallback.calls)
+}
+
+func TestFailoverAllServicesFail(t *testing.T) {
+	primary := &scriptedModel{callErr: &llm.APIError{Provider: "ollama", StatusCode: http.StatusBadGateway}}
+	fallback := &scriptedModel{err: &llm.APIError{Provider: "gemini", StatusCode: http.StatusTooManyRequests}}
+	model, failovers := newTestFailoverModel(&circuitBreakers{}, primary, fallback)
+
+	_, err := model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{})
+	assert.ErrorContains(t, err, "gemini returned status 429")
+	assert.Equal(t, []failoverRecord{{"service0", "service1"}}, *failovers)
+}
+
+func TestFailoverCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breakers := &circuitBreakers{now: func() time.Time { return now }}
+	primary := &scriptedModel{callErr: &llm.APIError{Provider: "ollama", StatusCode: http.StatusServiceUnavailable}}
+	fallback := &scriptedModel{chunks: []string{"ok"}}
+	model, failovers := newTestFailoverModel(breakers, primary, fallback)
+
+	for range CircuitBreakerThreshold {
+		text, err := model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "ok", text)
+	}
+	assert.Equal(t, CircuitBreakerThreshold, primary.calls)
+	assert.Len(t, *failovers, CircuitBreakerThreshold)
+
+	// The open breaker skips the primary entirely
+	_, err := model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, CircuitBreakerThreshold, primary.calls)
+	assert.Len(t, *failovers, CircuitBreakerThreshold)
+
+	// After the cooldown the primary is tried again and recovers
+	now = now.Add(CircuitBreakerCooldown)
+	primary.callErr = nil
+	primary.chunks = []string{"primary"}
+	text, err := model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", text)
+	assert.True(t, breakers.allow("bot/service0"))
+}
+
+func TestShouldFailover(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{openai.ErrStreamingTimeout, true},
+		{fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF), true},
+		{&openaiClient.RequestError{HTTPStatusCode: http.StatusInternalServerError}, true},
+		{&openaiClient.APIError{HTTPStatusCode: http.StatusTooManyRequests}, true},
+		{&openaiClient.APIError{HTTPStatusCode: http.StatusUnauthorized}, false},
+		{&llm.APIError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&llm.APIError{StatusCode: http.StatusNotFound}, false},
+		{errors.New("too many function calls"), false},
+	} {
+		assert.Equal(t, tc.want, shouldFailover(tc.err), "%v", tc.err)
+	}
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/mattermost/mattermost-plugin-ai/server/llm"
@@ -27,14 +28,14 @@ func (w *LanguageModelLogWrapper) logInput(request llm.CompletionRequest, opts .
 	w.log.Info("LLM Call", "prompt", prompt)
 }
 
-func (w *LanguageModelLogWrapper) ChatCompletion(request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+func (w *LanguageModelLogWrapper) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
 	w.logInput(request, opts...)
-	return w.wrapped.ChatCompletion(request, opts...)
+	return w.wrapped.ChatCompletion(ctx, request, opts...)
 }
 
-func (w *LanguageModelLogWrapper) ChatCompletionNoStream(request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+func (w *LanguageModelLogWrapper) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
 	w.logInput(request, opts...)
-	return w.wrapped.ChatCompletionNoStream(request, opts...)
+	return w.wrapped.ChatCompletionNoStream(ctx, request, opts...)
 }
 
 func (w *LanguageModelLogWrapper) CountTokens(text string) int {
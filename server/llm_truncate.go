@@ -4,8 +4,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"math"
+	"slices"
+	"strings"
+	"sync"
 
+	"github.com/invopop/jsonschema"
 	"github.com/mattermost/mattermost-plugin-ai/server/llm"
 )
 
@@ -13,26 +20,35 @@ const FunctionsTokenBudget = 200
 const TokenLimitBufferSize = 0.9
 const MinTokens = 100
 
+// LLMTruncationWrapper fits requests into the context window of the wrapped model, summarizing the history it
+// drops when prompts are set
 type LLMTruncationWrapper struct {
-	wrapped llm.LanguageModel
+	wrapped  llm.LanguageModel
+	model    string
+	prompts  *llm.Prompts
+	cache    llm.HistorySummaryCache
+	logError func(msg string, keyValuePairs ...any)
 }
 
-func NewLLMTruncationWrapper(llm llm.LanguageModel) *LLMTruncationWrapper {
+// NewLLMTruncationWrapper wraps the model configured as model, the name the service's token counter learns under
+func NewLLMTruncationWrapper(llm llm.LanguageModel, model string, prompts *llm.Prompts, cache llm.HistorySummaryCache, logError func(msg string, keyValuePairs ...any)) *LLMTruncationWrapper {
 	return &LLMTruncationWrapper{
-		wrapped: llm,
+		wrapped:  llm,
+		model:    model,
+		prompts:  prompts,
+		cache:    cache,
+		logError: logError,
 	}
 }
 
-func (w *LLMTruncationWrapper) ChatCompletion(request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
-	tokenLimit := int(math.Max(math.Floor(float64(w.wrapped.InputTokenLimit()-FunctionsTokenBudget)*TokenLimitBufferSize), MinTokens))
-	request.Truncate(tokenLimit, w.wrapped.CountTokens)
-	return w.wrapped.ChatCompletion(request, opts...)
+func (w *LLMTruncationWrapper) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	w.fit(ctx, &request, opts)
+	return w.wrapped.ChatCompletion(ctx, request, learnTokenRatio(w.model, request, opts)...)
 }
 
-func (w *LLMTruncationWrapper) ChatCompletionNoStream(request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
-	tokenLimit := int(math.Max(math.Floor(float64(w.wrapped.InputTokenLimit()-FunctionsTokenBudget)*TokenLimitBufferSize), MinTokens))
-	request.Truncate(tokenLimit, w.wrapped.CountTokens)
-	return w.wrapped.ChatCompletionNoStream(request, opts...)
+func (w *LLMTruncationWrapper) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	w.fit(ctx, &request, opts)
+	return w.wrapped.ChatCompletionNoStream(ctx, request, learnTokenRatio(w.model, request, opts)...)
 }
 
 func (w *LLMTruncationWrapper) CountTokens(text string) int {
@@ -42,3 +58,141 @@ func (w *LLMTruncationWrapper) CountTokens(text string) int {
 func (w *LLMTruncationWrapper) InputTokenLimit() int {
 	return w.wrapped.InputTokenLimit()
 }
+
+func (w *LLMTruncationWrapper) tokenLimit() int {
+	return int(math.Max(math.Floor(float64(w.wrapped.InputTokenLimit()-FunctionsTokenBudget)*TokenLimitBufferSize), MinTokens))
+}
+
+// fit truncates the request, the request is still sent if the dropped history can't be summarized
+func (w *LLMTruncationWrapper) fit(ctx context.Context, request *llm.CompletionRequest, opts []llm.LanguageModelOption) {
+	manager := llm.ContextManager{
+		CountTokens: w.wrapped.CountTokens,
+		Cache:       w.cache,
+	}
+	if w.prompts != nil {
+		manager.Summarizer = func(ctx context.Context, previous string, posts []llm.Post) (string, error) {
+			return w.summarize(ctx, request.Feature, previous, posts, opts)
+		}
+	}
+
+	if _, err := manager.Fit(ctx, request, w.tokenLimit()); err != nil && w.logError != nil {
+		w.logError("Failed to summarize dropped conversation history", "error", err.Error())
+	}
+}
+
+// learnTokenRatio passes the input tokens the service reports for the request to the learned chars per token
+// ratio of the configured model, used to count tokens for models without a known tokenizer. The ratio is
+// learned from everything sent as text, requests with images or for another model aren't observed.
+func learnTokenRatio(model string, request llm.CompletionRequest, opts []llm.LanguageModelOption) []llm.LanguageModelOption {
+	var cfg llm.LanguageModelConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if model == "" || (cfg.Model != "" && cfg.Model != model) || requestHasFiles(request) {
+		return opts
+	}
+
+	var once sync.Once
+	return append(slices.Clone(opts), llm.WithUsageCallback(func(usage llm.TokenUsage) {
+		// Requests resolving tools make more calls, only the first is for the request as it was counted
+		once.Do(func() {
+			llm.ObserveTokenUsage(model, requestText(request, cfg), usage.InputTokens)
+		})
+		cfg.ReportUsage(usage)
+	}))
+}
+
+func requestHasFiles(request llm.CompletionRequest) bool {
+	for _, post := range request.Posts {
+		if len(post.Files) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestText is the text the service receives for the request: the posts, the tool calls and their results,
+// the definitions of the tools and the schema of a structured response
+func requestText(request llm.CompletionRequest, cfg llm.LanguageModelConfig) string {
+	var text strings.Builder
+	for _, post := range request.Posts {
+		text.WriteString(post.Message)
+		for _, call := range post.ToolCalls {
+			text.WriteString(call.Name)
+			text.WriteString(call.Arguments)
+			text.WriteString(call.ModelResult())
+		}
+	}
+
+	if request.Context != nil && request.Context.Tools != nil {
+		reflector := jsonschema.Reflector{AllowAdditionalProperties: false, ExpandedStruct: true}
+		for _, tool := range request.Context.Tools.GetTools() {
+			text.WriteString(tool.Name)
+			text.WriteString(tool.Description)
+			if schema, err := json.Marshal(llm.ToolSchema(&reflector, tool)); err == nil {
+				text.Write(schema)
+			}
+		}
+	}
+
+	if cfg.JSONSchema != nil {
+		if schema, err := json.Marshal(cfg.JSONSchema); err == nil {
+			text.Write(schema)
+		}
+	}
+
+	return text.String()
+}
+
+type historyLine struct {
+	Speaker string
+	Message string
+}
+
+// summarize asks the wrapped model for the summary. The request's options are kept so the summary counts
+// towards the request's usage.
+func (w *LLMTruncationWrapper) summarize(ctx context.Context, feature, previous string, posts []llm.Post, opts []llm.LanguageModelOption) (string, error) {
+	lines := make([]historyLine, 0, len(posts))
+	for _, post := range posts {
+		speaker := "User"
+		if post.Role == llm.PostRoleBot {
+			speaker = "Assistant"
+		}
+		lines = append(lines, historyLine{Speaker: speaker, Message: post.Message})
+	}
+
+	llmContext := llm.NewContext(func(c *llm.Context) {
+		c.Parameters = map[string]interface{}{
+			"PreviousSummary": previous,
+			"Posts":           lines,
+		}
+	})
+
+	systemMessage, err := w.prompts.Format(llm.PromptSummarizeHistorySystem, llmContext)
+	if err != nil {
+		return "", fmt.Errorf("failed to format history summary system message: %w", err)
+	}
+
+	userMessage, err := w.prompts.Format(llm.PromptSummarizeHistoryUser, llmContext)
+	if err != nil {
+		return "", fmt.Errorf("failed to format history summary user message: %w", err)
+	}
+
+	summaryRequest := llm.CompletionRequest{
+		Posts: []llm.Post{
+			{Role: llm.PostRoleSystem, Message: systemMessage},
+			{Role: llm.PostRoleUser, Message: userMessage},
+		},
+		Context: llmContext,
+		Feature: feature,
+	}
+	// The history may itself be too long to summarize in one go
+	summaryRequest.Truncate(w.tokenLimit(), w.wrapped.CountTokens)
+
+	return w.wrapped.ChatCompletionNoStream(ctx, summaryRequest, append(slices.Clone(opts),
+		llm.WithMaxGeneratedTokens(llm.SummaryTokenBudget),
+		llm.WithTemperature(llm.SummaryTemperature),
+		// The summary is text even if the request wants a structured response
+		func(cfg *llm.LanguageModelConfig) { cfg.JSONSchema = nil },
+	)...)
+}
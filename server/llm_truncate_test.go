@@ -0,0 +1,52 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+type ratioTestArgs struct {
+	Query string `jsonschema_description:"What to search for"`
+}
+
+func TestLearnTokenRatio(t *testing.T) {
+	tools := llm.NewNoTools()
+	tools.AddTools([]llm.Tool{{
+		Name:        "search",
+		Description: "Search the posts of the channels the user can read",
+		Schema:      ratioTestArgs{},
+		Resolver: func(_ context.Context, _ *llm.Context, _ llm.ToolArgumentGetter) (string, error) {
+			return "", nil
+		},
+	}})
+	request := llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "What was decided about the release?"}},
+		Context: llm.NewContext(func(c *llm.Context) { c.Tools = tools }),
+	}
+	text := requestText(request, llm.LanguageModelConfig{})
+	assert.Contains(t, text, "Search the posts of the channels")
+
+	report := func(model string, opts ...llm.LanguageModelOption) {
+		var cfg llm.LanguageModelConfig
+		for _, opt := range learnTokenRatio(model, request, opts) {
+			opt(&cfg)
+		}
+		// Services report the model version they resolved the configured name to
+		cfg.ReportUsage(llm.TokenUsage{Model: model + "-2025-01-01", InputTokens: 100})
+	}
+
+	// Requests for another model than the configured one aren't observed
+	report("ratio-test-model", llm.WithModel("ratio-test-other"))
+	assert.Equal(t, llm.EstimateTokens(text), llm.NewTokenCounter("ratio-test-model")(text))
+
+	// The ratio is learned under the configured model, from the whole request
+	report("ratio-test-model")
+	assert.Equal(t, 100, llm.NewTokenCounter("ratio-test-model")(text))
+	assert.Equal(t, llm.EstimateTokens(text), llm.NewTokenCounter("ratio-test-model-2025-01-01")(text))
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+// Package mcp is a client for Model Context Protocol servers, which expose tools the models can call
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// ProtocolVersion is the version of the protocol the client asks for when it connects
+const ProtocolVersion = "2025-03-26"
+
+// maxMessageSize is the largest message read from a server, tool results can be large
+const maxMessageSize = 10 * 1024 * 1024
+
+const (
+	TransportStdio = "stdio"
+	TransportHTTP  = "http"
+)
+
+var (
+	// ErrToolFailed is returned when the server ran the tool but the tool reported an error
+	ErrToolFailed = errors.New("tool returned an error")
+	// ErrDisconnected is returned once the server exited or ended the session, the client must connect again
+	ErrDisconnected = errors.New("disconnected from MCP server")
+)
+
+// ServerConfig is an MCP server the tools come from
+type ServerConfig struct {
+	Name      string `json:"name"`
+	Transport string `json:"transport"` // stdio or http
+
+	// Command starts the server for the stdio transport
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+
+	// URL is the endpoint of the server for the http transport, sent with Headers
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+
+	// BotIDs are the bots that can use the server's tools, all bots can when it is empty
+	BotIDs []string `json:"botIDs"`
+	// ChannelTypes are the kinds of channel the tools can be used in: direct, public, private or group, like in
+	// the bots' tool policies. Only DMs with the bot can use them when it is empty, in other channels everyone
+	// sees the results.
+	ChannelTypes []string `json:"channelTypes"`
+	// UserSecretHeader is the header each user's own secret for the server is sent in, for the http transport
+	UserSecretHeader string `json:"userSecretHeader"`
+}
+
+// IsValid checks that the server can be connected to
+func (c *ServerConfig) IsValid() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	switch c.Transport {
+	case TransportStdio:
+		if c.Command == "" {
+			return errors.New("command is required for the stdio transport")
+		}
+		if c.UserSecretHeader != "" {
+			return errors.New("user secrets are only supported by the http transport")
+		}
+	case TransportHTTP:
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return errors.New("an http or https URL is required for the http transport")
+		}
+	default:
+		return fmt.Errorf("unsupported transport %q", c.Transport)
+	}
+	for _, channelType := range c.ChannelTypes {
+		if !slices.Contains(channelTypes, channelType) {
+			return fmt.Errorf("unsupported channel type %q", channelType)
+		}
+	}
+	return nil
+}
+
+// channelTypes are the kinds of channel a server can be allowed in
+var channelTypes = []string{"direct", "public", "private", "group"}
+
+// AllowsChannelType reports whether the tools can be used in the kind of channel
+func (c *ServerConfig) AllowsChannelType(channelType string) bool {
+	if len(c.ChannelTypes) == 0 {
+		return channelType == "direct"
+	}
+	return slices.Contains(c.ChannelTypes, channelType)
+}
+
+// Tool is a tool the server exposes
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+	Annotations struct {
+		ReadOnlyHint bool `json:"readOnlyHint"`
+	} `json:"annotations"`
+}
+
+// ReadOnly reports whether the server says the tool doesn't change anything. Tools are assumed to have side
+// effects unless they say otherwise.
+func (t Tool) ReadOnly() bool {
+	return t.Annotations.ReadOnlyHint
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      *int64 `json:"id,omitempty"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// rpcMessage is any message from the server: a response, or a request or notification of its own
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// transport sends requests to the server. Headers are added to the request where the transport supports them.
+type transport interface {
+	call(ctx context.Context, request rpcRequest, header http.Header) (*rpcMessage, error)
+	notify(ctx context.Context, request rpcRequest) error
+	close() error
+}
+
+// Client is a connection to an MCP server, it is safe for concurrent use
+type Client struct {
+	transport transport
+	nextID    atomic.Int64
+}
+
+// Connect starts or connects to the server and completes the protocol's handshake
+func Connect(ctx context.Context, cfg ServerConfig, httpClient *http.Client) (*Client, error) {
+	if err := cfg.IsValid(); err != nil {
+		return nil, fmt.Errorf("invalid MCP server %s: %w", cfg.Name, err)
+	}
+
+	var t transport
+	switch cfg.Transport {
+	case TransportStdio:
+		stdio, err := newStdioTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		t = stdio
+	case TransportHTTP:
+		t = newHTTPTransport(cfg, httpClient)
+	}
+
+	client := &Client{transport: t}
+	if err := client.initialize(ctx); err != nil {
+		_ = t.close()
+		return nil, fmt.Errorf("failed to initialize MCP server %s: %w", cfg.Name, err)
+	}
+	return client, nil
+}
+
+func (c *Client) initialize(ctx context.Context) error {
+	params := map[string]any{
+		"protocolVersion": ProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo": map[string]any{
+			"name":    "mattermost-ai",
+			"version": "1.0.0",
+		},
+	}
+	if err := c.request(ctx, "initialize", params, nil, nil); err != nil {
+		return err
+	}
+	return c.transport.notify(ctx, rpcRequest{JSONRPC: "2.0", Method: "notifications/initialized"})
+}
+
+// ListTools returns all the tools of the server, following its pages
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+	var tools []Tool
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var page struct {
+			Tools      []Tool `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := c.request(ctx, "tools/list", params, nil, &page); err != nil {
+			return nil, fmt.Errorf("failed to list tools: %w", err)
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+type toolContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// CallTool calls a tool and returns its text content. When the tool reports an error its content is returned
+// with ErrToolFailed so the model can see what went wrong.
+func (c *Client) CallTool(ctx context.Context, name string, arguments json.RawMessage, header http.Header) (string, error) {
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	params := map[string]any{
+		"name":      name,
+		"arguments": arguments,
+	}
+	var result struct {
+		Content []toolContent `json:"content"`
+		IsError bool          `json:"isError"`
+	}
+	if err := c.request(ctx, "tools/call", params, header, &result); err != nil {
+		return "", fmt.Errorf("failed to call tool %s: %w", name, err)
+	}
+
+	parts := make([]string, 0, len(result.Content))
+	for _, content := range result.Content {
+		if content.Type == "text" {
+			parts = append(parts, content.Text)
+		} else {
+			parts = append(parts, fmt.Sprintf("[%s content omitted]", content.Type))
+		}
+	}
+	text := strings.Join(parts, "\n")
+
+	if result.IsError {
+		return text, ErrToolFailed
+	}
+	return text, nil
+}
+
+// Close stops or disconnects from the server
+func (c *Client) Close() error {
+	return c.transport.close()
+}
+
+func (c *Client) request(ctx context.Context, method string, params any, header http.Header, result any) error {
+	id := c.nextID.Add(1)
+	response, err := c.transport.call(ctx, rpcRequest{JSONRPC: "2.0", ID: &id, Method: method, Params: params}, header)
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("failed to unmarshal %s result: %w", method, err)
+	}
+	return nil
+}
+
+// responseID returns the ID of a response to one of the client's requests, false for the server's own messages
+func (m *rpcMessage) responseID() (int64, bool) {
+	if m.Method != "" || len(m.ID) == 0 {
+		return 0, false
+	}
+	var id int64
+	if err := json.Unmarshal(m.ID, &id); err != nil {
+		return 0, false
+	}
+	return id, true
+}
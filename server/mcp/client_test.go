@@ -0,0 +1,226 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubServerEnv makes the test binary run as a stub MCP server over stdio
+const stubServerEnv = "MCP_STUB_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(stubServerEnv) != "" {
+		runStdioStub()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// stubResponse answers a message like an MCP server with the tools echo and fail, listed on two pages. The
+// result of echo includes the secret header so tests can check it was forwarded.
+func stubResponse(message rpcMessage, params json.RawMessage, secret string) any {
+	var result any
+	switch message.Method {
+	case "initialize":
+		result = map[string]any{
+			"protocolVersion": ProtocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "stub", "version": "1.0.0"},
+		}
+	case "tools/list":
+		var list struct {
+			Cursor string `json:"cursor"`
+		}
+		_ = json.Unmarshal(params, &list)
+		if list.Cursor == "" {
+			result = map[string]any{
+				"tools":      []any{map[string]any{"name": "echo", "description": "Echoes the text", "inputSchema": map[string]any{"type": "object", "properties": map[string]any{"text": map[string]any{"type": "string"}}}}},
+				"nextCursor": "2",
+			}
+		} else {
+			result = map[string]any{
+				"tools": []any{map[string]any{"name": "fail", "description": "Always fails", "inputSchema": map[string]any{"type": "object"}}},
+			}
+		}
+	case "tools/call":
+		var call struct {
+			Name      string `json:"name"`
+			Arguments struct {
+				Text string `json:"text"`
+			} `json:"arguments"`
+		}
+		_ = json.Unmarshal(params, &call)
+		switch call.Name {
+		case "echo":
+			text := call.Arguments.Text
+			if secret != "" {
+				text += " as " + secret
+			}
+			result = map[string]any{"content": []any{
+				map[string]any{"type": "text", "text": text},
+				map[string]any{"type": "image", "data": "", "mimeType": "image/png"},
+			}}
+		case "fail":
+			result = map[string]any{"content": []any{map[string]any{"type": "text", "text": "it broke"}}, "isError": true}
+		default:
+			return map[string]any{"jsonrpc": "2.0", "id": message.ID, "error": map[string]any{"code": -32602, "message": "unknown tool"}}
+		}
+	default:
+		return map[string]any{"jsonrpc": "2.0", "id": message.ID, "error": map[string]any{"code": -32601, "message": "method not found"}}
+	}
+	return map[string]any{"jsonrpc": "2.0", "id": message.ID, "result": result}
+}
+
+type stubMessage struct {
+	rpcMessage
+	Params json.RawMessage `json:"params"`
+}
+
+func runStdioStub() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var message stubMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil || len(message.ID) == 0 || message.Method == "" {
+			continue
+		}
+		// A ping from the server first, the client answers it without mixing it up with its own responses
+		if message.Method == "tools/call" {
+			fmt.Println(`{"jsonrpc":"2.0","id":"ping-1","method":"ping"}`)
+		}
+		data, _ := json.Marshal(stubResponse(message.rpcMessage, message.Params, ""))
+		fmt.Println(string(data))
+	}
+}
+
+// newHTTPStub serves the stub over HTTP, answering tool calls with an event stream. Its session expires when
+// the client ends it.
+func newHTTPStub(t *testing.T) *httptest.Server {
+	expired := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			assert.Equal(t, "session-1", r.Header.Get(sessionIDHeader))
+			expired = true
+			return
+		}
+		if expired {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		assert.Equal(t, "admin-token", r.Header.Get("Authorization"))
+
+		var message stubMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+		if message.Method == "initialize" {
+			w.Header().Set(sessionIDHeader, "session-1")
+		} else {
+			assert.Equal(t, "session-1", r.Header.Get(sessionIDHeader))
+		}
+		if len(message.ID) == 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		data, err := json.Marshal(stubResponse(message.rpcMessage, message.Params, r.Header.Get("X-User-Secret")))
+		require.NoError(t, err)
+		if message.Method == "tools/call" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\"}\n\n")
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testClientTools(t *testing.T, client *Client, secretHeader http.Header, echoResult string) {
+	t.Helper()
+	ctx := context.Background()
+
+	tools, err := client.ListTools(ctx)
+	require.NoError(t, err)
+	require.Len(t, tools, 2)
+	assert.Equal(t, "echo", tools[0].Name)
+	assert.Equal(t, "Echoes the text", tools[0].Description)
+	assert.JSONEq(t, `{"type":"object","properties":{"text":{"type":"string"}}}`, string(tools[0].InputSchema))
+	assert.Equal(t, "fail", tools[1].Name)
+
+	result, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"hi"}`), secretHeader)
+	require.NoError(t, err)
+	assert.Equal(t, echoResult+"\n[image content omitted]", result)
+
+	result, err = client.CallTool(ctx, "fail", nil, nil)
+	assert.ErrorIs(t, err, ErrToolFailed)
+	assert.Equal(t, "it broke", result)
+
+	_, err = client.CallTool(ctx, "missing", nil, nil)
+	assert.ErrorContains(t, err, "unknown tool")
+}
+
+func TestClientHTTP(t *testing.T) {
+	server := newHTTPStub(t)
+	client, err := Connect(context.Background(), ServerConfig{
+		Name:      "stub",
+		Transport: TransportHTTP,
+		URL:       server.URL,
+		Headers:   map[string]string{"Authorization": "admin-token"},
+	}, server.Client())
+	require.NoError(t, err)
+
+	testClientTools(t, client, http.Header{"X-User-Secret": []string{"user-token"}}, "hi as user-token")
+	require.NoError(t, client.Close())
+
+	_, err = client.ListTools(context.Background())
+	assert.ErrorIs(t, err, ErrDisconnected)
+}
+
+func TestClientStdio(t *testing.T) {
+	executable, err := os.Executable()
+	require.NoError(t, err)
+	client, err := Connect(context.Background(), ServerConfig{
+		Name:      "stub",
+		Transport: TransportStdio,
+		Command:   executable,
+		Env:       map[string]string{stubServerEnv: "1"},
+	}, nil)
+	require.NoError(t, err)
+
+	testClientTools(t, client, nil, "hi")
+	require.NoError(t, client.Close())
+
+	_, err = client.ListTools(context.Background())
+	assert.ErrorIs(t, err, ErrDisconnected)
+}
+
+func TestServerConfigIsValid(t *testing.T) {
+	for name, test := range map[string]struct {
+		cfg   ServerConfig
+		valid bool
+	}{
+		"stdio":                   {ServerConfig{Name: "a", Transport: TransportStdio, Command: "server"}, true},
+		"http":                    {ServerConfig{Name: "a", Transport: TransportHTTP, URL: "https://mcp.example.com/mcp", UserSecretHeader: "Authorization"}, true},
+		"no name":                 {ServerConfig{Transport: TransportStdio, Command: "server"}, false},
+		"stdio without command":   {ServerConfig{Name: "a", Transport: TransportStdio}, false},
+		"stdio with user secrets": {ServerConfig{Name: "a", Transport: TransportStdio, Command: "server", UserSecretHeader: "Authorization"}, false},
+		"http without url":        {ServerConfig{Name: "a", Transport: TransportHTTP, URL: "mcp.example.com"}, false},
+		"unknown transport":       {ServerConfig{Name: "a", Transport: "sse"}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.valid, test.cfg.IsValid() == nil)
+		})
+	}
+}
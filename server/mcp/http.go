@@ -0,0 +1,184 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const sessionIDHeader = "Mcp-Session-Id"
+
+// httpTransport posts each message to the server's endpoint, which answers with JSON or a stream of events
+type httpTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	sessionLock sync.RWMutex
+	sessionID   string
+}
+
+func newHTTPTransport(cfg ServerConfig, client *http.Client) *httpTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpTransport{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client:  client,
+	}
+}
+
+func (t *httpTransport) newRequest(ctx context.Context, method string, body io.Reader, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MCP request: %w", err)
+	}
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("MCP-Protocol-Version", ProtocolVersion)
+
+	t.sessionLock.RLock()
+	if t.sessionID != "" {
+		req.Header.Set(sessionIDHeader, t.sessionID)
+	}
+	t.sessionLock.RUnlock()
+	return req, nil
+}
+
+func (t *httpTransport) post(ctx context.Context, request rpcRequest, header http.Header) (*http.Response, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal MCP message: %w", err)
+	}
+	req, err := t.newRequest(ctx, http.MethodPost, bytes.NewReader(data), header)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send MCP request: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound && req.Header.Get(sessionIDHeader) != "" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: the session expired", ErrDisconnected)
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("MCP server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	// The server assigns the session when the client initializes
+	if sessionID := resp.Header.Get(sessionIDHeader); sessionID != "" {
+		t.sessionLock.Lock()
+		t.sessionID = sessionID
+		t.sessionLock.Unlock()
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) call(ctx context.Context, request rpcRequest, header http.Header) (*rpcMessage, error) {
+	resp, err := t.post(ctx, request, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return readEventStream(resp.Body, *request.ID)
+	}
+
+	var message rpcMessage
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		return nil, fmt.Errorf("failed to decode MCP response: %w", err)
+	}
+	return &message, nil
+}
+
+// readEventStream reads the events the server streams until the response to the request, skipping the
+// server's own messages
+func readEventStream(body io.Reader, id int64) (*rpcMessage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(value, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+
+		// A blank line ends the event
+		var message rpcMessage
+		err := json.Unmarshal([]byte(data.String()), &message)
+		data.Reset()
+		if err != nil {
+			continue
+		}
+		if responseID, ok := message.responseID(); ok && responseID == id {
+			return &message, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read MCP event stream: %w", err)
+	}
+	return nil, errors.New("MCP event stream ended without a response")
+}
+
+func (t *httpTransport) notify(ctx context.Context, request rpcRequest) error {
+	resp, err := t.post(ctx, request, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// close ends the session. Servers that don't support ending sessions let them expire.
+func (t *httpTransport) close() error {
+	t.sessionLock.RLock()
+	sessionID := t.sessionID
+	t.sessionLock.RUnlock()
+	if sessionID == "" {
+		return nil
+	}
+
+	req, err := t.newRequest(context.Background(), http.MethodDelete, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to end MCP session: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
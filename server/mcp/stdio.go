@@ -0,0 +1,186 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// stdioShutdownTimeout is how long a server has to exit once its input is closed
+const stdioShutdownTimeout = 2 * time.Second
+
+// stdioTransport runs the server as a child process and exchanges newline delimited messages over its standard
+// input and output
+type stdioTransport struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeLock sync.Mutex
+
+	pendingLock sync.Mutex
+	pending     map[int64]chan *rpcMessage
+	exited      bool
+}
+
+func newStdioTransport(cfg ServerConfig) (*stdioTransport, error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...) //nolint:gosec // The command is set by a system admin
+	cmd.Env = os.Environ()
+	for key, value := range cfg.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdin of MCP server: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdout of MCP server: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start MCP server: %w", err)
+	}
+
+	t := &stdioTransport{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan *rpcMessage),
+	}
+	go t.read(stdout)
+	return t, nil
+}
+
+// read dispatches the server's responses to the waiting calls until the server exits
+func (t *stdioTransport) read(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		var message rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+
+		if id, ok := message.responseID(); ok {
+			t.pendingLock.Lock()
+			response, waiting := t.pending[id]
+			delete(t.pending, id)
+			t.pendingLock.Unlock()
+			if waiting {
+				response <- &message
+			}
+			continue
+		}
+
+		// Requests from the server need an answer, notifications don't
+		if message.Method != "" && len(message.ID) > 0 {
+			t.answer(message)
+		}
+	}
+
+	t.pendingLock.Lock()
+	t.exited = true
+	for id, response := range t.pending {
+		close(response)
+		delete(t.pending, id)
+	}
+	t.pendingLock.Unlock()
+}
+
+// answer replies to the server's pings and tells it the client doesn't support its other requests
+func (t *stdioTransport) answer(request rpcMessage) {
+	reply := map[string]any{
+		"jsonrpc": "2.0",
+		"id":      request.ID,
+	}
+	if request.Method == "ping" {
+		reply["result"] = map[string]any{}
+	} else {
+		reply["error"] = rpcError{Code: -32601, Message: "method not found"}
+	}
+	_ = t.write(reply)
+}
+
+func (t *stdioTransport) write(message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal MCP message: %w", err)
+	}
+
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if _, err := t.stdin.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("%w: failed to write to the server: %w", ErrDisconnected, err)
+	}
+	return nil
+}
+
+// call sends the request and waits for its response. Headers don't apply to a child process.
+func (t *stdioTransport) call(ctx context.Context, request rpcRequest, _ http.Header) (*rpcMessage, error) {
+	response := make(chan *rpcMessage, 1)
+	t.pendingLock.Lock()
+	if t.exited {
+		t.pendingLock.Unlock()
+		return nil, fmt.Errorf("%w: the server exited", ErrDisconnected)
+	}
+	t.pending[*request.ID] = response
+	t.pendingLock.Unlock()
+
+	forget := func() {
+		t.pendingLock.Lock()
+		delete(t.pending, *request.ID)
+		t.pendingLock.Unlock()
+	}
+
+	if err := t.write(request); err != nil {
+		forget()
+		return nil, err
+	}
+
+	select {
+	case message, ok := <-response:
+		if !ok {
+			return nil, fmt.Errorf("%w: the server exited", ErrDisconnected)
+		}
+		return message, nil
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+}
+
+func (t *stdioTransport) notify(_ context.Context, request rpcRequest) error {
+	return t.write(request)
+}
+
+// close ends the server by closing its input, as the protocol asks, and kills it if it doesn't exit in time
+func (t *stdioTransport) close() error {
+	_ = t.stdin.Close()
+
+	exited := make(chan struct{})
+	go func() {
+		_ = t.cmd.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(stdioShutdownTimeout):
+	}
+	if err := t.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("failed to stop MCP server: %w", err)
+	}
+	<-exited
+	return nil
+}
@@ -0,0 +1,257 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/invopop/jsonschema"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/mcp"
+)
+
+const (
+	mcpConnectTimeout  = 30 * time.Second
+	mcpToolCallTimeout = time.Minute
+	// mcpRetryInterval is how long a server that failed to connect is left alone before it is tried again
+	mcpRetryInterval = time.Minute
+
+	mcpUserSecretKeyPrefix = "mcp_secret_"
+	// maxToolNameLength is the longest tool name every service accepts
+	maxToolNameLength = 64
+)
+
+var invalidToolNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mcpServer is a connected MCP server with the tools it had when it connected
+type mcpServer struct {
+	cfg    mcp.ServerConfig
+	client *mcp.Client
+	tools  []mcp.Tool
+}
+
+// mcpConnection is the state of a configured server: connecting, connected or waiting to be tried again
+type mcpConnection struct {
+	server   *mcpServer
+	failedAt time.Time
+	// connecting is closed once the connection attempt is over
+	connecting chan struct{}
+}
+
+// getMCPTools returns the tools of the MCP servers the bot can use in the kind of channel. Servers are connected
+// the first time their tools are needed and stay connected until the configuration changes.
+func (p *Plugin) getMCPTools(bot *Bot, kind llm.ToolChannelKind) []llm.Tool {
+	var tools []llm.Tool
+	for _, cfg := range p.getConfiguration().MCPServers {
+		if !cfg.AllowsChannelType(string(kind)) {
+			continue
+		}
+		if len(cfg.BotIDs) > 0 && !slices.Contains(cfg.BotIDs, bot.cfg.ID) {
+			continue
+		}
+
+		server := p.getMCPServer(cfg)
+		if server == nil {
+			continue
+		}
+		for _, tool := range server.tools {
+			tools = append(tools, llm.Tool{
+				Name:        mcpToolName(cfg.Name, tool.Name),
+				Description: tool.Description,
+				Schema:      mcpToolSchema(tool),
+				Resolver:    p.mcpToolResolver(server, tool.Name),
+				SideEffects: !tool.ReadOnly(),
+			})
+		}
+	}
+	return tools
+}
+
+// getMCPServer returns the connected server, connecting to it if it isn't already. The lock isn't held while
+// connecting, requests needing a server that is being connected wait for that attempt.
+func (p *Plugin) getMCPServer(cfg mcp.ServerConfig) *mcpServer {
+	p.mcpLock.Lock()
+	if p.mcpConnections == nil {
+		p.mcpConnections = make(map[string]*mcpConnection)
+	}
+	connection, ok := p.mcpConnections[cfg.Name]
+	switch {
+	case ok && connection.connecting != nil:
+		connecting := connection.connecting
+		p.mcpLock.Unlock()
+		<-connecting
+
+		p.mcpLock.Lock()
+		defer p.mcpLock.Unlock()
+		return connection.server
+	case ok && connection.server != nil:
+		server := connection.server
+		p.mcpLock.Unlock()
+		return server
+	case ok && time.Since(connection.failedAt) < mcpRetryInterval:
+		p.mcpLock.Unlock()
+		return nil
+	}
+	connection = &mcpConnection{connecting: make(chan struct{})}
+	p.mcpConnections[cfg.Name] = connection
+	p.mcpLock.Unlock()
+
+	server, err := p.connectMCPServer(cfg)
+	if err != nil {
+		p.pluginAPI.Log.Error("Failed to connect to MCP server, its tools will be unavailable", "server", cfg.Name, "error", err)
+	}
+
+	p.mcpLock.Lock()
+	defer p.mcpLock.Unlock()
+	defer close(connection.connecting)
+	connection.connecting = nil
+
+	// The servers were closed while connecting, the configuration may have changed
+	if p.mcpConnections[cfg.Name] != connection {
+		if server != nil {
+			_ = server.client.Close()
+		}
+		return nil
+	}
+	if err != nil {
+		connection.failedAt = time.Now()
+		return nil
+	}
+	connection.server = server
+	return server
+}
+
+func (p *Plugin) connectMCPServer(cfg mcp.ServerConfig) (*mcpServer, error) {
+	ctx, cancel := context.WithTimeout(p.activeContext(), mcpConnectTimeout)
+	defer cancel()
+
+	client, err := mcp.Connect(ctx, cfg, p.llmUpstreamHTTPClient)
+	if err != nil {
+		return nil, err
+	}
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return &mcpServer{cfg: cfg, client: client, tools: tools}, nil
+}
+
+// disconnectMCPServer forgets a server that disconnected so the next request connects to it again
+func (p *Plugin) disconnectMCPServer(server *mcpServer) {
+	p.mcpLock.Lock()
+	defer p.mcpLock.Unlock()
+
+	if connection, ok := p.mcpConnections[server.cfg.Name]; ok && connection.server == server {
+		delete(p.mcpConnections, server.cfg.Name)
+		_ = server.client.Close()
+	}
+}
+
+// closeMCPServers disconnects from all the servers, they are connected again with the current configuration
+// when their tools are next needed
+func (p *Plugin) closeMCPServers() {
+	p.mcpLock.Lock()
+	connections := p.mcpConnections
+	p.mcpConnections = nil
+	p.mcpLock.Unlock()
+
+	for name, connection := range connections {
+		if connection.server == nil {
+			continue
+		}
+		if err := connection.server.client.Close(); err != nil {
+			p.pluginAPI.Log.Warn("Failed to close MCP server", "server", name, "error", err)
+		}
+	}
+}
+
+func (p *Plugin) mcpToolResolver(server *mcpServer, toolName string) func(context.Context, *llm.Context, llm.ToolArgumentGetter) (string, error) {
+	return func(ctx context.Context, llmContext *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+		var args json.RawMessage
+		if err := argsGetter(&args); err != nil {
+			return "invalid arguments", fmt.Errorf("failed to get arguments for MCP tool %s: %w", toolName, err)
+		}
+
+		var header http.Header
+		if server.cfg.UserSecretHeader != "" {
+			if llmContext.RequestingUser == nil {
+				return "this tool is only available to users", errors.New("MCP tool called without a requesting user")
+			}
+			secret, err := p.getMCPUserSecret(server.cfg.Name, llmContext.RequestingUser.Id)
+			if err != nil {
+				return "internal failure", err
+			}
+			if secret == "" {
+				return fmt.Sprintf("The user hasn't set their secret for %s. They can set it with the command /mcpsecret %s <secret>.", server.cfg.Name, server.cfg.Name),
+					errors.New("user has no secret for the MCP server")
+			}
+			header = http.Header{}
+			header.Set(server.cfg.UserSecretHeader, secret)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, mcpToolCallTimeout)
+		defer cancel()
+
+		result, err := server.client.CallTool(ctx, toolName, args, header)
+		if errors.Is(err, mcp.ErrDisconnected) {
+			p.disconnectMCPServer(server)
+		}
+		return result, err
+	}
+}
+
+// mcpToolName prefixes the tool with its server so tools of different servers don't collide, keeping to the
+// characters the services accept in names
+func mcpToolName(serverName, toolName string) string {
+	name := invalidToolNameChars.ReplaceAllString(serverName+"_"+toolName, "_")
+	if len(name) > maxToolNameLength {
+		name = name[:maxToolNameLength]
+	}
+	return name
+}
+
+// mcpToolSchema is the schema the server gave for the tool's arguments, or an object without properties if it
+// isn't valid
+func mcpToolSchema(tool mcp.Tool) *jsonschema.Schema {
+	schema := &jsonschema.Schema{}
+	if len(tool.InputSchema) == 0 || json.Unmarshal(tool.InputSchema, schema) != nil || schema.Type != "object" {
+		return &jsonschema.Schema{Type: "object"}
+	}
+	return schema
+}
+
+func mcpUserSecretKey(serverName, userID string) string {
+	return mcpUserSecretKeyPrefix + userID + "_" + serverName
+}
+
+func (p *Plugin) getMCPUserSecret(serverName, userID string) (string, error) {
+	var secret string
+	if err := p.pluginAPI.KV.Get(mcpUserSecretKey(serverName, userID), &secret); err != nil {
+		return "", fmt.Errorf("failed to get MCP user secret: %w", err)
+	}
+	return secret, nil
+}
+
+// setMCPUserSecret saves the secret the user's calls to the server are made with, an empty secret removes it
+func (p *Plugin) setMCPUserSecret(serverName, userID, secret string) error {
+	key := mcpUserSecretKey(serverName, userID)
+	if secret == "" {
+		if err := p.pluginAPI.KV.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete MCP user secret: %w", err)
+		}
+		return nil
+	}
+	if _, err := p.pluginAPI.KV.Set(key, secret); err != nil {
+		return fmt.Errorf("failed to save MCP user secret: %w", err)
+	}
+	return nil
+}
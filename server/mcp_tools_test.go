@@ -0,0 +1,173 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/invopop/jsonschema"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/mcp"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMCPStub serves a read only tool and one with side effects, calls answer with the user's secret header.
+// onInitialize, if set, is called for every connection.
+func newMCPStub(t *testing.T, onInitialize func()) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+		if len(message.ID) == 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		var result any
+		switch message.Method {
+		case "initialize":
+			if onInitialize != nil {
+				onInitialize()
+			}
+			result = map[string]any{"protocolVersion": mcp.ProtocolVersion, "capabilities": map[string]any{}}
+		case "tools/list":
+			result = map[string]any{"tools": []any{
+				map[string]any{"name": "search items", "description": "Search", "inputSchema": map[string]any{"type": "object", "properties": map[string]any{"query": map[string]any{"type": "string"}}}, "annotations": map[string]any{"readOnlyHint": true}},
+				map[string]any{"name": "create", "description": "Create", "inputSchema": map[string]any{}},
+			}}
+		case "tools/call":
+			result = map[string]any{"content": []any{map[string]any{"type": "text", "text": "secret " + r.Header.Get("X-Token")}}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": message.ID, "result": result}))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetMCPTools(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+	defer e.plugin.closeMCPServers()
+
+	stub := newMCPStub(t, nil)
+	bot := e.plugin.bots[0]
+	bot.cfg.ID = "botconfigid"
+	e.plugin.setConfiguration(makeConfig(Config{MCPServers: []mcp.ServerConfig{
+		{Name: "dm.only", Transport: mcp.TransportHTTP, URL: stub.URL, UserSecretHeader: "X-Token"},
+		{Name: "channels", Transport: mcp.TransportHTTP, URL: stub.URL, ChannelTypes: []string{"direct", "public"}},
+		{Name: "other_bot", Transport: mcp.TransportHTTP, URL: stub.URL, BotIDs: []string{"otherbotid"}},
+	}}))
+
+	toolNames := func(tools []llm.Tool) []string {
+		names := make([]string, 0, len(tools))
+		for _, tool := range tools {
+			names = append(names, tool.Name)
+		}
+		return names
+	}
+
+	tools := e.plugin.getMCPTools(bot, llm.ToolChannelDirect)
+	assert.Equal(t, []string{"dm_only_search_items", "dm_only_create", "channels_search_items", "channels_create"}, toolNames(tools))
+	assert.Equal(t, []string{"channels_search_items", "channels_create"}, toolNames(e.plugin.getMCPTools(bot, llm.ToolChannelPublic)))
+	assert.Empty(t, e.plugin.getMCPTools(bot, llm.ToolChannelPrivate))
+
+	// Tools change things unless the server says they don't
+	assert.False(t, tools[0].SideEffects)
+	assert.True(t, tools[1].SideEffects)
+	schema := tools[0].Schema.(*jsonschema.Schema)
+	_, ok := schema.Properties.Get("query")
+	assert.True(t, ok)
+	assert.Equal(t, "object", tools[1].Schema.(*jsonschema.Schema).Type)
+
+	llmContext := llm.NewContext()
+	llmContext.RequestingUser = &model.User{Id: "userid"}
+	argsGetter := llm.ToolCall{Arguments: `{"query":"x"}`}.ArgumentGetter()
+
+	// The user's secret is forwarded, users without one are told how to set it
+	e.mockAPI.On("KVGet", "mcp_secret_userid_dm.only").Return([]byte(`"user-token"`), nil).Once()
+	result, err := tools[0].Resolver(context.Background(), llmContext, argsGetter)
+	require.NoError(t, err)
+	assert.Equal(t, "secret user-token", result)
+
+	e.mockAPI.On("KVGet", "mcp_secret_userid_dm.only").Return(nil, nil).Once()
+	result, err = tools[0].Resolver(context.Background(), llmContext, argsGetter)
+	assert.Error(t, err)
+	assert.Contains(t, result, "/mcpsecret dm.only")
+
+	result, err = tools[2].Resolver(context.Background(), llmContext, argsGetter)
+	require.NoError(t, err)
+	assert.Equal(t, "secret ", result)
+}
+
+func TestGetMCPServerConnectsOnce(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+	defer e.plugin.closeMCPServers()
+
+	var initializing atomic.Int32
+	release := make(chan struct{})
+	stub := newMCPStub(t, func() {
+		initializing.Add(1)
+		<-release
+	})
+	cfg := mcp.ServerConfig{Name: "slow", Transport: mcp.TransportHTTP, URL: stub.URL}
+
+	var wg sync.WaitGroup
+	servers := make([]*mcpServer, 5)
+	for i := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			servers[i] = e.plugin.getMCPServer(cfg)
+		}()
+	}
+
+	// The lock isn't held while the server is being connected
+	require.Eventually(t, func() bool { return initializing.Load() == 1 }, time.Second, 10*time.Millisecond)
+	require.True(t, e.plugin.mcpLock.TryLock())
+	e.plugin.mcpLock.Unlock()
+
+	close(release)
+	wg.Wait()
+
+	// Every request waited for the one connection
+	assert.Equal(t, int32(1), initializing.Load())
+	require.NotNil(t, servers[0])
+	for _, server := range servers {
+		assert.Same(t, servers[0], server)
+	}
+}
+
+func TestMCPServerConfigChannelTypes(t *testing.T) {
+	cfg := mcp.ServerConfig{Name: "server", Transport: mcp.TransportHTTP, URL: "https://mcp.example.com"}
+	assert.True(t, cfg.AllowsChannelType("direct"))
+	assert.False(t, cfg.AllowsChannelType("public"))
+
+	cfg.ChannelTypes = []string{"public", "group"}
+	assert.NoError(t, cfg.IsValid())
+	assert.False(t, cfg.AllowsChannelType("direct"))
+	assert.True(t, cfg.AllowsChannelType("group"))
+
+	cfg.ChannelTypes = []string{"channels"}
+	assert.Error(t, cfg.IsValid())
+}
+
+func TestMCPToolName(t *testing.T) {
+	assert.Equal(t, "jira_create_issue", mcpToolName("jira", "create_issue"))
+	assert.Equal(t, "my_server_get_page-2", mcpToolName("my server", "get.page-2"))
+	assert.Len(t, mcpToolName("server", strings.Repeat("a", 100)), maxToolNameLength)
+}
@@ -189,8 +189,10 @@ func (p *Plugin) newCallTranscriptionSummaryThread(bot *Bot, requestingUser *mod
 			channel,
 			p.WithLLMContextDefaultTools(bot, mmapi.IsDMWith(bot.mmBot.UserId, channel)),
 		)
-		summaryStream, err := p.summarizeTranscription(bot, transcription, requestContext)
+		streamContext := p.newStreamingContext()
+		summaryStream, err := p.summarizeTranscription(streamContext.ctx, bot, transcription, requestContext)
 		if err != nil {
+			streamContext.cancel()
 			return fmt.Errorf("unable to summarize transcription: %w", err)
 		}
 
@@ -200,7 +202,7 @@ func (p *Plugin) newCallTranscriptionSummaryThread(bot *Bot, requestingUser *mod
 			Message:   "",
 		}
 		summaryPost.AddProp(ReferencedTranscriptPostID, transcriptionPost.Id)
-		if err := p.streamResultToNewPost(bot.mmBot.UserId, requestingUser.Id, summaryStream, summaryPost, transcriptionPost.Id); err != nil {
+		if err := p.streamResultToNewPost(streamContext, bot.mmBot.UserId, requestingUser.Id, summaryStream, summaryPost, transcriptionPost.Id); err != nil {
 			return fmt.Errorf("unable to stream result to post: %w", err)
 		}
 
@@ -250,7 +252,13 @@ func (p *Plugin) summarizeCallRecording(bot *Bot, rootID string, requestingUser
 			channel,
 			p.WithLLMContextDefaultTools(bot, channel.Type == model.ChannelTypeDirect),
 		)
-		summaryStream, err := p.summarizeTranscription(bot, transcription, llmContext)
+		ctx, err := p.getPostStreamingContext(p.activeContext(), transcriptPost.Id)
+		if err != nil {
+			return fmt.Errorf("unable to get post streaming context: %w", err)
+		}
+		defer p.finishPostStreaming(ctx, transcriptPost.Id)
+
+		summaryStream, err := p.summarizeTranscription(ctx, bot, transcription, llmContext)
 		if err != nil {
 			return fmt.Errorf("unable to summarize transcription: %w", err)
 		}
@@ -259,12 +267,6 @@ func (p *Plugin) summarizeCallRecording(bot *Bot, rootID string, requestingUser
 			return fmt.Errorf("unable to update transcript post: %w", err)
 		}
 
-		ctx, err := p.getPostStreamingContext(context.Background(), transcriptPost.Id)
-		if err != nil {
-			return fmt.Errorf("unable to get post streaming context: %w", err)
-		}
-		defer p.finishPostStreaming(transcriptPost.Id)
-
 		p.streamResultToPost(ctx, summaryStream, transcriptPost, requestingUser.Locale)
 
 		return nil
@@ -273,7 +275,7 @@ func (p *Plugin) summarizeCallRecording(bot *Bot, rootID string, requestingUser
 	return nil
 }
 
-func (p *Plugin) summarizeTranscription(bot *Bot, transcription *subtitles.Subtitles, context *llm.Context) (*llm.TextStreamResult, error) {
+func (p *Plugin) summarizeTranscription(ctx context.Context, bot *Bot, transcription *subtitles.Subtitles, context *llm.Context) (*llm.TextStreamResult, error) {
 	llmFormattedTranscription := transcription.FormatForLLM()
 	tokens := p.getLLM(bot.cfg).CountTokens(llmFormattedTranscription)
 	tokenLimitWithMargin := int(float64(p.getLLM(bot.cfg).InputTokenLimit())*0.75) - ContextTokenMargin
@@ -303,9 +305,10 @@ func (p *Plugin) summarizeTranscription(bot *Bot, transcription *subtitles.Subti
 					},
 				},
 				Context: context,
+				Feature: llm.FeatureMeeting,
 			}
 
-			summarizedChunk, err := p.getLLM(bot.cfg).ChatCompletionNoStream(request)
+			summarizedChunk, err := p.getLLM(bot.cfg).ChatCompletionNoStream(ctx, request, llm.WithTemperature(llm.SummaryTemperature))
 			if err != nil {
 				return nil, fmt.Errorf("unable to get summarized chunk: %w", err)
 			}
@@ -336,9 +339,10 @@ func (p *Plugin) summarizeTranscription(bot *Bot, transcription *subtitles.Subti
 			},
 		},
 		Context: context,
+		Feature: llm.FeatureMeeting,
 	}
 
-	summaryStream, err := p.getLLM(bot.cfg).ChatCompletion(completionRequest)
+	summaryStream, err := p.getLLM(bot.cfg).ChatCompletion(ctx, completionRequest, llm.WithTemperature(llm.SummaryTemperature))
 	if err != nil {
 		return nil, fmt.Errorf("unable to get meeting summary: %w", err)
 	}
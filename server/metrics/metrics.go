@@ -48,7 +48,11 @@ type metrics struct {
 	httpRequestsTotal prometheus.Counter
 	httpErrorsTotal   prometheus.Counter
 
-	llmRequestsTotal *prometheus.CounterVec
+	llmRequestsTotal     *prometheus.CounterVec
+	llmFailoversTotal    *prometheus.CounterVec
+	llmInputTokensTotal  *prometheus.CounterVec
+	llmOutputTokensTotal *prometheus.CounterVec
+	llmCostTotal         *prometheus.CounterVec
 }
 
 // NewMetrics Factory method to create a new metrics collector.
@@ -129,6 +133,42 @@ func NewMetrics(info InstanceInfo) Metrics {
 	}, []string{"llm_name"})
 	m.registry.MustRegister(m.llmRequestsTotal)
 
+	m.llmFailoversTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   MetricsNamespace,
+		Subsystem:   MetricsSubsystemLLM,
+		Name:        "failovers_total",
+		Help:        "The total number of LLM requests moved to a fallback service.",
+		ConstLabels: additionalLabels,
+	}, []string{"llm_name", "from_service", "to_service"})
+	m.registry.MustRegister(m.llmFailoversTotal)
+
+	m.llmInputTokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   MetricsNamespace,
+		Subsystem:   MetricsSubsystemLLM,
+		Name:        "input_tokens_total",
+		Help:        "The total number of prompt tokens sent to LLMs.",
+		ConstLabels: additionalLabels,
+	}, []string{"llm_name", "model", "feature"})
+	m.registry.MustRegister(m.llmInputTokensTotal)
+
+	m.llmOutputTokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   MetricsNamespace,
+		Subsystem:   MetricsSubsystemLLM,
+		Name:        "output_tokens_total",
+		Help:        "The total number of completion tokens generated by LLMs.",
+		ConstLabels: additionalLabels,
+	}, []string{"llm_name", "model", "feature"})
+	m.registry.MustRegister(m.llmOutputTokensTotal)
+
+	m.llmCostTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   MetricsNamespace,
+		Subsystem:   MetricsSubsystemLLM,
+		Name:        "cost_total",
+		Help:        "The total cost of LLM requests, in the currency of the configured model prices.",
+		ConstLabels: additionalLabels,
+	}, []string{"llm_name", "model", "feature"})
+	m.registry.MustRegister(m.llmCostTotal)
+
 	return m
 }
 
@@ -159,17 +199,28 @@ func (m *metrics) GetMetricsForAIService(llmName string) *llmMetrics {
 		return nil
 	}
 
+	labels := prometheus.Labels{"llm_name": llmName}
 	return &llmMetrics{
-		llmRequestsTotal: m.llmRequestsTotal.MustCurryWith(prometheus.Labels{"llm_name": llmName}),
+		llmRequestsTotal:     m.llmRequestsTotal.MustCurryWith(labels),
+		llmFailoversTotal:    m.llmFailoversTotal.MustCurryWith(labels),
+		llmInputTokensTotal:  m.llmInputTokensTotal.MustCurryWith(labels),
+		llmOutputTokensTotal: m.llmOutputTokensTotal.MustCurryWith(labels),
+		llmCostTotal:         m.llmCostTotal.MustCurryWith(labels),
 	}
 }
 
 type LLMetrics interface {
 	IncrementLLMRequests()
+	IncrementLLMFailovers(fromService, toService string)
+	ObserveLLMTokenUsage(model, feature string, inputTokens, outputTokens int64, cost float64)
 }
 
 type llmMetrics struct {
-	llmRequestsTotal *prometheus.CounterVec
+	llmRequestsTotal     *prometheus.CounterVec
+	llmFailoversTotal    *prometheus.CounterVec
+	llmInputTokensTotal  *prometheus.CounterVec
+	llmOutputTokensTotal *prometheus.CounterVec
+	llmCostTotal         *prometheus.CounterVec
 }
 
 func (m *llmMetrics) IncrementLLMRequests() {
@@ -177,3 +228,18 @@ func (m *llmMetrics) IncrementLLMRequests() {
 		m.llmRequestsTotal.With(prometheus.Labels{}).Inc()
 	}
 }
+
+func (m *llmMetrics) IncrementLLMFailovers(fromService, toService string) {
+	if m != nil {
+		m.llmFailoversTotal.With(prometheus.Labels{"from_service": fromService, "to_service": toService}).Inc()
+	}
+}
+
+func (m *llmMetrics) ObserveLLMTokenUsage(model, feature string, inputTokens, outputTokens int64, cost float64) {
+	if m != nil {
+		labels := prometheus.Labels{"model": model, "feature": feature}
+		m.llmInputTokensTotal.With(labels).Add(float64(inputTokens))
+		m.llmOutputTokensTotal.With(labels).Add(float64(outputTokens))
+		m.llmCostTotal.With(labels).Add(cost)
+	}
+}
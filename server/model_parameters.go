@@ -0,0 +1,45 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"slices"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+)
+
+// ModelParametersLanguageModel applies a bot's model parameters to every request. Options passed with a request
+// come after the bot's so features can pin a parameter, like a low temperature for summaries.
+type ModelParametersLanguageModel struct {
+	wrapped    llm.LanguageModel
+	parameters []llm.LanguageModelOption
+}
+
+func NewModelParametersLanguageModel(wrapped llm.LanguageModel, parameters []llm.LanguageModelOption) *ModelParametersLanguageModel {
+	return &ModelParametersLanguageModel{
+		wrapped:    wrapped,
+		parameters: parameters,
+	}
+}
+
+func (m *ModelParametersLanguageModel) options(opts []llm.LanguageModelOption) []llm.LanguageModelOption {
+	return append(slices.Clone(m.parameters), opts...)
+}
+
+func (m *ModelParametersLanguageModel) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	return m.wrapped.ChatCompletion(ctx, request, m.options(opts)...)
+}
+
+func (m *ModelParametersLanguageModel) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	return m.wrapped.ChatCompletionNoStream(ctx, request, m.options(opts)...)
+}
+
+func (m *ModelParametersLanguageModel) CountTokens(text string) int {
+	return m.wrapped.CountTokens(text)
+}
+
+func (m *ModelParametersLanguageModel) InputTokenLimit() int {
+	return m.wrapped.InputTokenLimit()
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// configModel records the config of the last request
+type configModel struct {
+	scriptedModel
+	cfg llm.LanguageModelConfig
+}
+
+func (m *configModel) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	m.cfg = llm.LanguageModelConfig{}
+	for _, opt := range opts {
+		opt(&m.cfg)
+	}
+	return m.scriptedModel.ChatCompletionNoStream(ctx, request, opts...)
+}
+
+func TestModelParametersLanguageModel(t *testing.T) {
+	wrapped := &configModel{scriptedModel: scriptedModel{chunks: []string{"ok"}}}
+	temperature, seed := float32(0.9), 3
+	parameters := llm.ModelParameters{Temperature: &temperature, Seed: &seed}
+	model := NewModelParametersLanguageModel(wrapped, parameters.Options())
+
+	_, err := model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{Context: llm.NewContext()})
+	require.NoError(t, err)
+	assert.Equal(t, float32(0.9), *wrapped.cfg.Temperature)
+	assert.Equal(t, 3, *wrapped.cfg.Seed)
+
+	// Features pin parameters over the bot's
+	_, err = model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{Context: llm.NewContext()}, llm.WithTemperature(llm.SummaryTemperature))
+	require.NoError(t, err)
+	assert.Equal(t, float32(llm.SummaryTemperature), *wrapped.cfg.Temperature)
+	assert.Equal(t, 3, *wrapped.cfg.Seed)
+}
@@ -0,0 +1,503 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package mysql
+
+import (
+	"container/heap"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+)
+
+const (
+	EmbeddingsTable    = "LLM_PostEmbeddings"
+	defaultSearchLimit = 10
+
+	// DefaultMaxSearchRows bounds the rows vector search scores when the configuration doesn't
+	DefaultMaxSearchRows = 100_000
+	// identifierMatchScore is added to the keyword score of a row for each identifier of the query it contains,
+	// so exact identifier matches rank above rows that only share words with the query
+	identifierMatchScore = 100
+)
+
+// MySQLVectorConfig holds the configuration of the MySQL vector store
+type MySQLVectorConfig struct {
+	Dimensions int    `json:"dimensions"`
+	Space      string `json:"space"` // Embedding space the store reads and writes
+	// MaxSearchRows bounds the rows vector search decodes and scores per query, the most recent ones are kept.
+	// Zero uses DefaultMaxSearchRows.
+	MaxSearchRows int `json:"maxSearchRows"`
+	// OnSearchTruncated is called when a vector search reached MaxSearchRows, older posts weren't scored
+	OnSearchTruncated func(maxRows int) `json:"-"`
+}
+
+// MySQLVector implements embeddings.VectorStore and embeddings.KeywordSearcher on top of a plugin table.
+//
+// MySQL has no vector index, so embeddings are stored as packed float32 blobs and similarity is
+// computed while streaming the rows that pass the SQL filters. Every row the user can see is decoded
+// and scored on each query, up to the most recent MaxSearchRows, so the cost grows with the number of
+// indexed posts in the user's channels and older posts fall out of vector results on large instances,
+// OnSearchTruncated reports when that happens. Keyword search uses a FULLTEXT index on the same table so both sources see exactly the
+// same documents, identifiers the FULLTEXT parser splits apart are matched as substrings.
+//
+// Several embedding spaces share the table, each store only sees the rows of its own space.
+type MySQLVector struct {
+	db                *sqlx.DB
+	builder           sq.StatementBuilderType
+	dimensions        int
+	space             string
+	maxSearchRows     int
+	onSearchTruncated func(maxRows int)
+}
+
+type embeddingRow struct {
+	PostID      string  `db:"PostId"`
+	TeamID      string  `db:"TeamId"`
+	ChannelID   string  `db:"ChannelId"`
+	UserID      string  `db:"UserId"`
+	CreateAt    int64   `db:"CreateAt"`
+	Content     string  `db:"Content"`
+	IsChunk     bool    `db:"IsChunk"`
+	ChunkIndex  int     `db:"ChunkIndex"`
+	TotalChunks int     `db:"TotalChunks"`
+	Embedding   []byte  `db:"Embedding"`
+	Score       float32 `db:"Score"`
+}
+
+func (r embeddingRow) document() embeddings.PostDocument {
+	return embeddings.PostDocument{
+		PostID:      r.PostID,
+		CreateAt:    r.CreateAt,
+		TeamID:      r.TeamID,
+		ChannelID:   r.ChannelID,
+		UserID:      r.UserID,
+		Content:     r.Content,
+		IsChunk:     r.IsChunk,
+		ChunkIndex:  r.ChunkIndex,
+		TotalChunks: r.TotalChunks,
+	}
+}
+
+func NewMySQLVector(db *sqlx.DB, config MySQLVectorConfig) (*MySQLVector, error) {
+	store := &MySQLVector{
+		db:                db,
+		builder:           sq.StatementBuilder.PlaceholderFormat(sq.Question),
+		dimensions:        config.Dimensions,
+		space:             config.Space,
+		maxSearchRows:     config.MaxSearchRows,
+		onSearchTruncated: config.OnSearchTruncated,
+	}
+	if store.maxSearchRows <= 0 {
+		store.maxSearchRows = DefaultMaxSearchRows
+	}
+
+	if err := store.setupTable(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (m *MySQLVector) setupTable() error {
+	query := `
+		CREATE TABLE IF NOT EXISTS ` + EmbeddingsTable + ` (
+			SpaceId VARCHAR(64) NOT NULL,
+			Id VARCHAR(64) NOT NULL,
+			PostId VARCHAR(26) NOT NULL,
+			TeamId VARCHAR(26) NOT NULL,
+			ChannelId VARCHAR(26) NOT NULL,
+			UserId VARCHAR(26) NOT NULL,
+			CreateAt BIGINT NOT NULL,
+			Content TEXT NOT NULL,
+			IsChunk BOOLEAN NOT NULL DEFAULT FALSE,
+			ChunkIndex INT NOT NULL DEFAULT 0,
+			TotalChunks INT NOT NULL DEFAULT 0,
+			Embedding LONGBLOB NOT NULL,
+			PRIMARY KEY (SpaceId, Id),
+			INDEX idx_LLM_PostEmbeddings_SpaceId_PostId (SpaceId, PostId),
+			INDEX idx_LLM_PostEmbeddings_SpaceId_ChannelId_CreateAt (SpaceId, ChannelId, CreateAt),
+			FULLTEXT INDEX ftx_LLM_PostEmbeddings_Content (Content)
+		);
+	`
+
+	if _, err := m.db.Exec(query); err != nil {
+		return fmt.Errorf("can't create post embeddings table: %w", err)
+	}
+
+	return nil
+}
+
+// documentID is the primary key of a stored document. Whole posts use the post ID.
+func documentID(doc embeddings.PostDocument) string {
+	if doc.IsChunk {
+		return fmt.Sprintf("%s_chunk_%d", doc.PostID, doc.ChunkIndex)
+	}
+	return doc.PostID
+}
+
+func (m *MySQLVector) Store(ctx context.Context, docs []embeddings.PostDocument, embeddingsList [][]float32) error {
+	if len(docs) != len(embeddingsList) {
+		return fmt.Errorf("got %d documents and %d embeddings", len(docs), len(embeddingsList))
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	// Remove previous versions first since the number of chunks of a post may have changed.
+	postIDs := make([]string, 0, len(docs))
+	seen := make(map[string]bool)
+	for _, doc := range docs {
+		if !seen[doc.PostID] {
+			seen[doc.PostID] = true
+			postIDs = append(postIDs, doc.PostID)
+		}
+	}
+
+	insert := m.builder.Insert(EmbeddingsTable).
+		Columns("SpaceId", "Id", "PostId", "TeamId", "ChannelId", "UserId", "CreateAt", "Content", "IsChunk", "ChunkIndex", "TotalChunks", "Embedding")
+	for i, doc := range docs {
+		if m.dimensions > 0 && len(embeddingsList[i]) != m.dimensions {
+			return fmt.Errorf("embedding for post %s has %d dimensions, expected %d", doc.PostID, len(embeddingsList[i]), m.dimensions)
+		}
+		insert = insert.Values(m.space, documentID(doc), doc.PostID, doc.TeamID, doc.ChannelID, doc.UserID, doc.CreateAt,
+			doc.Content, doc.IsChunk, doc.ChunkIndex, doc.TotalChunks, encodeEmbedding(embeddingsList[i]))
+	}
+
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := execBuilder(ctx, tx, m.builder.Delete(EmbeddingsTable).Where(sq.Eq{"SpaceId": m.space, "PostId": postIDs})); err != nil {
+		return fmt.Errorf("failed to delete previous embeddings: %w", err)
+	}
+
+	if err := execBuilder(ctx, tx, insert); err != nil {
+		return fmt.Errorf("failed to insert embeddings: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit embeddings: %w", err)
+	}
+
+	return nil
+}
+
+// ErrUserRequired is returned by searches that don't say which user the results are for
+var ErrUserRequired = errors.New("a user ID is required to search")
+
+// documentColumns are the columns shared by vector and keyword search
+var documentColumns = []string{"e.PostId", "e.TeamId", "e.ChannelId", "e.UserId", "e.CreateAt", "e.Content", "e.IsChunk", "e.ChunkIndex", "e.TotalChunks"}
+
+// applyFilters adds the filters shared by vector and keyword search.
+//
+// Results are restricted in the query itself to channels the user is currently a member of, which covers
+// public and private channels, DMs and group messages. Public channels the user hasn't joined, or has left,
+// are excluded too even though the user could read them, search only covers the user's own channels.
+// Archived channels are excluded even though their memberships remain. Filtering here rather than after
+// the top-k keeps a user from getting fewer results, or none, because other users' channels ranked higher.
+func (m *MySQLVector) applyFilters(query sq.SelectBuilder, opts embeddings.SearchOptions) sq.SelectBuilder {
+	query = query.
+		Join("ChannelMembers AS cm ON cm.ChannelId = e.ChannelId AND cm.UserId = ?", opts.UserID).
+		Join("Channels AS c ON c.Id = e.ChannelId AND c.DeleteAt = 0").
+		Where(sq.Eq{"e.SpaceId": m.space})
+
+	if opts.TeamID != "" {
+		query = query.Where(sq.Eq{"e.TeamId": opts.TeamID})
+	}
+	if opts.ChannelID != "" {
+		query = query.Where(sq.Eq{"e.ChannelId": opts.ChannelID})
+	}
+	if opts.CreatedAfter != 0 {
+		query = query.Where(sq.Gt{"e.CreateAt": opts.CreatedAfter})
+	}
+	if opts.CreatedBefore != 0 {
+		query = query.Where(sq.Lt{"e.CreateAt": opts.CreatedBefore})
+	}
+	if len(opts.ExcludePostIDs) > 0 {
+		query = query.Where(sq.NotEq{"e.PostId": opts.ExcludePostIDs})
+	}
+	if len(opts.ExcludeChannelIDs) > 0 {
+		query = query.Where(sq.NotEq{"e.ChannelId": opts.ExcludeChannelIDs})
+	}
+	return query
+}
+
+func (m *MySQLVector) vectorSearchQuery(opts embeddings.SearchOptions) sq.SelectBuilder {
+	return m.applyFilters(m.builder.
+		Select(documentColumns...).
+		Column("e.Embedding").
+		From(EmbeddingsTable+" AS e"), opts).
+		OrderBy("e.CreateAt DESC").
+		Limit(uint64(m.maxSearchRows))
+}
+
+// identifierPattern matches terms like MM-1234, error_code or v1.2.3. The FULLTEXT parser splits them into
+// short tokens that are under the minimum token size or are stopwords, so they wouldn't match.
+var identifierPattern = regexp.MustCompile(`[\p{L}\p{N}]+(?:[-_.:/#@][\p{L}\p{N}]+)+`)
+
+// likeEscaper escapes the LIKE wildcards of a value matched as a substring
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (m *MySQLVector) keywordSearchQuery(queryText string, opts embeddings.SearchOptions, limit int) sq.SelectBuilder {
+	score := "MATCH(e.Content) AGAINST (? IN NATURAL LANGUAGE MODE)"
+	scoreArgs := []any{queryText}
+	matches := sq.Or{sq.Expr("MATCH(e.Content) AGAINST (? IN NATURAL LANGUAGE MODE)", queryText)}
+	for _, identifier := range identifierPattern.FindAllString(queryText, -1) {
+		pattern := "%" + likeEscaper.Replace(identifier) + "%"
+		score += fmt.Sprintf(" + (e.Content LIKE ?) * %d", identifierMatchScore)
+		scoreArgs = append(scoreArgs, pattern)
+		matches = append(matches, sq.Like{"e.Content": pattern})
+	}
+
+	return m.applyFilters(m.builder.
+		Select(documentColumns...).
+		Column(sq.Alias(sq.Expr(score, scoreArgs...), "Score")).
+		From(EmbeddingsTable+" AS e"), opts).
+		Where(matches).
+		OrderBy("Score DESC").
+		Limit(uint64(limit))
+}
+
+func (m *MySQLVector) Search(ctx context.Context, embedding []float32, opts embeddings.SearchOptions) ([]embeddings.SearchResult, error) {
+	if opts.UserID == "" {
+		return nil, ErrUserRequired
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	sqlString, args, err := m.vectorSearchQuery(opts).ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build sql: %w", err)
+	}
+
+	rows, err := m.db.QueryxContext(ctx, m.db.Rebind(sqlString), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query embeddings: %w", err)
+	}
+	defer rows.Close()
+
+	top := &resultHeap{}
+	scanned := 0
+	for rows.Next() {
+		scanned++
+		var row embeddingRow
+		if err := rows.StructScan(&row); err != nil {
+			return nil, fmt.Errorf("failed to scan embedding: %w", err)
+		}
+
+		score := cosineSimilarity(embedding, decodeEmbedding(row.Embedding))
+		if score < opts.MinScore {
+			continue
+		}
+
+		if top.Len() < limit {
+			heap.Push(top, embeddings.SearchResult{Document: row.document(), Score: score})
+		} else if score > (*top)[0].Score {
+			(*top)[0] = embeddings.SearchResult{Document: row.document(), Score: score}
+			heap.Fix(top, 0)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate embeddings: %w", err)
+	}
+	if scanned >= m.maxSearchRows && m.onSearchTruncated != nil {
+		m.onSearchTruncated(m.maxSearchRows)
+	}
+
+	results := make([]embeddings.SearchResult, top.Len())
+	for i := len(results) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(top).(embeddings.SearchResult)
+	}
+
+	return results, nil
+}
+
+func (m *MySQLVector) KeywordSearch(ctx context.Context, queryText string, opts embeddings.SearchOptions) ([]embeddings.SearchResult, error) {
+	if opts.UserID == "" {
+		return nil, ErrUserRequired
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	sqlString, args, err := m.keywordSearchQuery(queryText, opts, limit).ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build sql: %w", err)
+	}
+
+	var rows []embeddingRow
+	if err := sqlx.SelectContext(ctx, m.db, &rows, m.db.Rebind(sqlString), args...); err != nil {
+		return nil, fmt.Errorf("failed to run keyword search: %w", err)
+	}
+
+	results := make([]embeddings.SearchResult, 0, len(rows))
+	for _, row := range rows {
+		if row.Score < opts.MinScore {
+			continue
+		}
+		results = append(results, embeddings.SearchResult{Document: row.document(), Score: row.Score})
+	}
+
+	return results, nil
+}
+
+func (m *MySQLVector) GetEmbeddings(ctx context.Context, postIDs []string) (map[string][][]float32, error) {
+	result := make(map[string][][]float32)
+	if len(postIDs) == 0 {
+		return result, nil
+	}
+
+	sqlString, args, err := m.builder.
+		Select("PostId", "Embedding").
+		From(EmbeddingsTable).
+		Where(sq.Eq{"SpaceId": m.space, "PostId": postIDs}).
+		OrderBy("PostId", "ChunkIndex").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build sql: %w", err)
+	}
+
+	var rows []embeddingRow
+	if err := sqlx.SelectContext(ctx, m.db, &rows, m.db.Rebind(sqlString), args...); err != nil {
+		return nil, fmt.Errorf("failed to get embeddings: %w", err)
+	}
+
+	for _, row := range rows {
+		result[row.PostID] = append(result[row.PostID], decodeEmbedding(row.Embedding))
+	}
+
+	return result, nil
+}
+
+func (m *MySQLVector) Delete(ctx context.Context, postIDs []string) error {
+	if len(postIDs) == 0 {
+		return nil
+	}
+
+	return execBuilder(ctx, m.db, m.builder.Delete(EmbeddingsTable).Where(sq.Eq{"SpaceId": m.space, "PostId": postIDs}))
+}
+
+// Clear removes the documents of this store's embedding space
+func (m *MySQLVector) Clear(ctx context.Context) error {
+	return execBuilder(ctx, m.db, m.builder.Delete(EmbeddingsTable).Where(sq.Eq{"SpaceId": m.space}))
+}
+
+func (m *MySQLVector) DeleteSpacesExcept(ctx context.Context, keep []string, limit int) (int64, error) {
+	query := m.builder.Select("SpaceId", "Id").From(EmbeddingsTable).Limit(uint64(limit))
+	if len(keep) > 0 {
+		query = query.Where(sq.NotEq{"SpaceId": keep})
+	}
+	sqlString, args, err := query.ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build sql: %w", err)
+	}
+
+	var rows []struct {
+		SpaceID string `db:"SpaceId"`
+		ID      string `db:"Id"`
+	}
+	if err := m.db.SelectContext(ctx, &rows, m.db.Rebind(sqlString), args...); err != nil {
+		return 0, fmt.Errorf("failed to find stale documents: %w", err)
+	}
+
+	bySpace := map[string][]string{}
+	for _, row := range rows {
+		bySpace[row.SpaceID] = append(bySpace[row.SpaceID], row.ID)
+	}
+	for space, ids := range bySpace {
+		if err := execBuilder(ctx, m.db, m.builder.Delete(EmbeddingsTable).Where(sq.Eq{"SpaceId": space, "Id": ids})); err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(rows)), nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	Rebind(query string) string
+}
+
+func execBuilder(ctx context.Context, db execer, b sq.Sqlizer) error {
+	sqlString, args, err := b.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build sql: %w", err)
+	}
+
+	_, err = db.ExecContext(ctx, db.Rebind(sqlString), args...)
+	return err
+}
+
+// encodeEmbedding packs an embedding as little endian float32 values
+func encodeEmbedding(embedding []float32) []byte {
+	buf := make([]byte, 4*len(embedding))
+	for i, value := range embedding {
+		binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(value))
+	}
+	return buf
+}
+
+func decodeEmbedding(buf []byte) []float32 {
+	embedding := make([]float32, len(buf)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:]))
+	}
+	return embedding
+}
+
+// cosineSimilarity returns the cosine similarity of two vectors, or 0 if they can't be compared
+func cosineSimilarity(a, b []float32) float32 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return float32(dot / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
+
+// resultHeap is a min-heap on score used to keep the top results while streaming rows
+type resultHeap []embeddings.SearchResult
+
+func (h resultHeap) Len() int           { return len(h) }
+func (h resultHeap) Less(i, j int) bool { return h[i].Score < h[j].Score }
+func (h resultHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *resultHeap) Push(x any) {
+	*h = append(*h, x.(embeddings.SearchResult))
+}
+
+func (h *resultHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
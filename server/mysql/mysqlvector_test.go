@@ -0,0 +1,272 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddingEncoding(t *testing.T) {
+	embedding := []float32{0.5, -1.25, 3, 0}
+	assert.Equal(t, embedding, decodeEmbedding(encodeEmbedding(embedding)))
+	assert.Empty(t, decodeEmbedding(encodeEmbedding(nil)))
+}
+
+func TestCosineSimilarity(t *testing.T) {
+	assert.InDelta(t, 1.0, cosineSimilarity([]float32{1, 2}, []float32{2, 4}), 0.0001)
+	assert.InDelta(t, 0.0, cosineSimilarity([]float32{1, 0}, []float32{0, 1}), 0.0001)
+	assert.InDelta(t, -1.0, cosineSimilarity([]float32{1, 0}, []float32{-1, 0}), 0.0001)
+
+	// Vectors that can't be compared
+	assert.Zero(t, cosineSimilarity([]float32{1, 0}, []float32{1, 0, 0}))
+	assert.Zero(t, cosineSimilarity([]float32{0, 0}, []float32{1, 0}))
+}
+
+func newTestStore() *MySQLVector {
+	return &MySQLVector{
+		builder:       sq.StatementBuilder.PlaceholderFormat(sq.Question),
+		space:         "space1",
+		maxSearchRows: DefaultMaxSearchRows,
+	}
+}
+
+func TestSearchPermissionFiltering(t *testing.T) {
+	store := newTestStore()
+	opts := embeddings.SearchOptions{
+		UserID:    "user1",
+		TeamID:    "team1",
+		ChannelID: "channel1",
+	}
+
+	for name, query := range map[string]sq.SelectBuilder{
+		"vector":  store.vectorSearchQuery(opts),
+		"keyword": store.keywordSearchQuery("query text", opts, 10),
+	} {
+		t.Run(name, func(t *testing.T) {
+			sqlString, args, err := query.ToSql()
+			require.NoError(t, err)
+
+			// Channels the user left have no membership row, so they never match
+			assert.Contains(t, sqlString, "JOIN ChannelMembers AS cm ON cm.ChannelId = e.ChannelId AND cm.UserId = ?")
+			assert.Contains(t, args, "user1")
+
+			// Archived channels are excluded even though the user is still a member
+			assert.Contains(t, sqlString, "JOIN Channels AS c ON c.Id = e.ChannelId AND c.DeleteAt = 0")
+
+			// Permission filtering happens before the limit is applied
+			assert.Less(t, strings.Index(sqlString, "ChannelMembers"), strings.Index(sqlString, "WHERE"))
+			assert.Contains(t, sqlString, "e.TeamId = ?")
+			assert.Contains(t, sqlString, "e.ChannelId = ?")
+
+			// Only the store's own embedding space is searched
+			assert.Contains(t, sqlString, "e.SpaceId = ?")
+			assert.Contains(t, args, "space1")
+		})
+	}
+
+	t.Run("keyword arguments line up with placeholders", func(t *testing.T) {
+		sqlString, args, err := store.keywordSearchQuery("query text", opts, 10).ToSql()
+		require.NoError(t, err)
+		assert.Equal(t, strings.Count(sqlString, "?"), len(args))
+		assert.Equal(t, []interface{}{"query text", "user1", "space1", "team1", "channel1", "query text"}, args)
+	})
+}
+
+// newSQLiteStore runs the store's queries on an in-memory SQLite database with the tables they join. SQLite has
+// no FULLTEXT index, so only vector search runs, it applies the same filters as keyword search.
+func newSQLiteStore(t *testing.T) *MySQLVector {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE ` + EmbeddingsTable + ` (
+			SpaceId TEXT NOT NULL, Id TEXT NOT NULL, PostId TEXT NOT NULL, TeamId TEXT NOT NULL,
+			ChannelId TEXT NOT NULL, UserId TEXT NOT NULL, CreateAt BIGINT NOT NULL, Content TEXT NOT NULL,
+			IsChunk BOOLEAN NOT NULL DEFAULT FALSE, ChunkIndex INT NOT NULL DEFAULT 0,
+			TotalChunks INT NOT NULL DEFAULT 0, Embedding BLOB NOT NULL, PRIMARY KEY (SpaceId, Id)
+		);
+		CREATE TABLE Channels (Id TEXT PRIMARY KEY, TeamId TEXT NOT NULL, Type TEXT NOT NULL, DeleteAt BIGINT NOT NULL);
+		CREATE TABLE ChannelMembers (ChannelId TEXT NOT NULL, UserId TEXT NOT NULL);
+	`)
+	require.NoError(t, err)
+
+	store := newTestStore()
+	store.db = db
+	return store
+}
+
+func TestSearchPermissionFilteringResults(t *testing.T) {
+	store := newSQLiteStore(t)
+	ctx := context.Background()
+
+	_, err := store.db.Exec(`
+		INSERT INTO Channels VALUES
+			('joined', 'team1', 'O', 0), ('private', 'team1', 'P', 0), ('dm', '', 'D', 0),
+			('left', 'team1', 'P', 0), ('notjoined', 'team1', 'O', 0), ('archived', 'team1', 'O', 1000),
+			('otherteam', 'team2', 'O', 0);
+		INSERT INTO ChannelMembers VALUES
+			('joined', 'user1'), ('private', 'user1'), ('dm', 'user1'), ('archived', 'user1'), ('otherteam', 'user1'),
+			('left', 'user2'), ('notjoined', 'user2');
+	`)
+	require.NoError(t, err)
+
+	var docs []embeddings.PostDocument
+	var vectors [][]float32
+	for _, channel := range []struct{ id, team string }{
+		{"joined", "team1"}, {"private", "team1"}, {"dm", ""}, {"left", "team1"}, {"notjoined", "team1"},
+		{"archived", "team1"}, {"otherteam", "team2"},
+	} {
+		docs = append(docs, embeddings.PostDocument{PostID: channel.id + "_post", ChannelID: channel.id, TeamID: channel.team, Content: channel.id})
+		vectors = append(vectors, []float32{1, 0})
+	}
+	docs = append(docs, embeddings.PostDocument{PostID: "deleted_post", ChannelID: "joined", TeamID: "team1", Content: "deleted"})
+	vectors = append(vectors, []float32{1, 0})
+	require.NoError(t, store.Store(ctx, docs, vectors))
+	// Deleting a post removes it from the index
+	require.NoError(t, store.Delete(ctx, []string{"deleted_post"}))
+
+	// Another space's rows are never returned
+	other := *store
+	other.space = "space2"
+	require.NoError(t, other.Store(ctx, []embeddings.PostDocument{{PostID: "space2_post", ChannelID: "joined", TeamID: "team1"}}, [][]float32{{1, 0}}))
+
+	postIDs := func(opts embeddings.SearchOptions) []string {
+		opts.Limit = 100
+		results, err := store.Search(ctx, []float32{1, 0}, opts)
+		require.NoError(t, err)
+		ids := make([]string, 0, len(results))
+		for _, result := range results {
+			ids = append(ids, result.Document.PostID)
+		}
+		return ids
+	}
+
+	// Left, archived and unjoined channels, and deleted posts never come back
+	assert.ElementsMatch(t, []string{"joined_post", "private_post", "dm_post", "otherteam_post"}, postIDs(embeddings.SearchOptions{UserID: "user1"}))
+	// Posts of other teams are excluded when searching a team
+	assert.ElementsMatch(t, []string{"joined_post", "private_post"}, postIDs(embeddings.SearchOptions{UserID: "user1", TeamID: "team1"}))
+	assert.ElementsMatch(t, []string{"left_post", "notjoined_post"}, postIDs(embeddings.SearchOptions{UserID: "user2"}))
+	assert.Empty(t, postIDs(embeddings.SearchOptions{UserID: "user3"}))
+	assert.ElementsMatch(t, []string{"private_post", "otherteam_post"}, postIDs(embeddings.SearchOptions{UserID: "user1", ExcludeChannelIDs: []string{"joined", "dm"}}))
+
+	// The filter applies before the limit, other users' channels don't push out the user's results
+	results, err := store.Search(ctx, []float32{1, 0}, embeddings.SearchOptions{UserID: "user2", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Contains(t, []string{"left_post", "notjoined_post"}, results[0].Document.PostID)
+}
+
+func TestSearchReportsTruncation(t *testing.T) {
+	store := newSQLiteStore(t)
+	ctx := context.Background()
+
+	_, err := store.db.Exec(`
+		INSERT INTO Channels VALUES ('joined', 'team1', 'O', 0);
+		INSERT INTO ChannelMembers VALUES ('joined', 'user1');
+	`)
+	require.NoError(t, err)
+	var docs []embeddings.PostDocument
+	var vectors [][]float32
+	for i := range 3 {
+		docs = append(docs, embeddings.PostDocument{PostID: fmt.Sprintf("post%d", i), ChannelID: "joined", TeamID: "team1", CreateAt: int64(i)})
+		vectors = append(vectors, []float32{1, 0})
+	}
+	require.NoError(t, store.Store(ctx, docs, vectors))
+
+	truncated := 0
+	store.onSearchTruncated = func(maxRows int) { truncated = maxRows }
+
+	_, err = store.Search(ctx, []float32{1, 0}, embeddings.SearchOptions{UserID: "user1"})
+	require.NoError(t, err)
+	assert.Zero(t, truncated)
+
+	// Only the most recent rows are scored, the caller hears about the rest
+	store.maxSearchRows = 2
+	results, err := store.Search(ctx, []float32{1, 0}, embeddings.SearchOptions{UserID: "user1"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, truncated)
+	assert.Len(t, results, 2)
+	for _, result := range results {
+		assert.NotEqual(t, "post0", result.Document.PostID)
+	}
+}
+
+func TestDeleteSpacesExcept(t *testing.T) {
+	store := newSQLiteStore(t)
+	ctx := context.Background()
+
+	for _, space := range []string{"space0", "space1", "space2"} {
+		spaceStore := *store
+		spaceStore.space = space
+		docs := []embeddings.PostDocument{{PostID: "post1"}, {PostID: "post2"}, {PostID: "post3"}}
+		require.NoError(t, spaceStore.Store(ctx, docs, [][]float32{{1}, {1}, {1}}))
+	}
+
+	// Stale documents are deleted in batches
+	deleted, err := store.DeleteSpacesExcept(ctx, []string{"space1"}, 4)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), deleted)
+	deleted, err = store.DeleteSpacesExcept(ctx, []string{"space1"}, 4)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	deleted, err = store.DeleteSpacesExcept(ctx, []string{"space1"}, 4)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	// The kept space is untouched
+	var remaining []string
+	require.NoError(t, store.db.Select(&remaining, `SELECT PostId FROM `+EmbeddingsTable+` WHERE SpaceId = 'space1'`))
+	assert.Len(t, remaining, 3)
+}
+
+func TestKeywordSearchIdentifiers(t *testing.T) {
+	store := newTestStore()
+
+	sqlString, args, err := store.keywordSearchQuery("why does MM-1234 fail with error_code?", embeddings.SearchOptions{UserID: "user1"}, 10).ToSql()
+	require.NoError(t, err)
+	assert.Equal(t, strings.Count(sqlString, "?"), len(args))
+
+	// Identifiers are matched as substrings besides the full-text match, and score above it
+	assert.Contains(t, sqlString, "(MATCH(e.Content) AGAINST (? IN NATURAL LANGUAGE MODE) + (e.Content LIKE ?) * 100 + (e.Content LIKE ?) * 100) AS Score")
+	assert.Contains(t, sqlString, "(MATCH(e.Content) AGAINST (? IN NATURAL LANGUAGE MODE) OR e.Content LIKE ? OR e.Content LIKE ?)")
+	assert.Equal(t, []interface{}{
+		"why does MM-1234 fail with error_code?", "%MM-1234%", `%error\_code%`,
+		"user1", "space1",
+		"why does MM-1234 fail with error_code?", "%MM-1234%", `%error\_code%`,
+	}, args)
+}
+
+func TestSearchExcludePosts(t *testing.T) {
+	store := newTestStore()
+
+	sqlString, args, err := store.vectorSearchQuery(embeddings.SearchOptions{
+		UserID:         "user1",
+		ExcludePostIDs: []string{"post1", "post2"},
+	}).ToSql()
+	require.NoError(t, err)
+	assert.Contains(t, sqlString, "e.PostId NOT IN (?,?)")
+	assert.Equal(t, []interface{}{"user1", "space1", "post1", "post2"}, args)
+}
+
+func TestSearchRequiresUser(t *testing.T) {
+	store := newTestStore()
+
+	_, err := store.Search(context.Background(), []float32{1, 0}, embeddings.SearchOptions{})
+	assert.ErrorIs(t, err, ErrUserRequired)
+
+	_, err = store.KeywordSearch(context.Background(), "query", embeddings.SearchOptions{})
+	assert.ErrorIs(t, err, ErrUserRequired)
+}
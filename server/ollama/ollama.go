@@ -0,0 +1,606 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package ollama
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/invopop/jsonschema"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/metrics"
+)
+
+const (
+	// DefaultContextLength is used when the model's metadata doesn't include its context length
+	DefaultContextLength = 4096
+
+	// modelInfoTTL controls how long model metadata is cached, models can be replaced on the server at any time
+	modelInfoTTL = 10 * time.Minute
+
+	// modelInfoFailureTTL controls how long a failed lookup is remembered, requests use the default context length
+	// meanwhile rather than each waiting for the server again
+	modelInfoFailureTTL = time.Minute
+
+	// modelInfoTimeout bounds the metadata lookup, requests fall back to the default context length
+	modelInfoTimeout = 10 * time.Second
+
+	capabilityTools  = "tools"
+	capabilityVision = "vision"
+	// capabilityThinking is reported by models that can reason before they respond
+	capabilityThinking = "thinking"
+)
+
+// ErrModelNotFound is returned when the model hasn't been pulled to the Ollama server
+var ErrModelNotFound = errors.New("model not found on the Ollama server")
+
+type Ollama struct {
+	// ctx bounds the lookups made outside of a request
+	ctx              context.Context
+	httpClient       *http.Client
+	apiURL           string
+	defaultModel     string
+	keepAlive        any
+	inputTokenLimit  int
+	outputTokenLimit int
+	retryPolicy      llm.RetryPolicy
+	metricsService   metrics.LLMetrics
+	countTokens      llm.TokenCounter
+}
+
+// New creates a client for the server. ctx ends the metadata lookups that aren't part of a request, such as the one
+// for InputTokenLimit, it should be cancelled when the plugin stops.
+func New(ctx context.Context, llmService llm.ServiceConfig, httpClient *http.Client, metricsService metrics.LLMetrics) *Ollama {
+	return &Ollama{
+		ctx:              ctx,
+		httpClient:       httpClient,
+		apiURL:           strings.TrimSuffix(llmService.APIURL, "/"),
+		defaultModel:     llmService.DefaultModel,
+		keepAlive:        parseKeepAlive(llmService.KeepAlive),
+		inputTokenLimit:  llmService.InputTokenLimit,
+		outputTokenLimit: llmService.OutputTokenLimit,
+		retryPolicy:      llm.NewRetryPolicy(llmService),
+		metricsService:   metricsService,
+		countTokens:      llm.NewTokenCounter(llmService.DefaultModel),
+	}
+}
+
+// parseKeepAlive converts the configured keep alive to what the API expects. Ollama takes durations such as
+// "10m" as strings but a plain number of seconds, including -1 to keep the model loaded forever, as a number.
+func parseKeepAlive(keepAlive string) any {
+	keepAlive = strings.TrimSpace(keepAlive)
+	if keepAlive == "" {
+		return nil
+	}
+	if seconds, err := strconv.Atoi(keepAlive); err == nil {
+		return seconds
+	}
+	return keepAlive
+}
+
+type chatRequest struct {
+	Model     string         `json:"model"`
+	Messages  []chatMessage  `json:"messages"`
+	Tools     []tool         `json:"tools,omitempty"`
+	Stream    bool           `json:"stream"`
+	KeepAlive any            `json:"keep_alive,omitempty"`
+	Options   map[string]any `json:"options,omitempty"`
+	// Format is a JSON schema the response must follow
+	Format any `json:"format,omitempty"`
+	// Think turns on reasoning, gpt-oss models take a reasoning effort instead of true
+	Think any `json:"think,omitempty"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Thinking is the reasoning of thinking models
+	Thinking  string     `json:"thinking,omitempty"`
+	Images    []string   `json:"images,omitempty"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	ToolName  string     `json:"tool_name,omitempty"`
+}
+
+type tool struct {
+	Type     string       `json:"type"`
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
+type toolCall struct {
+	Function toolCallFunction `json:"function"`
+}
+
+type toolCallFunction struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type chatResponse struct {
+	Message    chatMessage `json:"message"`
+	Done       bool        `json:"done"`
+	DoneReason string      `json:"done_reason"`
+	Error      string      `json:"error"`
+
+	// Token counts, sent with the final chunk
+	PromptEvalCount int64 `json:"prompt_eval_count"`
+	EvalCount       int64 `json:"eval_count"`
+}
+
+type showResponse struct {
+	ModelInfo    map[string]any `json:"model_info"`
+	Capabilities []string       `json:"capabilities"`
+}
+
+// ModelInfo is the metadata of a model reported by the Ollama server
+type ModelInfo struct {
+	ContextLength int
+	Capabilities  []string
+}
+
+// Supports reports whether the model has a capability. Older servers don't report capabilities,
+// in which case everything is assumed to be supported.
+func (m ModelInfo) Supports(capability string) bool {
+	return len(m.Capabilities) == 0 || slices.Contains(m.Capabilities, capability)
+}
+
+// PullProgress is a status update while a model is pulled
+type PullProgress struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+}
+
+type cachedModelInfo struct {
+	info    ModelInfo
+	err     error
+	expires time.Time
+}
+
+// modelInfoCache is shared because a new client is created for every request
+var (
+	modelInfoCache     = map[string]cachedModelInfo{}
+	modelInfoCacheLock sync.Mutex
+)
+
+func (o *Ollama) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.apiURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to ollama failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+		apiErr := &llm.APIError{
+			Provider:   "ollama",
+			StatusCode: resp.StatusCode,
+			Message:    errResp.Error,
+			RetryAfter: llm.ParseRetryAfter(resp.Header),
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %w", ErrModelNotFound, apiErr)
+		}
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
+
+// GetModelInfo returns the context length and capabilities of a model
+func (o *Ollama) GetModelInfo(ctx context.Context, model string) (ModelInfo, error) {
+	key := o.apiURL + "|" + model
+	modelInfoCacheLock.Lock()
+	cached, ok := modelInfoCache[key]
+	modelInfoCacheLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.info, cached.err
+	}
+
+	info, err := o.fetchModelInfo(ctx, model)
+	// Failures are remembered for a shorter time, unless the lookup was only cut short by its caller
+	if err == nil || ctx.Err() == nil {
+		ttl := modelInfoTTL
+		if err != nil {
+			ttl = modelInfoFailureTTL
+		}
+		modelInfoCacheLock.Lock()
+		modelInfoCache[key] = cachedModelInfo{info: info, err: err, expires: time.Now().Add(ttl)}
+		modelInfoCacheLock.Unlock()
+	}
+
+	return info, err
+}
+
+func (o *Ollama) fetchModelInfo(ctx context.Context, model string) (ModelInfo, error) {
+	resp, err := o.post(ctx, "/api/show", map[string]string{"model": model})
+	if err != nil {
+		return ModelInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	var show showResponse
+	if err := json.NewDecoder(resp.Body).Decode(&show); err != nil {
+		return ModelInfo{}, fmt.Errorf("failed to decode model info: %w", err)
+	}
+
+	info := ModelInfo{Capabilities: show.Capabilities}
+	// Metadata keys are prefixed with the model architecture, for example llama.context_length
+	for key, value := range show.ModelInfo {
+		if !strings.HasSuffix(key, ".context_length") {
+			continue
+		}
+		if length, ok := value.(float64); ok {
+			info.ContextLength = int(length)
+		}
+	}
+	return info, nil
+}
+
+// modelInfo returns the model's metadata, or defaults if the server couldn't be asked
+func (o *Ollama) modelInfo(ctx context.Context, model string) ModelInfo {
+	ctx, cancel := context.WithTimeout(ctx, modelInfoTimeout)
+	defer cancel()
+
+	info, err := o.GetModelInfo(ctx, model)
+	if err != nil || info.ContextLength <= 0 {
+		info.ContextLength = DefaultContextLength
+	}
+	return info
+}
+
+// PullModel downloads a model to the Ollama server, calling progress with each status update
+func (o *Ollama) PullModel(ctx context.Context, model string, progress func(PullProgress)) error {
+	resp, err := o.post(ctx, "/api/pull", map[string]any{"model": model, "stream": true})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var update struct {
+			PullProgress
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &update); err != nil {
+			return fmt.Errorf("failed to decode pull status: %w", err)
+		}
+		if update.Error != "" {
+			return fmt.Errorf("failed to pull model %s: %s", model, update.Error)
+		}
+		if progress != nil {
+			progress(update.PullProgress)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// The model's metadata, or the failure to find it, is looked up again now that it is on the server
+	modelInfoCacheLock.Lock()
+	delete(modelInfoCache, o.apiURL+"|"+model)
+	modelInfoCacheLock.Unlock()
+
+	return nil
+}
+
+func (o *Ollama) GetDefaultConfig() llm.LanguageModelConfig {
+	return llm.LanguageModelConfig{
+		Model:              o.defaultModel,
+		MaxGeneratedTokens: o.outputTokenLimit,
+	}
+}
+
+func (o *Ollama) createConfig(opts []llm.LanguageModelOption) llm.LanguageModelConfig {
+	cfg := o.GetDefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// postsToMessages converts the conversation to chat messages. Images are dropped with a note if the model
+// can't see them.
+func postsToMessages(posts []llm.Post, vision bool) []chatMessage {
+	messages := make([]chatMessage, 0, len(posts))
+	for _, post := range posts {
+		message := chatMessage{
+			Role:    "user",
+			Content: post.Message,
+		}
+		switch post.Role {
+		case llm.PostRoleBot:
+			message.Role = "assistant"
+		case llm.PostRoleSystem:
+			message.Role = "system"
+		}
+
+		for _, file := range post.Files {
+			if !vision {
+				message.Content += "\n[The user attached an image but this model can't view images. Tell the user this.]"
+				continue
+			}
+			if file.MimeType != "image/png" && file.MimeType != "image/jpeg" {
+				message.Content += fmt.Sprintf("\n[Unsupported image type: %s]", file.MimeType)
+				continue
+			}
+			data, err := io.ReadAll(file.Reader)
+			if err != nil {
+				message.Content += "\n[Error reading image data]"
+				continue
+			}
+			message.Images = append(message.Images, base64.StdEncoding.EncodeToString(data))
+		}
+
+		if post.Role == llm.PostRoleBot && len(post.ToolCalls) > 0 {
+			for _, call := range post.ToolCalls {
+				arguments := call.Arguments
+				if arguments == "" {
+					arguments = "{}"
+				}
+				message.ToolCalls = append(message.ToolCalls, toolCall{Function: toolCallFunction{Name: call.Name, Arguments: json.RawMessage(arguments)}})
+			}
+			messages = append(messages, message)
+			messages = append(messages, toolMessages(post.ToolCalls)...)
+			continue
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages
+}
+
+// toolMessages are the results of the tools the model called, one message for each
+func toolMessages(results []llm.ToolCall) []chatMessage {
+	messages := make([]chatMessage, 0, len(results))
+	for _, result := range results {
+		messages = append(messages, chatMessage{
+			Role:     "tool",
+			Content:  result.ModelResult(),
+			ToolName: result.Name,
+		})
+	}
+	return messages
+}
+
+func convertTools(tools []llm.Tool) []tool {
+	schemaMaker := jsonschema.Reflector{
+		Anonymous:      true,
+		ExpandedStruct: true,
+	}
+
+	converted := make([]tool, 0, len(tools))
+	for _, t := range tools {
+		converted = append(converted, tool{
+			Type: "function",
+			Function: toolFunction{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  llm.ToolSchema(&schemaMaker, t),
+			},
+		})
+	}
+	return converted
+}
+
+func (o *Ollama) chatRequest(ctx context.Context, cfg llm.LanguageModelConfig, request llm.CompletionRequest) chatRequest {
+	info := o.modelInfo(ctx, cfg.Model)
+
+	// The context window defaults to a few thousand tokens regardless of the model so it's always set explicitly
+	contextLength := info.ContextLength
+	if o.inputTokenLimit > 0 {
+		contextLength = o.inputTokenLimit + max(cfg.MaxGeneratedTokens, 0)
+	}
+	options := map[string]any{"num_ctx": contextLength}
+	if cfg.MaxGeneratedTokens > 0 {
+		options["num_predict"] = cfg.MaxGeneratedTokens
+	}
+	if cfg.Temperature != nil {
+		options["temperature"] = *cfg.Temperature
+	}
+	if cfg.TopP != nil {
+		options["top_p"] = *cfg.TopP
+	}
+	if len(cfg.StopSequences) > 0 {
+		options["stop"] = cfg.StopSequences
+	}
+	if cfg.Seed != nil {
+		options["seed"] = *cfg.Seed
+	}
+
+	chat := chatRequest{
+		Model:     cfg.Model,
+		Messages:  postsToMessages(request.Posts, info.Supports(capabilityVision)),
+		Stream:    true,
+		KeepAlive: o.keepAlive,
+		Options:   options,
+	}
+
+	// Models without tool support reject requests that include tools
+	if request.Context != nil && request.Context.Tools != nil && info.Supports(capabilityTools) {
+		chat.Tools = convertTools(request.Context.Tools.GetTools())
+	}
+	if cfg.JSONSchema != nil {
+		chat.Format = cfg.JSONSchema
+	}
+	if (cfg.ReasoningEffort != "" || cfg.ThinkingBudget > 0) && info.Supports(capabilityThinking) {
+		chat.Think = true
+		if strings.HasPrefix(cfg.Model, "gpt-oss") {
+			chat.Think = cmp.Or(cfg.ReasoningEffort, llm.ReasoningEffortMedium)
+		}
+	}
+
+	return chat
+}
+
+// streamChat streams one response to the chat, one step of the agent loop. The model's turn is added to the
+// chat when it calls tools so their results can follow it.
+func (o *Ollama) streamChat(ctx context.Context, cfg llm.LanguageModelConfig, request *chatRequest, events chan<- llm.StreamEvent) (llm.AgentStepResult, error) {
+	// Nothing has been streamed for this request yet so failures can be retried
+	var resp *http.Response
+	err := o.retryPolicy.Do(ctx, llm.ClassifyError, func() error {
+		var postErr error
+		resp, postErr = o.post(ctx, "/api/chat", request)
+		return postErr
+	})
+	if err != nil {
+		return llm.AgentStepResult{}, err
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	var toolCalls []toolCall
+	var usage llm.TokenUsage
+	// Models without the thinking capability put their reasoning in the content
+	var thinkTags llm.ThinkTagParser
+	emit := func(parsed []llm.StreamEvent) {
+		for _, event := range parsed {
+			if event.Type == llm.EventTypeText {
+				content.WriteString(event.Text)
+			}
+			events <- event
+		}
+	}
+	finishReason := llm.FinishReasonStop
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var chunk chatResponse
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return llm.AgentStepResult{}, fmt.Errorf("failed to decode ollama response: %w", err)
+		}
+		if chunk.Error != "" {
+			return llm.AgentStepResult{}, fmt.Errorf("error from ollama stream: %s", chunk.Error)
+		}
+
+		if chunk.Message.Thinking != "" {
+			events <- llm.StreamEvent{Type: llm.EventTypeReasoning, Text: chunk.Message.Thinking}
+		}
+		if chunk.Message.Content != "" {
+			emit(thinkTags.Parse(chunk.Message.Content))
+		}
+		// Tool calls arrive whole rather than as deltas
+		toolCalls = append(toolCalls, chunk.Message.ToolCalls...)
+
+		if chunk.Done {
+			usage = llm.TokenUsage{Model: cfg.Model, InputTokens: chunk.PromptEvalCount, OutputTokens: chunk.EvalCount}
+			cfg.ReportUsage(usage)
+			events <- llm.StreamEvent{Type: llm.EventTypeUsage, Usage: &usage}
+			if chunk.DoneReason != "" {
+				finishReason = chunk.DoneReason
+			}
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return llm.AgentStepResult{}, fmt.Errorf("error reading ollama stream: %w", err)
+	}
+	emit(thinkTags.Flush())
+
+	result := llm.AgentStepResult{FinishReason: finishReason, Usage: usage}
+	if len(toolCalls) == 0 {
+		return result, nil
+	}
+
+	request.Messages = append(request.Messages, chatMessage{
+		Role:      "assistant",
+		Content:   content.String(),
+		ToolCalls: toolCalls,
+	})
+	for _, call := range toolCalls {
+		result.Calls = append(result.Calls, llm.ToolCall{Name: call.Function.Name, Arguments: string(call.Function.Arguments)})
+	}
+	return result, nil
+}
+
+func (o *Ollama) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	o.metricsService.IncrementLLMRequests()
+
+	cfg := o.createConfig(opts)
+	chat := o.chatRequest(ctx, cfg, request)
+
+	events := make(chan llm.StreamEvent)
+	go func() {
+		defer close(events)
+
+		loop := llm.NewAgentLoop(cfg, request.Context, events)
+		reason, err := loop.Run(ctx, func(ctx context.Context, results []llm.ToolCall) (llm.AgentStepResult, error) {
+			chat.Messages = append(chat.Messages, toolMessages(results)...)
+			return o.streamChat(ctx, cfg, &chat, events)
+		})
+		if err != nil {
+			events <- llm.StreamEvent{Type: llm.EventTypeError, Err: err}
+			return
+		}
+		events <- llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: reason}
+	}()
+
+	return &llm.TextStreamResult{Events: events}, nil
+}
+
+func (o *Ollama) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	result, err := o.ChatCompletion(ctx, request, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	text, err := result.ReadText()
+	if err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// CountTokens uses the ratio learned from the usage Ollama reports, it has no tokenize endpoint
+func (o *Ollama) CountTokens(text string) int {
+	return o.countTokens(text)
+}
+
+// InputTokenLimit is the configured limit, or the model's context length less the space reserved for output
+func (o *Ollama) InputTokenLimit() int {
+	if o.inputTokenLimit > 0 {
+		return o.inputTokenLimit
+	}
+
+	limit := o.modelInfo(o.ctx, o.defaultModel).ContextLength - o.outputTokenLimit
+	if limit <= 0 {
+		return DefaultContextLength
+	}
+	return limit
+}
@@ -0,0 +1,431 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package ollama
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncrementLLMRequests()                                   {}
+func (noopMetrics) IncrementLLMFailovers(_, _ string)                       {}
+func (noopMetrics) ObserveLLMTokenUsage(_, _ string, _, _ int64, _ float64) {}
+
+// fakeOllama is a minimal Ollama server. Each chat request is answered with the next scripted response,
+// a list of NDJSON lines.
+type fakeOllama struct {
+	t            *testing.T
+	server       *httptest.Server
+	capabilities []string
+	contextLen   int
+
+	lock        sync.Mutex
+	chats       [][]string
+	requests    []chatRequest
+	showCalls   int
+	unavailable int
+}
+
+func newFakeOllama(t *testing.T, capabilities []string, contextLen int, chats ...[]string) *fakeOllama {
+	f := &fakeOllama{t: t, capabilities: capabilities, contextLen: contextLen, chats: chats}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/show", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		f.showCalls++
+		f.lock.Unlock()
+
+		var req map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req["model"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"model 'missing' not found"}`)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"model_info":   map[string]any{"general.architecture": "llama", "llama.context_length": f.contextLen},
+			"capabilities": f.capabilities,
+		})
+	})
+	mux.HandleFunc("/api/chat", func(w http.ResponseWriter, r *http.Request) {
+		var req chatRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.requests = append(f.requests, req)
+		if f.unavailable > 0 {
+			f.unavailable--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":"server busy"}`)
+			return
+		}
+		if req.Model == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"model 'missing' not found, try pulling it first"}`)
+			return
+		}
+		require.NotEmpty(t, f.chats, "unexpected chat request")
+		lines := f.chats[0]
+		f.chats = f.chats[1:]
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	})
+	mux.HandleFunc("/api/pull", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req["model"] == "unknown" {
+			fmt.Fprintln(w, `{"status":"pulling manifest"}`)
+			fmt.Fprintln(w, `{"error":"pull model manifest: file does not exist"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"status":"pulling manifest"}`)
+		fmt.Fprintln(w, `{"status":"downloading","digest":"sha256:abc","total":100,"completed":50}`)
+		fmt.Fprintln(w, `{"status":"success"}`)
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	// Metadata is cached per server URL, every test server has its own
+	return f
+}
+
+func (f *fakeOllama) client(cfg llm.ServiceConfig) *Ollama {
+	cfg.APIURL = f.server.URL
+	if cfg.DefaultModel == "" {
+		cfg.DefaultModel = "llama3.2"
+	}
+	return New(context.Background(), cfg, f.server.Client(), noopMetrics{})
+}
+
+func textChunks(texts ...string) []string {
+	lines := make([]string, 0, len(texts)+1)
+	for _, text := range texts {
+		line, _ := json.Marshal(chatResponse{Message: chatMessage{Role: "assistant", Content: text}})
+		lines = append(lines, string(line))
+	}
+	return append(lines, `{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop"}`)
+}
+
+func userRequest(message string, llmContext *llm.Context) llm.CompletionRequest {
+	if llmContext == nil {
+		llmContext = llm.NewContext()
+	}
+	return llm.CompletionRequest{
+		Posts: []llm.Post{
+			{Role: llm.PostRoleSystem, Message: "You are helpful"},
+			{Role: llm.PostRoleUser, Message: message},
+		},
+		Context: llmContext,
+	}
+}
+
+func TestChatCompletionStreams(t *testing.T) {
+	fake := newFakeOllama(t, []string{"completion"}, 32768, textChunks("Hello", " there"))
+	client := fake.client(llm.ServiceConfig{KeepAlive: "10m", OutputTokenLimit: 512})
+
+	result, err := client.ChatCompletion(context.Background(), userRequest("Hi", nil))
+	require.NoError(t, err)
+
+	var chunks []string
+	var last llm.StreamEvent
+	for event := range result.Events {
+		if event.Type == llm.EventTypeText {
+			chunks = append(chunks, event.Text)
+		}
+		last = event
+	}
+	assert.Equal(t, []string{"Hello", " there"}, chunks)
+	assert.Equal(t, llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: llm.FinishReasonStop}, last)
+
+	require.Len(t, fake.requests, 1)
+	req := fake.requests[0]
+	assert.Equal(t, "llama3.2", req.Model)
+	assert.True(t, req.Stream)
+	assert.Equal(t, "10m", req.KeepAlive)
+	assert.Equal(t, []chatMessage{{Role: "system", Content: "You are helpful"}, {Role: "user", Content: "Hi"}}, req.Messages)
+
+	// The model's full context window is requested instead of the server default
+	assert.EqualValues(t, 32768, req.Options["num_ctx"])
+	assert.EqualValues(t, 512, req.Options["num_predict"])
+}
+
+func TestChatCompletionNoStreamReturnsErrors(t *testing.T) {
+	fake := newFakeOllama(t, nil, 8192, []string{`{"message":{"role":"assistant","content":"partial"}}`, `{"error":"out of memory"}`})
+	client := fake.client(llm.ServiceConfig{})
+
+	_, err := client.ChatCompletionNoStream(context.Background(), userRequest("Hi", nil))
+	assert.ErrorContains(t, err, "out of memory")
+}
+
+func TestChatCompletionModelNotFound(t *testing.T) {
+	fake := newFakeOllama(t, nil, 0)
+	client := fake.client(llm.ServiceConfig{DefaultModel: "missing"})
+
+	_, err := client.ChatCompletionNoStream(context.Background(), userRequest("Hi", nil))
+	assert.ErrorIs(t, err, ErrModelNotFound)
+}
+
+func TestChatCompletionRetries(t *testing.T) {
+	fake := newFakeOllama(t, nil, 8192, textChunks("ok"))
+	fake.unavailable = 1
+	client := fake.client(llm.ServiceConfig{RetryBackoffMilliseconds: 1})
+
+	text, err := client.ChatCompletionNoStream(context.Background(), userRequest("Hi", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", text)
+	assert.Len(t, fake.requests, 2)
+
+	// Retries can be turned off
+	fake.unavailable = 1
+	_, err = fake.client(llm.ServiceConfig{MaxRetries: -1}).ChatCompletionNoStream(context.Background(), userRequest("Hi", nil))
+	var apiErr *llm.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+}
+
+type lookupArgs struct {
+	Term string `json:"term"`
+}
+
+func TestChatCompletionToolCalls(t *testing.T) {
+	toolCallChunk := `{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"lookup","arguments":{"term":"ollama"}}}]},"done":true}`
+	fake := newFakeOllama(t, []string{"completion", "tools"}, 8192, []string{toolCallChunk}, textChunks("It runs models locally."))
+	client := fake.client(llm.ServiceConfig{})
+
+	var gotTerm string
+	tools := llm.NewNoTools()
+	tools.AddTools([]llm.Tool{{
+		Name:        "lookup",
+		Description: "Looks up a term",
+		Schema:      lookupArgs{},
+		Resolver: func(_ context.Context, _ *llm.Context, argsGetter llm.ToolArgumentGetter) (string, error) {
+			var args lookupArgs
+			if err := argsGetter(&args); err != nil {
+				return "", err
+			}
+			gotTerm = args.Term
+			return "Ollama is a local model runner", nil
+		},
+	}})
+	llmContext := llm.NewContext()
+	llmContext.Tools = tools
+
+	text, err := client.ChatCompletionNoStream(context.Background(), userRequest("What is ollama?", llmContext))
+	require.NoError(t, err)
+	assert.Equal(t, "It runs models locally.", text)
+	assert.Equal(t, "ollama", gotTerm)
+
+	require.Len(t, fake.requests, 2)
+	require.Len(t, fake.requests[0].Tools, 1)
+	assert.Equal(t, "lookup", fake.requests[0].Tools[0].Function.Name)
+
+	// The follow up request carries the tool call and its result
+	messages := fake.requests[1].Messages
+	require.Len(t, messages, 4)
+	assert.Equal(t, "assistant", messages[2].Role)
+	assert.Equal(t, "lookup", messages[2].ToolCalls[0].Function.Name)
+	assert.Equal(t, chatMessage{Role: "tool", Content: "Ollama is a local model runner", ToolName: "lookup"}, messages[3])
+}
+
+func TestChatCompletionToolErrorSentToModel(t *testing.T) {
+	toolCallChunk := `{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"lookup","arguments":{"term":"ollama"}}}]},"done":true}`
+	fake := newFakeOllama(t, []string{"completion", "tools"}, 8192, []string{toolCallChunk}, textChunks("The lookup failed."))
+	client := fake.client(llm.ServiceConfig{})
+
+	llmContext := llm.NewContext()
+	llmContext.Tools = llm.NewNoTools()
+	llmContext.Tools.AddTools([]llm.Tool{{
+		Name:   "lookup",
+		Schema: lookupArgs{},
+		Resolver: func(_ context.Context, _ *llm.Context, _ llm.ToolArgumentGetter) (string, error) {
+			return "", errors.New("service unavailable")
+		},
+	}})
+
+	// Failed tools don't fail the request, the model is told so it can recover
+	text, err := client.ChatCompletionNoStream(context.Background(), userRequest("What is ollama?", llmContext))
+	require.NoError(t, err)
+	assert.Equal(t, "The lookup failed.", text)
+
+	require.Len(t, fake.requests, 2)
+	messages := fake.requests[1].Messages
+	require.Len(t, messages, 4)
+	assert.Equal(t, chatMessage{Role: "tool", Content: "Error: service unavailable", ToolName: "lookup"}, messages[3])
+}
+
+func TestPostsToMessagesToolCalls(t *testing.T) {
+	messages := postsToMessages([]llm.Post{
+		{Role: llm.PostRoleUser, Message: "Create an issue"},
+		{Role: llm.PostRoleBot, Message: "Creating it", ToolCalls: []llm.ToolCall{
+			{Name: "CreateIssue", Arguments: `{"title":"Bug"}`, Result: "Created MM-1"},
+		}},
+	}, false)
+
+	require.Len(t, messages, 3)
+	assert.Equal(t, "assistant", messages[1].Role)
+	assert.Equal(t, []toolCall{{Function: toolCallFunction{Name: "CreateIssue", Arguments: json.RawMessage(`{"title":"Bug"}`)}}}, messages[1].ToolCalls)
+	assert.Equal(t, chatMessage{Role: "tool", Content: "Created MM-1", ToolName: "CreateIssue"}, messages[2])
+}
+
+func TestChatCompletionSkipsUnsupportedFeatures(t *testing.T) {
+	fake := newFakeOllama(t, []string{"completion"}, 8192, textChunks("ok"))
+	client := fake.client(llm.ServiceConfig{})
+
+	llmContext := llm.NewContext()
+	llmContext.Tools = llm.NewNoTools()
+	llmContext.Tools.AddTools([]llm.Tool{{Name: "lookup", Schema: lookupArgs{}}})
+	request := userRequest("What's in this picture?", llmContext)
+	request.Posts[1].Files = []llm.File{{MimeType: "image/png", Reader: bytes.NewReader([]byte("png"))}}
+
+	_, err := client.ChatCompletionNoStream(context.Background(), request)
+	require.NoError(t, err)
+
+	require.Len(t, fake.requests, 1)
+	assert.Empty(t, fake.requests[0].Tools)
+	assert.Empty(t, fake.requests[0].Messages[1].Images)
+	assert.Contains(t, fake.requests[0].Messages[1].Content, "can't view images")
+}
+
+func TestChatCompletionModelParameters(t *testing.T) {
+	fake := newFakeOllama(t, []string{"completion", "thinking"}, 8192, textChunks("ok"), textChunks("ok"))
+
+	opts := []llm.LanguageModelOption{
+		llm.WithTemperature(0.2),
+		llm.WithStopSequences("END"),
+		llm.WithSeed(7),
+		llm.WithReasoningEffort(llm.ReasoningEffortLow),
+	}
+	_, err := fake.client(llm.ServiceConfig{}).ChatCompletionNoStream(context.Background(), userRequest("Hi", nil), opts...)
+	require.NoError(t, err)
+	_, err = fake.client(llm.ServiceConfig{DefaultModel: "gpt-oss:20b"}).ChatCompletionNoStream(context.Background(), userRequest("Hi", nil), opts...)
+	require.NoError(t, err)
+
+	require.Len(t, fake.requests, 2)
+	options := fake.requests[0].Options
+	assert.InDelta(t, 0.2, options["temperature"], 0.001)
+	assert.Equal(t, []any{"END"}, options["stop"])
+	assert.Equal(t, float64(7), options["seed"])
+	assert.NotContains(t, options, "top_p")
+	assert.Equal(t, true, fake.requests[0].Think)
+	// gpt-oss models take the effort itself
+	assert.Equal(t, llm.ReasoningEffortLow, fake.requests[1].Think)
+}
+
+func TestChatCompletionThinkTags(t *testing.T) {
+	fake := newFakeOllama(t, []string{"completion"}, 8192, textChunks("<think>The user", " greets</think>", "\n\nHello"))
+	client := fake.client(llm.ServiceConfig{DefaultModel: "deepseek-r1"})
+
+	result, err := client.ChatCompletion(context.Background(), userRequest("Hi", nil))
+	require.NoError(t, err)
+	var text, reasoning string
+	for event := range result.Events {
+		switch event.Type {
+		case llm.EventTypeText:
+			text += event.Text
+		case llm.EventTypeReasoning:
+			reasoning += event.Text
+		}
+	}
+	assert.Equal(t, "Hello", text)
+	assert.Equal(t, "The user greets", reasoning)
+}
+
+func TestChatCompletionVision(t *testing.T) {
+	fake := newFakeOllama(t, []string{"completion", "vision"}, 8192, textChunks("A cat"))
+	client := fake.client(llm.ServiceConfig{})
+
+	request := userRequest("What's in this picture?", nil)
+	request.Posts[1].Files = []llm.File{
+		{MimeType: "image/png", Reader: bytes.NewReader([]byte("png"))},
+		{MimeType: "image/tiff", Reader: bytes.NewReader([]byte("tiff"))},
+	}
+
+	_, err := client.ChatCompletionNoStream(context.Background(), request)
+	require.NoError(t, err)
+
+	message := fake.requests[0].Messages[1]
+	assert.Equal(t, []string{"cG5n"}, message.Images)
+	assert.Contains(t, message.Content, "Unsupported image type: image/tiff")
+}
+
+func TestInputTokenLimit(t *testing.T) {
+	t.Run("read from the model metadata", func(t *testing.T) {
+		fake := newFakeOllama(t, nil, 131072)
+		assert.Equal(t, 131072, fake.client(llm.ServiceConfig{}).InputTokenLimit())
+		assert.Equal(t, 131072-1024, fake.client(llm.ServiceConfig{OutputTokenLimit: 1024}).InputTokenLimit())
+
+		// Metadata is cached between clients
+		assert.Equal(t, 1, fake.showCalls)
+	})
+
+	t.Run("configured limit wins", func(t *testing.T) {
+		fake := newFakeOllama(t, nil, 131072, textChunks("ok"))
+		client := fake.client(llm.ServiceConfig{InputTokenLimit: 16000, OutputTokenLimit: 1000})
+		assert.Equal(t, 16000, client.InputTokenLimit())
+
+		_, err := client.ChatCompletionNoStream(context.Background(), userRequest("Hi", nil))
+		require.NoError(t, err)
+		assert.EqualValues(t, 17000, fake.requests[0].Options["num_ctx"])
+	})
+
+	t.Run("unknown model", func(t *testing.T) {
+		fake := newFakeOllama(t, nil, 0)
+		assert.Equal(t, DefaultContextLength, fake.client(llm.ServiceConfig{DefaultModel: "missing"}).InputTokenLimit())
+
+		// A failed lookup isn't repeated for every request
+		assert.Equal(t, DefaultContextLength, fake.client(llm.ServiceConfig{DefaultModel: "missing"}).InputTokenLimit())
+		assert.Equal(t, 1, fake.showCalls)
+	})
+
+	t.Run("cancelled lookups aren't remembered", func(t *testing.T) {
+		fake := newFakeOllama(t, nil, 131072)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		client := New(ctx, llm.ServiceConfig{APIURL: fake.server.URL, DefaultModel: "llama3.2"}, fake.server.Client(), noopMetrics{})
+		assert.Equal(t, DefaultContextLength, client.InputTokenLimit())
+		assert.Equal(t, 131072, fake.client(llm.ServiceConfig{}).InputTokenLimit())
+	})
+}
+
+func TestPullModel(t *testing.T) {
+	fake := newFakeOllama(t, nil, 131072)
+	client := fake.client(llm.ServiceConfig{DefaultModel: "missing"})
+	assert.Equal(t, DefaultContextLength, client.InputTokenLimit())
+
+	var statuses []string
+	err := client.PullModel(context.Background(), "missing", func(progress PullProgress) {
+		statuses = append(statuses, progress.Status)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pulling manifest", "downloading", "success"}, statuses)
+
+	// The failed lookup from before the pull isn't remembered
+	client.InputTokenLimit()
+	assert.Equal(t, 2, fake.showCalls)
+
+	err = client.PullModel(context.Background(), "unknown", nil)
+	assert.ErrorContains(t, err, "file does not exist")
+}
+
+func TestParseKeepAlive(t *testing.T) {
+	assert.Nil(t, parseKeepAlive(""))
+	assert.Equal(t, "5m", parseKeepAlive("5m"))
+	assert.Equal(t, -1, parseKeepAlive("-1"))
+	assert.Equal(t, 300, parseKeepAlive(" 300 "))
+}
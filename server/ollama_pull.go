@@ -0,0 +1,102 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/ollama"
+)
+
+var (
+	errOllamaPullRunning = errors.New("the model is already being pulled")
+	errNotOllamaBot      = errors.New("the bot doesn't use an Ollama service")
+)
+
+// OllamaPullStatus is the progress of pulling a bot's model to its Ollama server
+type OllamaPullStatus struct {
+	Bot       string `json:"bot"`
+	Model     string `json:"model"`
+	Status    string `json:"status"`
+	Total     int64  `json:"total"`
+	Completed int64  `json:"completed"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+// startOllamaPull pulls the default model of the bot's Ollama service in the background. Progress is kept on this
+// server only, the status can be read with getOllamaPull until the next pull of the bot starts.
+func (p *Plugin) startOllamaPull(botName string) (OllamaPullStatus, error) {
+	var service llm.ServiceConfig
+	found := false
+	for _, bot := range p.getConfiguration().Bots {
+		if bot.Name == botName {
+			service = bot.Service
+			found = true
+			break
+		}
+	}
+	if !found || service.Type != llm.ServiceTypeOllama {
+		return OllamaPullStatus{}, errNotOllamaBot
+	}
+
+	p.ollamaPullsLock.Lock()
+	defer p.ollamaPullsLock.Unlock()
+	if current, ok := p.ollamaPulls[botName]; ok && !current.Done {
+		return current, errOllamaPullRunning
+	}
+	if p.ollamaPulls == nil {
+		p.ollamaPulls = map[string]OllamaPullStatus{}
+	}
+	status := OllamaPullStatus{Bot: botName, Model: service.DefaultModel, Status: "starting"}
+	p.ollamaPulls[botName] = status
+
+	// Pulls aren't requests to the model so they aren't counted in its metrics
+	client := ollama.New(p.activeContext(), service, p.llmUpstreamHTTPClient, nil)
+	go func() {
+		err := client.PullModel(p.activeContext(), service.DefaultModel, func(progress ollama.PullProgress) {
+			p.updateOllamaPull(botName, func(status *OllamaPullStatus) {
+				status.Status = progress.Status
+				status.Total = progress.Total
+				status.Completed = progress.Completed
+			})
+		})
+		if err != nil {
+			p.pluginAPI.Log.Error("Failed to pull Ollama model", "bot", botName, "model", service.DefaultModel, "error", err)
+		}
+		p.updateOllamaPull(botName, func(status *OllamaPullStatus) {
+			status.Done = true
+			if err != nil {
+				status.Error = err.Error()
+			}
+		})
+	}()
+
+	return status, nil
+}
+
+func (p *Plugin) updateOllamaPull(botName string, update func(status *OllamaPullStatus)) {
+	p.ollamaPullsLock.Lock()
+	defer p.ollamaPullsLock.Unlock()
+	status := p.ollamaPulls[botName]
+	update(&status)
+	p.ollamaPulls[botName] = status
+}
+
+// getOllamaPull returns the status of the last pull of the bot's model, if one was started on this server
+func (p *Plugin) getOllamaPull(botName string) (OllamaPullStatus, bool) {
+	p.ollamaPullsLock.Lock()
+	defer p.ollamaPullsLock.Unlock()
+	status, ok := p.ollamaPulls[botName]
+	return status, ok
+}
+
+// modelNotFoundMessage explains errors from a model that hasn't been pulled to its server, ok is false for other errors
+func modelNotFoundMessage(T TranslationFunc, err error) (string, bool) {
+	if !errors.Is(err, ollama.ErrModelNotFound) {
+		return "", false
+	}
+	return T("copilot.ollama_model_not_found", "Sorry! The model isn't available on the Ollama server yet. A system admin can pull it from the bot's settings in the System Console."), true
+}
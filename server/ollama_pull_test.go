@@ -0,0 +1,78 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/ollama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartOllamaPull(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/pull", r.URL.Path)
+		fmt.Fprintln(w, `{"status":"downloading","total":100,"completed":50}`)
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprintln(w, `{"status":"success"}`)
+	}))
+	defer server.Close()
+
+	e.plugin.llmUpstreamHTTPClient = server.Client()
+	e.plugin.setConfiguration(makeConfig(Config{Bots: []llm.BotConfig{
+		{Name: "local", Service: llm.ServiceConfig{Type: llm.ServiceTypeOllama, APIURL: server.URL, DefaultModel: "llama3.2"}},
+		{Name: "hosted", Service: llm.ServiceConfig{Type: llm.ServiceTypeOpenAI}},
+	}}))
+
+	_, err := e.plugin.startOllamaPull("hosted")
+	assert.ErrorIs(t, err, errNotOllamaBot)
+	_, err = e.plugin.startOllamaPull("unknown")
+	assert.ErrorIs(t, err, errNotOllamaBot)
+	_, ok := e.plugin.getOllamaPull("local")
+	assert.False(t, ok)
+
+	status, err := e.plugin.startOllamaPull("local")
+	require.NoError(t, err)
+	assert.Equal(t, "llama3.2", status.Model)
+
+	require.Eventually(t, func() bool {
+		status, _ := e.plugin.getOllamaPull("local")
+		return status.Status == "downloading"
+	}, time.Second, 10*time.Millisecond)
+	status, _ = e.plugin.getOllamaPull("local")
+	assert.Equal(t, int64(50), status.Completed)
+
+	// A second pull waits for the first to finish
+	_, err = e.plugin.startOllamaPull("local")
+	assert.ErrorIs(t, err, errOllamaPullRunning)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		status, _ := e.plugin.getOllamaPull("local")
+		return status.Done
+	}, time.Second, 10*time.Millisecond)
+	status, _ = e.plugin.getOllamaPull("local")
+	assert.Equal(t, OllamaPullStatus{Bot: "local", Model: "llama3.2", Status: "success", Done: true}, status)
+}
+
+func TestModelNotFoundMessage(t *testing.T) {
+	T := i18nLocalizerFunc(i18nInit(), "en")
+	message, ok := modelNotFoundMessage(T, fmt.Errorf("request failed: %w", ollama.ErrModelNotFound))
+	assert.True(t, ok)
+	assert.Contains(t, message, "pull it")
+
+	_, ok = modelNotFoundMessage(T, fmt.Errorf("request failed"))
+	assert.False(t, ok)
+}
@@ -7,12 +7,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"image"
 	"image/png"
 	"io"
+	"maps"
+	"math"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -26,27 +28,30 @@ import (
 )
 
 type Config struct {
-	APIKey              string        `json:"apiKey"`
-	APIURL              string        `json:"apiURL"`
-	OrgID               string        `json:"orgID"`
-	DefaultModel        string        `json:"defaultModel"`
-	InputTokenLimit     int           `json:"inputTokenLimit"`
-	OutputTokenLimit    int           `json:"outputTokenLimit"`
-	StreamingTimeout    time.Duration `json:"streamingTimeout"`
-	SendUserID          bool          `json:"sendUserID"`
-	EmbeddingModel      string        `json:"embeddingModel"`
-	EmbeddingDimentions int           `json:"embeddingDimensions"`
+	APIKey              string          `json:"apiKey"`
+	APIURL              string          `json:"apiURL"`
+	OrgID               string          `json:"orgID"`
+	DefaultModel        string          `json:"defaultModel"`
+	InputTokenLimit     int             `json:"inputTokenLimit"`
+	OutputTokenLimit    int             `json:"outputTokenLimit"`
+	StreamingTimeout    time.Duration   `json:"streamingTimeout"`
+	SendUserID          bool            `json:"sendUserID"`
+	EmbeddingModel      string          `json:"embeddingModel"`
+	EmbeddingDimentions int             `json:"embeddingDimensions"`
+	RetryPolicy         llm.RetryPolicy `json:"retryPolicy"`
+	// StreamUsage asks for the token usage at the end of streams, not every compatible API supports it
+	StreamUsage bool `json:"streamUsage"`
 }
 
 type OpenAI struct {
 	client         *openaiClient.Client
 	config         Config
 	metricsService metrics.LLMetrics
+	countTokens    llm.TokenCounter
 }
 
 const (
 	StreamingTimeoutDefault = 10 * time.Second
-	MaxFunctionCalls        = 10
 	OpenAIMaxImageSize      = 20 * 1024 * 1024 // 20 MB
 )
 
@@ -76,6 +81,7 @@ func NewCompatible(llmService llm.ServiceConfig, httpClient *http.Client, metric
 
 func New(llmService llm.ServiceConfig, httpClient *http.Client, metricsService metrics.LLMetrics) *OpenAI {
 	config := configFromLLMService(llmService)
+	config.StreamUsage = true
 	return newOpenAI(config, httpClient, metricsService,
 		func(apiKey string) openaiClient.ClientConfig {
 			clientConfig := openaiClient.DefaultConfig(apiKey)
@@ -85,6 +91,22 @@ func New(llmService llm.ServiceConfig, httpClient *http.Client, metricsService m
 	)
 }
 
+// NewEmbeddings creates a new OpenAI client configured only for embeddings functionality
+func NewEmbeddings(config Config, httpClient *http.Client) *OpenAI {
+	if config.EmbeddingModel == "" {
+		config.EmbeddingModel = string(openaiClient.LargeEmbedding3)
+		config.EmbeddingDimentions = 3072
+	}
+
+	return newOpenAI(config, httpClient, nil,
+		func(apiKey string) openaiClient.ClientConfig {
+			clientConfig := openaiClient.DefaultConfig(apiKey)
+			clientConfig.OrgID = config.OrgID
+			return clientConfig
+		},
+	)
+}
+
 // NewCompatibleEmbeddings creates a new OpenAI client configured only for embeddings functionality
 func NewCompatibleEmbeddings(config Config, httpClient *http.Client) *OpenAI {
 	if config.EmbeddingModel == "" {
@@ -121,6 +143,7 @@ func configFromLLMService(llmService llm.ServiceConfig) Config {
 		OutputTokenLimit: llmService.OutputTokenLimit,
 		StreamingTimeout: streamingTimeout,
 		SendUserID:       llmService.SendUserID,
+		RetryPolicy:      llm.NewRetryPolicy(llmService),
 	}
 }
 
@@ -131,12 +154,14 @@ func newOpenAI(
 	baseConfigFunc func(apiKey string) openaiClient.ClientConfig,
 ) *OpenAI {
 	clientConfig := baseConfigFunc(config.APIKey)
-	clientConfig.HTTPClient = httpClient
+	// The client's errors don't include response headers, they are recorded for retries instead
+	clientConfig.HTTPClient = llm.NewRetryAfterRecordingClient(httpClient)
 
 	return &OpenAI{
 		client:         openaiClient.NewClientWithConfig(clientConfig),
 		config:         config,
 		metricsService: metricsService,
+		countTokens:    llm.NewTokenCounter(config.DefaultModel),
 	}
 }
 
@@ -157,7 +182,7 @@ func toolsToOpenAITools(tools []llm.Tool) []openaiClient.Tool {
 	}
 
 	for _, tool := range tools {
-		schema := schemaMaker.Reflect(tool.Schema)
+		schema := llm.ToolSchema(&schemaMaker, tool)
 		result = append(result, openaiClient.Tool{
 			Type: openaiClient.ToolTypeFunction,
 			Function: &openaiClient.FunctionDefinition{
@@ -230,155 +255,107 @@ func postsToChatCompletionMessages(posts []llm.Post) []openaiClient.ChatCompleti
 			completionMessage.Content = post.Message
 		}
 
+		if post.Role == llm.PostRoleBot && len(post.ToolCalls) > 0 {
+			completionMessage.ToolCalls = openAIToolCalls(post.ToolCalls)
+			result = append(result, completionMessage)
+			result = append(result, toolMessages(post.ToolCalls)...)
+			continue
+		}
+
 		result = append(result, completionMessage)
 	}
 
 	return result
 }
 
-// createFunctionArgumentResolver Creates a resolver for the json arguments of an openai function call. Unmarshalling the json into the supplied struct.
-func createFunctionArgumentResolver(jsonArgs string) llm.ToolArgumentGetter {
-	return func(args any) error {
-		return json.Unmarshal([]byte(jsonArgs), args)
-	}
-}
-
 type ToolBufferElement struct {
 	id   strings.Builder
 	name strings.Builder
 	args strings.Builder
 }
 
-func (s *OpenAI) streamResultToChannels(request openaiClient.ChatCompletionRequest, llmContext *llm.Context, output chan<- string, errChan chan<- error) {
+// streamResultToChannels streams one response, one step of the agent loop. The model's turn is added to the
+// request when it calls tools so their results can follow it.
+func (s *OpenAI) streamResultToChannels(requestCtx context.Context, request *openaiClient.ChatCompletionRequest, cfg llm.LanguageModelConfig, events chan<- llm.StreamEvent) (llm.AgentStepResult, error) {
 	request.Stream = true
 
-	ctx, cancel := context.WithCancelCause(context.Background())
-	defer cancel(nil)
-
-	// watchdog to cancel if the streaming stalls
-	watchdog := make(chan struct{})
-	go func() {
-		timer := time.NewTimer(s.config.StreamingTimeout)
-		defer timer.Stop()
-		for {
-			select {
-			case <-timer.C:
-				cancel(ErrStreamingTimeout)
-				return
-			case <-ctx.Done():
-				return
-			case <-watchdog:
-				if !timer.Stop() {
-					<-timer.C
-				}
-				timer.Reset(s.config.StreamingTimeout)
+	// Nothing has been streamed for this request yet so failures opening the stream can be retried
+	var stream *openaiClient.ChatCompletionStream
+	var ctx context.Context
+	var cancel context.CancelCauseFunc
+	var pingWatchdog func()
+	var retryAfter *llm.RetryAfterRecorder
+	err := s.config.RetryPolicy.Do(requestCtx, func(err error) (bool, time.Duration) {
+		return classifyError(err, retryAfter)
+	}, func() error {
+		attemptCtx, attemptCancel, attemptPing := watchStream(requestCtx, s.config.StreamingTimeout)
+		attemptCtx, retryAfter = llm.WithRetryAfterRecorder(attemptCtx)
+		attemptStream, err := s.client.CreateChatCompletionStream(attemptCtx, *request)
+		if err != nil {
+			if ctxErr := context.Cause(attemptCtx); ctxErr != nil {
+				err = ctxErr
 			}
+			attemptCancel(nil)
+			return err
 		}
-	}()
-
-	stream, err := s.client.CreateChatCompletionStream(ctx, request)
+		stream, ctx, cancel, pingWatchdog = attemptStream, attemptCtx, attemptCancel, attemptPing
+		return nil
+	})
 	if err != nil {
-		if ctxErr := context.Cause(ctx); ctxErr != nil {
-			errChan <- ctxErr
-		} else {
-			errChan <- err
-		}
-		return
+		return llm.AgentStepResult{}, err
 	}
 
+	defer cancel(nil)
 	defer stream.Close()
 
 	// Buffering in the case of tool use
 	var toolsBuffer map[int]*ToolBufferElement
+	var finishReason openaiClient.FinishReason
+	var usage llm.TokenUsage
+	var content strings.Builder
+	// Reasoning models served through compatible APIs put their reasoning in the content
+	var thinkTags llm.ThinkTagParser
+	emit := func(parsed []llm.StreamEvent) {
+		for _, event := range parsed {
+			if event.Type == llm.EventTypeText {
+				content.WriteString(event.Text)
+			}
+			events <- event
+		}
+	}
 	for {
 		response, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
-			return
+			break
 		}
 		if err != nil {
 			if ctxErr := context.Cause(ctx); ctxErr != nil {
-				errChan <- ctxErr
-			} else {
-				errChan <- err
+				err = ctxErr
 			}
-			return
+			return llm.AgentStepResult{}, err
 		}
 
 		// Ping the watchdog when we receive a response
-		watchdog <- struct{}{}
+		pingWatchdog()
+
+		// When usage is requested it comes in a last chunk after the finish reason, without choices
+		if response.Usage != nil {
+			usage = llm.TokenUsage{
+				Model:        cfg.Model,
+				InputTokens:  int64(response.Usage.PromptTokens),
+				OutputTokens: int64(response.Usage.CompletionTokens),
+			}
+			cfg.ReportUsage(usage)
+			events <- llm.StreamEvent{Type: llm.EventTypeUsage, Usage: &usage}
+		}
 
-		if len(response.Choices) == 0 {
+		if len(response.Choices) == 0 || finishReason != "" {
 			continue
 		}
 
-		// Check finishing conditions
-		switch response.Choices[0].FinishReason {
-		case "":
-			// Not done yet, keep going
-		case openaiClient.FinishReasonStop:
-			return
-		case openaiClient.FinishReasonToolCalls:
-			// Verify OpenAI functions are not recursing too deep.
-			numFunctionCalls := 0
-			for i := len(request.Messages) - 1; i >= 0; i-- {
-				if request.Messages[i].Role == openaiClient.ChatMessageRoleTool {
-					numFunctionCalls++
-				} else {
-					break
-				}
-			}
-			if numFunctionCalls > MaxFunctionCalls {
-				errChan <- errors.New("too many function calls")
-				return
-			}
-
-			// Transfer the buffered tools into tool calls
-			tools := []openaiClient.ToolCall{}
-			for i, tool := range toolsBuffer {
-				name := tool.name.String()
-				arguments := tool.args.String()
-				toolID := tool.id.String()
-				num := i
-				tools = append(tools, openaiClient.ToolCall{
-					Function: openaiClient.FunctionCall{
-						Name:      name,
-						Arguments: arguments,
-					},
-					ID:    toolID,
-					Index: &num,
-					Type:  openaiClient.ToolTypeFunction,
-				})
-			}
-
-			// Add the tool calls to the request
-			request.Messages = append(request.Messages, openaiClient.ChatCompletionMessage{
-				Role:      openaiClient.ChatMessageRoleAssistant,
-				ToolCalls: tools,
-			})
-
-			// Resolve the tools and create messages for each
-			for _, tool := range tools {
-				name := tool.Function.Name
-				arguments := tool.Function.Arguments
-				toolID := tool.ID
-				toolResult, err := llmContext.Tools.ResolveTool(name, createFunctionArgumentResolver(arguments), llmContext)
-				if err != nil {
-					fmt.Printf("Error resolving function %s: %s", name, err)
-				}
-				request.Messages = append(request.Messages, openaiClient.ChatCompletionMessage{
-					Role:       openaiClient.ChatMessageRoleTool,
-					Name:       name,
-					Content:    toolResult,
-					ToolCallID: toolID,
-				})
-			}
-
-			// Call ourselves again with the result of the function call
-			s.streamResultToChannels(request, llmContext, output, errChan)
-			return
-		default:
-			fmt.Printf("Unknown finish reason: %s", response.Choices[0].FinishReason)
-			return
+		if response.Choices[0].FinishReason != "" {
+			finishReason = response.Choices[0].FinishReason
+			continue
 		}
 
 		delta := response.Choices[0].Delta
@@ -401,20 +378,143 @@ func (s *OpenAI) streamResultToChannels(request openaiClient.ChatCompletionReque
 			}
 		}
 
-		output <- response.Choices[0].Delta.Content
+		if delta.Content != "" {
+			emit(thinkTags.Parse(delta.Content))
+		}
 	}
+	emit(thinkTags.Flush())
+
+	if finishReason == "" {
+		finishReason = openaiClient.FinishReasonStop
+	}
+	result := llm.AgentStepResult{FinishReason: string(finishReason), Usage: usage}
+	if finishReason != openaiClient.FinishReasonToolCalls || len(toolsBuffer) == 0 {
+		return result, nil
+	}
+
+	// Transfer the buffered tools into tool calls, in the order the model made them
+	for _, i := range slices.Sorted(maps.Keys(toolsBuffer)) {
+		tool := toolsBuffer[i]
+		result.Calls = append(result.Calls, llm.ToolCall{ID: tool.id.String(), Name: tool.name.String(), Arguments: tool.args.String()})
+	}
+
+	// Add the tool calls to the request
+	request.Messages = append(request.Messages, openaiClient.ChatCompletionMessage{
+		Role:      openaiClient.ChatMessageRoleAssistant,
+		Content:   content.String(),
+		ToolCalls: openAIToolCalls(result.Calls),
+	})
+
+	return result, nil
+}
+
+// openAIToolCalls are the calls of an assistant message
+func openAIToolCalls(calls []llm.ToolCall) []openaiClient.ToolCall {
+	tools := make([]openaiClient.ToolCall, 0, len(calls))
+	for i, call := range calls {
+		index := i
+		tools = append(tools, openaiClient.ToolCall{
+			Function: openaiClient.FunctionCall{
+				Name:      call.Name,
+				Arguments: call.Arguments,
+			},
+			ID:    call.ID,
+			Index: &index,
+			Type:  openaiClient.ToolTypeFunction,
+		})
+	}
+	return tools
 }
 
-func (s *OpenAI) streamResult(request openaiClient.ChatCompletionRequest, llmContext *llm.Context) (*llm.TextStreamResult, error) {
-	output := make(chan string)
-	errChan := make(chan error)
+// toolMessages are the results of the tools the model called, one message for each
+func toolMessages(results []llm.ToolCall) []openaiClient.ChatCompletionMessage {
+	messages := make([]openaiClient.ChatCompletionMessage, 0, len(results))
+	for _, result := range results {
+		messages = append(messages, openaiClient.ChatCompletionMessage{
+			Role:       openaiClient.ChatMessageRoleTool,
+			Name:       result.Name,
+			Content:    result.ModelResult(),
+			ToolCallID: result.ID,
+		})
+	}
+	return messages
+}
+
+// watchStream returns a context that is cancelled with ErrStreamingTimeout if the returned ping function
+// isn't called for longer than the timeout, or when the parent context is
+func watchStream(parent context.Context, timeout time.Duration) (context.Context, context.CancelCauseFunc, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+
+	watchdog := make(chan struct{})
 	go func() {
-		defer close(output)
-		defer close(errChan)
-		s.streamResultToChannels(request, llmContext, output, errChan)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				cancel(ErrStreamingTimeout)
+				return
+			case <-ctx.Done():
+				return
+			case <-watchdog:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+			}
+		}
 	}()
 
-	return &llm.TextStreamResult{Stream: output, Err: errChan}, nil
+	ping := func() {
+		select {
+		case watchdog <- struct{}{}:
+		case <-ctx.Done():
+		}
+	}
+	return ctx, cancel, ping
+}
+
+// classifyError decides whether a failed request is retried, using the Retry-After recorded for it
+func classifyError(err error, retryAfter *llm.RetryAfterRecorder) (bool, time.Duration) {
+	statusCode := 0
+	var apiErr *openaiClient.APIError
+	var requestErr *openaiClient.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		statusCode = apiErr.HTTPStatusCode
+	case errors.As(err, &requestErr):
+		statusCode = requestErr.HTTPStatusCode
+	default:
+		return llm.ClassifyError(err)
+	}
+
+	if !llm.IsRetryableStatus(statusCode) {
+		return false, 0
+	}
+	if retryAfter == nil {
+		return true, 0
+	}
+	return true, retryAfter.RetryAfter()
+}
+
+func (s *OpenAI) streamResult(ctx context.Context, request openaiClient.ChatCompletionRequest, cfg llm.LanguageModelConfig, llmContext *llm.Context) (*llm.TextStreamResult, error) {
+	events := make(chan llm.StreamEvent)
+	go func() {
+		defer close(events)
+
+		loop := llm.NewAgentLoop(cfg, llmContext, events)
+		reason, err := loop.Run(ctx, func(ctx context.Context, results []llm.ToolCall) (llm.AgentStepResult, error) {
+			request.Messages = append(request.Messages, toolMessages(results)...)
+			return s.streamResultToChannels(ctx, &request, cfg, events)
+		})
+		if err != nil {
+			events <- llm.StreamEvent{Type: llm.EventTypeError, Err: err}
+			return
+		}
+		events <- llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: reason}
+	}()
+
+	return &llm.TextStreamResult{Events: events}, nil
 }
 
 func (s *OpenAI) GetDefaultConfig() llm.LanguageModelConfig {
@@ -438,32 +538,84 @@ func (s *OpenAI) completionRequestFromConfig(cfg llm.LanguageModelConfig) openai
 		Model: cfg.Model,
 	}
 
-	request.MaxTokens = cfg.MaxGeneratedTokens
+	reasoning := isReasoningModel(cfg.Model)
+	if reasoning {
+		// Reasoning models count the reasoning towards the limit and reject max_tokens
+		request.MaxCompletionTokens = cfg.MaxGeneratedTokens
+	} else {
+		request.MaxTokens = cfg.MaxGeneratedTokens
+	}
+
+	// Reasoning models only sample at their defaults
+	if cfg.Temperature != nil && !reasoning {
+		request.Temperature = *cfg.Temperature
+		if request.Temperature == 0 {
+			// A zero temperature would be omitted from the request
+			request.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	if cfg.TopP != nil && !reasoning {
+		request.TopP = *cfg.TopP
+		if request.TopP == 0 {
+			request.TopP = math.SmallestNonzeroFloat32
+		}
+	}
+	request.Stop = cfg.StopSequences
+	request.Seed = cfg.Seed
+	if cfg.ReasoningEffort != "" && (reasoning || strings.HasPrefix(cfg.Model, "gpt-oss")) {
+		request.ReasoningEffort = cfg.ReasoningEffort
+	}
+
+	if cfg.JSONSchema != nil {
+		request.ResponseFormat = &openaiClient.ChatCompletionResponseFormat{
+			Type: openaiClient.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openaiClient.ChatCompletionResponseFormatJSONSchema{
+				Name:   llm.StructuredResponseName,
+				Schema: cfg.JSONSchema,
+			},
+		}
+	}
 
 	return request
 }
 
-func (s *OpenAI) ChatCompletion(request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+// reasoningModelPrefixes are the OpenAI models that reason before they respond
+var reasoningModelPrefixes = []string{"o1", "o3", "o4", "gpt-5"}
+
+func isReasoningModel(model string) bool {
+	for _, prefix := range reasoningModelPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *OpenAI) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
 	s.metricsService.IncrementLLMRequests()
 
-	openAIRequest := s.completionRequestFromConfig(s.createConfig(opts))
+	cfg := s.createConfig(opts)
+	openAIRequest := s.completionRequestFromConfig(cfg)
 	openAIRequest = modifyCompletionRequestWithRequest(openAIRequest, request)
 	openAIRequest.Stream = true
+	if s.config.StreamUsage {
+		openAIRequest.StreamOptions = &openaiClient.StreamOptions{IncludeUsage: true}
+	}
 	if s.config.SendUserID {
 		if request.Context.RequestingUser != nil {
 			openAIRequest.User = request.Context.RequestingUser.Id
 		}
 	}
-	return s.streamResult(openAIRequest, request.Context)
+	return s.streamResult(ctx, openAIRequest, cfg, request.Context)
 }
 
-func (s *OpenAI) ChatCompletionNoStream(request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+func (s *OpenAI) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
 	// This could perform better if we didn't use the streaming API here, but the complexity is not worth it.
-	result, err := s.ChatCompletion(request, opts...)
+	result, err := s.ChatCompletion(ctx, request, opts...)
 	if err != nil {
 		return "", err
 	}
-	return result.ReadAll(), nil
+	return result.ReadText()
 }
 
 func (s *OpenAI) Transcribe(file io.Reader) (*subtitles.Subtitles, error) {
@@ -512,13 +664,9 @@ func (s *OpenAI) GenerateImage(prompt string) (image.Image, error) {
 	return imgData, nil
 }
 
+// CountTokens uses the model's vocabulary, models served through compatible APIs use the learned ratio
 func (s *OpenAI) CountTokens(text string) int {
-	// Counting tokens is really annoying, so we approximate for now.
-	charCount := float64(len(text)) / 4.0
-	wordCount := float64(len(strings.Fields(text))) / 0.75
-
-	// Average the two
-	return int((charCount + wordCount) / 2.0)
+	return s.countTokens(text)
 }
 
 func (s *OpenAI) InputTokenLimit() int {
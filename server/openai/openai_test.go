@@ -0,0 +1,184 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	openaiClient "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncrementLLMRequests()                                   {}
+func (noopMetrics) IncrementLLMFailovers(_, _ string)                       {}
+func (noopMetrics) ObserveLLMTokenUsage(_, _ string, _, _ int64, _ float64) {}
+
+func TestChatCompletionReportsStreamUsage(t *testing.T) {
+	var received openaiClient.ChatCompletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+			`{"choices":[{"index":0,"delta":{"content":" world"}}]}`,
+			`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			`{"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":2,"total_tokens":14}}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	model := newOpenAI(Config{DefaultModel: "gpt-4o", StreamingTimeout: time.Second, StreamUsage: true}, server.Client(), noopMetrics{},
+		func(apiKey string) openaiClient.ClientConfig {
+			clientConfig := openaiClient.DefaultConfig(apiKey)
+			clientConfig.BaseURL = server.URL
+			return clientConfig
+		},
+	)
+
+	var usage []llm.TokenUsage
+	text, err := model.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+		Context: llm.NewContext(),
+	}, llm.WithUsageCallback(func(u llm.TokenUsage) {
+		usage = append(usage, u)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello world", text)
+
+	require.NotNil(t, received.StreamOptions)
+	assert.True(t, received.StreamOptions.IncludeUsage)
+	assert.Equal(t, []llm.TokenUsage{{Model: "gpt-4o", InputTokens: 12, OutputTokens: 2}}, usage)
+}
+
+func TestChatCompletionCancelAbortsRequest(t *testing.T) {
+	aborted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer server.Close()
+
+	model := newOpenAI(Config{DefaultModel: "gpt-4o", StreamingTimeout: time.Minute}, server.Client(), noopMetrics{},
+		func(apiKey string) openaiClient.ClientConfig {
+			clientConfig := openaiClient.DefaultConfig(apiKey)
+			clientConfig.BaseURL = server.URL
+			return clientConfig
+		},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result, err := model.ChatCompletion(ctx, llm.CompletionRequest{
+		Posts:   []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+		Context: llm.NewContext(),
+	})
+	require.NoError(t, err)
+
+	first := <-result.Events
+	assert.Equal(t, llm.StreamEvent{Type: llm.EventTypeText, Text: "Hello"}, first)
+
+	cancel()
+	text, err := result.ReadText()
+	assert.Empty(t, text)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not aborted")
+	}
+}
+
+func TestCompletionRequestJSONSchema(t *testing.T) {
+	model := New(llm.ServiceConfig{DefaultModel: "gpt-4o"}, http.DefaultClient, noopMetrics{})
+
+	type title struct {
+		Title string `json:"title"`
+	}
+	request := model.completionRequestFromConfig(model.createConfig([]llm.LanguageModelOption{llm.WithJSONSchema(title{})}))
+	require.NotNil(t, request.ResponseFormat)
+	assert.Equal(t, openaiClient.ChatCompletionResponseFormatTypeJSONSchema, request.ResponseFormat.Type)
+	assert.Equal(t, llm.StructuredResponseName, request.ResponseFormat.JSONSchema.Name)
+
+	schema, err := json.Marshal(request.ResponseFormat.JSONSchema.Schema)
+	require.NoError(t, err)
+	assert.Contains(t, string(schema), `"required":["title"]`)
+
+	// Plain text otherwise
+	assert.Nil(t, model.completionRequestFromConfig(model.createConfig(nil)).ResponseFormat)
+}
+
+func TestCompletionRequestModelParameters(t *testing.T) {
+	model := New(llm.ServiceConfig{DefaultModel: "gpt-4o", OutputTokenLimit: 100}, http.DefaultClient, noopMetrics{})
+	opts := []llm.LanguageModelOption{
+		llm.WithTemperature(0),
+		llm.WithTopP(0.9),
+		llm.WithStopSequences("END"),
+		llm.WithSeed(42),
+		llm.WithReasoningEffort(llm.ReasoningEffortHigh),
+	}
+
+	request := model.completionRequestFromConfig(model.createConfig(opts))
+	assert.Equal(t, float32(math.SmallestNonzeroFloat32), request.Temperature)
+	assert.Equal(t, float32(0.9), request.TopP)
+	assert.Equal(t, []string{"END"}, request.Stop)
+	require.NotNil(t, request.Seed)
+	assert.Equal(t, 42, *request.Seed)
+	assert.Equal(t, 100, request.MaxTokens)
+	// Only reasoning models take an effort
+	assert.Empty(t, request.ReasoningEffort)
+
+	// Reasoning models keep their sampling defaults
+	request = model.completionRequestFromConfig(model.createConfig(append(opts, llm.WithModel("o3-mini"))))
+	assert.Zero(t, request.Temperature)
+	assert.Zero(t, request.TopP)
+	assert.Equal(t, llm.ReasoningEffortHigh, request.ReasoningEffort)
+	assert.Zero(t, request.MaxTokens)
+	assert.Equal(t, 100, request.MaxCompletionTokens)
+	assert.NoError(t, openaiClient.NewReasoningValidator().Validate(request))
+}
+
+func TestPostsToChatCompletionMessagesToolCalls(t *testing.T) {
+	messages := postsToChatCompletionMessages([]llm.Post{
+		{Role: llm.PostRoleUser, Message: "Create an issue"},
+		{Role: llm.PostRoleBot, Message: "Creating it", ToolCalls: []llm.ToolCall{
+			{ID: "call1", Name: "CreateIssue", Arguments: `{"title":"Bug"}`, Result: "Created MM-1"},
+			{ID: "call2", Name: "Notify", Err: llm.ErrToolCallDenied},
+		}},
+	})
+
+	// The assistant message with the calls is followed by a message with the result of each
+	require.Len(t, messages, 4)
+	assert.Equal(t, openaiClient.ChatMessageRoleAssistant, messages[1].Role)
+	assert.Equal(t, "Creating it", messages[1].Content)
+	require.Len(t, messages[1].ToolCalls, 2)
+	assert.Equal(t, "call1", messages[1].ToolCalls[0].ID)
+	assert.Equal(t, openaiClient.FunctionCall{Name: "CreateIssue", Arguments: `{"title":"Bug"}`}, messages[1].ToolCalls[0].Function)
+	assert.Equal(t, openaiClient.ChatCompletionMessage{
+		Role:       openaiClient.ChatMessageRoleTool,
+		Name:       "CreateIssue",
+		Content:    "Created MM-1",
+		ToolCallID: "call1",
+	}, messages[2])
+	assert.Equal(t, "Error: the user denied this tool call", messages[3].Content)
+	assert.Equal(t, "call2", messages[3].ToolCallID)
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"net/http"
 	"os"
@@ -14,10 +15,14 @@ import (
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
 	"github.com/mattermost/mattermost-plugin-ai/server/anthropic"
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
 	"github.com/mattermost/mattermost-plugin-ai/server/enterprise"
+	"github.com/mattermost/mattermost-plugin-ai/server/gemini"
 	"github.com/mattermost/mattermost-plugin-ai/server/llm"
 	"github.com/mattermost/mattermost-plugin-ai/server/metrics"
+	"github.com/mattermost/mattermost-plugin-ai/server/ollama"
 	"github.com/mattermost/mattermost-plugin-ai/server/openai"
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
 	"github.com/mattermost/mattermost/server/public/shared/httpservice"
@@ -70,6 +75,21 @@ type Plugin struct {
 	i18n *i18n.Bundle
 
 	llmUpstreamHTTPClient *http.Client
+
+	searchLock sync.RWMutex
+	search     embeddings.EmbeddingSearch
+
+	llmCircuitBreakers circuitBreakers
+
+	mcpLock        sync.Mutex
+	mcpConnections map[string]*mcpConnection
+
+	ollamaPullsLock sync.Mutex
+	ollamaPulls     map[string]OllamaPullStatus
+
+	// activeCtx is cancelled by OnDeactivate to abort the requests still running
+	activeCtx  context.Context
+	deactivate context.CancelFunc
 }
 
 func resolveffmpegPath() string {
@@ -86,6 +106,7 @@ func resolveffmpegPath() string {
 }
 
 func (p *Plugin) OnActivate() error {
+	p.activeCtx, p.deactivate = context.WithCancel(context.Background())
 	p.pluginAPI = pluginapi.NewClient(p.API, p.Driver)
 
 	p.licenseChecker = enterprise.NewLicenseChecker(p.pluginAPI)
@@ -128,6 +149,11 @@ func (p *Plugin) OnActivate() error {
 		return err
 	}
 
+	if err := p.initSearch(); err != nil {
+		p.pluginAPI.Log.Error("Failed to initialize search, search functionality will be disabled", "error", err)
+		// Don't fail on search errors so the configuration can still be fixed from the system console
+	}
+
 	p.ffmpegPath = resolveffmpegPath()
 	if p.ffmpegPath == "" {
 		p.pluginAPI.Log.Error("ffmpeg not installed, transcriptions will be disabled.", "error", err)
@@ -140,22 +166,92 @@ func (p *Plugin) OnActivate() error {
 
 // OnDeactivate handles cleanup when the plugin is deactivated
 func (p *Plugin) OnDeactivate() error {
+	if p.deactivate != nil {
+		p.deactivate()
+	}
+	p.closeMCPServers()
 	return nil
 }
 
+// OnPluginClusterEvent handles the events published by the other nodes of the cluster
+func (p *Plugin) OnPluginClusterEvent(_ *plugin.Context, ev model.PluginClusterEvent) {
+	switch ev.Id {
+	case embeddingSpacesChangedEvent:
+		if err := p.initSearch(); err != nil {
+			p.pluginAPI.Log.Error("Failed to switch search to the new embedding space", "error", err)
+		}
+	case stopPostStreamingEvent:
+		p.stopPostStreaming(string(ev.Data))
+	}
+}
+
+// activeContext is the context for work that isn't tied to a user's HTTP request, it is cancelled when the
+// plugin is deactivated
+func (p *Plugin) activeContext() context.Context {
+	if p.activeCtx == nil {
+		return context.Background()
+	}
+	return p.activeCtx
+}
+
 func (p *Plugin) getLLM(llmBotConfig llm.BotConfig) llm.LanguageModel {
 	llmMetrics := p.metricsService.GetMetricsForAIService(llmBotConfig.Name)
 
+	result := p.newLanguageModel(llmBotConfig.Service, llmMetrics)
+	if len(llmBotConfig.FallbackServices) > 0 {
+		result = p.withFailover(llmBotConfig, result, llmMetrics)
+	}
+	if opts := llmBotConfig.ModelParameters.Options(); len(opts) > 0 {
+		result = NewModelParametersLanguageModel(result, opts)
+	}
+
+	result = NewUsageAccountingLanguageModel(result, llmBotConfig, p.getConfiguration().ModelPrices, llmMetrics, p, p.pluginAPI.Log.Error)
+
+	if quotas := p.getConfiguration().Quotas; quotas.Enabled {
+		result = NewQuotaLanguageModel(result, llmBotConfig.Name, quotas, p, p.i18n, p.pluginAPI.Log.Error)
+	}
+
+	return result
+}
+
+// withFailover moves requests to the bot's fallback services when the primary service is unavailable
+func (p *Plugin) withFailover(llmBotConfig llm.BotConfig, primary llm.LanguageModel, llmMetrics metrics.LLMetrics) llm.LanguageModel {
+	services := []FailoverService{{
+		Name:       serviceLabel(llmBotConfig.Service),
+		BreakerKey: llmBotConfig.Name + "/" + serviceLabel(llmBotConfig.Service),
+		Model:      primary,
+	}}
+	for _, fallback := range llmBotConfig.FallbackServices {
+		services = append(services, FailoverService{
+			Name:       serviceLabel(fallback),
+			BreakerKey: llmBotConfig.Name + "/" + serviceLabel(fallback),
+			Model:      p.newLanguageModel(fallback, llmMetrics),
+		})
+	}
+
+	return NewFailoverLanguageModel(services, &p.llmCircuitBreakers, func(from, to string, err error) {
+		llmMetrics.IncrementLLMFailovers(from, to)
+		if p.getConfiguration().EnableLLMTrace {
+			p.pluginAPI.Log.Info("LLM Failover", "bot", llmBotConfig.Name, "from", from, "to", to, "error", err.Error())
+		}
+	})
+}
+
+func (p *Plugin) newLanguageModel(serviceConfig llm.ServiceConfig, llmMetrics metrics.LLMetrics) llm.LanguageModel {
 	var result llm.LanguageModel
-	switch llmBotConfig.Service.Type {
+	switch serviceConfig.Type {
 	case llm.ServiceTypeOpenAI:
-		result = openai.New(llmBotConfig.Service, p.llmUpstreamHTTPClient, llmMetrics)
+		result = openai.New(serviceConfig, p.llmUpstreamHTTPClient, llmMetrics)
 	case llm.ServiceTypeOpenAICompatible:
-		result = openai.NewCompatible(llmBotConfig.Service, p.llmUpstreamHTTPClient, llmMetrics)
+		result = openai.NewCompatible(serviceConfig, p.llmUpstreamHTTPClient, llmMetrics)
 	case llm.ServiceTypeAzure:
-		result = openai.NewAzure(llmBotConfig.Service, p.llmUpstreamHTTPClient, llmMetrics)
+		result = openai.NewAzure(serviceConfig, p.llmUpstreamHTTPClient, llmMetrics)
 	case llm.ServiceTypeAnthropic:
-		result = anthropic.New(llmBotConfig.Service, p.llmUpstreamHTTPClient, llmMetrics)
+		result = anthropic.New(serviceConfig, p.llmUpstreamHTTPClient, llmMetrics)
+	case llm.ServiceTypeOllama:
+		result = ollama.New(p.activeContext(), serviceConfig, p.llmUpstreamHTTPClient, llmMetrics)
+	case llm.ServiceTypeGemini:
+		result = gemini.New(p.activeContext(), serviceConfig, p.llmUpstreamHTTPClient, llmMetrics)
 	}
 
 	cfg := p.getConfiguration()
@@ -163,11 +259,20 @@ func (p *Plugin) getLLM(llmBotConfig llm.BotConfig) llm.LanguageModel {
 		result = NewLanguageModelLogWrapper(p.pluginAPI.Log, result)
 	}
 
-	result = NewLLMTruncationWrapper(result)
+	// Each service is truncated to its own limit so fallbacks with a smaller context still fit
+	result = NewLLMTruncationWrapper(result, serviceConfig.DefaultModel, p.prompts, p, p.pluginAPI.Log.Error)
 
 	return result
 }
 
+// serviceLabel names a service in logs and metrics
+func serviceLabel(serviceConfig llm.ServiceConfig) string {
+	if serviceConfig.Name != "" {
+		return serviceConfig.Name
+	}
+	return serviceConfig.Type
+}
+
 func (p *Plugin) getTranscribe() Transcriber {
 	cfg := p.getConfiguration()
 	var botConfig llm.BotConfig
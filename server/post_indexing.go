@@ -3,13 +3,28 @@
 
 package main
 
-import "github.com/mattermost/mattermost/server/public/model"
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	// indexingTimeout bounds how long indexing a single post may take, embedding requests can be slow
+	indexingTimeout = time.Minute
+	// maxIndexedFileText bounds the text of a post's files that is indexed. Bots can read far larger files,
+	// but every indexed chunk is an embedding to create and store so only the start of long files is indexed.
+	maxIndexedFileText = 100 * 1024
+)
 
 // ShouldIndexPost returns whether a post should be indexed based on consistent criteria
-// This is kept for future compatibility but is not used in MySQL version
 func (p *Plugin) ShouldIndexPost(post *model.Post, channel *model.Channel) bool {
 	// Skip posts that don't have content
-	if post.Message == "" {
+	if post.Message == "" && len(post.FileIds) == 0 && len(post.Attachments()) == 0 {
 		return false
 	}
 
@@ -35,3 +50,132 @@ func (p *Plugin) ShouldIndexPost(post *model.Post, channel *model.Channel) bool
 
 	return true
 }
+
+// postToDocument converts a post to a document for the search index.
+// The content includes message attachments and the text of attached files, so long documents
+// are split into chunks that all link back to the post.
+func (p *Plugin) postToDocument(post *model.Post, channel *model.Channel) embeddings.PostDocument {
+	return embeddings.PostDocument{
+		PostID:    post.Id,
+		CreateAt:  post.CreateAt,
+		TeamID:    channel.TeamId,
+		ChannelID: post.ChannelId,
+		UserID:    post.UserId,
+		Content:   p.postContentForIndex(post),
+	}
+}
+
+// postContentForIndex returns the text of a post and its attachments and files
+func (p *Plugin) postContentForIndex(post *model.Post) string {
+	content := strings.TrimSpace(FormatPostBody(post))
+	if len(post.FileIds) == 0 {
+		return content
+	}
+
+	remaining := int64(maxIndexedFileText)
+	var fileContents []string
+	for _, fileID := range post.FileIds {
+		if remaining <= 0 {
+			break
+		}
+		maxFileSize := min(p.indexingMaxFileSize(), remaining)
+
+		fileInfo, err := p.pluginAPI.File.GetInfo(fileID)
+		if err != nil {
+			p.pluginAPI.Log.Warn("Failed to get file info for indexing", "file_id", fileID, "error", err)
+			continue
+		}
+
+		fileContent, err := p.readFileContent(fileInfo, maxFileSize)
+		if err != nil {
+			p.pluginAPI.Log.Warn("Failed to read file for indexing", "file_id", fileID, "error", err)
+			continue
+		}
+		if fileContent == "" {
+			continue
+		}
+		// Text files are already read up to the limit but content extracted by the server can be longer
+		if int64(len(fileContent)) > maxFileSize {
+			fileContent = strings.ToValidUTF8(fileContent[:maxFileSize], "")
+		}
+
+		fileContents = append(fileContents, formatFileContent(fileInfo.Name, fileContent))
+		remaining -= int64(len(fileContent))
+	}
+
+	if len(fileContents) == 0 {
+		return content
+	}
+
+	return strings.TrimSpace(content + "\n\nAttached File Contents:\n" + strings.Join(fileContents, "\n\n"))
+}
+
+// indexingMaxFileSize is the limit on how much of each file is indexed. Indexing isn't tied to a bot
+// so the default bot's limit is used, since that is the bot search answers come from by default.
+func (p *Plugin) indexingMaxFileSize() int64 {
+	cfg := p.getConfiguration()
+	for _, bot := range cfg.Bots {
+		if bot.Name == cfg.DefaultBotName {
+			return maxFileSizeForBot(bot)
+		}
+	}
+
+	return defaultMaxFileSize
+}
+
+// indexPost adds or replaces a post in the search index. Posts that shouldn't be indexed are removed.
+func (p *Plugin) indexPost(post *model.Post) error {
+	search := p.getSearch()
+	if search == nil {
+		return nil
+	}
+
+	channel, err := p.pluginAPI.Channel.Get(post.ChannelId)
+	if err != nil {
+		return fmt.Errorf("failed to get channel: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), indexingTimeout)
+	defer cancel()
+
+	if !p.ShouldIndexPost(post, channel) {
+		// The post may have been indexed before it was edited to no longer qualify
+		return search.Delete(ctx, []string{post.Id})
+	}
+
+	if err := search.Store(ctx, []embeddings.PostDocument{p.postToDocument(post, channel)}); err != nil {
+		return fmt.Errorf("failed to index post: %w", err)
+	}
+
+	return nil
+}
+
+// deletePostFromIndex removes a post from the search index
+func (p *Plugin) deletePostFromIndex(postID string) error {
+	search := p.getSearch()
+	if search == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), indexingTimeout)
+	defer cancel()
+
+	if err := search.Delete(ctx, []string{postID}); err != nil {
+		return fmt.Errorf("failed to delete post from index: %w", err)
+	}
+
+	return nil
+}
+
+// indexPostAsync indexes a post without blocking the calling hook
+func (p *Plugin) indexPostAsync(post *model.Post) {
+	if p.getSearch() == nil {
+		return
+	}
+
+	go func() {
+		if err := p.indexPost(post); err != nil {
+			p.pluginAPI.Log.Error("Failed to index post", "post_id", post.Id, "error", err)
+		}
+	}()
+}
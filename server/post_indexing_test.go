@@ -0,0 +1,135 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostContentForIndex(t *testing.T) {
+	t.Run("message and attachments", func(t *testing.T) {
+		e := SetupTestEnvironment(t)
+		defer e.Cleanup(t)
+		e.plugin.setConfiguration(makeConfig(Config{}))
+
+		post := &model.Post{Message: "Weekly report"}
+		post.AddProp("attachments", []*model.SlackAttachment{{
+			Title:  "Pricing",
+			Fields: []*model.SlackAttachmentField{{Title: "Seats", Value: "50"}},
+		}})
+
+		content := e.plugin.postContentForIndex(post)
+		assert.Contains(t, content, "Weekly report")
+		assert.Contains(t, content, "Pricing")
+		assert.Contains(t, content, `Seats: "50"`)
+	})
+
+	t.Run("extracted and text file contents", func(t *testing.T) {
+		e := SetupTestEnvironment(t)
+		defer e.Cleanup(t)
+		e.plugin.setConfiguration(makeConfig(Config{}))
+
+		e.mockAPI.On("GetFileInfo", "pdffile").Return(&model.FileInfo{
+			Id:       "pdffile",
+			Name:     "contract.pdf",
+			MimeType: "application/pdf",
+			Content:  "We agreed on the pricing of 10 dollars per seat.",
+		}, nil)
+		e.mockAPI.On("GetFileInfo", "textfile").Return(&model.FileInfo{
+			Id:       "textfile",
+			Name:     "notes.txt",
+			MimeType: "text/plain",
+		}, nil)
+		e.mockAPI.On("GetFile", "textfile").Return([]byte("Meeting notes"), nil)
+		e.mockAPI.On("GetFileInfo", "imagefile").Return(&model.FileInfo{
+			Id:       "imagefile",
+			Name:     "diagram.png",
+			MimeType: "image/png",
+		}, nil)
+
+		post := &model.Post{
+			Message: "See attached",
+			FileIds: []string{"pdffile", "textfile", "imagefile"},
+		}
+
+		content := e.plugin.postContentForIndex(post)
+		assert.Contains(t, content, "See attached")
+		assert.Contains(t, content, "File Name: contract.pdf\nContent: We agreed on the pricing of 10 dollars per seat.")
+		assert.Contains(t, content, "File Name: notes.txt\nContent: Meeting notes")
+		assert.NotContains(t, content, "diagram.png")
+	})
+
+	t.Run("respects the default bot max file size", func(t *testing.T) {
+		e := SetupTestEnvironment(t)
+		defer e.Cleanup(t)
+		e.plugin.setConfiguration(makeConfig(Config{
+			DefaultBotName: "ai",
+			Bots:           []llm.BotConfig{{Name: "ai", MaxFileSize: 10}},
+		}))
+
+		e.mockAPI.On("GetFileInfo", "pdffile").Return(&model.FileInfo{
+			Id:       "pdffile",
+			Name:     "contract.pdf",
+			MimeType: "application/pdf",
+			Content:  strings.Repeat("a", 100),
+		}, nil)
+
+		content := e.plugin.postContentForIndex(&model.Post{FileIds: []string{"pdffile"}})
+		assert.Contains(t, content, "Content: "+strings.Repeat("a", 10))
+		assert.NotContains(t, content, strings.Repeat("a", 11))
+	})
+
+	t.Run("bounds the indexed text of all files", func(t *testing.T) {
+		e := SetupTestEnvironment(t)
+		defer e.Cleanup(t)
+		e.plugin.setConfiguration(makeConfig(Config{}))
+
+		// The third file isn't read at all
+		for _, fileID := range []string{"first", "second"} {
+			e.mockAPI.On("GetFileInfo", fileID).Return(&model.FileInfo{
+				Id:       fileID,
+				Name:     fileID + ".pdf",
+				MimeType: "application/pdf",
+				Content:  strings.Repeat("x", maxIndexedFileText*2/3),
+			}, nil)
+		}
+
+		content := e.plugin.postContentForIndex(&model.Post{FileIds: []string{"first", "second", "third"}})
+		assert.Contains(t, content, "first.pdf")
+		assert.Contains(t, content, "second.pdf")
+		assert.NotContains(t, content, "third.pdf")
+		assert.Equal(t, maxIndexedFileText, strings.Count(content, "x"))
+	})
+}
+
+func TestReindexRowToPost(t *testing.T) {
+	row := reindexPostRow{
+		ID:          "postid",
+		Message:     "hello",
+		ChannelID:   "channelid",
+		TeamID:      "teamid",
+		ChannelType: string(model.ChannelTypeOpen),
+		Props:       `{"attachments":[{"title":"Pricing"}]}`,
+		FileIds:     `["fileid"]`,
+	}
+
+	post, channel := row.toPostAndChannel()
+	assert.Equal(t, []string{"fileid"}, []string(post.FileIds))
+	require.Len(t, post.Attachments(), 1)
+	assert.Equal(t, "Pricing", post.Attachments()[0].Title)
+	assert.Equal(t, "teamid", channel.TeamId)
+
+	// Invalid JSON doesn't prevent indexing the message
+	row.Props = "not json"
+	row.FileIds = ""
+	post, _ = row.toPostAndChannel()
+	assert.Equal(t, "hello", post.Message)
+	assert.Empty(t, post.FileIds)
+}
@@ -33,7 +33,9 @@ func (t *ThreadData) cutoffBeforePostID(postID string) {
 	}
 }
 
+// PostStreamContext is the context of the LLM request streaming to a post, stopping the post cancels it
 type PostStreamContext struct {
+	ctx    context.Context
 	cancel context.CancelFunc
 }
 
@@ -88,6 +90,9 @@ func formatThread(data *ThreadData) string {
 const LLMRequesterUserID = "llm_requester_user_id"
 const UnsafeLinksPostProp = "unsafe_links"
 
+// ReasoningPostProp keeps the reasoning of the response when the bot shares it
+const ReasoningPostProp = "reasoning"
+
 func (p *Plugin) modifyPostForBot(botid string, requesterUserID string, post *model.Post, respondingToPostID string) {
 	post.UserId = botid
 	post.Type = "custom_llmbot" // This must be the only place we add this type for security.
@@ -122,21 +127,23 @@ func (p *Plugin) botDMNonResponse(botid string, userID string, post *model.Post)
 	return nil
 }
 
-func (p *Plugin) streamResultToNewPost(botid string, requesterUserID string, stream *llm.TextStreamResult, post *model.Post, respondingToPostID string) error {
+func (p *Plugin) streamResultToNewPost(streamContext PostStreamContext, botid string, requesterUserID string, stream *llm.TextStreamResult, post *model.Post, respondingToPostID string) error {
 	// We use modifyPostForBot directly here to add the responding to post ID
 	p.modifyPostForBot(botid, requesterUserID, post, respondingToPostID)
 
 	if err := p.pluginAPI.Post.CreatePost(post); err != nil {
+		streamContext.cancel()
 		return fmt.Errorf("unable to create post: %w", err)
 	}
 
-	ctx, err := p.getPostStreamingContext(context.Background(), post.Id)
-	if err != nil {
+	if err := p.registerPostStreaming(post.Id, streamContext); err != nil {
+		streamContext.cancel()
 		return err
 	}
+	ctx := streamContext.ctx
 
 	go func() {
-		defer p.finishPostStreaming(post.Id)
+		defer p.finishPostStreaming(ctx, post.Id)
 		user, err := p.pluginAPI.User.Get(requesterUserID)
 		locale := *p.API.GetConfig().LocalizationSettings.DefaultServerLocale
 		if err != nil {
@@ -162,21 +169,23 @@ func (p *Plugin) streamResultToNewPost(botid string, requesterUserID string, str
 	return nil
 }
 
-func (p *Plugin) streamResultToNewDM(botid string, stream *llm.TextStreamResult, userID string, post *model.Post, respondingToPostID string) error {
+func (p *Plugin) streamResultToNewDM(streamContext PostStreamContext, botid string, stream *llm.TextStreamResult, userID string, post *model.Post, respondingToPostID string) error {
 	// We use modifyPostForBot directly here to add the responding to post ID
 	p.modifyPostForBot(botid, userID, post, respondingToPostID)
 
 	if err := p.pluginAPI.Post.DM(botid, userID, post); err != nil {
+		streamContext.cancel()
 		return fmt.Errorf("failed to post DM: %w", err)
 	}
 
-	ctx, err := p.getPostStreamingContext(context.Background(), post.Id)
-	if err != nil {
+	if err := p.registerPostStreaming(post.Id, streamContext); err != nil {
+		streamContext.cancel()
 		return err
 	}
+	ctx := streamContext.ctx
 
 	go func() {
-		defer p.finishPostStreaming(post.Id)
+		defer p.finishPostStreaming(ctx, post.Id)
 		user, err := p.pluginAPI.User.Get(userID)
 		locale := *p.API.GetConfig().LocalizationSettings.DefaultServerLocale
 		if err != nil {
@@ -214,6 +223,19 @@ func (p *Plugin) sendPostStreamingUpdateEvent(post *model.Post, message string)
 const PostStreamingControlCancel = "cancel"
 const PostStreamingControlEnd = "end"
 const PostStreamingControlStart = "start"
+const PostStreamingControlTool = "tool"
+const PostStreamingControlReasoning = "reasoning"
+
+// sendPostStreamingReasoningEvent sends the reasoning so far, shown above the response while it streams
+func (p *Plugin) sendPostStreamingReasoningEvent(post *model.Post, reasoning string) {
+	p.API.PublishWebSocketEvent("postupdate", map[string]interface{}{
+		"post_id":   post.Id,
+		"control":   PostStreamingControlReasoning,
+		"reasoning": reasoning,
+	}, &model.WebsocketBroadcast{
+		ChannelId: post.ChannelId,
+	})
+}
 
 func (p *Plugin) sendPostStreamingControlEvent(post *model.Post, control string) {
 	p.API.PublishWebSocketEvent("postupdate", map[string]interface{}{
@@ -224,6 +246,32 @@ func (p *Plugin) sendPostStreamingControlEvent(post *model.Post, control string)
 	})
 }
 
+// sendPostStreamingToolEvent shows what the bot is doing while it waits for a tool, an empty activity clears it
+func (p *Plugin) sendPostStreamingToolEvent(post *model.Post, activity string) {
+	p.API.PublishWebSocketEvent("postupdate", map[string]interface{}{
+		"post_id":       post.Id,
+		"control":       PostStreamingControlTool,
+		"tool_activity": activity,
+	}, &model.WebsocketBroadcast{
+		ChannelId: post.ChannelId,
+	})
+}
+
+// stopPostStreamingEvent asks every node of the cluster to stop streaming to the post in the event's data, the
+// stream runs on the node that started it
+const stopPostStreamingEvent = "stop_post_streaming"
+
+// stopPostStreamingInCluster stops streaming to the post on whichever node is streaming to it
+func (p *Plugin) stopPostStreamingInCluster(postID string) {
+	p.stopPostStreaming(postID)
+	if err := p.API.PublishPluginClusterEvent(
+		model.PluginClusterEvent{Id: stopPostStreamingEvent, Data: []byte(postID)},
+		model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable},
+	); err != nil {
+		p.pluginAPI.Log.Warn("Failed to ask the cluster to stop streaming to the post", "post_id", postID, "error", err)
+	}
+}
+
 func (p *Plugin) stopPostStreaming(postID string) {
 	p.streamingContextsMutex.Lock()
 	defer p.streamingContextsMutex.Unlock()
@@ -235,37 +283,68 @@ func (p *Plugin) stopPostStreaming(postID string) {
 
 var ErrAlreadyStreamingToPost = fmt.Errorf("already streaming to post")
 
-func (p *Plugin) getPostStreamingContext(inCtx context.Context, postID string) (context.Context, error) {
+// newStreamingContext returns the context for an LLM request whose response will be streamed to a post that
+// doesn't exist yet. streamResultToNewPost and streamResultToNewDM register it for the post once it is created,
+// until then only deactivating the plugin cancels it. The caller cancels it if the post is never created.
+func (p *Plugin) newStreamingContext() PostStreamContext {
+	ctx, cancel := context.WithCancel(p.activeContext())
+	return PostStreamContext{ctx: ctx, cancel: cancel}
+}
+
+func (p *Plugin) registerPostStreaming(postID string, streamContext PostStreamContext) error {
 	p.streamingContextsMutex.Lock()
 	defer p.streamingContextsMutex.Unlock()
 
 	if _, ok := p.streamingContexts[postID]; ok {
-		return nil, ErrAlreadyStreamingToPost
+		return ErrAlreadyStreamingToPost
 	}
+	p.streamingContexts[postID] = streamContext
 
-	ctx, cancel := context.WithCancel(inCtx)
+	return nil
+}
 
-	streamingContext := PostStreamContext{
-		cancel: cancel,
+// getPostStreamingContext returns the context for an LLM request streaming to an existing post
+func (p *Plugin) getPostStreamingContext(inCtx context.Context, postID string) (context.Context, error) {
+	ctx, cancel := context.WithCancel(inCtx)
+	if err := p.registerPostStreaming(postID, PostStreamContext{ctx: ctx, cancel: cancel}); err != nil {
+		cancel()
+		return nil, err
 	}
 
-	p.streamingContexts[postID] = streamingContext
-
 	return ctx, nil
 }
 
-// finishPostStreaming should be called when a post streaming operation is finished on success or failure.
-// It is safe to call multiple times, must be called at least once.
-func (p *Plugin) finishPostStreaming(postID string) {
+// finishPostStreaming should be called with the streaming context when a post streaming operation is finished
+// on success or failure. It is safe to call multiple times, must be called at least once.
+func (p *Plugin) finishPostStreaming(ctx context.Context, postID string) {
 	p.streamingContextsMutex.Lock()
 	defer p.streamingContextsMutex.Unlock()
-	delete(p.streamingContexts, postID)
+
+	// A stopped post may already be streaming again with a new context
+	if streamContext, ok := p.streamingContexts[postID]; ok && streamContext.ctx == ctx {
+		streamContext.cancel()
+		delete(p.streamingContexts, postID)
+	}
 }
 
 // streamResultToPost streams the result of a TextStreamResult to a post.
 // it will internally handle logging needs and updating the post.
 func (p *Plugin) streamResultToPost(ctx context.Context, stream *llm.TextStreamResult, post *model.Post, userLocale string) {
 	T := i18nLocalizerFunc(p.i18n, userLocale)
+
+	// Reasoning is only kept when the bot shares it, a regenerated post starts without the previous one
+	var reasoning strings.Builder
+	bot := p.GetBotByID(post.UserId)
+	showReasoning := bot != nil && bot.cfg.ShowReasoning
+	post.DelProp(ReasoningPostProp)
+	// A regenerated post no longer waits for the tool calls of its previous response
+	if post.GetProp(ToolApprovalPostProp) != nil {
+		post.DelProp(ToolApprovalPostProp)
+		if err := p.pluginAPI.KV.Delete(toolApprovalKey(post.Id)); err != nil {
+			p.API.LogError("Failed to delete pending tool approval", "error", err.Error())
+		}
+	}
+
 	p.sendPostStreamingControlEvent(post, PostStreamingControlStart)
 	defer func() {
 		p.sendPostStreamingControlEvent(post, PostStreamingControlEnd)
@@ -273,39 +352,79 @@ func (p *Plugin) streamResultToPost(ctx context.Context, stream *llm.TextStreamR
 
 	for {
 		select {
-		case next := <-stream.Stream:
-			post.Message += next
-			p.sendPostStreamingUpdateEvent(post, post.Message)
-		case err, ok := <-stream.Err:
-			// Stream has closed cleanly
-			if !ok {
-				if strings.TrimSpace(post.Message) == "" {
+		case event, ok := <-stream.Events:
+			if !ok || event.Type == llm.EventTypeEnd {
+				// The partial response is kept when tool calls used up the budget, with why it stopped
+				if event.FinishReason == llm.FinishReasonToolBudget {
+					if strings.TrimSpace(post.Message) != "" {
+						post.Message += "\n\n"
+					}
+					post.Message += T("copilot.stream_to_post_tool_budget", "I stopped before finishing because I reached my limit of tool calls for a single response. Ask me to continue if you need more.")
+					p.sendPostStreamingUpdateEvent(post, post.Message)
+				}
+				// Stream has finished cleanly, a response waiting for approval may have nothing to say yet
+				if strings.TrimSpace(post.Message) == "" && event.FinishReason != llm.FinishReasonToolApproval {
 					p.API.LogError("LLM closed stream with no result")
 					post.Message = T("copilot.stream_to_post_llm_not_return", "Sorry! The LLM did not return a result.")
 					p.sendPostStreamingUpdateEvent(post, post.Message)
 				}
-				if err = p.pluginAPI.Post.UpdatePost(post); err != nil {
+				p.attachCitations(post)
+				if err := p.pluginAPI.Post.UpdatePost(post); err != nil {
 					p.API.LogError("Streaming failed to update post", "error", err)
 					return
 				}
 				return
 			}
-			// Handle partial results
-			if strings.TrimSpace(post.Message) == "" {
-				post.Message = ""
-			} else {
-				post.Message += "\n\n"
-			}
-			p.API.LogError("Streaming result to post failed partway", "error", err)
-			post.Message = T("copilot.stream_to_post_access_llm_error", "Sorry! An error occurred while accessing the LLM. See server logs for details.")
 
-			if err := p.pluginAPI.Post.UpdatePost(post); err != nil {
-				p.API.LogError("Error recovering from streaming error", "error", err)
+			switch event.Type {
+			case llm.EventTypeText:
+				post.Message += event.Text
+				p.sendPostStreamingUpdateEvent(post, post.Message)
+			case llm.EventTypeReasoning:
+				if showReasoning {
+					reasoning.WriteString(event.Text)
+					post.AddProp(ReasoningPostProp, reasoning.String())
+					p.sendPostStreamingReasoningEvent(post, reasoning.String())
+				}
+			case llm.EventTypeToolCallStarted:
+				p.sendPostStreamingToolEvent(post, toolActivityMessage(T, event.ToolCall))
+			case llm.EventTypeToolCallFinished:
+				p.sendPostStreamingToolEvent(post, "")
+			case llm.EventTypeToolApproval:
+				if err := p.requestToolApproval(post, event.ToolCalls); err != nil {
+					p.API.LogError("Failed to request tool approval", "error", err.Error())
+					if strings.TrimSpace(post.Message) != "" {
+						post.Message += "\n\n"
+					}
+					post.Message += T("copilot.tool_approval_error", "Sorry! I couldn't ask for your approval to use a tool. See server logs for details.")
+					p.sendPostStreamingUpdateEvent(post, post.Message)
+				}
+			case llm.EventTypeError:
+				// Handle partial results
+				if strings.TrimSpace(post.Message) == "" {
+					post.Message = ""
+				} else {
+					post.Message += "\n\n"
+				}
+				p.API.LogError("Streaming result to post failed partway", "error", event.Err)
+				post.Message = T("copilot.stream_to_post_access_llm_error", "Sorry! An error occurred while accessing the LLM. See server logs for details.")
+				if message, ok := modelNotFoundMessage(T, event.Err); ok {
+					post.Message = message
+				}
+
+				if err := p.pluginAPI.Post.UpdatePost(post); err != nil {
+					p.API.LogError("Error recovering from streaming error", "error", err)
+					return
+				}
+				p.sendPostStreamingUpdateEvent(post, post.Message)
 				return
 			}
-			p.sendPostStreamingUpdateEvent(post, post.Message)
-			return
 		case <-ctx.Done():
+			// The request is aborted, what is left of the stream is read so the wrappers can finish
+			go func() {
+				for range stream.Events {
+				}
+			}()
 			if err := p.pluginAPI.Post.UpdatePost(post); err != nil {
 				p.API.LogError("Error updating post on stop signaled", "error", err)
 				return
@@ -385,15 +504,50 @@ func isImageMimeType(mimeType string) bool {
 	return strings.HasPrefix(mimeType, "image/")
 }
 
+func maxFileSizeForBot(cfg llm.BotConfig) int64 {
+	if cfg.MaxFileSize > 0 {
+		return cfg.MaxFileSize
+	}
+	return defaultMaxFileSize
+}
+
+func formatFileContent(name string, content string) string {
+	return fmt.Sprintf("File Name: %s\nContent: %s", name, content)
+}
+
+// readFileContent returns the text of a file that has been interpreted already by the server or is a text file.
+// Other files have no content. Text files are read up to maxFileSize bytes.
+func (p *Plugin) readFileContent(fileInfo *model.FileInfo, maxFileSize int64) (string, error) {
+	if trimmedContent := strings.TrimSpace(fileInfo.Content); trimmedContent != "" {
+		return trimmedContent, nil
+	}
+
+	if !strings.HasPrefix(fileInfo.MimeType, "text/") {
+		return "", nil
+	}
+
+	file, err := p.pluginAPI.File.Get(fileInfo.Id)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file: %w", err)
+	}
+	contentBytes, err := io.ReadAll(io.LimitReader(file, maxFileSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	content := string(contentBytes)
+	if int64(len(contentBytes)) == maxFileSize {
+		content += "\n... (content truncated due to size limit)"
+	}
+
+	return content, nil
+}
+
 func (p *Plugin) PostToAIPost(bot *Bot, post *model.Post) llm.Post {
 	var filesForUpstream []llm.File
 	message := FormatPostBody(post)
 	var extractedFileContents []string
 
-	maxFileSize := defaultMaxFileSize
-	if bot.cfg.MaxFileSize > 0 {
-		maxFileSize = bot.cfg.MaxFileSize
-	}
+	maxFileSize := maxFileSizeForBot(bot.cfg)
 
 	for _, fileID := range post.FileIds {
 		fileInfo, err := p.pluginAPI.File.GetInfo(fileID)
@@ -402,30 +556,14 @@ func (p *Plugin) PostToAIPost(bot *Bot, post *model.Post) llm.Post {
 			continue
 		}
 
-		// Check for files that have been interpreted already by the server or are text files.
-		content := ""
-		if trimmedContent := strings.TrimSpace(fileInfo.Content); trimmedContent != "" {
-			content = trimmedContent
-		} else if strings.HasPrefix(fileInfo.MimeType, "text/") {
-			file, err := p.pluginAPI.File.Get(fileID)
-			if err != nil {
-				p.API.LogError("Error getting file", "error", err)
-				continue
-			}
-			contentBytes, err := io.ReadAll(io.LimitReader(file, maxFileSize))
-			if err != nil {
-				p.API.LogError("Error reading file content", "error", err)
-				continue
-			}
-			content = string(contentBytes)
-			if int64(len(contentBytes)) == maxFileSize {
-				content += "\n... (content truncated due to size limit)"
-			}
+		content, err := p.readFileContent(fileInfo, maxFileSize)
+		if err != nil {
+			p.API.LogError("Error reading file content", "error", err)
+			continue
 		}
 
 		if content != "" {
-			fileContent := fmt.Sprintf("File Name: %s\nContent: %s", fileInfo.Name, content)
-			extractedFileContents = append(extractedFileContents, fileContent)
+			extractedFileContents = append(extractedFileContents, formatFileContent(fileInfo.Name, content))
 		}
 
 		if bot.cfg.EnableVision && isImageMimeType(fileInfo.MimeType) {
@@ -0,0 +1,96 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func reasoningStream() *llm.TextStreamResult {
+	events := make(chan llm.StreamEvent, 4)
+	events <- llm.StreamEvent{Type: llm.EventTypeReasoning, Text: "Let me "}
+	events <- llm.StreamEvent{Type: llm.EventTypeReasoning, Text: "think"}
+	events <- llm.StreamEvent{Type: llm.EventTypeText, Text: "Hello"}
+	events <- llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: llm.FinishReasonStop}
+	close(events)
+	return &llm.TextStreamResult{Events: events}
+}
+
+func TestStreamResultToPostReasoning(t *testing.T) {
+	for _, showReasoning := range []bool{true, false} {
+		e := SetupTestEnvironment(t)
+		e.plugin.bots[0].cfg.ShowReasoning = showReasoning
+
+		var published []map[string]any
+		e.mockAPI.On("PublishWebSocketEvent", "postupdate", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			published = append(published, args.Get(1).(map[string]any))
+		})
+		e.mockAPI.On("UpdatePost", mock.Anything).Return(func(post *model.Post) *model.Post { return post.Clone() }, nil)
+
+		post := &model.Post{Id: "postid", UserId: "botid", ChannelId: "channelid"}
+		// A regenerated post starts without the previous reasoning
+		post.AddProp(ReasoningPostProp, "old")
+		e.plugin.streamResultToPost(context.Background(), reasoningStream(), post, "en")
+
+		assert.Equal(t, "Hello", post.Message)
+		var reasoningEvents []any
+		for _, event := range published {
+			if event["control"] == PostStreamingControlReasoning {
+				reasoningEvents = append(reasoningEvents, event["reasoning"])
+			}
+		}
+		if showReasoning {
+			assert.Equal(t, "Let me think", post.GetProp(ReasoningPostProp))
+			assert.Equal(t, []any{"Let me ", "Let me think"}, reasoningEvents)
+		} else {
+			assert.Nil(t, post.GetProp(ReasoningPostProp))
+			assert.Empty(t, reasoningEvents)
+		}
+		e.Cleanup(t)
+	}
+}
+
+func TestStreamResultToPostToolBudget(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+	e.plugin.i18n = i18nInit()
+
+	e.mockAPI.On("PublishWebSocketEvent", "postupdate", mock.Anything, mock.Anything)
+	e.mockAPI.On("UpdatePost", mock.Anything).Return(func(post *model.Post) *model.Post { return post.Clone() }, nil)
+
+	events := make(chan llm.StreamEvent, 2)
+	events <- llm.StreamEvent{Type: llm.EventTypeText, Text: "So far I found"}
+	events <- llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: llm.FinishReasonToolBudget}
+	close(events)
+
+	post := &model.Post{Id: "postid", UserId: "botid", ChannelId: "channelid"}
+	e.plugin.streamResultToPost(context.Background(), &llm.TextStreamResult{Events: events}, post, "en")
+
+	// The partial response is kept and followed by why it stopped
+	assert.True(t, strings.HasPrefix(post.Message, "So far I found\n\n"))
+	assert.Contains(t, post.Message, "limit of tool calls")
+}
+
+func TestStopPostStreamingInCluster(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	// The node handling the stop request asks the others to stop the stream too
+	e.mockAPI.On("PublishPluginClusterEvent", model.PluginClusterEvent{Id: stopPostStreamingEvent, Data: []byte("postid")}, mock.Anything).Return(nil).Once()
+	e.plugin.stopPostStreamingInCluster("postid")
+
+	// The node streaming to the post cancels it when the event arrives
+	e.plugin.streamingContexts = map[string]PostStreamContext{}
+	ctx, err := e.plugin.getPostStreamingContext(context.Background(), "postid")
+	assert.NoError(t, err)
+	e.plugin.OnPluginClusterEvent(nil, model.PluginClusterEvent{Id: stopPostStreamingEvent, Data: []byte("postid")})
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+const (
+	QuotaPeriodDay   = "day"
+	QuotaPeriodMonth = "month"
+)
+
+const (
+	UsageScopeUser = "user"
+	UsageScopeTeam = "team"
+	UsageScopeBot  = "bot"
+)
+
+const (
+	QuotaLimitRequests     = "requests"
+	QuotaLimitInputTokens  = "input_tokens"
+	QuotaLimitOutputTokens = "output_tokens"
+)
+
+// QuotaLimits are the limits applied to each user, team or bot. Zero means unlimited.
+type QuotaLimits struct {
+	RequestsPerMinute int   `json:"requestsPerMinute"`
+	InputTokens       int64 `json:"inputTokens"`
+	OutputTokens      int64 `json:"outputTokens"`
+	// TokenPeriod is the period token limits apply to, day or month. Periods follow UTC.
+	TokenPeriod string `json:"tokenPeriod"`
+}
+
+type QuotaConfig struct {
+	Enabled bool        `json:"enabled"`
+	User    QuotaLimits `json:"user"`
+	Team    QuotaLimits `json:"team"`
+	Bot     QuotaLimits `json:"bot"`
+}
+
+// UsageScope is who usage is counted against, ID is a user ID, team ID or bot username
+type UsageScope struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type Usage struct {
+	Requests     int64 `json:"requests" db:"Requests"`
+	InputTokens  int64 `json:"inputTokens" db:"InputTokens"`
+	OutputTokens int64 `json:"outputTokens" db:"OutputTokens"`
+}
+
+// Usage is stored in rows per minute, for request rates, and per day. Monthly usage is the sum of the days.
+func minuteUsagePeriod(t time.Time) string {
+	return "minute:" + t.UTC().Format("2006-01-02T15:04")
+}
+
+func dayUsagePeriod(t time.Time) string {
+	return "day:" + t.UTC().Format("2006-01-02")
+}
+
+func monthUsagePeriodPrefix(t time.Time) string {
+	return "day:" + t.UTC().Format("2006-01-")
+}
+
+func tokenUsagePeriodPrefix(period string, t time.Time) string {
+	if period == QuotaPeriodMonth {
+		return monthUsagePeriodPrefix(t)
+	}
+	return dayUsagePeriod(t)
+}
+
+type usageStore interface {
+	// getUsage sums the usage of the periods starting with the prefix
+	getUsage(scope UsageScope, periodPrefix string) (Usage, error)
+	addUsage(scope UsageScope, period string, usage Usage) error
+	// reserveRequest counts a request in the period unless it already has limit requests, atomically
+	reserveRequest(scope UsageScope, period string, limit int64) (bool, error)
+}
+
+// QuotaExceededError is returned when a request is refused because a quota has been used up
+type QuotaExceededError struct {
+	Scope  string
+	Limit  string
+	Period string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %s per %s", e.Scope, e.Limit, e.Period)
+}
+
+// Message explains the refusal to the user
+func (e *QuotaExceededError) Message(T TranslationFunc) string {
+	if e.Limit == QuotaLimitRequests {
+		if e.Scope == UsageScopeUser {
+			return T("copilot.quota_user_requests", "You're sending requests too quickly. Please wait a minute and try again.")
+		}
+		return T("copilot.quota_shared_requests", "Too many requests are being sent to this bot right now. Please wait a minute and try again.")
+	}
+
+	switch {
+	case e.Scope == UsageScopeUser && e.Period == QuotaPeriodMonth:
+		return T("copilot.quota_user_tokens_month", "You've reached your monthly AI usage limit. It resets at the start of next month.")
+	case e.Scope == UsageScopeUser:
+		return T("copilot.quota_user_tokens_day", "You've reached your daily AI usage limit. It resets tomorrow.")
+	case e.Scope == UsageScopeTeam && e.Period == QuotaPeriodMonth:
+		return T("copilot.quota_team_tokens_month", "Your team has reached its monthly AI usage limit. It resets at the start of next month.")
+	case e.Scope == UsageScopeTeam:
+		return T("copilot.quota_team_tokens_day", "Your team has reached its daily AI usage limit. It resets tomorrow.")
+	case e.Period == QuotaPeriodMonth:
+		return T("copilot.quota_bot_tokens_month", "This bot has reached its monthly usage limit. It resets at the start of next month.")
+	default:
+		return T("copilot.quota_bot_tokens_day", "This bot has reached its daily usage limit. It resets tomorrow.")
+	}
+}
+
+type scopedLimits struct {
+	scope  UsageScope
+	limits QuotaLimits
+}
+
+// QuotaLanguageModel refuses requests once the bot, the requesting user or their team has used up a quota,
+// and records the usage of the requests it lets through.
+type QuotaLanguageModel struct {
+	wrapped  llm.LanguageModel
+	botName  string
+	config   QuotaConfig
+	store    usageStore
+	i18n     *i18n.Bundle
+	logError func(msg string, keyValuePairs ...any)
+	now      func() time.Time
+}
+
+func NewQuotaLanguageModel(wrapped llm.LanguageModel, botName string, config QuotaConfig, store usageStore, bundle *i18n.Bundle, logError func(msg string, keyValuePairs ...any)) *QuotaLanguageModel {
+	return &QuotaLanguageModel{
+		wrapped:  wrapped,
+		botName:  botName,
+		config:   config,
+		store:    store,
+		i18n:     bundle,
+		logError: logError,
+		now:      time.Now,
+	}
+}
+
+func (q *QuotaLanguageModel) scopes(request llm.CompletionRequest) []scopedLimits {
+	scopes := []scopedLimits{{UsageScope{UsageScopeBot, q.botName}, q.config.Bot}}
+	if request.Context == nil {
+		return scopes
+	}
+	if request.Context.RequestingUser != nil {
+		scopes = append(scopes, scopedLimits{UsageScope{UsageScopeUser, request.Context.RequestingUser.Id}, q.config.User})
+	}
+	if request.Context.Team != nil {
+		scopes = append(scopes, scopedLimits{UsageScope{UsageScopeTeam, request.Context.Team.Id}, q.config.Team})
+	}
+	return scopes
+}
+
+// checkQuotas returns a QuotaExceededError if any scope of the request is over a token limit. Usage that can't
+// be read doesn't block the request.
+func (q *QuotaLanguageModel) checkQuotas(scopes []scopedLimits, inputTokens int64) error {
+	now := q.now()
+	for _, s := range scopes {
+		if s.limits.InputTokens <= 0 && s.limits.OutputTokens <= 0 {
+			continue
+		}
+		period := s.limits.TokenPeriod
+		if period != QuotaPeriodMonth {
+			period = QuotaPeriodDay
+		}
+		usage, err := q.store.getUsage(s.scope, tokenUsagePeriodPrefix(period, now))
+		if err != nil {
+			q.logError("Failed to get usage for quota", "scope", s.scope.Type, "id", s.scope.ID, "error", err.Error())
+			continue
+		}
+		if s.limits.InputTokens > 0 && usage.InputTokens+inputTokens > s.limits.InputTokens {
+			return &QuotaExceededError{Scope: s.scope.Type, Limit: QuotaLimitInputTokens, Period: period}
+		}
+		if s.limits.OutputTokens > 0 && usage.OutputTokens >= s.limits.OutputTokens {
+			return &QuotaExceededError{Scope: s.scope.Type, Limit: QuotaLimitOutputTokens, Period: period}
+		}
+	}
+	return nil
+}
+
+// reserveRequests counts the request in the minute of every scope, or none of them if a scope is at its
+// requests per minute limit. Usage that can't be written doesn't block the request.
+func (q *QuotaLanguageModel) reserveRequests(scopes []scopedLimits) error {
+	period := minuteUsagePeriod(q.now())
+	reserved := make([]scopedLimits, 0, len(scopes))
+	for _, s := range scopes {
+		limit := int64(math.MaxInt64)
+		if s.limits.RequestsPerMinute > 0 {
+			limit = int64(s.limits.RequestsPerMinute)
+		}
+		ok, err := q.store.reserveRequest(s.scope, period, limit)
+		if err != nil {
+			q.logError("Failed to reserve request for quota", "scope", s.scope.Type, "id", s.scope.ID, "error", err.Error())
+			continue
+		}
+		if !ok {
+			// Refused requests don't count towards the scopes that had room
+			for _, r := range reserved {
+				if err := q.store.addUsage(r.scope, period, Usage{Requests: -1}); err != nil {
+					q.logError("Failed to release reserved request", "scope", r.scope.Type, "id", r.scope.ID, "error", err.Error())
+				}
+			}
+			return &QuotaExceededError{Scope: s.scope.Type, Limit: QuotaLimitRequests, Period: "minute"}
+		}
+		reserved = append(reserved, s)
+	}
+	return nil
+}
+
+// record adds usage to the day of every scope, requests per minute are counted by reserveRequests
+func (q *QuotaLanguageModel) record(scopes []scopedLimits, usage Usage) {
+	now := q.now()
+	for _, s := range scopes {
+		if err := q.store.addUsage(s.scope, dayUsagePeriod(now), usage); err != nil {
+			q.logError("Failed to record usage", "scope", s.scope.Type, "id", s.scope.ID, "error", err.Error())
+		}
+	}
+}
+
+// start checks the quotas, counts the request and returns the options that collect the usage the service reports
+func (q *QuotaLanguageModel) start(request llm.CompletionRequest, opts []llm.LanguageModelOption) ([]scopedLimits, int64, *usageCollector, []llm.LanguageModelOption, error) {
+	scopes := q.scopes(request)
+	inputTokens := estimateInputTokens(q.wrapped, request)
+	if err := q.checkQuotas(scopes, inputTokens); err != nil {
+		return nil, 0, nil, nil, err
+	}
+	if err := q.reserveRequests(scopes); err != nil {
+		return nil, 0, nil, nil, err
+	}
+	q.record(scopes, Usage{Requests: 1})
+
+	// Keep any callback the caller asked for
+	var cfg llm.LanguageModelConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	collector := &usageCollector{next: cfg.UsageCallback}
+	opts = append(opts, llm.WithUsageCallback(collector.add))
+
+	return scopes, inputTokens, collector, opts, nil
+}
+
+// finish records the tokens used, counting them where the service didn't report them
+func (q *QuotaLanguageModel) finish(scopes []scopedLimits, inputTokens int64, collector *usageCollector, output string) {
+	reported := collector.total()
+	usage := Usage{InputTokens: reported.InputTokens, OutputTokens: reported.OutputTokens}
+	if usage.InputTokens == 0 {
+		usage.InputTokens = inputTokens
+	}
+	if usage.OutputTokens == 0 {
+		usage.OutputTokens = int64(q.wrapped.CountTokens(output))
+	}
+	q.record(scopes, usage)
+}
+
+func (q *QuotaLanguageModel) refusal(request llm.CompletionRequest, err *QuotaExceededError) string {
+	locale := ""
+	if request.Context != nil && request.Context.RequestingUser != nil {
+		locale = request.Context.RequestingUser.Locale
+	}
+	return err.Message(i18nLocalizerFunc(q.i18n, locale))
+}
+
+// ChatCompletion answers refused requests with a localized explanation in place of the response
+func (q *QuotaLanguageModel) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	scopes, inputTokens, collector, opts, err := q.start(request, opts)
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return llm.NewStreamFromString(q.refusal(request, quotaErr)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := q.wrapped.ChatCompletion(ctx, request, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return observeStream(result, func(output string, _ error) {
+		q.finish(scopes, inputTokens, collector, output)
+	}), nil
+}
+
+func (q *QuotaLanguageModel) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	scopes, inputTokens, collector, opts, err := q.start(request, opts)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := q.wrapped.ChatCompletionNoStream(ctx, request, opts...)
+	q.finish(scopes, inputTokens, collector, result)
+	return result, err
+}
+
+func (q *QuotaLanguageModel) CountTokens(text string) int {
+	return q.wrapped.CountTokens(text)
+}
+
+func (q *QuotaLanguageModel) InputTokenLimit() int {
+	return q.wrapped.InputTokenLimit()
+}
+
+// usageCollector adds up the usage reported for each upstream call of a request
+type usageCollector struct {
+	lock  sync.Mutex
+	usage llm.TokenUsage
+	next  func(llm.TokenUsage)
+}
+
+func (c *usageCollector) add(usage llm.TokenUsage) {
+	c.lock.Lock()
+	c.usage = c.usage.Add(usage)
+	c.lock.Unlock()
+
+	if c.next != nil {
+		c.next(usage)
+	}
+}
+
+func (c *usageCollector) total() llm.TokenUsage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.usage
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryUsageStore struct {
+	lock  sync.Mutex
+	usage map[UsageScope]map[string]Usage
+}
+
+func (s *memoryUsageStore) getUsage(scope UsageScope, periodPrefix string) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var total Usage
+	for period, usage := range s.usage[scope] {
+		if len(period) >= len(periodPrefix) && period[:len(periodPrefix)] == periodPrefix {
+			total.Requests += usage.Requests
+			total.InputTokens += usage.InputTokens
+			total.OutputTokens += usage.OutputTokens
+		}
+	}
+	return total, nil
+}
+
+func (s *memoryUsageStore) addUsage(scope UsageScope, period string, usage Usage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.add(scope, period, usage)
+	return nil
+}
+
+func (s *memoryUsageStore) reserveRequest(scope UsageScope, period string, limit int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.usage[scope][period].Requests >= limit {
+		return false, nil
+	}
+	s.add(scope, period, Usage{Requests: 1})
+	return true, nil
+}
+
+func (s *memoryUsageStore) add(scope UsageScope, period string, usage Usage) {
+	if s.usage == nil {
+		s.usage = make(map[UsageScope]map[string]Usage)
+	}
+	if s.usage[scope] == nil {
+		s.usage[scope] = make(map[string]Usage)
+	}
+	current := s.usage[scope][period]
+	current.Requests += usage.Requests
+	current.InputTokens += usage.InputTokens
+	current.OutputTokens += usage.OutputTokens
+	s.usage[scope][period] = current
+}
+
+func newTestQuotaModel(wrapped llm.LanguageModel, config QuotaConfig, store usageStore, now time.Time) *QuotaLanguageModel {
+	quotaModel := NewQuotaLanguageModel(wrapped, "ai", config, store, i18nInit(), func(string, ...any) {})
+	quotaModel.now = func() time.Time { return now }
+	return quotaModel
+}
+
+func quotaTestRequest(locale string) llm.CompletionRequest {
+	return llm.CompletionRequest{
+		Posts: []llm.Post{{Role: llm.PostRoleUser, Message: "0123456789"}},
+		Context: llm.NewContext(func(c *llm.Context) {
+			c.RequestingUser = &model.User{Id: "user1", Locale: locale}
+			c.Team = &model.Team{Id: "team1"}
+		}),
+	}
+}
+
+func TestQuotaRecordsUsage(t *testing.T) {
+	now := time.Date(2025, 3, 14, 10, 30, 0, 0, time.UTC)
+	store := &memoryUsageStore{}
+	wrapped := &scriptedModel{chunks: []string{"Hello", " there"}}
+	quotaModel := newTestQuotaModel(wrapped, QuotaConfig{Enabled: true}, store, now)
+
+	result, err := quotaModel.ChatCompletion(context.Background(), quotaTestRequest(""))
+	require.NoError(t, err)
+	text, err := result.ReadText()
+	require.NoError(t, err)
+	assert.Equal(t, "Hello there", text)
+
+	// Without reported usage the tokens are counted, scriptedModel counts one token per character
+	expected := Usage{Requests: 1, InputTokens: 10, OutputTokens: 11}
+	for _, scope := range []UsageScope{{UsageScopeBot, "ai"}, {UsageScopeUser, "user1"}, {UsageScopeTeam, "team1"}} {
+		assert.Equal(t, expected, store.usage[scope]["day:2025-03-14"], scope.Type)
+		assert.Equal(t, Usage{Requests: 1}, store.usage[scope]["minute:2025-03-14T10:30"], scope.Type)
+	}
+
+	// Usage reported by the service takes precedence, and callbacks set by the caller still get it
+	wrapped.usage = llm.TokenUsage{InputTokens: 100, OutputTokens: 50}
+	var callerUsage llm.TokenUsage
+	_, err = quotaModel.ChatCompletionNoStream(context.Background(), quotaTestRequest(""), llm.WithUsageCallback(func(usage llm.TokenUsage) {
+		callerUsage = usage
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, wrapped.usage, callerUsage)
+	assert.Equal(t, Usage{Requests: 2, InputTokens: 110, OutputTokens: 61}, store.usage[UsageScope{UsageScopeUser, "user1"}]["day:2025-03-14"])
+}
+
+func TestQuotaRefusesRequests(t *testing.T) {
+	now := time.Date(2025, 3, 14, 10, 30, 0, 0, time.UTC)
+
+	t.Run("monthly token quota", func(t *testing.T) {
+		store := &memoryUsageStore{}
+		require.NoError(t, store.addUsage(UsageScope{UsageScopeTeam, "team1"}, "day:2025-03-01", Usage{OutputTokens: 600}))
+		require.NoError(t, store.addUsage(UsageScope{UsageScopeTeam, "team1"}, "day:2025-03-13", Usage{OutputTokens: 400}))
+		wrapped := &scriptedModel{chunks: []string{"Hello"}}
+		quotaModel := newTestQuotaModel(wrapped, QuotaConfig{
+			Enabled: true,
+			Team:    QuotaLimits{OutputTokens: 1000, TokenPeriod: QuotaPeriodMonth},
+		}, store, now)
+
+		result, err := quotaModel.ChatCompletion(context.Background(), quotaTestRequest(""))
+		require.NoError(t, err)
+		text, err := result.ReadText()
+		require.NoError(t, err)
+		assert.Equal(t, "Your team has reached its monthly AI usage limit. It resets at the start of next month.", text)
+		assert.Zero(t, wrapped.calls)
+
+		_, err = quotaModel.ChatCompletionNoStream(context.Background(), quotaTestRequest(""))
+		var quotaErr *QuotaExceededError
+		require.ErrorAs(t, err, &quotaErr)
+		assert.Equal(t, &QuotaExceededError{Scope: UsageScopeTeam, Limit: QuotaLimitOutputTokens, Period: QuotaPeriodMonth}, quotaErr)
+	})
+
+	t.Run("daily input quota counts the request", func(t *testing.T) {
+		store := &memoryUsageStore{}
+		require.NoError(t, store.addUsage(UsageScope{UsageScopeUser, "user1"}, "day:2025-03-14", Usage{InputTokens: 95}))
+		quotaModel := newTestQuotaModel(&scriptedModel{}, QuotaConfig{
+			Enabled: true,
+			User:    QuotaLimits{InputTokens: 100},
+		}, store, now)
+
+		_, err := quotaModel.ChatCompletionNoStream(context.Background(), quotaTestRequest(""))
+		assert.ErrorContains(t, err, "user quota exceeded: input_tokens per day")
+
+		// Yesterday's usage doesn't count
+		quotaModel.now = func() time.Time { return now.Add(24 * time.Hour) }
+		_, err = quotaModel.ChatCompletionNoStream(context.Background(), quotaTestRequest(""))
+		assert.NoError(t, err)
+	})
+
+	t.Run("requests per minute are localized", func(t *testing.T) {
+		store := &memoryUsageStore{}
+		quotaModel := newTestQuotaModel(&scriptedModel{chunks: []string{"ok"}}, QuotaConfig{
+			Enabled: true,
+			User:    QuotaLimits{RequestsPerMinute: 2},
+		}, store, now)
+
+		for range 2 {
+			_, err := quotaModel.ChatCompletionNoStream(context.Background(), quotaTestRequest("es"))
+			require.NoError(t, err)
+		}
+
+		result, err := quotaModel.ChatCompletion(context.Background(), quotaTestRequest("es"))
+		require.NoError(t, err)
+		text, err := result.ReadText()
+		require.NoError(t, err)
+		assert.Equal(t, "Está enviando solicitudes demasiado rápido. Espere un minuto e inténtelo de nuevo.", text)
+
+		// The next minute starts over
+		quotaModel.now = func() time.Time { return now.Add(time.Minute) }
+		_, err = quotaModel.ChatCompletionNoStream(context.Background(), quotaTestRequest("es"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("concurrent requests can't exceed the requests per minute", func(t *testing.T) {
+		store := &memoryUsageStore{}
+		quotaModel := newTestQuotaModel(&scriptedModel{chunks: []string{"ok"}}, QuotaConfig{
+			Enabled: true,
+			User:    QuotaLimits{RequestsPerMinute: 5},
+		}, store, now)
+		scopes := quotaModel.scopes(quotaTestRequest(""))
+
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		allowed := 0
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if quotaModel.reserveRequests(scopes) == nil {
+					lock.Lock()
+					allowed++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 5, allowed)
+		// Refused requests aren't counted for the bot even though it has no limit
+		assert.Equal(t, int64(5), store.usage[UsageScope{UsageScopeBot, "ai"}]["minute:2025-03-14T10:30"].Requests)
+	})
+}
+
+func TestAbortWithQuotaError(t *testing.T) {
+	p := &Plugin{i18n: i18nInit()}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	quotaErr := &QuotaExceededError{Scope: UsageScopeUser, Limit: QuotaLimitRequests, Period: "minute"}
+	assert.True(t, p.abortWithQuotaError(c, fmt.Errorf("completion failed: %w", quotaErr), "es"))
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	var body map[string]string
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, "Está enviando solicitudes demasiado rápido. Espere un minuto e inténtelo de nuevo.", body["error"])
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	assert.False(t, p.abortWithQuotaError(c, errors.New("service unavailable"), "es"))
+	assert.False(t, p.abortWithQuotaError(c, nil, "es"))
+	assert.False(t, c.IsAborted())
+}
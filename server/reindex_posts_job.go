@@ -4,8 +4,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 )
 
 const (
@@ -16,6 +25,13 @@ const (
 
 	// KV store keys
 	ReindexJobKey = "reindex_job_status"
+
+	reindexBatchSize = 100
+
+	// A running job saves its status at least every reindexHeartbeatInterval, a job that hasn't for
+	// reindexJobStaleAfter is considered dead, its node crashed or stopped, and a new job can take over
+	reindexHeartbeatInterval = 30 * time.Second
+	reindexJobStaleAfter     = 5 * time.Minute
 )
 
 // JobStatus represents the status of a reindex job
@@ -26,23 +42,395 @@ type JobStatus struct {
 	CompletedAt   time.Time `json:"completed_at,omitempty"`
 	ProcessedRows int64     `json:"processed_rows"`
 	TotalRows     int64     `json:"total_rows"`
+	SpaceID       string    `json:"space_id,omitempty"` // Embedding space being migrated to, if any
+	JobID         string    `json:"job_id,omitempty"`
+	HeartbeatAt   time.Time `json:"heartbeat_at,omitempty"`
+}
+
+// isStale reports whether a running job stopped saving its status
+func (s *JobStatus) isStale(now time.Time) bool {
+	last := s.HeartbeatAt
+	if last.IsZero() {
+		last = s.StartedAt
+	}
+	return now.Sub(last) > reindexJobStaleAfter
+}
+
+// reindexPostRow is a post with the channel information needed to index it
+type reindexPostRow struct {
+	ID          string `db:"Id"`
+	Message     string `db:"Message"`
+	UserID      string `db:"UserId"`
+	ChannelID   string `db:"ChannelId"`
+	CreateAt    int64  `db:"CreateAt"`
+	Type        string `db:"Type"`
+	Props       string `db:"Props"`
+	FileIds     string `db:"FileIds"`
+	TeamID      string `db:"TeamId"`
+	ChannelType string `db:"ChannelType"`
+	ChannelName string `db:"ChannelName"`
+}
+
+// toPostAndChannel converts a row to the post and channel models. Props and file IDs that can't be
+// parsed are left empty so the post's message is still indexed.
+func (r reindexPostRow) toPostAndChannel() (*model.Post, *model.Channel) {
+	post := &model.Post{
+		Id:        r.ID,
+		Message:   r.Message,
+		UserId:    r.UserID,
+		ChannelId: r.ChannelID,
+		CreateAt:  r.CreateAt,
+		Type:      r.Type,
+	}
+
+	var props model.StringInterface
+	if r.Props != "" && json.Unmarshal([]byte(r.Props), &props) == nil {
+		post.SetProps(props)
+	}
+
+	var fileIDs model.StringArray
+	if r.FileIds != "" && json.Unmarshal([]byte(r.FileIds), &fileIDs) == nil {
+		post.FileIds = fileIDs
+	}
+
+	channel := &model.Channel{
+		Id:     r.ChannelID,
+		TeamId: r.TeamID,
+		Type:   model.ChannelType(r.ChannelType),
+		Name:   r.ChannelName,
+	}
+
+	return post, channel
+}
+
+// countPostsToIndex returns an estimate of the number of posts the reindex job will process
+func (p *Plugin) countPostsToIndex() (int64, error) {
+	var counts []int64
+	if err := p.doQuery(&counts, p.builder.
+		Select("COUNT(*)").
+		From("Posts").
+		Where(sq.Eq{"DeleteAt": 0}).
+		Where(sq.Eq{"Type": ""}),
+	); err != nil {
+		return 0, fmt.Errorf("failed to count posts: %w", err)
+	}
+
+	if len(counts) == 0 {
+		return 0, nil
+	}
+
+	return counts[0], nil
+}
+
+var (
+	// errReindexJobRunning is returned when a reindex job is started while another one is running
+	errReindexJobRunning = errors.New("job already running")
+	// errReindexJobStopped is returned when the status of a job was changed by someone else, it was canceled
+	// or a new job took over
+	errReindexJobStopped = errors.New("job was canceled or taken over")
+	// errNoRunningReindexJob is returned when canceling while no job is running
+	errNoRunningReindexJob = errors.New("no running job to cancel")
+)
+
+// startReindexJob starts a reindex job in the background. If a job is already running its status is
+// returned along with errReindexJobRunning. A job that stopped saving its status is taken over.
+func (p *Plugin) startReindexJob() (*JobStatus, error) {
+	mtx, err := cluster.NewMutex(p.API, "ai_reindex_job")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mutex: %w", err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	existingData, existing, err := p.getJobStatusData()
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Status == JobStatusRunning {
+		if !existing.isStale(time.Now()) {
+			return existing, errReindexJobRunning
+		}
+		p.pluginAPI.Log.Warn("Taking over stale reindex job", "job_id", existing.JobID, "heartbeat_at", existing.HeartbeatAt)
+	}
+
+	total, err := p.countPostsToIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &reindexJob{
+		p:     p,
+		saved: existingData,
+		status: &JobStatus{
+			Status:      JobStatusRunning,
+			StartedAt:   now,
+			TotalRows:   total,
+			JobID:       model.NewId(),
+			HeartbeatAt: now,
+		},
+	}
+	if err := job.update(func(*JobStatus) {}); err != nil {
+		if errors.Is(err, errReindexJobStopped) {
+			return nil, errors.New("job status changed while starting the job")
+		}
+		return nil, err
+	}
+
+	go p.runReindexJob(job)
+
+	return job.currentStatus(), nil
+}
+
+// startEmbeddingMigration starts the reindex job that backfills a pending embedding space
+func (p *Plugin) startEmbeddingMigration() {
+	if _, err := p.startReindexJob(); err != nil && !errors.Is(err, errReindexJobRunning) {
+		p.pluginAPI.Log.Error("Failed to start embedding migration", "error", err)
+	}
+}
+
+// reindexJob is a running job and the status it last saved. Its status is only saved over that value, so a
+// job never overwrites a cancel or the status of a job that took over from it.
+type reindexJob struct {
+	p *Plugin
+
+	mu     sync.Mutex
+	status *JobStatus
+	saved  []byte
+}
+
+// update changes the status and saves it with a new heartbeat. It returns errReindexJobStopped when the saved
+// status was changed by someone else.
+func (j *reindexJob) update(change func(status *JobStatus)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	next := *j.status
+	change(&next)
+	next.HeartbeatAt = time.Now()
+
+	data, err := json.Marshal(next)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job status: %w", err)
+	}
+	saved, appErr := j.p.API.KVSetWithOptions(ReindexJobKey, data, model.PluginKVSetOptions{Atomic: true, OldValue: j.saved})
+	if appErr != nil {
+		return fmt.Errorf("failed to save job status: %w", appErr)
+	}
+	if !saved {
+		return errReindexJobStopped
+	}
+
+	*j.status = next
+	j.saved = data
+	return nil
+}
+
+func (j *reindexJob) currentStatus() *JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := *j.status
+	return &status
+}
+
+// heartbeat saves the status regularly while a batch is indexed, it cancels the job once it is stopped
+func (j *reindexJob) heartbeat(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(reindexHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := j.update(func(*JobStatus) {})
+			if errors.Is(err, errReindexJobStopped) {
+				cancel(err)
+				return
+			}
+			if err != nil {
+				j.p.pluginAPI.Log.Warn("Failed to save reindex job heartbeat", "error", err)
+			}
+		}
+	}
+}
+
+// runReindexJob indexes all posts again in batches. Normally the search index is cleared and rebuilt, but
+// while an embedding space is pending only the pending space is rebuilt and searches switch to it once
+// the job is done. The job stops when its status in the KV store is changed to canceled.
+func (p *Plugin) runReindexJob(job *reindexJob) {
+	ctx, cancel := context.WithCancelCause(p.activeContext())
+	defer cancel(nil)
+	go job.heartbeat(ctx, cancel)
+
+	err := p.reindexPosts(ctx, job)
+	if errors.Is(err, errReindexJobStopped) || errors.Is(context.Cause(ctx), errReindexJobStopped) {
+		status := job.currentStatus()
+		p.pluginAPI.Log.Info("Reindex job stopped", "job_id", status.JobID, "processed_rows", status.ProcessedRows)
+		return
+	}
+	if err != nil {
+		p.failReindexJob(job, err.Error())
+	}
+}
+
+// reindexPosts runs the job until it is done, it returns errReindexJobStopped when the job was canceled
+func (p *Plugin) reindexPosts(ctx context.Context, job *reindexJob) error {
+	search := p.getSearch()
+	if search == nil {
+		return errors.New("search is not configured")
+	}
+
+	spaces, err := p.getEmbeddingSpaces()
+	if err != nil {
+		return fmt.Errorf("failed to get embedding spaces: %w", err)
+	}
+	var spaceID string
+	if spaces.Pending != nil {
+		search, _, err = p.newEmbeddingSearch(p.getConfiguration().EmbeddingSearchConfig, *spaces.Pending)
+		if err != nil {
+			return fmt.Errorf("failed to create search for the pending embedding space: %w", err)
+		}
+		spaceID = spaces.Pending.ID
+		if err := job.update(func(status *JobStatus) { status.SpaceID = spaceID }); err != nil {
+			return err
+		}
+	}
+
+	if err := search.Clear(ctx); err != nil {
+		return fmt.Errorf("failed to clear search index: %w", err)
+	}
+
+	var lastCreateAt int64
+	var lastID string
+	for {
+		var rows []reindexPostRow
+		if err := p.doQuery(&rows, p.builder.
+			Select("p.Id", "p.Message", "p.UserId", "p.ChannelId", "p.CreateAt", "p.Type", "p.Props", "p.FileIds",
+				"c.TeamId", "c.Type AS ChannelType", "c.Name AS ChannelName").
+			From("Posts AS p").
+			Join("Channels AS c ON c.Id = p.ChannelId").
+			Where(sq.Eq{"p.DeleteAt": 0}).
+			Where(sq.Eq{"p.Type": ""}).
+			Where(sq.Or{
+				sq.Gt{"p.CreateAt": lastCreateAt},
+				sq.And{sq.Eq{"p.CreateAt": lastCreateAt}, sq.Gt{"p.Id": lastID}},
+			}).
+			OrderBy("p.CreateAt ASC", "p.Id ASC").
+			Limit(reindexBatchSize),
+		); err != nil {
+			return fmt.Errorf("failed to fetch posts: %w", err)
+		}
+
+		if len(rows) == 0 {
+			break
+		}
+
+		docs := make([]embeddings.PostDocument, 0, len(rows))
+		for _, row := range rows {
+			post, channel := row.toPostAndChannel()
+			if p.ShouldIndexPost(post, channel) {
+				docs = append(docs, p.postToDocument(post, channel))
+			}
+		}
+
+		if err := search.Store(ctx, docs); err != nil {
+			return fmt.Errorf("failed to index posts: %w", err)
+		}
+
+		lastCreateAt = rows[len(rows)-1].CreateAt
+		lastID = rows[len(rows)-1].ID
+		if err := job.update(func(status *JobStatus) { status.ProcessedRows += int64(len(rows)) }); err != nil {
+			return err
+		}
+	}
+
+	promoted := false
+	if spaceID != "" {
+		promoted, err = p.promoteEmbeddingSpace(spaceID)
+		if err != nil {
+			return fmt.Errorf("failed to switch to the new embedding space: %w", err)
+		}
+	}
+
+	if err := job.update(func(status *JobStatus) {
+		status.Status = JobStatusCompleted
+		status.CompletedAt = time.Now()
+	}); err != nil {
+		return err
+	}
+
+	p.pluginAPI.Log.Info("Reindex job completed", "processed_rows", job.currentStatus().ProcessedRows)
+
+	// The embedding settings changed again while the job was running
+	if spaceID != "" && !promoted {
+		p.startEmbeddingMigration()
+	}
+
+	return nil
+}
+
+func (p *Plugin) failReindexJob(job *reindexJob, message string) {
+	p.pluginAPI.Log.Error("Reindex job failed", "error", message)
+
+	if err := job.update(func(status *JobStatus) {
+		status.Status = JobStatusFailed
+		status.Error = message
+		status.CompletedAt = time.Now()
+	}); err != nil {
+		p.pluginAPI.Log.Warn("Failed to save failed reindex job status", "error", err)
+	}
+}
+
+// getJobStatus loads the reindex job status from the KV store. It returns nil if no job has run.
+func (p *Plugin) getJobStatus() (*JobStatus, error) {
+	_, status, err := p.getJobStatusData()
+	return status, err
 }
 
-// Since vector search is not available in MySQL, this is a stub implementation
-// that just returns an error status
-func (p *Plugin) runReindexJob(jobStatus *JobStatus) {
-	jobStatus.Status = JobStatusFailed
-	jobStatus.Error = "Reindexing is not available when using MySQL. Vector search requires PostgreSQL with the pgvector extension."
-	jobStatus.CompletedAt = time.Now()
-	p.saveJobStatus(jobStatus)
+// getJobStatusData loads the reindex job status along with the saved value, for updates that must not
+// overwrite a change made since
+func (p *Plugin) getJobStatusData() ([]byte, *JobStatus, error) {
+	data, appErr := p.API.KVGet(ReindexJobKey)
+	if appErr != nil {
+		return nil, nil, fmt.Errorf("failed to get job status: %w", appErr)
+	}
+	if data == nil {
+		return nil, nil, nil
+	}
+
+	var status JobStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse job status: %w", err)
+	}
 
-	p.pluginAPI.Log.Warn("Reindexing not available with MySQL database")
+	return data, &status, nil
 }
 
-// saveJobStatus saves the job status to KV store
-func (p *Plugin) saveJobStatus(status *JobStatus) {
-	data, _ := json.Marshal(status)
-	if err := p.API.KVSet(ReindexJobKey, data); err != nil {
-		p.pluginAPI.Log.Error("Failed to save job status", "error", err)
+// cancelReindexJob marks the running job as canceled, the job stops at its next status update
+func (p *Plugin) cancelReindexJob() (*JobStatus, error) {
+	// The job updates its status between batches, retry if it did so in the meantime
+	for range 5 {
+		data, status, err := p.getJobStatusData()
+		if err != nil {
+			return nil, err
+		}
+		if status == nil || status.Status != JobStatusRunning {
+			return nil, errNoRunningReindexJob
+		}
+
+		status.Status = JobStatusCanceled
+		status.CompletedAt = time.Now()
+		canceled, err := json.Marshal(status)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal job status: %w", err)
+		}
+		saved, appErr := p.API.KVSetWithOptions(ReindexJobKey, canceled, model.PluginKVSetOptions{Atomic: true, OldValue: data})
+		if appErr != nil {
+			return nil, fmt.Errorf("failed to save job status: %w", appErr)
+		}
+		if saved {
+			return status, nil
+		}
 	}
+	return nil, errors.New("job status kept changing while canceling")
 }
@@ -0,0 +1,71 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReindexJobUpdate(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	running := []byte(`{"status":"running","job_id":"jobid"}`)
+	job := &reindexJob{p: e.plugin, saved: running, status: &JobStatus{Status: JobStatusRunning, JobID: "jobid"}}
+
+	var saved []byte
+	e.mockAPI.On("KVSetWithOptions", ReindexJobKey, mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: running}).Run(func(args mock.Arguments) {
+		saved = args.Get(1).([]byte)
+	}).Return(true, nil).Once()
+	require.NoError(t, job.update(func(status *JobStatus) { status.ProcessedRows = 100 }))
+
+	var status JobStatus
+	require.NoError(t, json.Unmarshal(saved, &status))
+	assert.Equal(t, int64(100), status.ProcessedRows)
+	assert.False(t, status.HeartbeatAt.IsZero())
+
+	// The status was canceled since the last update, the job stops without overwriting it
+	e.mockAPI.On("KVSetWithOptions", ReindexJobKey, mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: saved}).Return(false, nil).Once()
+	err := job.update(func(status *JobStatus) { status.ProcessedRows = 200 })
+	assert.ErrorIs(t, err, errReindexJobStopped)
+	assert.Equal(t, int64(100), job.currentStatus().ProcessedRows)
+}
+
+func TestCancelReindexJob(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	first := []byte(`{"status":"running","processed_rows":100}`)
+	second := []byte(`{"status":"running","processed_rows":200}`)
+	e.mockAPI.On("KVGet", ReindexJobKey).Return(first, nil).Once()
+	e.mockAPI.On("KVGet", ReindexJobKey).Return(second, nil).Once()
+	// The job saved a batch between the read and the cancel, the cancel is retried over the new status
+	e.mockAPI.On("KVSetWithOptions", ReindexJobKey, mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: first}).Return(false, nil).Once()
+	e.mockAPI.On("KVSetWithOptions", ReindexJobKey, mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: second}).Return(true, nil).Once()
+
+	status, err := e.plugin.cancelReindexJob()
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusCanceled, status.Status)
+	assert.Equal(t, int64(200), status.ProcessedRows)
+
+	e.mockAPI.On("KVGet", ReindexJobKey).Return([]byte(`{"status":"completed"}`), nil).Once()
+	_, err = e.plugin.cancelReindexJob()
+	assert.ErrorIs(t, err, errNoRunningReindexJob)
+}
+
+func TestJobStatusIsStale(t *testing.T) {
+	now := time.Now()
+	assert.False(t, (&JobStatus{StartedAt: now.Add(-time.Hour), HeartbeatAt: now.Add(-time.Minute)}).isStale(now))
+	assert.True(t, (&JobStatus{StartedAt: now.Add(-time.Hour), HeartbeatAt: now.Add(-10 * time.Minute)}).isStale(now))
+	// Jobs started before heartbeats were saved
+	assert.True(t, (&JobStatus{StartedAt: now.Add(-time.Hour)}).isStale(now))
+	assert.False(t, (&JobStatus{StartedAt: now}).isStale(now))
+}
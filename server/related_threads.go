@@ -0,0 +1,142 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	defaultRelatedThreads = 5
+	maxRelatedThreads     = 20
+
+	// relatedCandidateMultiplier controls how many posts are fetched per requested thread,
+	// since several matching posts often belong to the same thread
+	relatedCandidateMultiplier = 4
+
+	// maxRelatedThreadPosts limits how many posts of a long thread are used to describe it
+	maxRelatedThreadPosts = 50
+)
+
+var ErrRelatedNotSupported = errors.New("related threads are not supported by the configured search")
+
+// findRelatedThreads returns the root posts of the earlier threads in other channels most similar to the thread
+// containing the post. Only threads in channels the user can read are returned and each result's score is its
+// best matching post.
+func (p *Plugin) findRelatedThreads(ctx context.Context, userID string, post *model.Post, limit int) ([]RAGResult, error) {
+	search := p.getSearch()
+	if search == nil {
+		return nil, errors.New("search is not configured")
+	}
+	similar, ok := search.(embeddings.SimilarSearcher)
+	if !ok {
+		return nil, ErrRelatedNotSupported
+	}
+
+	if limit <= 0 {
+		limit = defaultRelatedThreads
+	}
+	limit = min(limit, maxRelatedThreads)
+
+	rootID := post.Id
+	if post.RootId != "" {
+		rootID = post.RootId
+	}
+
+	thread, err := p.pluginAPI.Post.GetPostThread(rootID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread: %w", err)
+	}
+
+	channel, err := p.pluginAPI.Channel.Get(post.ChannelId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+
+	root, ok := thread.Posts[rootID]
+	if !ok {
+		return nil, errors.New("thread is missing its root post")
+	}
+
+	thread.SortByCreateAt()
+	threadPostIDs := make([]string, 0, len(thread.Order))
+	docs := make([]embeddings.PostDocument, 0, min(len(thread.Order), maxRelatedThreadPosts))
+	for _, postID := range thread.Order {
+		threadPostIDs = append(threadPostIDs, postID)
+		threadPost := thread.Posts[postID]
+		if len(docs) < maxRelatedThreadPosts && p.ShouldIndexPost(threadPost, channel) {
+			docs = append(docs, p.postToDocument(threadPost, channel))
+		}
+	}
+	if len(docs) == 0 {
+		return []RAGResult{}, nil
+	}
+
+	// Newer threads and the rest of the channel would crowd out the earlier answers to the same question
+	results, err := similar.SearchSimilar(ctx, docs, embeddings.SearchOptions{
+		Limit:             limit * relatedCandidateMultiplier,
+		UserID:            userID,
+		CreatedBefore:     root.CreateAt,
+		ExcludePostIDs:    threadPostIDs,
+		ExcludeChannelIDs: []string{root.ChannelId},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for similar posts: %w", err)
+	}
+
+	return p.groupResultsByThread(results, root, limit), nil
+}
+
+// groupResultsByThread converts matching posts to the root posts of their threads, keeping the first
+// and so best match of each thread. Only threads started before the current one in other channels are kept.
+func (p *Plugin) groupResultsByThread(results []embeddings.SearchResult, current *model.Post, limit int) []RAGResult {
+	seen := map[string]bool{current.Id: true}
+	threads := make([]RAGResult, 0, limit)
+	for _, result := range results {
+		matched, err := p.pluginAPI.Post.GetPost(result.Document.PostID)
+		if err != nil {
+			continue
+		}
+
+		root := matched
+		if matched.RootId != "" {
+			if seen[matched.RootId] {
+				continue
+			}
+			root, err = p.pluginAPI.Post.GetPost(matched.RootId)
+			if err != nil {
+				continue
+			}
+		}
+		if seen[root.Id] || root.DeleteAt != 0 || root.CreateAt >= current.CreateAt || root.ChannelId == current.ChannelId {
+			continue
+		}
+		seen[root.Id] = true
+
+		channelName := root.ChannelId
+		if channel, err := p.pluginAPI.Channel.Get(root.ChannelId); err == nil {
+			channelName = channel.DisplayName
+		}
+
+		threads = append(threads, p.newRAGResult(embeddings.PostDocument{
+			PostID:    root.Id,
+			CreateAt:  root.CreateAt,
+			TeamID:    result.Document.TeamID,
+			ChannelID: root.ChannelId,
+			UserID:    root.UserId,
+			Content:   FormatPostBody(root),
+		}, channelName, result.Score))
+
+		if len(threads) == limit {
+			break
+		}
+	}
+
+	return threads
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestGroupResultsByThread(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	siteURL := "https://mattermost.example.com"
+	e.mockAPI.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+	e.mockAPI.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", DisplayName: "Support"}, nil)
+	e.mockAPI.On("GetUser", mock.Anything).Return(&model.User{Username: "someone"}, nil)
+
+	posts := map[string]*model.Post{
+		"replyA":  {Id: "replyA", RootId: "rootA", ChannelId: "channel1"},
+		"rootA":   {Id: "rootA", ChannelId: "channel1", Message: "How do I reset my password?"},
+		"replyB":  {Id: "replyB", RootId: "current", ChannelId: "channel1"},
+		"rootC":   {Id: "rootC", ChannelId: "channel1", Message: "Password reset link expired"},
+		"deleted": {Id: "deleted", ChannelId: "channel1", DeleteAt: 1},
+		"newer":   {Id: "newer", ChannelId: "channel1", CreateAt: 2000},
+		"same":    {Id: "same", ChannelId: "support", CreateAt: 500},
+	}
+	for id, post := range posts {
+		e.mockAPI.On("GetPost", id).Return(post, nil).Maybe()
+	}
+
+	results := []embeddings.SearchResult{
+		{Document: embeddings.PostDocument{PostID: "replyA"}, Score: 0.9},
+		{Document: embeddings.PostDocument{PostID: "rootA"}, Score: 0.8},
+		{Document: embeddings.PostDocument{PostID: "replyB"}, Score: 0.7},
+		{Document: embeddings.PostDocument{PostID: "deleted"}, Score: 0.6},
+		{Document: embeddings.PostDocument{PostID: "newer"}, Score: 0.6},
+		{Document: embeddings.PostDocument{PostID: "same"}, Score: 0.6},
+		{Document: embeddings.PostDocument{PostID: "rootC"}, Score: 0.5},
+	}
+
+	// Threads started after the current one, or in its channel, aren't the earlier answers looked for
+	current := &model.Post{Id: "current", ChannelId: "support", CreateAt: 1000}
+	threads := e.plugin.groupResultsByThread(results, current, 5)
+	if assert.Len(t, threads, 2) {
+		// Threads keep the score of their best matching post and point at the root post
+		assert.Equal(t, "rootA", threads[0].PostID)
+		assert.Equal(t, float32(0.9), threads[0].Score)
+		assert.Equal(t, "How do I reset my password?", threads[0].Content)
+		assert.Equal(t, "Support", threads[0].ChannelName)
+		assert.Equal(t, siteURL+"/_redirect/pl/rootA", threads[0].Permalink)
+		assert.Equal(t, "rootC", threads[1].PostID)
+	}
+
+	// The limit applies to threads, not matching posts
+	assert.Len(t, e.plugin.groupResultsByThread(results, current, 1), 1)
+}
@@ -166,9 +166,10 @@ Wish them a pleasant time off. DO NOT USE MORE THAN 2 SENTENCES.`
 			},
 		},
 		Context: context,
+		Feature: llm.FeatureRollCall,
 	}
 
-	result, err := p.getLLM(bot.cfg).ChatCompletionNoStream(messageRequest)
+	result, err := p.getLLM(bot.cfg).ChatCompletionNoStream(p.activeContext(), messageRequest)
 	if err != nil {
 		return fmt.Errorf("failed to generate personalized message: %w", err)
 	}
@@ -0,0 +1,177 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost-plugin-ai/server/mysql"
+	"github.com/mattermost/mattermost-plugin-ai/server/openai"
+)
+
+const (
+	// SearchTypeDisabled is what the system console saves before search has been configured
+	SearchTypeDisabled = "disabled"
+
+	VectorStoreTypeMySQL = "mysql"
+
+	EmbeddingProviderTypeOpenAI           = "openai"
+	EmbeddingProviderTypeOpenAICompatible = "openai-compatible"
+)
+
+func (p *Plugin) getSearch() embeddings.EmbeddingSearch {
+	p.searchLock.RLock()
+	defer p.searchLock.RUnlock()
+	return p.search
+}
+
+func (p *Plugin) setSearch(search embeddings.EmbeddingSearch) {
+	p.searchLock.Lock()
+	defer p.searchLock.Unlock()
+	p.search = search
+}
+
+// initSearch builds the embedding search from the configuration. Search is disabled if it isn't configured.
+// While the embedding settings are being migrated, posts are indexed in both the active and the pending space.
+func (p *Plugin) initSearch() error {
+	// The database isn't available until the plugin is activated
+	if p.db == nil {
+		return nil
+	}
+
+	cfg := p.getConfiguration().EmbeddingSearchConfig
+	switch cfg.Type {
+	case "", SearchTypeDisabled:
+		p.setSearch(nil)
+		return nil
+	case embeddings.SearchTypeComposite:
+	default:
+		p.setSearch(nil)
+		return fmt.Errorf("unsupported search type: %s", cfg.Type)
+	}
+
+	spaces, err := p.updateEmbeddingSpaces(cfg)
+	if err != nil {
+		p.setSearch(nil)
+		return err
+	}
+
+	search, store, err := p.newEmbeddingSearch(cfg, *spaces.Active)
+	if err != nil {
+		p.setSearch(nil)
+		return err
+	}
+
+	if spaces.Pending != nil {
+		pending, _, err := p.newEmbeddingSearch(cfg, *spaces.Pending)
+		if err != nil {
+			p.setSearch(nil)
+			return fmt.Errorf("failed to create search for the pending embedding space: %w", err)
+		}
+		p.setSearch(embeddings.NewDualWriteSearch(search, pending))
+		p.startEmbeddingMigration()
+	} else {
+		p.setSearch(search)
+	}
+
+	p.deleteStaleEmbeddingSpaces(store)
+	return nil
+}
+
+// newEmbeddingSearch creates the search of an embedding space. Settings that don't affect the stored embeddings,
+// like the vector store and ranking, are shared by all spaces.
+func (p *Plugin) newEmbeddingSearch(cfg embeddings.EmbeddingSearchConfig, space EmbeddingSpace) (*embeddings.CompositeSearch, embeddings.VectorStore, error) {
+	store, err := p.newVectorStore(cfg.VectorStore, space)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create vector store: %w", err)
+	}
+
+	provider, err := p.newEmbeddingProvider(space.EmbeddingProvider, space.Dimensions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create embedding provider: %w", err)
+	}
+
+	// Keyword search is optional, stores that don't support it only offer vector search
+	keyword, _ := store.(embeddings.KeywordSearcher)
+
+	var opts []embeddings.CompositeSearchOption
+	reranker, err := p.newReranker(cfg.Rerank)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create reranker: %w", err)
+	}
+	if reranker != nil {
+		opts = append(opts, embeddings.WithReranker(reranker, cfg.Rerank.Depth))
+	}
+
+	return embeddings.NewCompositeSearch(store, provider, keyword, space.ChunkingOptions, cfg.HybridSearch, opts...), store, nil
+}
+
+func (p *Plugin) newVectorStore(cfg embeddings.UpstreamConfig, space EmbeddingSpace) (embeddings.VectorStore, error) {
+	switch cfg.Type {
+	case VectorStoreTypeMySQL:
+		var config mysql.MySQLVectorConfig
+		if len(cfg.Parameters) > 0 {
+			if err := json.Unmarshal(cfg.Parameters, &config); err != nil {
+				return nil, fmt.Errorf("failed to parse vector store parameters: %w", err)
+			}
+		}
+		config.Dimensions = space.Dimensions
+		config.Space = space.ID
+		// Every search of a large instance reaches the limit, it is reported once per store
+		var truncated sync.Once
+		config.OnSearchTruncated = func(maxRows int) {
+			truncated.Do(func() {
+				p.pluginAPI.Log.Warn("Vector search only scores the most recent posts of the user's channels, older posts aren't found by similarity. Raise the vector store's maxSearchRows to score more.", "max_search_rows", maxRows)
+			})
+		}
+		return mysql.NewMySQLVector(p.db, config)
+	}
+
+	return nil, fmt.Errorf("unsupported vector store type: %s", cfg.Type)
+}
+
+func (p *Plugin) newEmbeddingProvider(cfg embeddings.UpstreamConfig, dimensions int) (embeddings.EmbeddingProvider, error) {
+	var config openai.Config
+	if len(cfg.Parameters) > 0 {
+		if err := json.Unmarshal(cfg.Parameters, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse embedding provider parameters: %w", err)
+		}
+	}
+	if config.EmbeddingDimentions == 0 {
+		config.EmbeddingDimentions = dimensions
+	}
+
+	switch cfg.Type {
+	case EmbeddingProviderTypeOpenAI:
+		return openai.NewEmbeddings(config, p.llmUpstreamHTTPClient), nil
+	case EmbeddingProviderTypeOpenAICompatible:
+		return openai.NewCompatibleEmbeddings(config, p.llmUpstreamHTTPClient), nil
+	}
+
+	return nil, fmt.Errorf("unsupported embedding provider type: %s", cfg.Type)
+}
+
+func (p *Plugin) newReranker(cfg embeddings.RerankOptions) (embeddings.Reranker, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case embeddings.RerankerTypeLexical:
+		return embeddings.NewLexicalReranker(), nil
+	case embeddings.RerankerTypeLLM:
+		botName := cfg.Bot
+		if botName == "" {
+			botName = p.getConfiguration().DefaultBotName
+		}
+		bot := p.GetBotByUsernameOrFirst(botName)
+		if bot == nil {
+			return nil, fmt.Errorf("no bot available to rerank with: %s", botName)
+		}
+		return embeddings.NewLLMReranker(p.getLLM(bot.cfg), p.prompts, cfg.BatchSize), nil
+	}
+
+	return nil, fmt.Errorf("unsupported reranker type: %s", cfg.Type)
+}
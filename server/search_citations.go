@@ -0,0 +1,92 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/embeddings"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// maxCitations bounds the number of cited posts looked up for a single response
+const maxCitations = 20
+
+var permalinkPattern = regexp.MustCompile(`/_redirect/pl/([a-z0-9]{26})`)
+
+// citedPostIDs returns the IDs of the posts linked from a message in order of first appearance
+func citedPostIDs(message string) []string {
+	seen := make(map[string]bool)
+	var postIDs []string
+	for _, match := range permalinkPattern.FindAllStringSubmatch(message, -1) {
+		postID := match[1]
+		if seen[postID] || !model.IsValidId(postID) {
+			continue
+		}
+		seen[postID] = true
+		postIDs = append(postIDs, postID)
+		if len(postIDs) == maxCitations {
+			break
+		}
+	}
+
+	return postIDs
+}
+
+// attachCitations adds the posts a bot response links to as search results so the webapp can render them as references.
+// The links come from LLM output so every cited post is checked against the requester's permissions.
+func (p *Plugin) attachCitations(post *model.Post) {
+	if post.GetProp(SearchResultsProp) != nil {
+		return
+	}
+
+	requesterID, ok := post.GetProp(LLMRequesterUserID).(string)
+	if !ok || requesterID == "" {
+		return
+	}
+
+	postIDs := citedPostIDs(post.Message)
+	if len(postIDs) == 0 {
+		return
+	}
+
+	citations := make([]RAGResult, 0, len(postIDs))
+	for _, postID := range postIDs {
+		cited, err := p.pluginAPI.Post.GetPost(postID)
+		if err != nil || cited.DeleteAt != 0 {
+			continue
+		}
+
+		channel, err := p.pluginAPI.Channel.Get(cited.ChannelId)
+		if err != nil || channel.DeleteAt != 0 {
+			continue
+		}
+
+		if !p.pluginAPI.User.HasPermissionToChannel(requesterID, channel.Id, model.PermissionReadChannel) {
+			continue
+		}
+
+		citations = append(citations, p.newRAGResult(embeddings.PostDocument{
+			PostID:    cited.Id,
+			CreateAt:  cited.CreateAt,
+			TeamID:    channel.TeamId,
+			ChannelID: channel.Id,
+			UserID:    cited.UserId,
+			Content:   cited.Message,
+		}, channel.DisplayName, 0))
+	}
+
+	if len(citations) == 0 {
+		return
+	}
+
+	citationsJSON, err := json.Marshal(citations)
+	if err != nil {
+		p.API.LogError("Failed to marshal citations", "error", err)
+		return
+	}
+
+	post.AddProp(SearchResultsProp, string(citationsJSON))
+}
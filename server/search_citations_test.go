@@ -0,0 +1,84 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCitedPostIDs(t *testing.T) {
+	postID1 := "abcdefghijklmnopqrstuvwxyz"
+	postID2 := "zyxwvutsrqponmlkjihgfedcba"
+
+	for name, test := range map[string]struct {
+		message  string
+		expected []string
+	}{
+		"no links": {
+			message:  "There is nothing to cite here.",
+			expected: nil,
+		},
+		"markdown links": {
+			message:  "According to Jane [[1]](https://example.com/_redirect/pl/" + postID1 + ") and Bob [[2]](https://example.com/_redirect/pl/" + postID2 + ")",
+			expected: []string{postID1, postID2},
+		},
+		"duplicates keep first appearance": {
+			message:  "[[1]](/_redirect/pl/" + postID2 + ") [[2]](/_redirect/pl/" + postID1 + ") [[1]](/_redirect/pl/" + postID2 + ")",
+			expected: []string{postID2, postID1},
+		},
+		"invalid ids are ignored": {
+			message:  "[[1]](/_redirect/pl/tooshort) [[2]](/_redirect/pl/" + postID1 + ")",
+			expected: []string{postID1},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, citedPostIDs(test.message))
+		})
+	}
+}
+
+func TestAttachCitationsPermissions(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	readableID := "abcdefghijklmnopqrstuvwxyz"
+	unreadableID := "zyxwvutsrqponmlkjihgfedcba"
+	archivedID := "aaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	e.mockAPI.On("GetPost", readableID).Return(&model.Post{Id: readableID, ChannelId: "readable", UserId: "author", Message: "readable"}, nil)
+	e.mockAPI.On("GetPost", unreadableID).Return(&model.Post{Id: unreadableID, ChannelId: "private", UserId: "author", Message: "secret"}, nil)
+	e.mockAPI.On("GetPost", archivedID).Return(&model.Post{Id: archivedID, ChannelId: "archived", UserId: "author", Message: "archived"}, nil)
+	e.mockAPI.On("GetChannel", "readable").Return(&model.Channel{Id: "readable", DisplayName: "Town Square"}, nil)
+	e.mockAPI.On("GetChannel", "private").Return(&model.Channel{Id: "private", DisplayName: "Private"}, nil)
+	e.mockAPI.On("GetChannel", "archived").Return(&model.Channel{Id: "archived", DeleteAt: 1}, nil)
+	e.mockAPI.On("HasPermissionToChannel", "requester", "readable", model.PermissionReadChannel).Return(true)
+	e.mockAPI.On("HasPermissionToChannel", "requester", "private", model.PermissionReadChannel).Return(false)
+	e.mockAPI.On("GetUser", "author").Return(&model.User{Id: "author", Username: "jane"}, nil)
+	e.mockAPI.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: model.NewPointer("https://mm.example.com")}})
+
+	// The links come from the model, which could cite a post the requester can't read
+	post := &model.Post{Message: "See [[1]](/_redirect/pl/" + unreadableID + "), [[2]](/_redirect/pl/" + readableID + ") and [[3]](/_redirect/pl/" + archivedID + ")"}
+	post.AddProp(LLMRequesterUserID, "requester")
+	e.plugin.attachCitations(post)
+
+	var citations []RAGResult
+	require.NoError(t, json.Unmarshal([]byte(post.GetProp(SearchResultsProp).(string)), &citations))
+	require.Len(t, citations, 1)
+	assert.Equal(t, readableID, citations[0].PostID)
+	assert.Equal(t, "jane", citations[0].Username)
+	assert.Equal(t, "https://mm.example.com/_redirect/pl/"+readableID, citations[0].Permalink)
+	e.mockAPI.AssertNotCalled(t, "HasPermissionToChannel", "requester", "archived", mock.Anything)
+
+	// Nothing is attached when no cited post can be read
+	post = &model.Post{Message: "See [[1]](/_redirect/pl/" + unreadableID + ")"}
+	post.AddProp(LLMRequesterUserID, "requester")
+	e.plugin.attachCitations(post)
+	assert.Nil(t, post.GetProp(SearchResultsProp))
+}
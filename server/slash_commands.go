@@ -45,6 +45,17 @@ func (p *Plugin) registerSlashCommands() error {
 		return err
 	}
 
+	if err := p.API.RegisterCommand(&model.Command{
+		Trigger:          "mcpsecret",
+		DisplayName:      "MCP secret",
+		Description:      "Set the secret the AI tools of an MCP server use on your behalf",
+		AutoComplete:     true,
+		AutoCompleteHint: "<server> [secret]",
+		AutoCompleteDesc: "Set your secret for an MCP server, or remove it by leaving it out",
+	}); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -63,6 +74,8 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		return p.executeCheckOutCommand(args), nil
 	case "absent":
 		return p.executeAbsentCommand(args), nil
+	case "mcpsecret":
+		return p.executeMCPSecretCommand(args), nil
 	default:
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
@@ -291,3 +304,47 @@ func (p *Plugin) executeAbsentCommand(args *model.CommandArgs) *model.CommandRes
 		Text:         responseText,
 	}
 }
+
+// executeMCPSecretCommand saves the user's own secret for an MCP server, which is forwarded with their tool calls
+func (p *Plugin) executeMCPSecretCommand(args *model.CommandArgs) *model.CommandResponse {
+	parts := strings.Fields(args.Command)
+	if len(parts) < 2 {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Usage: `/mcpsecret <server> [secret]`. Leave out the secret to remove it.",
+		}
+	}
+	serverName := parts[1]
+	secret := strings.Join(parts[2:], " ")
+
+	found := false
+	for _, server := range p.getConfiguration().MCPServers {
+		if server.Name == serverName && server.UserSecretHeader != "" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("There is no MCP server named %s that uses your own secret.", serverName),
+		}
+	}
+
+	if err := p.setMCPUserSecret(serverName, args.UserId, secret); err != nil {
+		p.API.LogError("Failed to save MCP user secret", "server", serverName, "error", err.Error())
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "There was an issue saving your secret. Please try again.",
+		}
+	}
+
+	text := fmt.Sprintf("Your secret for %s has been saved.", serverName)
+	if secret == "" {
+		text = fmt.Sprintf("Your secret for %s has been removed.", serverName)
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
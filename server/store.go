@@ -9,6 +9,8 @@ import (
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost/server/public/model"
 )
 
 type builder interface {
@@ -66,6 +68,59 @@ func (p *Plugin) SetupTables() error {
 		return fmt.Errorf("can't create llm titles table: %w", err)
 	}
 
+	usageQuery := `
+		CREATE TABLE IF NOT EXISTS LLM_Usage (
+			ScopeType VARCHAR(16) NOT NULL,
+			ScopeID VARCHAR(64) NOT NULL,
+			Period VARCHAR(32) NOT NULL,
+			Requests BIGINT NOT NULL DEFAULT 0,
+			InputTokens BIGINT NOT NULL DEFAULT 0,
+			OutputTokens BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (ScopeType, ScopeID, Period)
+		);
+	`
+
+	if _, err := p.db.Exec(usageQuery); err != nil {
+		return fmt.Errorf("can't create llm usage table: %w", err)
+	}
+
+	usageRecordsQuery := `
+		CREATE TABLE IF NOT EXISTS LLM_UsageRecords (
+			ID VARCHAR(26) NOT NULL PRIMARY KEY,
+			CreateAt BIGINT NOT NULL,
+			BotName VARCHAR(64) NOT NULL,
+			UserID VARCHAR(26) NOT NULL DEFAULT '',
+			TeamID VARCHAR(26) NOT NULL DEFAULT '',
+			ChannelID VARCHAR(26) NOT NULL DEFAULT '',
+			Feature VARCHAR(32) NOT NULL,
+			Model VARCHAR(128) NOT NULL,
+			InputTokens BIGINT NOT NULL DEFAULT 0,
+			OutputTokens BIGINT NOT NULL DEFAULT 0,
+			Cost DOUBLE NOT NULL DEFAULT 0,
+			Estimated BOOLEAN NOT NULL DEFAULT FALSE,
+			INDEX idx_llm_usagerecords_createat (CreateAt)
+		);
+	`
+
+	if _, err := p.db.Exec(usageRecordsQuery); err != nil {
+		return fmt.Errorf("can't create llm usage records table: %w", err)
+	}
+
+	historySummariesQuery := `
+		CREATE TABLE IF NOT EXISTS LLM_HistorySummaries (
+			ConversationID VARCHAR(26) NOT NULL PRIMARY KEY,
+			Summary TEXT NOT NULL,
+			Posts INT NOT NULL,
+			Hash VARCHAR(64) NOT NULL,
+			UpdateAt BIGINT NOT NULL,
+			CONSTRAINT FK_LLM_HistorySummaries_Posts FOREIGN KEY (ConversationID) REFERENCES Posts(Id) ON DELETE CASCADE
+		);
+	`
+
+	if _, err := p.db.Exec(historySummariesQuery); err != nil {
+		return fmt.Errorf("can't create llm history summaries table: %w", err)
+	}
+
 	return nil
 }
 
@@ -85,6 +140,44 @@ func (p *Plugin) saveTitle(threadID, title string) error {
 	return err
 }
 
+type historySummaryRow struct {
+	Summary string `db:"Summary"`
+	Posts   int    `db:"Posts"`
+	Hash    string `db:"Hash"`
+}
+
+// GetHistorySummary returns the running summary of a conversation's dropped history, nil if there is none
+func (p *Plugin) GetHistorySummary(conversationID string) (*llm.HistorySummary, error) {
+	var summaries []historySummaryRow
+	if err := p.doQuery(&summaries, p.builder.
+		Select("Summary", "Posts", "Hash").
+		From("LLM_HistorySummaries").
+		Where(sq.Eq{"ConversationID": conversationID}),
+	); err != nil {
+		return nil, fmt.Errorf("failed to get history summary: %w", err)
+	}
+	if len(summaries) == 0 {
+		return nil, nil
+	}
+	return &llm.HistorySummary{
+		Summary: summaries[0].Summary,
+		Posts:   summaries[0].Posts,
+		Hash:    summaries[0].Hash,
+	}, nil
+}
+
+func (p *Plugin) SaveHistorySummary(conversationID string, summary llm.HistorySummary) error {
+	updateAt := model.GetMillis()
+	_, err := p.execBuilder(p.builder.Insert("LLM_HistorySummaries").
+		Columns("ConversationID", "Summary", "Posts", "Hash", "UpdateAt").
+		Values(conversationID, summary.Summary, summary.Posts, summary.Hash, updateAt).
+		Suffix("ON DUPLICATE KEY UPDATE Summary = ?, Posts = ?, Hash = ?, UpdateAt = ?", summary.Summary, summary.Posts, summary.Hash, updateAt))
+	if err != nil {
+		return fmt.Errorf("failed to save history summary: %w", err)
+	}
+	return nil
+}
+
 type AIThread struct {
 	ID         string
 	Message    string
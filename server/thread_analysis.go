@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/mattermost/mattermost-plugin-ai/server/llm"
@@ -14,7 +15,7 @@ const ThreadIDProp = "referenced_thread"
 const AnalysisTypeProp = "prompt_type"
 
 // DM the user with a standard message. Run the inferance
-func (p *Plugin) analyzeThread(bot *Bot, postIDToAnalyze string, analysisType string, context *llm.Context) (*llm.TextStreamResult, error) {
+func (p *Plugin) analyzeThread(ctx context.Context, bot *Bot, postIDToAnalyze string, analysisType string, context *llm.Context) (*llm.TextStreamResult, error) {
 	posts, err := p.getAnalyzeThreadPosts(postIDToAnalyze, context, analysisType)
 	if err != nil {
 		return nil, err
@@ -23,8 +24,9 @@ func (p *Plugin) analyzeThread(bot *Bot, postIDToAnalyze string, analysisType st
 	completionReqest := llm.CompletionRequest{
 		Posts:   posts,
 		Context: context,
+		Feature: llm.FeatureSummarize,
 	}
-	analysisStream, err := p.getLLM(bot.cfg).ChatCompletion(completionReqest)
+	analysisStream, err := p.getLLM(bot.cfg).ChatCompletion(ctx, completionReqest, llm.WithTemperature(llm.SummaryTemperature))
 	if err != nil {
 		return nil, err
 	}
@@ -102,13 +104,15 @@ func (p *Plugin) analysisPostMessage(locale string, postIDToAnalyze string, anal
 }
 
 func (p *Plugin) startNewAnalysisThread(bot *Bot, postIDToAnalyze string, analysisType string, context *llm.Context) (*model.Post, error) {
-	analysisStream, err := p.analyzeThread(bot, postIDToAnalyze, analysisType, context)
+	streamContext := p.newStreamingContext()
+	analysisStream, err := p.analyzeThread(streamContext.ctx, bot, postIDToAnalyze, analysisType, context)
 	if err != nil {
+		streamContext.cancel()
 		return nil, err
 	}
 
 	post := p.makeAnalysisPost(context.RequestingUser.Locale, postIDToAnalyze, analysisType)
-	if err := p.streamResultToNewDM(bot.mmBot.UserId, analysisStream, context.RequestingUser.Id, post, postIDToAnalyze); err != nil {
+	if err := p.streamResultToNewDM(streamContext, bot.mmBot.UserId, analysisStream, context.RequestingUser.Id, post, postIDToAnalyze); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,297 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+)
+
+// ToolApprovalPostProp holds the tool calls a response waits on, the post asks the requester to approve them
+const ToolApprovalPostProp = "pending_tool_calls"
+
+const toolApprovalKeyPrefix = "tool_approval_"
+
+// toolApprovalTTL is how long a response waits for the requester to decide, the calls are dropped after that
+const toolApprovalTTL = 24 * time.Hour
+
+var (
+	errNoPendingToolApproval = errors.New("no tool calls are waiting for approval")
+	errToolApprovalExpired   = errors.New("the tool calls waited too long for approval")
+)
+
+// PendingToolApproval is a response stopped for the requesting user to approve its tool calls. It is kept in
+// the KV store so the response can continue after a restart.
+type PendingToolApproval struct {
+	PostID   string            `json:"post_id"`
+	UserID   string            `json:"user_id"`
+	Calls    []PendingToolCall `json:"calls"`
+	CreateAt int64             `json:"create_at"`
+}
+
+// PendingToolCall is a call of the step that stopped, the calls without side effects are already resolved
+type PendingToolCall struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	Arguments        string `json:"arguments"`
+	Result           string `json:"result,omitempty"`
+	Error            string `json:"error,omitempty"`
+	RequiresApproval bool   `json:"requires_approval,omitempty"`
+}
+
+// toolApprovalPrompt is a call shown to the user in the post
+type toolApprovalPrompt struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+func toolApprovalKey(postID string) string {
+	return toolApprovalKeyPrefix + postID
+}
+
+func pendingToolCalls(calls []llm.ToolCall) []PendingToolCall {
+	pending := make([]PendingToolCall, 0, len(calls))
+	for _, call := range calls {
+		pendingCall := PendingToolCall{
+			ID:               call.ID,
+			Name:             call.Name,
+			Arguments:        call.Arguments,
+			Result:           call.Result,
+			RequiresApproval: call.RequiresApproval,
+		}
+		if call.Err != nil {
+			pendingCall.Error = call.Err.Error()
+		}
+		pending = append(pending, pendingCall)
+	}
+	return pending
+}
+
+// expiresIn is how long the approval can still be decided, zero or less once it expired
+func (a PendingToolApproval) expiresIn(now time.Time) time.Duration {
+	return time.UnixMilli(a.CreateAt).Add(toolApprovalTTL).Sub(now)
+}
+
+func (a PendingToolApproval) toolCalls() []llm.ToolCall {
+	calls := make([]llm.ToolCall, 0, len(a.Calls))
+	for _, pending := range a.Calls {
+		call := llm.ToolCall{
+			ID:               pending.ID,
+			Name:             pending.Name,
+			Arguments:        pending.Arguments,
+			Result:           pending.Result,
+			RequiresApproval: pending.RequiresApproval,
+		}
+		if pending.Error != "" {
+			call.Err = errors.New(pending.Error)
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// requestToolApproval keeps the calls the response waits on and adds the prompt for them to the post
+func (p *Plugin) requestToolApproval(post *model.Post, calls []llm.ToolCall) error {
+	// Only conversations can be rebuilt to continue once the user decides
+	if _, ok := post.GetProp(RespondingToProp).(string); !ok {
+		return errors.New("only responses in conversations can wait for tool approval")
+	}
+
+	requesterID, _ := post.GetProp(LLMRequesterUserID).(string)
+	approval := PendingToolApproval{
+		PostID:   post.Id,
+		UserID:   requesterID,
+		Calls:    pendingToolCalls(calls),
+		CreateAt: model.GetMillis(),
+	}
+	if err := p.saveToolApproval(approval); err != nil {
+		return err
+	}
+
+	var prompt []toolApprovalPrompt
+	for _, call := range calls {
+		if call.RequiresApproval {
+			prompt = append(prompt, toolApprovalPrompt{Name: call.Name, Arguments: call.Arguments})
+		}
+	}
+	promptJSON, err := json.Marshal(prompt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tool approval prompt: %w", err)
+	}
+	post.AddProp(ToolApprovalPostProp, string(promptJSON))
+
+	return nil
+}
+
+// saveToolApproval keeps the approval until it expires
+func (p *Plugin) saveToolApproval(approval PendingToolApproval) error {
+	expiresIn := approval.expiresIn(time.Now())
+	if expiresIn <= 0 {
+		return errToolApprovalExpired
+	}
+	if _, err := p.pluginAPI.KV.Set(toolApprovalKey(approval.PostID), approval, pluginapi.SetExpiry(expiresIn)); err != nil {
+		return fmt.Errorf("failed to save pending tool approval: %w", err)
+	}
+	return nil
+}
+
+// claimToolApproval removes the pending approval of the post and returns it. Only one decision can claim it so
+// the tools run once even if the user clicks twice.
+func (p *Plugin) claimToolApproval(postID string) (*PendingToolApproval, error) {
+	var data []byte
+	if err := p.pluginAPI.KV.Get(toolApprovalKey(postID), &data); err != nil {
+		return nil, fmt.Errorf("failed to get pending tool approval: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, errNoPendingToolApproval
+	}
+
+	claimed, err := p.pluginAPI.KV.Set(toolApprovalKey(postID), nil, pluginapi.SetAtomic(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim pending tool approval: %w", err)
+	}
+	if !claimed {
+		return nil, errNoPendingToolApproval
+	}
+
+	var approval PendingToolApproval
+	if err := json.Unmarshal(data, &approval); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pending tool approval: %w", err)
+	}
+	// The KV store expires approvals too, but only removes them eventually
+	if approval.expiresIn(time.Now()) <= 0 {
+		return nil, errToolApprovalExpired
+	}
+	return &approval, nil
+}
+
+func (p *Plugin) handleToolApproval(c *gin.Context) {
+	userID := c.GetHeader("Mattermost-User-Id")
+	post := c.MustGet(ContextPostKey).(*model.Post)
+	channel := c.MustGet(ContextChannelKey).(*model.Channel)
+
+	bot := p.GetBotByID(post.UserId)
+	if bot == nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("unable to get bot"))
+		return
+	}
+
+	if post.GetProp(LLMRequesterUserID) != userID {
+		c.AbortWithError(http.StatusForbidden, errors.New("only the original poster can approve tool calls"))
+		return
+	}
+
+	var data struct {
+		Approved bool `json:"approved"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := p.pluginAPI.User.Get(userID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("unable to get user to continue post: %w", err))
+		return
+	}
+
+	if err := p.continueAfterToolApproval(bot, post, user, channel, data.Approved); err != nil {
+		if errors.Is(err, errNoPendingToolApproval) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, errToolApprovalExpired) {
+			c.AbortWithError(http.StatusGone, err)
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("unable to continue post after tool approval: %w", err))
+		return
+	}
+}
+
+// continueAfterToolApproval resolves the calls the user approved, or tells the model they were denied, and
+// streams the rest of the response into the post
+func (p *Plugin) continueAfterToolApproval(bot *Bot, post *model.Post, user *model.User, channel *model.Channel, approved bool) error {
+	respondingToPostID, ok := post.GetProp(RespondingToProp).(string)
+	if !ok {
+		return errors.New("post missing responding to prop")
+	}
+	respondingToPost, err := p.pluginAPI.Post.GetPost(respondingToPostID)
+	if err != nil {
+		return fmt.Errorf("could not get post being responded to: %w", err)
+	}
+
+	ctx, err := p.getPostStreamingContext(p.activeContext(), post.Id)
+	if err != nil {
+		return err
+	}
+	defer p.finishPostStreaming(ctx, post.Id)
+
+	approval, err := p.claimToolApproval(post.Id)
+	if err != nil {
+		return err
+	}
+
+	request, err := p.conversationCompletionRequest(bot, user, channel, respondingToPost)
+	if err != nil {
+		// Nothing has run yet, the user can try again
+		if restoreErr := p.saveToolApproval(*approval); restoreErr != nil {
+			p.API.LogError("Failed to restore pending tool approval", "error", restoreErr.Error())
+		}
+		return fmt.Errorf("could not continue conversation after tool approval: %w", err)
+	}
+
+	calls := p.decideToolCalls(ctx, request.Context, approval, approved)
+	request.Posts = append(request.Posts, llm.Post{
+		Role:      llm.PostRoleBot,
+		Message:   post.Message,
+		ToolCalls: calls,
+	})
+
+	result, err := p.getLLM(bot.cfg).ChatCompletion(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	post.DelProp(ToolApprovalPostProp)
+	if post.Message != "" {
+		post.Message += "\n\n"
+	}
+	p.streamResultToPost(ctx, result, post, p.responseLocale(bot, user, channel))
+
+	return nil
+}
+
+// decideToolCalls resolves the calls waiting for approval if the user approved them, otherwise their result tells
+// the model the user denied them
+func (p *Plugin) decideToolCalls(ctx context.Context, llmContext *llm.Context, approval *PendingToolApproval, approved bool) []llm.ToolCall {
+	calls := approval.toolCalls()
+	for i, call := range calls {
+		if !call.RequiresApproval {
+			continue
+		}
+		if !approved {
+			calls[i].Err = llm.ErrToolCallDenied
+			continue
+		}
+		calls[i].Result, calls[i].Err = p.resolveApprovedTool(ctx, llmContext, call)
+	}
+	return calls
+}
+
+// resolveApprovedTool runs a call the user approved, with the same timeout as calls made in the agent loop
+func (p *Plugin) resolveApprovedTool(ctx context.Context, llmContext *llm.Context, call llm.ToolCall) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, llm.DefaultToolTimeout)
+	defer cancel()
+	return llmContext.Tools.ResolveTool(ctx, call.Name, call.ArgumentGetter(), llmContext)
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamResultToPostToolApproval(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	var saved []byte
+	var options model.PluginKVSetOptions
+	e.mockAPI.On("PublishWebSocketEvent", "postupdate", mock.Anything, mock.Anything)
+	e.mockAPI.On("KVSetWithOptions", "tool_approval_postid", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		saved = args.Get(1).([]byte)
+		options = args.Get(2).(model.PluginKVSetOptions)
+	}).Return(true, nil)
+	e.mockAPI.On("UpdatePost", mock.Anything).Return(func(post *model.Post) *model.Post { return post.Clone() }, nil)
+
+	events := make(chan llm.StreamEvent, 2)
+	events <- llm.StreamEvent{Type: llm.EventTypeToolApproval, ToolCalls: []llm.ToolCall{
+		{ID: "1", Name: "LookupMattermostUser", Arguments: `{"username":"bob"}`, Result: "Bob"},
+		{ID: "2", Name: "CreateIssue", Arguments: `{"title":"Bug"}`, RequiresApproval: true},
+	}}
+	events <- llm.StreamEvent{Type: llm.EventTypeEnd, FinishReason: llm.FinishReasonToolApproval}
+	close(events)
+
+	post := &model.Post{Id: "postid", UserId: "botid", ChannelId: "channelid"}
+	post.AddProp(LLMRequesterUserID, "userid")
+	post.AddProp(RespondingToProp, "questionid")
+	e.plugin.streamResultToPost(context.Background(), &llm.TextStreamResult{Events: events}, post, "en")
+
+	// A response waiting for approval isn't an empty response
+	assert.Empty(t, post.Message)
+	assert.JSONEq(t, `[{"name":"CreateIssue","arguments":"{\"title\":\"Bug\"}"}]`, post.GetProp(ToolApprovalPostProp).(string))
+
+	var approval PendingToolApproval
+	require.NoError(t, json.Unmarshal(saved, &approval))
+	assert.Equal(t, "postid", approval.PostID)
+	assert.Equal(t, "userid", approval.UserID)
+	assert.Equal(t, []PendingToolCall{
+		{ID: "1", Name: "LookupMattermostUser", Arguments: `{"username":"bob"}`, Result: "Bob"},
+		{ID: "2", Name: "CreateIssue", Arguments: `{"title":"Bug"}`, RequiresApproval: true},
+	}, approval.Calls)
+	// Approvals the requester never decides on are dropped
+	assert.Positive(t, options.ExpireInSeconds)
+}
+
+func TestClaimToolApproval(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	data, err := json.Marshal(PendingToolApproval{
+		PostID:   "postid",
+		Calls:    []PendingToolCall{{ID: "1", Name: "CreateIssue", Error: "boom", RequiresApproval: true}},
+		CreateAt: model.GetMillis(),
+	})
+	require.NoError(t, err)
+	expired, err := json.Marshal(PendingToolApproval{
+		PostID:   "expiredid",
+		CreateAt: time.Now().Add(-toolApprovalTTL - time.Minute).UnixMilli(),
+	})
+	require.NoError(t, err)
+
+	e.mockAPI.On("KVGet", "tool_approval_postid").Return(data, nil)
+	claimOptions := model.PluginKVSetOptions{Atomic: true, OldValue: data}
+	e.mockAPI.On("KVSetWithOptions", "tool_approval_postid", []byte(nil), claimOptions).Return(true, nil).Once()
+	e.mockAPI.On("KVSetWithOptions", "tool_approval_postid", []byte(nil), claimOptions).Return(false, nil).Once()
+	e.mockAPI.On("KVGet", "tool_approval_otherid").Return(nil, nil)
+	e.mockAPI.On("KVGet", "tool_approval_expiredid").Return(expired, nil)
+	e.mockAPI.On("KVSetWithOptions", "tool_approval_expiredid", []byte(nil), model.PluginKVSetOptions{Atomic: true, OldValue: expired}).Return(true, nil)
+
+	approval, err := e.plugin.claimToolApproval("postid")
+	require.NoError(t, err)
+	calls := approval.toolCalls()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "CreateIssue", calls[0].Name)
+	assert.True(t, calls[0].RequiresApproval)
+	assert.EqualError(t, calls[0].Err, "boom")
+
+	// Only one decision claims the approval
+	_, err = e.plugin.claimToolApproval("postid")
+	assert.ErrorIs(t, err, errNoPendingToolApproval)
+
+	_, err = e.plugin.claimToolApproval("otherid")
+	assert.ErrorIs(t, err, errNoPendingToolApproval)
+
+	// Approvals can't be decided once they expired, even if the KV store hasn't removed them yet
+	_, err = e.plugin.claimToolApproval("expiredid")
+	assert.ErrorIs(t, err, errToolApprovalExpired)
+}
+
+func TestHandleToolApprovalRequester(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	post := &model.Post{Id: "postid", UserId: "botid", ChannelId: "channelid"}
+	post.AddProp(LLMRequesterUserID, "userid")
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/post/postid/tool_approval", strings.NewReader(`{"approved":true}`))
+	c.Request.Header.Set("Mattermost-User-Id", "otheruser")
+	c.Set(ContextPostKey, post)
+	c.Set(ContextChannelKey, &model.Channel{Id: "channelid"})
+
+	// Only the user the response is for can decide, the approval isn't claimed
+	e.plugin.handleToolApproval(c)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestDecideToolCalls(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+
+	resolved := 0
+	tools := llm.NewNoTools()
+	tools.AddTools([]llm.Tool{{
+		Name: "CreateIssue",
+		Resolver: func(_ context.Context, _ *llm.Context, _ llm.ToolArgumentGetter) (string, error) {
+			resolved++
+			return "created", nil
+		},
+	}})
+	llmContext := llm.NewContext(func(c *llm.Context) { c.Tools = tools })
+	approval := &PendingToolApproval{Calls: []PendingToolCall{
+		{ID: "1", Name: "LookupMattermostUser", Result: "Bob"},
+		{ID: "2", Name: "CreateIssue", Arguments: `{"title":"Bug"}`, RequiresApproval: true},
+	}}
+
+	// A denial is sent to the model as the result of the calls waiting for approval, nothing runs
+	calls := e.plugin.decideToolCalls(context.Background(), llmContext, approval, false)
+	require.Len(t, calls, 2)
+	assert.Equal(t, "Bob", calls[0].Result)
+	assert.NoError(t, calls[0].Err)
+	assert.ErrorIs(t, calls[1].Err, llm.ErrToolCallDenied)
+	assert.Zero(t, resolved)
+
+	calls = e.plugin.decideToolCalls(context.Background(), llmContext, approval, true)
+	assert.Equal(t, "created", calls[1].Result)
+	assert.NoError(t, calls[1].Err)
+	assert.Equal(t, 1, resolved)
+}
+
+func TestContinueAfterToolApprovalRestoresApproval(t *testing.T) {
+	e := SetupTestEnvironment(t)
+	defer e.Cleanup(t)
+	e.plugin.streamingContexts = map[string]PostStreamContext{}
+	e.plugin.bots[0].cfg.DisableTools = true
+
+	data, err := json.Marshal(PendingToolApproval{
+		PostID:   "postid",
+		UserID:   "userid",
+		Calls:    []PendingToolCall{{ID: "1", Name: "CreateIssue", RequiresApproval: true}},
+		CreateAt: model.GetMillis(),
+	})
+	require.NoError(t, err)
+
+	e.mockAPI.On("GetPost", "questionid").Return(&model.Post{Id: "questionid", RootId: "rootid", ChannelId: "channelid"}, nil)
+	e.mockAPI.On("KVGet", "tool_approval_postid").Return(data, nil)
+	e.mockAPI.On("KVSetWithOptions", "tool_approval_postid", []byte(nil), model.PluginKVSetOptions{Atomic: true, OldValue: data}).Return(true, nil).Once()
+	// Building the request fails, the approval is saved again with the time it had left
+	var restored []byte
+	var restoreOptions model.PluginKVSetOptions
+	e.mockAPI.On("KVSetWithOptions", "tool_approval_postid", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		restored = args.Get(1).([]byte)
+		restoreOptions = args.Get(2).(model.PluginKVSetOptions)
+	}).Return(true, nil).Once()
+	e.mockAPI.On("GetConfig").Return(&model.Config{})
+	e.mockAPI.On("GetLicense").Return(nil)
+	e.mockAPI.On("GetPostThread", "questionid").Return(nil, &model.AppError{Message: "thread not found"})
+
+	post := &model.Post{Id: "postid", UserId: "botid", ChannelId: "channelid"}
+	post.AddProp(RespondingToProp, "questionid")
+	channel := &model.Channel{Id: "channelid", Type: model.ChannelTypeDirect, Name: "botid__userid"}
+	err = e.plugin.continueAfterToolApproval(e.plugin.bots[0], post, &model.User{Id: "userid"}, channel, true)
+	assert.ErrorContains(t, err, "could not continue conversation after tool approval")
+
+	assert.JSONEq(t, string(data), string(restored))
+	assert.Positive(t, restoreOptions.ExpireInSeconds)
+	assert.LessOrEqual(t, restoreOptions.ExpireInSeconds, int64(toolApprovalTTL.Seconds()))
+}
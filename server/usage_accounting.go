@@ -0,0 +1,200 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost-plugin-ai/server/metrics"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ModelPrice is what a model costs per million tokens. Any currency can be used as long as every price uses the same.
+type ModelPrice struct {
+	// Model is matched exactly first, then as the longest prefix of the model name
+	Model            string  `json:"model"`
+	InputPerMillion  float64 `json:"inputPerMillion"`
+	OutputPerMillion float64 `json:"outputPerMillion"`
+}
+
+func (p ModelPrice) cost(inputTokens, outputTokens int64) float64 {
+	return (float64(inputTokens)*p.InputPerMillion + float64(outputTokens)*p.OutputPerMillion) / 1_000_000
+}
+
+// priceForModel finds the price of a model, models without a price cost nothing
+func priceForModel(prices []ModelPrice, modelName string) ModelPrice {
+	var best ModelPrice
+	for _, price := range prices {
+		if price.Model == modelName {
+			return price
+		}
+		if price.Model != "" && strings.HasPrefix(modelName, price.Model) && len(price.Model) > len(best.Model) {
+			best = price
+		}
+	}
+	return best
+}
+
+// UsageRecord is the usage of a single request, kept for chargeback reports
+type UsageRecord struct {
+	ID           string  `json:"id" db:"ID"`
+	CreateAt     int64   `json:"createAt" db:"CreateAt"`
+	BotName      string  `json:"botName" db:"BotName"`
+	UserID       string  `json:"userId" db:"UserID"`
+	TeamID       string  `json:"teamId" db:"TeamID"`
+	ChannelID    string  `json:"channelId" db:"ChannelID"`
+	Feature      string  `json:"feature" db:"Feature"`
+	Model        string  `json:"model" db:"Model"`
+	InputTokens  int64   `json:"inputTokens" db:"InputTokens"`
+	OutputTokens int64   `json:"outputTokens" db:"OutputTokens"`
+	Cost         float64 `json:"cost" db:"Cost"`
+	// Estimated is set when the service didn't report its usage and the tokens were counted instead
+	Estimated bool `json:"estimated" db:"Estimated"`
+}
+
+type usageRecordStore interface {
+	saveUsageRecord(record UsageRecord) error
+}
+
+// UsageAccountingLanguageModel records the tokens and cost of every request, in metrics and per request
+type UsageAccountingLanguageModel struct {
+	wrapped      llm.LanguageModel
+	botName      string
+	defaultModel string
+	prices       []ModelPrice
+	metrics      metrics.LLMetrics
+	store        usageRecordStore
+	logError     func(msg string, keyValuePairs ...any)
+	now          func() time.Time
+}
+
+func NewUsageAccountingLanguageModel(wrapped llm.LanguageModel, botConfig llm.BotConfig, prices []ModelPrice, llmMetrics metrics.LLMetrics, store usageRecordStore, logError func(msg string, keyValuePairs ...any)) *UsageAccountingLanguageModel {
+	return &UsageAccountingLanguageModel{
+		wrapped:      wrapped,
+		botName:      botConfig.Name,
+		defaultModel: botConfig.Service.DefaultModel,
+		prices:       prices,
+		metrics:      llmMetrics,
+		store:        store,
+		logError:     logError,
+		now:          time.Now,
+	}
+}
+
+// start returns the options that collect the usage the service reports, keeping any callback the caller set
+func (u *UsageAccountingLanguageModel) start(opts []llm.LanguageModelOption) (*usageCollector, []llm.LanguageModelOption) {
+	var cfg llm.LanguageModelConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	collector := &usageCollector{next: cfg.UsageCallback}
+	return collector, append(opts, llm.WithUsageCallback(collector.add))
+}
+
+func (u *UsageAccountingLanguageModel) finish(request llm.CompletionRequest, collector *usageCollector, output string, err error) {
+	usage := collector.total()
+	if err != nil && output == "" && usage == (llm.TokenUsage{}) {
+		// Nothing was generated, the request most likely never reached the model
+		return
+	}
+
+	record := UsageRecord{
+		ID:           model.NewId(),
+		CreateAt:     u.now().UnixMilli(),
+		BotName:      u.botName,
+		Feature:      cmp.Or(request.Feature, llm.FeatureOther),
+		Model:        cmp.Or(usage.Model, u.defaultModel),
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+	}
+	if record.InputTokens == 0 {
+		record.InputTokens = estimateInputTokens(u.wrapped, request)
+		record.Estimated = true
+	}
+	if record.OutputTokens == 0 && output != "" {
+		record.OutputTokens = int64(u.wrapped.CountTokens(output))
+		record.Estimated = true
+	}
+	record.Cost = priceForModel(u.prices, record.Model).cost(record.InputTokens, record.OutputTokens)
+
+	if request.Context != nil {
+		if request.Context.RequestingUser != nil {
+			record.UserID = request.Context.RequestingUser.Id
+		}
+		if request.Context.Team != nil {
+			record.TeamID = request.Context.Team.Id
+		}
+		if request.Context.Channel != nil {
+			record.ChannelID = request.Context.Channel.Id
+		}
+	}
+
+	u.metrics.ObserveLLMTokenUsage(record.Model, record.Feature, record.InputTokens, record.OutputTokens, record.Cost)
+	if err := u.store.saveUsageRecord(record); err != nil {
+		u.logError("Failed to save usage record", "bot", u.botName, "error", err.Error())
+	}
+}
+
+func (u *UsageAccountingLanguageModel) ChatCompletion(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (*llm.TextStreamResult, error) {
+	collector, opts := u.start(opts)
+	result, err := u.wrapped.ChatCompletion(ctx, request, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return observeStream(result, func(output string, err error) {
+		u.finish(request, collector, output, err)
+	}), nil
+}
+
+func (u *UsageAccountingLanguageModel) ChatCompletionNoStream(ctx context.Context, request llm.CompletionRequest, opts ...llm.LanguageModelOption) (string, error) {
+	collector, opts := u.start(opts)
+	result, err := u.wrapped.ChatCompletionNoStream(ctx, request, opts...)
+	u.finish(request, collector, result, err)
+	return result, err
+}
+
+func (u *UsageAccountingLanguageModel) CountTokens(text string) int {
+	return u.wrapped.CountTokens(text)
+}
+
+func (u *UsageAccountingLanguageModel) InputTokenLimit() int {
+	return u.wrapped.InputTokenLimit()
+}
+
+// estimateInputTokens counts the tokens of a request for services that don't report them
+func estimateInputTokens(languageModel llm.LanguageModel, request llm.CompletionRequest) int64 {
+	var tokens int64
+	for _, post := range request.Posts {
+		tokens += int64(languageModel.CountTokens(post.Message))
+	}
+	return tokens
+}
+
+// observeStream passes a stream on unchanged and calls done with the full text and the error it ended with once it finishes
+func observeStream(result *llm.TextStreamResult, done func(output string, err error)) *llm.TextStreamResult {
+	events := make(chan llm.StreamEvent)
+	go func() {
+		defer close(events)
+
+		var text strings.Builder
+		var lastErr error
+		for event := range result.Events {
+			switch event.Type {
+			case llm.EventTypeText:
+				text.WriteString(event.Text)
+			case llm.EventTypeError:
+				lastErr = event.Err
+			}
+			events <- event
+		}
+		done(text.String(), lastErr)
+	}()
+
+	return &llm.TextStreamResult{Events: events}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryUsageRecordStore struct {
+	records []UsageRecord
+}
+
+func (s *memoryUsageRecordStore) saveUsageRecord(record UsageRecord) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+type tokenUsageObservation struct {
+	model, feature            string
+	inputTokens, outputTokens int64
+	cost                      float64
+}
+
+type recordingMetrics struct {
+	observations []tokenUsageObservation
+}
+
+func (m *recordingMetrics) IncrementLLMRequests()             {}
+func (m *recordingMetrics) IncrementLLMFailovers(_, _ string) {}
+func (m *recordingMetrics) ObserveLLMTokenUsage(model, feature string, inputTokens, outputTokens int64, cost float64) {
+	m.observations = append(m.observations, tokenUsageObservation{model, feature, inputTokens, outputTokens, cost})
+}
+
+func newTestUsageAccountingModel(wrapped llm.LanguageModel, prices []ModelPrice) (*UsageAccountingLanguageModel, *memoryUsageRecordStore, *recordingMetrics) {
+	store := &memoryUsageRecordStore{}
+	llmMetrics := &recordingMetrics{}
+	botConfig := llm.BotConfig{Name: "ai", Service: llm.ServiceConfig{DefaultModel: "gpt-4o"}}
+	return NewUsageAccountingLanguageModel(wrapped, botConfig, prices, llmMetrics, store, func(string, ...any) {}), store, llmMetrics
+}
+
+func TestUsageAccountingReportedUsage(t *testing.T) {
+	wrapped := &scriptedModel{chunks: []string{"Hello"}, usage: llm.TokenUsage{Model: "gpt-4o-mini", InputTokens: 2000, OutputTokens: 500}}
+	accounting, store, llmMetrics := newTestUsageAccountingModel(wrapped, []ModelPrice{
+		{Model: "gpt-4o", InputPerMillion: 2.5, OutputPerMillion: 10},
+		{Model: "gpt-4o-mini", InputPerMillion: 0.15, OutputPerMillion: 0.6},
+	})
+
+	request := llm.CompletionRequest{
+		Posts: []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+		Context: llm.NewContext(func(c *llm.Context) {
+			c.RequestingUser = &model.User{Id: "user1"}
+			c.Team = &model.Team{Id: "team1"}
+			c.Channel = &model.Channel{Id: "channel1"}
+		}),
+		Feature: llm.FeatureMention,
+	}
+	result, err := accounting.ChatCompletion(context.Background(), request)
+	require.NoError(t, err)
+	text, err := result.ReadText()
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", text)
+
+	require.Len(t, store.records, 1)
+	record := store.records[0]
+	assert.NotEmpty(t, record.ID)
+	assert.Equal(t, "ai", record.BotName)
+	assert.Equal(t, "user1", record.UserID)
+	assert.Equal(t, "team1", record.TeamID)
+	assert.Equal(t, "channel1", record.ChannelID)
+	assert.Equal(t, llm.FeatureMention, record.Feature)
+	assert.Equal(t, "gpt-4o-mini", record.Model)
+	assert.Equal(t, int64(2000), record.InputTokens)
+	assert.Equal(t, int64(500), record.OutputTokens)
+	assert.InDelta(t, 0.0006, record.Cost, 1e-12)
+	assert.False(t, record.Estimated)
+
+	assert.Equal(t, []tokenUsageObservation{{"gpt-4o-mini", llm.FeatureMention, 2000, 500, record.Cost}}, llmMetrics.observations)
+}
+
+func TestUsageAccountingEstimatedUsage(t *testing.T) {
+	accounting, store, llmMetrics := newTestUsageAccountingModel(&scriptedModel{chunks: []string{"Hello"}}, nil)
+
+	text, err := accounting.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{
+		Posts: []llm.Post{{Role: llm.PostRoleUser, Message: "Hi there"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", text)
+
+	// scriptedModel counts one token per character, without prices nothing is charged
+	require.Len(t, store.records, 1)
+	record := store.records[0]
+	assert.Equal(t, llm.FeatureOther, record.Feature)
+	assert.Equal(t, "gpt-4o", record.Model)
+	assert.Equal(t, int64(8), record.InputTokens)
+	assert.Equal(t, int64(5), record.OutputTokens)
+	assert.Zero(t, record.Cost)
+	assert.True(t, record.Estimated)
+	assert.Len(t, llmMetrics.observations, 1)
+}
+
+func TestUsageAccountingFailedRequest(t *testing.T) {
+	accounting, store, llmMetrics := newTestUsageAccountingModel(&scriptedModel{err: errors.New("bad request")}, nil)
+
+	_, err := accounting.ChatCompletionNoStream(context.Background(), llm.CompletionRequest{
+		Posts: []llm.Post{{Role: llm.PostRoleUser, Message: "Hi"}},
+	})
+	assert.Error(t, err)
+	assert.Empty(t, store.records)
+	assert.Empty(t, llmMetrics.observations)
+}
+
+func TestPriceForModel(t *testing.T) {
+	prices := []ModelPrice{
+		{Model: "claude-3", InputPerMillion: 1},
+		{Model: "claude-3-5-sonnet", InputPerMillion: 3},
+		{Model: "claude-3-5-sonnet-latest", InputPerMillion: 4},
+	}
+	assert.Equal(t, 4.0, priceForModel(prices, "claude-3-5-sonnet-latest").InputPerMillion)
+	assert.Equal(t, 3.0, priceForModel(prices, "claude-3-5-sonnet-20241022").InputPerMillion)
+	assert.Equal(t, 1.0, priceForModel(prices, "claude-3-opus-20240229").InputPerMillion)
+	assert.Equal(t, ModelPrice{}, priceForModel(prices, "gpt-4o"))
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+type ScopeUsage struct {
+	ScopeID string `json:"id" db:"ScopeID"`
+	Usage
+}
+
+func (p *Plugin) getUsage(scope UsageScope, periodPrefix string) (Usage, error) {
+	var usage []Usage
+	if err := p.doQuery(&usage, p.builder.
+		Select(
+			"COALESCE(SUM(Requests), 0) AS Requests",
+			"COALESCE(SUM(InputTokens), 0) AS InputTokens",
+			"COALESCE(SUM(OutputTokens), 0) AS OutputTokens",
+		).
+		From("LLM_Usage").
+		Where(sq.Eq{"ScopeType": scope.Type, "ScopeID": scope.ID}).
+		Where(sq.Like{"Period": periodPrefix + "%"}),
+	); err != nil {
+		return Usage{}, fmt.Errorf("failed to get usage: %w", err)
+	}
+	if len(usage) == 0 {
+		return Usage{}, nil
+	}
+	return usage[0], nil
+}
+
+func (p *Plugin) addUsage(scope UsageScope, period string, usage Usage) error {
+	result, err := p.execBuilder(p.builder.Insert("LLM_Usage").
+		Columns("ScopeType", "ScopeID", "Period", "Requests", "InputTokens", "OutputTokens").
+		Values(scope.Type, scope.ID, period, usage.Requests, usage.InputTokens, usage.OutputTokens).
+		Suffix("ON DUPLICATE KEY UPDATE Requests = Requests + ?, InputTokens = InputTokens + ?, OutputTokens = OutputTokens + ?",
+			usage.Requests, usage.InputTokens, usage.OutputTokens))
+	if err != nil {
+		return fmt.Errorf("failed to add usage: %w", err)
+	}
+
+	if rows, rowsErr := result.RowsAffected(); rowsErr == nil && rows == 1 {
+		return p.deleteOldMinuteUsage(scope, period)
+	}
+
+	return nil
+}
+
+// reserveRequest counts a request in the period unless it already has limit requests. The check and the count
+// are one statement so concurrent requests can't all pass the check.
+func (p *Plugin) reserveRequest(scope UsageScope, period string, limit int64) (bool, error) {
+	result, err := p.execBuilder(p.builder.Insert("LLM_Usage").
+		Columns("ScopeType", "ScopeID", "Period", "Requests", "InputTokens", "OutputTokens").
+		Values(scope.Type, scope.ID, period, 1, 0, 0).
+		Suffix("ON DUPLICATE KEY UPDATE Requests = IF(Requests < ?, Requests + 1, Requests)", limit))
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve request: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve request: %w", err)
+	}
+
+	// A new row counts as one affected row, an updated one as two and a row left unchanged at the limit as none
+	switch rows {
+	case 0:
+		return false, nil
+	case 1:
+		if err := p.deleteOldMinuteUsage(scope, period); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// deleteOldMinuteUsage drops the minute rows before period. Minute rows are only needed for the current minute,
+// the previous ones are dropped when a new one starts.
+func (p *Plugin) deleteOldMinuteUsage(scope UsageScope, period string) error {
+	if !strings.HasPrefix(period, "minute:") {
+		return nil
+	}
+	if _, err := p.execBuilder(p.builder.Delete("LLM_Usage").
+		Where(sq.Eq{"ScopeType": scope.Type, "ScopeID": scope.ID}).
+		Where(sq.Like{"Period": "minute:%"}).
+		Where(sq.NotEq{"Period": period}),
+	); err != nil {
+		return fmt.Errorf("failed to delete old usage: %w", err)
+	}
+	return nil
+}
+
+// listUsage sums the usage of every user, team or bot over the periods starting with the prefix, highest first
+func (p *Plugin) listUsage(scopeType string, periodPrefix string) ([]ScopeUsage, error) {
+	usage := []ScopeUsage{}
+	if err := p.doQuery(&usage, p.builder.
+		Select(
+			"ScopeID",
+			"SUM(Requests) AS Requests",
+			"SUM(InputTokens) AS InputTokens",
+			"SUM(OutputTokens) AS OutputTokens",
+		).
+		From("LLM_Usage").
+		Where(sq.Eq{"ScopeType": scopeType}).
+		Where(sq.Like{"Period": periodPrefix + "%"}).
+		GroupBy("ScopeID").
+		OrderBy("SUM(InputTokens) + SUM(OutputTokens) DESC").
+		Limit(100),
+	); err != nil {
+		return nil, fmt.Errorf("failed to list usage: %w", err)
+	}
+	return usage, nil
+}
+
+// resetUsage deletes the recorded usage of a user, team or bot
+func (p *Plugin) resetUsage(scope UsageScope) error {
+	if _, err := p.execBuilder(p.builder.Delete("LLM_Usage").
+		Where(sq.Eq{"ScopeType": scope.Type, "ScopeID": scope.ID}),
+	); err != nil {
+		return fmt.Errorf("failed to reset usage: %w", err)
+	}
+	return nil
+}
+
+func (p *Plugin) saveUsageRecord(record UsageRecord) error {
+	if _, err := p.execBuilder(p.builder.Insert("LLM_UsageRecords").
+		Columns("ID", "CreateAt", "BotName", "UserID", "TeamID", "ChannelID", "Feature", "Model", "InputTokens", "OutputTokens", "Cost", "Estimated").
+		Values(record.ID, record.CreateAt, record.BotName, record.UserID, record.TeamID, record.ChannelID, record.Feature, record.Model,
+			record.InputTokens, record.OutputTokens, record.Cost, record.Estimated),
+	); err != nil {
+		return fmt.Errorf("failed to save usage record: %w", err)
+	}
+	return nil
+}
+
+// usageReportColumns are the columns a usage report can be grouped by
+var usageReportColumns = map[string]string{
+	"bot":     "BotName",
+	"user":    "UserID",
+	"team":    "TeamID",
+	"channel": "ChannelID",
+	"feature": "Feature",
+	"model":   "Model",
+}
+
+type UsageReportRow struct {
+	Key          string  `json:"key" db:"GroupKey"`
+	Requests     int64   `json:"requests" db:"Requests"`
+	InputTokens  int64   `json:"inputTokens" db:"InputTokens"`
+	OutputTokens int64   `json:"outputTokens" db:"OutputTokens"`
+	Cost         float64 `json:"cost" db:"Cost"`
+}
+
+// getUsageReport sums the usage records created in [since, until) grouped by one of usageReportColumns, costliest first
+func (p *Plugin) getUsageReport(groupBy string, since, until int64) ([]UsageReportRow, error) {
+	column, ok := usageReportColumns[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("invalid usage report grouping %q", groupBy)
+	}
+
+	rows := []UsageReportRow{}
+	if err := p.doQuery(&rows, p.builder.
+		Select(
+			column+" AS GroupKey",
+			"COUNT(*) AS Requests",
+			"SUM(InputTokens) AS InputTokens",
+			"SUM(OutputTokens) AS OutputTokens",
+			"SUM(Cost) AS Cost",
+		).
+		From("LLM_UsageRecords").
+		Where(sq.GtOrEq{"CreateAt": since}).
+		Where(sq.Lt{"CreateAt": until}).
+		GroupBy(column).
+		OrderBy("SUM(Cost) DESC", "SUM(InputTokens) + SUM(OutputTokens) DESC"),
+	); err != nil {
+		return nil, fmt.Errorf("failed to get usage report: %w", err)
+	}
+	return rows, nil
+}
@@ -127,6 +127,24 @@ export async function doRegenerate(postid: string) {
     });
 }
 
+export async function doToolApproval(postid: string, approved: boolean) {
+    const url = `${postRoute(postid)}/tool_approval`;
+    const response = await fetch(url, Client4.getOptions({
+        method: 'POST',
+        body: JSON.stringify({approved}),
+    }));
+
+    if (response.ok) {
+        return;
+    }
+
+    throw new ClientError(Client4.url, {
+        message: '',
+        status_code: response.status,
+        url,
+    });
+}
+
 export async function doPostbackSummary(postid: string) {
     const url = `${postRoute(postid)}/postback_summary`;
     const response = await fetch(url, Client4.getOptions({
@@ -319,6 +337,23 @@ export async function doReindexPosts() {
     });
 }
 
+export async function getRelatedThreads(postid: string, limit?: number) {
+    const url = `${postRoute(postid)}/related${limit ? `?limit=${limit}` : ''}`;
+    const response = await fetch(url, Client4.getOptions({
+        method: 'GET',
+    }));
+
+    if (response.ok) {
+        return response.json();
+    }
+
+    throw new ClientError(Client4.url, {
+        message: '',
+        status_code: response.status,
+        url,
+    });
+}
+
 export async function getReindexStatus() {
     const url = `${baseRoute()}/admin/reindex/status`;
     const response = await fetch(url, Client4.getOptions({
@@ -352,6 +387,41 @@ export async function cancelReindex() {
         url,
     });
 }
+export async function doPullOllamaModel(bot: string) {
+    const url = `${baseRoute()}/admin/ollama/pull`;
+    const response = await fetch(url, Client4.getOptions({
+        method: 'POST',
+        body: JSON.stringify({bot}),
+    }));
+
+    if (response.ok) {
+        return response.json();
+    }
+
+    throw new ClientError(Client4.url, {
+        message: '',
+        status_code: response.status,
+        url,
+    });
+}
+
+export async function getOllamaPullStatus(bot: string) {
+    const url = `${baseRoute()}/admin/ollama/pull/status?bot=${encodeURIComponent(bot)}`;
+    const response = await fetch(url, Client4.getOptions({
+        method: 'GET',
+    }));
+
+    if (response.ok) {
+        return response.json();
+    }
+
+    throw new ClientError(Client4.url, {
+        message: '',
+        status_code: response.status,
+        url,
+    });
+}
+
 export async function getChannelInterval(
     channelID: string,
     startTime: number,
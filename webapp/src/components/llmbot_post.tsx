@@ -9,9 +9,9 @@ import styled from 'styled-components';
 import {WebSocketMessage} from '@mattermost/client';
 import {GlobalState} from '@mattermost/types/store';
 
-import {SendIcon} from '@mattermost/compass-icons/components';
+import {ChevronDownIcon, ChevronUpIcon, SendIcon} from '@mattermost/compass-icons/components';
 
-import {doPostbackSummary, doRegenerate, doStopGenerating} from '@/client';
+import {doPostbackSummary, doRegenerate, doStopGenerating, doToolApproval} from '@/client';
 
 import {useSelectNotAIPost} from '@/hooks';
 
@@ -24,6 +24,8 @@ import IconRegenerate from './assets/icon_regenerate';
 import IconCancel from './assets/icon_cancel';
 
 const SearchResultsPropKey = 'search_results';
+const ReasoningPropKey = 'reasoning';
+const ToolApprovalPropKey = 'pending_tool_calls';
 
 const PostBody = styled.div`
 `;
@@ -92,10 +94,176 @@ const PostSummaryHelpMessage = styled.div`
 	margin-top: 16px;
 `;
 
+const ToolActivity = styled.div`
+	font-size: 12px;
+	font-style: italic;
+	line-height: 16px;
+	color: rgba(var(--center-channel-color-rgb), 0.64);
+	margin-top: 4px;
+`;
+
+const ReasoningContainer = styled.div`
+	margin-bottom: 8px;
+`;
+
+const ReasoningToggle = styled.button`
+	display: flex;
+	align-items: center;
+	gap: 4px;
+	border: none;
+	background: none;
+	padding: 0;
+	font-size: 12px;
+	font-weight: 600;
+	line-height: 16px;
+	color: rgba(var(--center-channel-color-rgb), 0.64);
+
+	:hover {
+		color: rgba(var(--center-channel-color-rgb), 0.72);
+	}
+
+	svg {
+		width: 16px;
+		height: 16px;
+	}
+`;
+
+const ReasoningText = styled.div`
+	margin-top: 4px;
+	padding-left: 12px;
+	border-left: 2px solid rgba(var(--center-channel-color-rgb), 0.16);
+	font-size: 13px;
+	line-height: 18px;
+	white-space: pre-wrap;
+	color: rgba(var(--center-channel-color-rgb), 0.72);
+`;
+
+const ToolApprovalContainer = styled.div`
+	margin-top: 8px;
+	padding: 8px 12px;
+	border: 1px solid rgba(var(--center-channel-color-rgb), 0.16);
+	border-radius: 4px;
+`;
+
+const ToolApprovalTitle = styled.div`
+	font-size: 14px;
+	font-weight: 600;
+	line-height: 20px;
+`;
+
+const ToolApprovalCall = styled.div`
+	margin-top: 4px;
+	font-size: 12px;
+	line-height: 16px;
+	color: rgba(var(--center-channel-color-rgb), 0.72);
+
+	code {
+		white-space: pre-wrap;
+		word-break: break-all;
+	}
+`;
+
+type ToolApprovalCallData = {
+    name: string
+    arguments: string
+}
+
+type ToolApprovalProps = {
+    calls: ToolApprovalCallData[]
+    canDecide: boolean
+    onDecide: (approved: boolean) => void
+}
+
+// ToolApproval asks the requester to approve the tools with side effects the bot wants to use
+const ToolApproval = (props: ToolApprovalProps) => {
+    return (
+        <ToolApprovalContainer
+            data-testid='llm-bot-tool-approval'
+        >
+            <ToolApprovalTitle>
+                <FormattedMessage defaultMessage='The bot wants to use these tools:'/>
+            </ToolApprovalTitle>
+            {props.calls.map((call, i) => (
+                <ToolApprovalCall key={i}>
+                    <strong>{call.name}</strong>{' '}<code>{call.arguments}</code>
+                </ToolApprovalCall>
+            ))}
+            {props.canDecide ? (
+                <ControlsBar>
+                    <PostSummaryButton
+                        data-testid='tool-approval-approve'
+                        onClick={() => props.onDecide(true)}
+                    >
+                        <FormattedMessage defaultMessage='Approve'/>
+                    </PostSummaryButton>
+                    <GenerationButton
+                        data-testid='tool-approval-deny'
+                        onClick={() => props.onDecide(false)}
+                    >
+                        <FormattedMessage defaultMessage='Deny'/>
+                    </GenerationButton>
+                </ControlsBar>
+            ) : (
+                <ToolActivity>
+                    <FormattedMessage defaultMessage='Waiting for approval from the requester'/>
+                </ToolActivity>
+            )}
+        </ToolApprovalContainer>
+    );
+};
+
+function parseToolApprovalCalls(post: any): ToolApprovalCallData[] {
+    const calls = post.props?.[ToolApprovalPropKey];
+    if (!calls) {
+        return [];
+    }
+    try {
+        return JSON.parse(calls) ?? [];
+    } catch (e) {
+        return [];
+    }
+}
+
+type ReasoningProps = {
+    reasoning: string
+    thinking: boolean
+}
+
+// Reasoning is the collapsible reasoning of thinking models, collapsed unless the user opens it
+const Reasoning = (props: ReasoningProps) => {
+    const [open, setOpen] = useState(false);
+
+    return (
+        <ReasoningContainer>
+            <ReasoningToggle
+                data-testid='llm-bot-reasoning-toggle'
+                aria-expanded={open}
+                onClick={() => setOpen((o) => !o)}
+            >
+                {open ? <ChevronUpIcon/> : <ChevronDownIcon/>}
+                {props.thinking ? (
+                    <FormattedMessage defaultMessage='Thinking...'/>
+                ) : (
+                    <FormattedMessage defaultMessage='Thinking'/>
+                )}
+            </ReasoningToggle>
+            {open && (
+                <ReasoningText
+                    data-testid='llm-bot-reasoning'
+                >
+                    {props.reasoning}
+                </ReasoningText>
+            )}
+        </ReasoningContainer>
+    );
+};
+
 export interface PostUpdateWebsocketMessage {
     next: string
     post_id: string
     control?: string
+    tool_activity?: string
+    reasoning?: string
 }
 
 interface Props {
@@ -111,6 +279,12 @@ export const LLMBotPost = (props: Props) => {
     // Generating is true while we are reciving new content from the websocket
     const [generating, setGenerating] = useState(false);
 
+    // What the bot is doing while it waits for a tool, shown under the message while generating
+    const [toolActivity, setToolActivity] = useState('');
+
+    // The reasoning of thinking models, only sent when the bot shares it
+    const [reasoning, setReasoning] = useState<string>(props.post.props?.[ReasoningPropKey] ?? '');
+
     // Stopped is a flag that is used to prevent the websocket from updating the message after the user has stopped the generation
     // Needs a ref because of the useEffect closure.
     const [stopped, setStopped] = useState(false);
@@ -127,12 +301,20 @@ export const LLMBotPost = (props: Props) => {
             if (!data.control && !stoppedRef.current) {
                 setGenerating(true);
                 setMessage(data.next);
+            } else if (data.control === 'tool' && !stoppedRef.current) {
+                setToolActivity(data.tool_activity || '');
+            } else if (data.control === 'reasoning' && !stoppedRef.current) {
+                setGenerating(true);
+                setReasoning(data.reasoning || '');
             } else if (data.control === 'end') {
                 setGenerating(false);
                 setStopped(false);
+                setToolActivity('');
             } else if (data.control === 'start') {
                 setGenerating(true);
                 setStopped(false);
+                setToolActivity('');
+                setReasoning('');
             }
         });
         return () => {
@@ -144,6 +326,7 @@ export const LLMBotPost = (props: Props) => {
         setGenerating(true);
         setStopped(false);
         setMessage('');
+        setReasoning('');
         doRegenerate(props.post.id);
     };
 
@@ -153,6 +336,12 @@ export const LLMBotPost = (props: Props) => {
         doStopGenerating(props.post.id);
     };
 
+    const decideToolApproval = (approved: boolean) => {
+        setGenerating(true);
+        setStopped(false);
+        doToolApproval(props.post.id, approved);
+    };
+
     const postSummary = async () => {
         const result = await doPostbackSummary(props.post.id);
         selectPost(result.rootid, result.channelid);
@@ -176,6 +365,9 @@ export const LLMBotPost = (props: Props) => {
         }
     }
 
+    const toolApprovalCalls = parseToolApprovalCalls(props.post);
+    const showToolApproval = !generating && toolApprovalCalls.length > 0;
+
     const showRegenerate = !generating && requesterIsCurrentUser && !isNoShowRegen;
     const showPostbackButton = !generating && requesterIsCurrentUser && isTranscriptionResult;
     const showStopGeneratingButton = generating && requesterIsCurrentUser;
@@ -190,12 +382,32 @@ export const LLMBotPost = (props: Props) => {
                 {permalinkView}
             </>
             }
+            {reasoning !== '' && (
+                <Reasoning
+                    reasoning={reasoning}
+                    thinking={generating && message === ''}
+                />
+            )}
             <PostText
                 message={message}
                 channelID={props.post.channel_id}
                 postID={props.post.id}
                 showCursor={generating}
             />
+            {showToolApproval && (
+                <ToolApproval
+                    calls={toolApprovalCalls}
+                    canDecide={requesterIsCurrentUser}
+                    onDecide={decideToolApproval}
+                />
+            )}
+            {generating && toolActivity !== '' && (
+                <ToolActivity
+                    data-testid='llm-bot-tool-activity'
+                >
+                    {toolActivity}
+                </ToolActivity>
+            )}
             {props.post.props?.[SearchResultsPropKey] && (
                 <SearchSources
                     sources={JSON.parse(props.post.props[SearchResultsPropKey])}
@@ -101,7 +101,7 @@ interface Source {
     channelId: string;
     userId: string;
     content: string;
-    score: number;
+    score?: number;
 }
 
 interface SourceItemProps {
@@ -113,10 +113,12 @@ const SearchSource = ({source, index}: SourceItemProps & {index: number}) => {
         <SourceItem>
             <SourceHeader>
                 <SourceNumber>{index + 1}{'.'}</SourceNumber>
-                <RelevanceScore>
-                    <ScoreIcon className='icon icon-check-circle'/>
-                    {formatScore(source.score)}
-                </RelevanceScore>
+                {source.score !== undefined && (
+                    <RelevanceScore>
+                        <ScoreIcon className='icon icon-check-circle'/>
+                        {formatScore(source.score)}
+                    </RelevanceScore>
+                )}
             </SourceHeader>
             <PostPreview
                 postId={source.postId}
@@ -5,16 +5,17 @@ import React, {useState} from 'react';
 import styled from 'styled-components';
 import {FormattedMessage, useIntl} from 'react-intl';
 
-import {TrashCanOutlineIcon, ChevronDownIcon, AlertOutlineIcon, ChevronUpIcon} from '@mattermost/compass-icons/components';
+import {TrashCanOutlineIcon, ChevronDownIcon, AlertOutlineIcon, ChevronUpIcon, PlusIcon} from '@mattermost/compass-icons/components';
 
 import IconAI from '../assets/icon_ai';
 import {DangerPill, Pill} from '../pill';
 
-import {ButtonIcon} from '../assets/buttons';
+import {ButtonIcon, TertiaryButton} from '../assets/buttons';
 
-import {BooleanItem, ItemList, SelectionItem, SelectionItemOption, TextItem} from './item';
+import {BooleanItem, ItemLabel, ItemList, SelectionItem, SelectionItemOption, TextItem} from './item';
 import AvatarItem from './avatar';
 import {ChannelAccessLevelItem, UserAccessLevelItem} from './llm_access';
+import OllamaPullItem from './ollama_pull';
 
 export type LLMService = {
     type: string
@@ -26,6 +27,9 @@ export type LLMService = {
     streamingTimeoutSeconds: number
     sendUserId: boolean
     outputTokenLimit: number
+    keepAlive?: string
+    maxRetries?: number
+    retryBackoffMilliseconds?: number
 }
 
 export enum ChannelAccessLevel {
@@ -55,6 +59,33 @@ export type LLMBotConfig = {
     userAccessLevel: UserAccessLevel
     userIDs: string[]
     teamIDs: string[]
+    fallbackServices?: LLMService[]
+    modelParameters?: ModelParameters
+    showReasoning?: boolean
+    toolPolicy?: ToolPolicy
+}
+
+export type ToolPolicy = {
+    directMessages?: string[]
+    publicChannels?: string[]
+    privateChannels?: string[]
+    groupMessages?: string[]
+    rules?: ToolRule[]
+}
+
+export type ToolRule = {
+    tool: string
+    userIDs?: string[]
+    teamIDs?: string[]
+}
+
+export type ModelParameters = {
+    temperature?: number
+    topP?: number
+    stopSequences?: string[]
+    seed?: number
+    reasoningEffort?: string
+    thinkingBudget?: number
 }
 
 type Props = {
@@ -69,6 +100,8 @@ const mapServiceTypeToDisplayName = new Map<string, string>([
     ['openaicompatible', 'OpenAI Compatible'],
     ['azure', 'Azure'],
     ['anthropic', 'Anthropic'],
+    ['ollama', 'Ollama'],
+    ['gemini', 'Google Gemini'],
 ]);
 
 function serviceTypeToDisplayName(serviceType: string): string {
@@ -81,8 +114,8 @@ const Bot = (props: Props) => {
     const missingInfo = props.bot.name === '' ||
 		props.bot.displayName === '' ||
 		props.bot.service.type === '' ||
-		(props.bot.service.type !== 'openaicompatible' && props.bot.service.type !== 'azure' && props.bot.service.apiKey === '') ||
-		((props.bot.service.type === 'openaicompatible' || props.bot.service.type === 'azure') && props.bot.service.apiURL === '');
+		(props.bot.service.type !== 'openaicompatible' && props.bot.service.type !== 'azure' && props.bot.service.type !== 'ollama' && props.bot.service.apiKey === '') ||
+		((props.bot.service.type === 'openaicompatible' || props.bot.service.type === 'azure' || props.bot.service.type === 'ollama') && props.bot.service.apiURL === '');
 
     const invalidUsername = props.bot.name !== '' && (!(/^[a-z0-9.\-_]+$/).test(props.bot.name) || !(/[a-z]/).test(props.bot.name.charAt(0)));
     const invalidMaxTokens = props.bot.service.type === 'anthropic' && props.bot.service?.outputTokenLimit === 0;
@@ -145,20 +178,27 @@ const Bot = (props: Props) => {
                             botusername={props.bot.name}
                             changedAvatar={props.changedAvatar}
                         />
-                        <SelectionItem
+                        <ServiceTypeItem
                             label={intl.formatMessage({defaultMessage: 'Service'})}
                             value={props.bot.service.type}
-                            onChange={(e) => props.onChange({...props.bot, service: {...props.bot.service, type: e.target.value}})}
-                        >
-                            <SelectionItemOption value='openai'>{'OpenAI'}</SelectionItemOption>
-                            <SelectionItemOption value='openaicompatible'>{'OpenAI Compatible'}</SelectionItemOption>
-                            <SelectionItemOption value='azure'>{'Azure'}</SelectionItemOption>
-                            <SelectionItemOption value='anthropic'>{'Anthropic'}</SelectionItemOption>
-                        </SelectionItem>
+                            onChange={(type) => props.onChange({...props.bot, service: {...props.bot.service, type}})}
+                        />
                         <ServiceItem
                             service={props.bot.service}
                             onChange={(service) => props.onChange({...props.bot, service})}
                         />
+                        {props.bot.service.type === 'ollama' && (
+                            <OllamaPullItem botName={props.bot.name}/>
+                        )}
+                        <FallbackServicesItem
+                            services={props.bot.fallbackServices ?? []}
+                            onChange={(fallbackServices) => props.onChange({...props.bot, fallbackServices})}
+                        />
+                        <ModelParametersItem
+                            serviceType={props.bot.service.type}
+                            parameters={props.bot.modelParameters ?? {}}
+                            onChange={(modelParameters) => props.onChange({...props.bot, modelParameters})}
+                        />
                         <TextItem
                             label={intl.formatMessage({defaultMessage: 'Custom instructions'})}
                             placeholder={intl.formatMessage({defaultMessage: 'How would you like the AI to respond?'})}
@@ -166,7 +206,7 @@ const Bot = (props: Props) => {
                             value={props.bot.customInstructions}
                             onChange={(e) => props.onChange({...props.bot, customInstructions: e.target.value})}
                         />
-                        {(props.bot.service.type === 'openai' || props.bot.service.type === 'openaicompatible' || props.bot.service.type === 'azure' || props.bot.service.type === 'anthropic') && (
+                        {(props.bot.service.type === 'openai' || props.bot.service.type === 'openaicompatible' || props.bot.service.type === 'azure' || props.bot.service.type === 'anthropic' || props.bot.service.type === 'ollama' || props.bot.service.type === 'gemini') && (
                             <>
                                 <BooleanItem
                                     label={
@@ -187,6 +227,20 @@ const Bot = (props: Props) => {
                                     onChange={(to: boolean) => props.onChange({...props.bot, disableTools: !to})}
                                     helpText={intl.formatMessage({defaultMessage: 'By default some tool use is enabled to allow for features such as integrations with JIRA. Disabling this allows use of models that do not support or are not very good at tool use. Some features will not work without tools.'})}
                                 />
+                                {!props.bot.disableTools && (
+                                    <ToolPolicyItem
+                                        policy={props.bot.toolPolicy ?? {}}
+                                        onChange={(toolPolicy) => props.onChange({...props.bot, toolPolicy})}
+                                    />
+                                )}
+                                <BooleanItem
+                                    label={
+                                        <FormattedMessage defaultMessage='Show Reasoning'/>
+                                    }
+                                    value={props.bot.showReasoning ?? false}
+                                    onChange={(to: boolean) => props.onChange({...props.bot, showReasoning: to})}
+                                    helpText={intl.formatMessage({defaultMessage: 'Show the reasoning of thinking models in a collapsible section above responses. When disabled the reasoning is kept private and discarded.'})}
+                                />
                             </>
                         )}
                         <ChannelAccessLevelItem
@@ -219,6 +273,258 @@ const Horizontal = styled.div`
 	gap: 8px;
 `;
 
+type ServiceTypeItemProps = {
+    label: string
+    value: string
+    onChange: (type: string) => void
+}
+
+const ServiceTypeItem = (props: ServiceTypeItemProps) => {
+    return (
+        <SelectionItem
+            label={props.label}
+            value={props.value}
+            onChange={(e) => props.onChange(e.target.value)}
+        >
+            {Array.from(mapServiceTypeToDisplayName.entries()).map(([type, displayName]) => (
+                <SelectionItemOption
+                    key={type}
+                    value={type}
+                >
+                    {displayName}
+                </SelectionItemOption>
+            ))}
+        </SelectionItem>
+    );
+};
+
+type FallbackServicesItemProps = {
+    services: LLMService[]
+    onChange: (services: LLMService[]) => void
+}
+
+const newFallbackService: LLMService = {
+    type: 'openai',
+    apiURL: '',
+    apiKey: '',
+    orgId: '',
+    defaultModel: '',
+    tokenLimit: 0,
+    streamingTimeoutSeconds: 0,
+    sendUserId: false,
+    outputTokenLimit: 0,
+};
+
+// FallbackServicesItem edits the services tried in order when the bot's service is unavailable
+const FallbackServicesItem = (props: FallbackServicesItemProps) => {
+    const intl = useIntl();
+
+    const update = (index: number, service: LLMService) => {
+        props.onChange(props.services.map((s, i) => (i === index ? service : s)));
+    };
+
+    return (
+        <>
+            {props.services.map((service, index) => (
+                // eslint-disable-next-line react/no-array-index-key
+                <React.Fragment key={index}>
+                    <ServiceTypeItem
+                        label={intl.formatMessage({defaultMessage: 'Fallback service {number}'}, {number: index + 1})}
+                        value={service.type}
+                        onChange={(type) => update(index, {...service, type})}
+                    />
+                    <ServiceItem
+                        service={service}
+                        onChange={(changed) => update(index, changed)}
+                    />
+                    <ItemLabel/>
+                    <div>
+                        <TertiaryButton
+                            onClick={(e) => {
+                                e.preventDefault();
+                                props.onChange(props.services.filter((_, i) => i !== index));
+                            }}
+                        >
+                            <FormattedMessage defaultMessage='Remove fallback service'/>
+                        </TertiaryButton>
+                    </div>
+                </React.Fragment>
+            ))}
+            <ItemLabel/>
+            <div>
+                <TertiaryButton
+                    onClick={(e) => {
+                        e.preventDefault();
+                        props.onChange([...props.services, {...newFallbackService}]);
+                    }}
+                >
+                    <PlusFallbackIcon/>
+                    <FormattedMessage defaultMessage='Add fallback service'/>
+                </TertiaryButton>
+            </div>
+        </>
+    );
+};
+
+const PlusFallbackIcon = styled(PlusIcon)`
+	width: 18px;
+	height: 18px;
+	margin-right: 8px;
+`;
+
+type ToolPolicyItemProps = {
+    policy: ToolPolicy
+    onChange: (policy: ToolPolicy) => void
+}
+
+// parseToolList keeps an empty list unset so the default tools of the channel type apply
+const parseToolList = (value: string) => {
+    if (value.trim() === '') {
+        return undefined;
+    }
+    return value.split('\n').map((tool) => tool.trim());
+};
+
+// ToolPolicyItem edits the tools the bot can use in each type of channel
+const ToolPolicyItem = (props: ToolPolicyItemProps) => {
+    const intl = useIntl();
+    const placeholder = intl.formatMessage({defaultMessage: 'Default tools'});
+    const helptext = intl.formatMessage({defaultMessage: 'One tool name per line, or * for every tool available there. Tools only available in direct messages can\'t be added to channels. Leave empty for the default tools.'});
+
+    return (
+        <>
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Tools in direct messages'})}
+                multiline={true}
+                placeholder={placeholder}
+                value={(props.policy.directMessages ?? []).join('\n')}
+                onChange={(e) => props.onChange({...props.policy, directMessages: parseToolList(e.target.value)})}
+                helptext={helptext}
+            />
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Tools in public channels'})}
+                multiline={true}
+                placeholder={placeholder}
+                value={(props.policy.publicChannels ?? []).join('\n')}
+                onChange={(e) => props.onChange({...props.policy, publicChannels: parseToolList(e.target.value)})}
+                helptext={helptext}
+            />
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Tools in private channels'})}
+                multiline={true}
+                placeholder={placeholder}
+                value={(props.policy.privateChannels ?? []).join('\n')}
+                onChange={(e) => props.onChange({...props.policy, privateChannels: parseToolList(e.target.value)})}
+                helptext={helptext}
+            />
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Tools in group messages'})}
+                multiline={true}
+                placeholder={placeholder}
+                value={(props.policy.groupMessages ?? []).join('\n')}
+                onChange={(e) => props.onChange({...props.policy, groupMessages: parseToolList(e.target.value)})}
+                helptext={helptext}
+            />
+        </>
+    );
+};
+
+type ModelParametersItemProps = {
+    serviceType: string
+    parameters: ModelParameters
+    onChange: (parameters: ModelParameters) => void
+}
+
+// parseOptionalNumber leaves a parameter unset, and so at the service's default, when its input is cleared
+const parseOptionalNumber = (value: string, parse: (value: string) => number) => {
+    const parsed = parse(value);
+    return isNaN(parsed) ? undefined : parsed;
+};
+
+// ModelParametersItem edits the sampling and reasoning parameters sent with every request of the bot
+const ModelParametersItem = (props: ModelParametersItemProps) => {
+    const intl = useIntl();
+    const supportsSeed = props.serviceType !== 'anthropic';
+    const supportsThinkingBudget = props.serviceType === 'anthropic' || props.serviceType === 'gemini';
+
+    return (
+        <>
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Temperature'})}
+                type='number'
+                step='0.1'
+                min='0'
+                max={props.serviceType === 'anthropic' ? '1' : '2'}
+                placeholder={intl.formatMessage({defaultMessage: 'Service default'})}
+                value={props.parameters.temperature?.toString() ?? ''}
+                onChange={(e) => props.onChange({...props.parameters, temperature: parseOptionalNumber(e.target.value, parseFloat)})}
+                helptext={intl.formatMessage({defaultMessage: 'Lower values make responses more focused and deterministic. Summaries always use a low temperature.'})}
+            />
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Top P'})}
+                type='number'
+                step='0.05'
+                min='0'
+                max='1'
+                placeholder={intl.formatMessage({defaultMessage: 'Service default'})}
+                value={props.parameters.topP?.toString() ?? ''}
+                onChange={(e) => props.onChange({...props.parameters, topP: parseOptionalNumber(e.target.value, parseFloat)})}
+            />
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Stop sequences'})}
+                multiline={true}
+                placeholder={intl.formatMessage({defaultMessage: 'One sequence per line'})}
+                value={(props.parameters.stopSequences ?? []).join('\n')}
+                onChange={(e) => {
+                    const stopSequences = e.target.value.split('\n').filter((sequence) => sequence !== '');
+                    props.onChange({...props.parameters, stopSequences});
+                }}
+                helptext={intl.formatMessage({defaultMessage: 'The response ends when the model generates one of these sequences.'})}
+            />
+            {supportsSeed && (
+                <TextItem
+                    label={intl.formatMessage({defaultMessage: 'Seed'})}
+                    type='number'
+                    placeholder={intl.formatMessage({defaultMessage: 'Random'})}
+                    value={props.parameters.seed?.toString() ?? ''}
+                    onChange={(e) => props.onChange({...props.parameters, seed: parseOptionalNumber(e.target.value, (value) => parseInt(value, 10))})}
+                    helptext={intl.formatMessage({defaultMessage: 'Makes sampling repeatable on a best effort basis.'})}
+                />
+            )}
+            <SelectionItem
+                label={intl.formatMessage({defaultMessage: 'Reasoning effort'})}
+                value={props.parameters.reasoningEffort ?? ''}
+                onChange={(e) => props.onChange({...props.parameters, reasoningEffort: e.target.value || undefined})}
+                helptext={intl.formatMessage({defaultMessage: 'How much reasoning models think before they respond. Ignored by models that do not reason.'})}
+            >
+                <SelectionItemOption value=''>
+                    {intl.formatMessage({defaultMessage: 'Model default'})}
+                </SelectionItemOption>
+                <SelectionItemOption value='low'>
+                    {intl.formatMessage({defaultMessage: 'Low'})}
+                </SelectionItemOption>
+                <SelectionItemOption value='medium'>
+                    {intl.formatMessage({defaultMessage: 'Medium'})}
+                </SelectionItemOption>
+                <SelectionItemOption value='high'>
+                    {intl.formatMessage({defaultMessage: 'High'})}
+                </SelectionItemOption>
+            </SelectionItem>
+            {supportsThinkingBudget && (
+                <TextItem
+                    label={intl.formatMessage({defaultMessage: 'Thinking budget'})}
+                    type='number'
+                    min={props.serviceType === 'anthropic' ? '1024' : '0'}
+                    placeholder={intl.formatMessage({defaultMessage: 'From reasoning effort'})}
+                    value={props.parameters.thinkingBudget?.toString() ?? ''}
+                    onChange={(e) => props.onChange({...props.parameters, thinkingBudget: parseOptionalNumber(e.target.value, (value) => parseInt(value, 10))})}
+                    helptext={props.serviceType === 'anthropic' ? intl.formatMessage({defaultMessage: 'Tokens the model can use for extended thinking, at least 1024. Temperature and Top P must be left at their defaults when thinking.'}) : intl.formatMessage({defaultMessage: 'Tokens the model can use for thinking before it responds.'})}
+                />
+            )}
+        </>
+    );
+};
+
 type ServiceItemProps = {
     service: LLMService
     onChange: (service: LLMService) => void
@@ -240,19 +546,22 @@ const ServiceItem = (props: ServiceItemProps) => {
 
     return (
         <>
-            {(type === 'openaicompatible' || type === 'azure') && (
+            {(type === 'openaicompatible' || type === 'azure' || type === 'ollama') && (
                 <TextItem
                     label={intl.formatMessage({defaultMessage: 'API URL'})}
+                    placeholder={type === 'ollama' ? 'http://localhost:11434' : undefined}
                     value={props.service.apiURL}
                     onChange={(e) => props.onChange({...props.service, apiURL: e.target.value})}
                 />
             )}
-            <TextItem
-                label={intl.formatMessage({defaultMessage: 'API Key'})}
-                type='password'
-                value={props.service.apiKey}
-                onChange={(e) => props.onChange({...props.service, apiKey: e.target.value})}
-            />
+            {type !== 'ollama' && (
+                <TextItem
+                    label={intl.formatMessage({defaultMessage: 'API Key'})}
+                    type='password'
+                    value={props.service.apiKey}
+                    onChange={(e) => props.onChange({...props.service, apiKey: e.target.value})}
+                />
+            )}
             {isOpenAIType && (
                 <>
                     <TextItem
@@ -293,6 +602,15 @@ const ServiceItem = (props: ServiceItemProps) => {
                     props.onChange({...props.service, outputTokenLimit});
                 }}
             />
+            {type === 'ollama' && (
+                <TextItem
+                    label={intl.formatMessage({defaultMessage: 'Keep alive'})}
+                    placeholder='5m'
+                    value={props.service.keepAlive ?? ''}
+                    onChange={(e) => props.onChange({...props.service, keepAlive: e.target.value})}
+                    helptext={intl.formatMessage({defaultMessage: 'How long the model stays loaded after a request, for example 10m. Use -1 to keep it loaded. Leave the input token limit at 0 to use the context length reported by the model.'})}
+                />
+            )}
             {isOpenAIType && (
                 <TextItem
                     label={intl.formatMessage({defaultMessage: 'Streaming Timeout Seconds'})}
@@ -305,6 +623,28 @@ const ServiceItem = (props: ServiceItemProps) => {
                     }}
                 />
             )}
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Max retries'})}
+                type='number'
+                value={props.service.maxRetries?.toString() || '0'}
+                onChange={(e) => {
+                    const value = parseInt(e.target.value, 10);
+                    const maxRetries = isNaN(value) ? 0 : value;
+                    props.onChange({...props.service, maxRetries});
+                }}
+                helptext={intl.formatMessage({defaultMessage: 'How many times a request that fails before any response is streamed is retried. Use 0 for the default of 2 or -1 to disable retries.'})}
+            />
+            <TextItem
+                label={intl.formatMessage({defaultMessage: 'Retry backoff milliseconds'})}
+                type='number'
+                value={props.service.retryBackoffMilliseconds?.toString() || '0'}
+                onChange={(e) => {
+                    const value = parseInt(e.target.value, 10);
+                    const retryBackoffMilliseconds = isNaN(value) ? 0 : value;
+                    props.onChange({...props.service, retryBackoffMilliseconds});
+                }}
+                helptext={intl.formatMessage({defaultMessage: 'Delay before the first retry, doubled for each following retry. Use 0 for the default of 500. A Retry-After sent by the service takes precedence.'})}
+            />
         </>
     );
 };
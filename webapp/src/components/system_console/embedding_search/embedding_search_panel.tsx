@@ -16,6 +16,8 @@ import {IntItem} from '../number_items';
 import {EmbeddingSearchConfig} from './types';
 import {OpenAIProviderConfig, OpenAICompatibleProviderConfig} from './provider_configs';
 import {ChunkingOptionsConfig} from './chunking_options';
+import {HybridSearchConfig} from './hybrid_search_options';
+import {RerankConfig} from './rerank_options';
 import {ReindexSection} from './reindex_section';
 import {ReindexConfirmation} from './reindex_confirmation';
 import {useJobStatus} from './use_job_status';
@@ -99,7 +101,7 @@ const EmbeddingSearchPanel = ({value, onChange}: Props) => {
                             // Set defaults when enabling
                             onChange({
                                 type: newType,
-                                vectorStore: {type: 'pgvector', parameters: {}},
+                                vectorStore: {type: 'mysql', parameters: {}},
                                 embeddingProvider: {type: 'openai', parameters: {embeddingModel: '', apiKey: ''}},
                                 parameters: {},
                                 dimensions: 0,
@@ -128,10 +130,24 @@ const EmbeddingSearchPanel = ({value, onChange}: Props) => {
                         vectorStore: {...value.vectorStore, type: e.target.value},
                     })}
                 >
-                    <SelectionItemOption value='pgvector'>{'PostgreSQL pgvector'}</SelectionItemOption>
+                    <SelectionItemOption value='mysql'>{'MySQL'}</SelectionItemOption>
                 </SelectionItem>
                 }
 
+                {value.type && value.type !== '' && value.vectorStore.type === 'mysql' && (
+                    <IntItem
+                        label={intl.formatMessage({defaultMessage: 'Max Search Rows'})}
+                        placeholder='100000'
+                        value={(value.vectorStore.parameters?.maxSearchRows as number) ?? 0}
+                        onChange={(maxSearchRows) => onChange({
+                            ...value,
+                            vectorStore: {...value.vectorStore, parameters: {...value.vectorStore.parameters, maxSearchRows}},
+                        })}
+                        min={0}
+                        helptext={intl.formatMessage({defaultMessage: 'How many of the most recent posts in the user\'s channels are compared with each search. Older posts are not found by similarity. Higher values find more but make every search slower. Use 0 for the default of 100000.'})}
+                    />
+                )}
+
                 {value.type && value.type !== '' &&
                 <SelectionItem
                     label={intl.formatMessage({defaultMessage: 'Embedding Provider Type'})}
@@ -192,6 +208,16 @@ const EmbeddingSearchPanel = ({value, onChange}: Props) => {
                             value={value}
                             onChange={onChange}
                         />
+
+                        <HybridSearchConfig
+                            value={value}
+                            onChange={onChange}
+                        />
+
+                        <RerankConfig
+                            value={value}
+                            onChange={onChange}
+                        />
                     </>
                 )}
 
@@ -0,0 +1,82 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+import React from 'react';
+import {useIntl} from 'react-intl';
+
+import {SelectionItem, SelectionItemOption} from '../item';
+import {IntItem, FloatItem} from '../number_items';
+
+import {EmbeddingSearchConfig, HybridSearchOptions} from './types';
+
+interface HybridSearchOptionsProps {
+    value: EmbeddingSearchConfig;
+    onChange: (config: EmbeddingSearchConfig) => void;
+}
+
+export const HybridSearchConfig = ({value, onChange}: HybridSearchOptionsProps) => {
+    const intl = useIntl();
+
+    // Keep in sync with DefaultHybridSearchOptions on the server
+    const defaultHybridSearchOptions = {
+        defaultMode: 'vector',
+        vectorWeight: 1,
+        keywordWeight: 1,
+        rankConstant: 60,
+    };
+
+    const current = value.hybridSearch || defaultHybridSearchOptions;
+    const update = (changes: Partial<HybridSearchOptions>) => onChange({
+        ...value,
+        hybridSearch: {
+            ...current,
+            ...changes,
+        } as HybridSearchOptions,
+    });
+
+    return (
+        <>
+            <SelectionItem
+                label={intl.formatMessage({defaultMessage: 'Default Search Mode'})}
+                value={current.defaultMode || defaultHybridSearchOptions.defaultMode}
+                onChange={(e) => update({defaultMode: e.target.value})}
+                helptext={intl.formatMessage({defaultMessage: 'Hybrid search combines keyword matching with vector similarity, which helps with names, error codes and other exact terms.'})}
+            >
+                <SelectionItemOption value='vector'>{'Vector'}</SelectionItemOption>
+                <SelectionItemOption value='keyword'>{'Keyword'}</SelectionItemOption>
+                <SelectionItemOption value='hybrid'>{'Hybrid'}</SelectionItemOption>
+            </SelectionItem>
+
+            {current.defaultMode === 'hybrid' && (
+                <>
+                    <FloatItem
+                        label={intl.formatMessage({defaultMessage: 'Vector Weight'})}
+                        placeholder={defaultHybridSearchOptions.vectorWeight.toString()}
+                        value={current.vectorWeight ?? defaultHybridSearchOptions.vectorWeight}
+                        onChange={(vectorWeight) => update({vectorWeight})}
+                        min={0}
+                        helptext={intl.formatMessage({defaultMessage: 'How much vector similarity ranks count when merging results.'})}
+                    />
+
+                    <FloatItem
+                        label={intl.formatMessage({defaultMessage: 'Keyword Weight'})}
+                        placeholder={defaultHybridSearchOptions.keywordWeight.toString()}
+                        value={current.keywordWeight ?? defaultHybridSearchOptions.keywordWeight}
+                        onChange={(keywordWeight) => update({keywordWeight})}
+                        min={0}
+                        helptext={intl.formatMessage({defaultMessage: 'How much keyword match ranks count when merging results.'})}
+                    />
+
+                    <IntItem
+                        label={intl.formatMessage({defaultMessage: 'Rank Constant'})}
+                        placeholder={defaultHybridSearchOptions.rankConstant.toString()}
+                        value={current.rankConstant || defaultHybridSearchOptions.rankConstant}
+                        onChange={(rankConstant) => update({rankConstant})}
+                        min={1}
+                        helptext={intl.formatMessage({defaultMessage: 'The k constant of reciprocal rank fusion. Larger values reduce the advantage of top ranked results.'})}
+                    />
+                </>
+            )}
+        </>
+    );
+};
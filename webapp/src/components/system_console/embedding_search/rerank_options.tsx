@@ -0,0 +1,81 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+import React from 'react';
+import {useIntl} from 'react-intl';
+
+import {SelectionItem, SelectionItemOption, TextItem} from '../item';
+import {IntItem} from '../number_items';
+
+import {EmbeddingSearchConfig, RerankOptions} from './types';
+
+interface RerankOptionsProps {
+    value: EmbeddingSearchConfig;
+    onChange: (config: EmbeddingSearchConfig) => void;
+}
+
+export const RerankConfig = ({value, onChange}: RerankOptionsProps) => {
+    const intl = useIntl();
+
+    // Keep in sync with the defaults in the server's rerank.go
+    const defaultRerankOptions = {
+        type: '',
+        depth: 30,
+        bot: '',
+        batchSize: 10,
+    };
+
+    const current = value.rerank || defaultRerankOptions;
+    const update = (changes: Partial<RerankOptions>) => onChange({
+        ...value,
+        rerank: {
+            ...current,
+            ...changes,
+        } as RerankOptions,
+    });
+
+    return (
+        <>
+            <SelectionItem
+                label={intl.formatMessage({defaultMessage: 'Reranker'})}
+                value={current.type}
+                onChange={(e) => update({type: e.target.value})}
+                helptext={intl.formatMessage({defaultMessage: 'Reorders the top search candidates before they are used. Lexical reranking is cheap; LLM reranking is more accurate but makes extra LLM requests for every search.'})}
+            >
+                <SelectionItemOption value=''>{'None'}</SelectionItemOption>
+                <SelectionItemOption value='lexical'>{'Lexical'}</SelectionItemOption>
+                <SelectionItemOption value='llm'>{'LLM'}</SelectionItemOption>
+            </SelectionItem>
+
+            {current.type !== '' && (
+                <IntItem
+                    label={intl.formatMessage({defaultMessage: 'Rerank Depth'})}
+                    placeholder={defaultRerankOptions.depth.toString()}
+                    value={current.depth || defaultRerankOptions.depth}
+                    onChange={(depth) => update({depth})}
+                    min={1}
+                    helptext={intl.formatMessage({defaultMessage: 'Number of candidates to fetch and rerank.'})}
+                />
+            )}
+
+            {current.type === 'llm' && (
+                <>
+                    <TextItem
+                        label={intl.formatMessage({defaultMessage: 'Rerank Bot'})}
+                        value={current.bot}
+                        onChange={(e) => update({bot: e.target.value})}
+                        helptext={intl.formatMessage({defaultMessage: 'Username of the bot whose model scores candidates. Leave empty to use the default bot.'})}
+                    />
+                    <IntItem
+                        label={intl.formatMessage({defaultMessage: 'Rerank Batch Size'})}
+                        placeholder={defaultRerankOptions.batchSize.toString()}
+                        value={current.batchSize || defaultRerankOptions.batchSize}
+                        onChange={(batchSize) => update({batchSize})}
+                        min={1}
+                        helptext={intl.formatMessage({defaultMessage: 'Number of candidates scored in each LLM request.'})}
+                    />
+                </>
+            )}
+        </>
+    );
+};
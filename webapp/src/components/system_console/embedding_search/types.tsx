@@ -13,6 +13,20 @@ export interface ChunkingOptions {
     chunkingStrategy: string;
 }
 
+export interface HybridSearchOptions {
+    defaultMode: string;
+    vectorWeight: number;
+    keywordWeight: number;
+    rankConstant: number;
+}
+
+export interface RerankOptions {
+    type: string;
+    depth: number;
+    bot: string;
+    batchSize: number;
+}
+
 export interface EmbeddingSearchConfig {
     type: string;
     vectorStore: UpstreamConfig;
@@ -20,6 +34,8 @@ export interface EmbeddingSearchConfig {
     parameters: Record<string, unknown>;
     dimensions: number;
     chunkingOptions?: ChunkingOptions;
+    hybridSearch?: HybridSearchOptions;
+    rerank?: RerankOptions;
 }
 
 // Match the server's JobStatus struct field names
@@ -30,6 +46,7 @@ export interface JobStatusType {
     completed_at?: string;
     processed_rows: number;
     total_rows: number;
+    space_id?: string; // Embedding space being migrated to, if any
 }
 
 export interface StatusMessageType {
@@ -0,0 +1,102 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+import React, {useCallback, useEffect, useState} from 'react';
+import {FormattedMessage, useIntl} from 'react-intl';
+
+import {doPullOllamaModel, getOllamaPullStatus} from '../../client';
+import {TertiaryButton} from '../assets/buttons';
+
+import {HelpText, ItemLabel} from './item';
+
+type PullStatus = {
+    model: string
+    status: string
+    total: number
+    completed: number
+    done: boolean
+    error?: string
+}
+
+type Props = {
+    botName: string
+}
+
+// OllamaPullItem pulls the saved default model of the bot to its Ollama server and shows the progress
+const OllamaPullItem = (props: Props) => {
+    const intl = useIntl();
+    const [status, setStatus] = useState<PullStatus | null>(null);
+    const [failed, setFailed] = useState(false);
+
+    const fetchStatus = useCallback(async () => {
+        try {
+            setStatus(await getOllamaPullStatus(props.botName));
+        } catch (error) {
+            setStatus(null);
+        }
+    }, [props.botName]);
+
+    const pulling = Boolean(status && !status.done);
+
+    useEffect(() => {
+        fetchStatus();
+    }, [fetchStatus]);
+
+    useEffect(() => {
+        if (pulling) {
+            const interval = setInterval(fetchStatus, 2000);
+            return () => clearInterval(interval);
+        }
+
+        // Return a noop function
+        return function noop() { /* No cleanup needed */ };
+    }, [pulling, fetchStatus]);
+
+    const handlePull = async () => {
+        setFailed(false);
+        try {
+            setStatus(await doPullOllamaModel(props.botName));
+        } catch (error) {
+            setFailed(true);
+        }
+    };
+
+    let message = '';
+    if (failed) {
+        message = intl.formatMessage({defaultMessage: 'Failed to start pulling the model. Save the configuration first if the bot or its model is new.'});
+    } else if (status?.error) {
+        message = intl.formatMessage({defaultMessage: 'Failed to pull {model}: {error}'}, {model: status.model, error: status.error});
+    } else if (status?.done) {
+        message = intl.formatMessage({defaultMessage: '{model} is ready.'}, {model: status.model});
+    } else if (status) {
+        message = status.total ? intl.formatMessage({defaultMessage: 'Pulling {model}: {status} ({percent}%)'}, {
+            model: status.model,
+            status: status.status,
+            percent: Math.floor((status.completed / status.total) * 100),
+        }) : intl.formatMessage({defaultMessage: 'Pulling {model}: {status}'}, {model: status.model, status: status.status});
+    }
+
+    return (
+        <>
+            <ItemLabel>
+                <FormattedMessage defaultMessage='Model on the server'/>
+            </ItemLabel>
+            <div>
+                <TertiaryButton
+                    disabled={pulling}
+                    onClick={(e) => {
+                        e.preventDefault();
+                        handlePull();
+                    }}
+                >
+                    <FormattedMessage defaultMessage='Pull model'/>
+                </TertiaryButton>
+                <HelpText>
+                    {message || intl.formatMessage({defaultMessage: 'Downloads the saved default model to the Ollama server. Requests fail until the model has been pulled.'})}
+                </HelpText>
+            </div>
+        </>
+    );
+};
+
+export default OllamaPullItem;